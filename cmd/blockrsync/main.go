@@ -1,71 +1,358 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"go.uber.org/zap/zapcore"
 
+	"github.com/go-logr/logr"
 	"github.com/spf13/pflag"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/awels/blockrsync/pkg/blockrsync"
+	"github.com/awels/blockrsync/pkg/transport"
 )
 
 func usage() {
 	_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [devicepath] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s [devicepath=module]... --source [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s [devicepath] --source --rsh \"ssh host %s --target --stdio [devicepath]\" [flags]\n", os.Args[0], os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s [devicepath] --source --ssh [user@]host --ssh-command \"%s --target --stdio [devicepath]\" [flags]\n", os.Args[0], os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s [devicepath] --source --fan-out-target [address[=module]]... [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s [devicepath] --source --changed-extents [extentsfile] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s [devicepath] --target --relay-to [address] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s [sourcepath] [targetpath] --local [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s daemon --config [configfile] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s hash [targetpath] [flags] > hashes.bin\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s delta [sourcepath] --hashes hashes.bin [flags] > delta.brd\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s verify [deltafile] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s apply [deltafile] [targetpath] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s rollback [undolog] [targetpath] [flags]\n", os.Args[0])
 	flag.PrintDefaults()
-	os.Exit(2)
+	os.Exit(exitUsage)
 }
 
-func main() {
-	var (
-		sourceMode    = flag.Bool("source", false, "Source mode")
-		targetMode    = flag.Bool("target", false, "Target mode")
-		targetAddress = flag.String("target-address", "", "address of the server, source only")
-		port          = flag.Int("port", 8000, "port to listen on or connect to")
-	)
-	opts := blockrsync.BlockRsyncOptions{}
+// Exit codes for the kinds of errors, so automation can decide whether to retry
+const (
+	exitError        = 1
+	exitUsage        = 2
+	exitConnection   = 3
+	exitProtocol     = 4
+	exitSourceIO     = 5
+	exitTargetIO     = 6
+	exitVerification = 7
+	exitCancelled    = 8
+)
 
-	flag.BoolVar(&opts.Preallocation, "preallocate", false, "Preallocate empty file space")
-	flag.IntVar(&opts.BlockSize, "block-size", 65536, "block size, must be > 0 and a multiple of 4096")
+func exitCode(err error) int {
+	switch blockrsync.ErrorKind(err) {
+	case blockrsync.ErrConnection:
+		return exitConnection
+	case blockrsync.ErrProtocol:
+		return exitProtocol
+	case blockrsync.ErrSourceIO:
+		return exitSourceIO
+	case blockrsync.ErrTargetIO:
+		return exitTargetIO
+	case blockrsync.ErrVerification:
+		return exitVerification
+	case blockrsync.ErrCancelled:
+		return exitCancelled
+	}
+	return exitError
+}
+
+// exitOnSignal exits with the cancelled exit code when interrupted or terminated,
+// for commands that do not write a target.
+func exitOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "%v: received %v\n", blockrsync.ErrCancelled, sig)
+		os.Exit(exitCode(blockrsync.ErrCancelled))
+	}()
+}
 
+// cancelOnSignal returns a channel that is closed when interrupted or terminated,
+// the sync then cleans up and fails with ErrCancelled. A second signal exits
+// immediately.
+func cancelOnSignal() <-chan struct{} {
+	cancel := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "%v: received %v, stopping the sync\n", blockrsync.ErrCancelled, sig)
+		close(cancel)
+		sig = <-signals
+		fmt.Fprintf(os.Stderr, "%v: received %v\n", blockrsync.ErrCancelled, sig)
+		os.Exit(exitCode(blockrsync.ErrCancelled))
+	}()
+	return cancel
+}
+
+func parseFlags(args []string, logOutput io.Writer) logr.Logger {
 	zapopts := zap.Options{
 		Development: true,
 		TimeEncoder: zapcore.ISO8601TimeEncoder,
-		DestWriter:  os.Stdout,
+		DestWriter:  logOutput,
 	}
 	zapopts.BindFlags(flag.CommandLine)
 
 	// Import flags into pflag so they can be bound by viper
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 
-	pflag.Parse()
-	logger := zap.New(zap.UseFlagOptions(&zapopts))
+	if err := pflag.CommandLine.Parse(args); err != nil {
+		usage()
+	}
+	// stdout carries the data when using stdio
+	if stdio := pflag.CommandLine.Lookup("stdio"); stdio != nil && stdio.Value.String() == "true" {
+		zapopts.DestWriter = os.Stderr
+	}
+	return zap.New(zap.UseFlagOptions(&zapopts))
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "daemon":
+			runDaemon(os.Args[2:])
+			return
+		case "hash":
+			runHash(os.Args[2:])
+			return
+		case "delta":
+			runDelta(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "apply":
+			runApply(os.Args[2:])
+			return
+		case "rollback":
+			runRollback(os.Args[2:])
+			return
+		}
+	}
+	var (
+		sourceMode    = flag.Bool("source", false, "Source mode")
+		targetMode    = flag.Bool("target", false, "Target mode")
+		localMode     = flag.Bool("local", false, "Local mode, sync a source file to a target file on the same host")
+		targetAddress = flag.String("target-address", "", "address of the server, a host, unix:///path, vsock://cid:port or http(s)://host:port/path, source only")
+		port          = flag.Int("port", 8000, "port to listen on or connect to")
+		reportFile    = flag.String("report-file", "", "file to write the dry run report to, defaults to stdout")
+		stdio         = flag.Bool("stdio", false, "use stdin and stdout as the connection instead of tcp")
+		rsh           = flag.String("rsh", "", "command to start the target, its stdin and stdout are used as the connection, source or relay only")
+		sshHost       = flag.String("ssh", "", "connect over ssh to [user@]host[:port], source or relay only")
+		sshCommand    = flag.String("ssh-command", "", "remote command that starts blockrsync with --stdio, if not set the connection is forwarded to target-address or relay-to over ssh")
+		sshKnownHosts = flag.String("ssh-known-hosts", "", "known hosts file used to verify the host key, defaults to ~/.ssh/known_hosts")
+		sshIdentities arrayFlags
+		fanOutTargets arrayFlags
+		relayTo       = flag.String("relay-to", "", "address of the next target, a host[:port], unix:///path, vsock://cid:port or http(s)://host:port/path, the port defaults to port, the received blocks are written and forwarded to it, target only")
+		converge      = flag.Bool("converge", false, "sync in rounds until the changes are below the threshold, then run a final round, source only")
+		extentsFile   = flag.String("changed-extents", "", "file with the changed extents of the source, only these blocks are sent instead of hashing the source, source only")
+		extentsFormat = flag.String("changed-extents-format", "", "format of the changed extents, json, csv, thin-delta or rbd-diff, detected if not set")
+		verifyExtents = flag.Bool("verify-changed-extents", false, "hash the blocks in the changed extents, and only send the blocks that differ from the target")
+	)
+	convergeOpts := blockrsync.ConvergeOptions{}
+	identity := blockrsync.TargetIdentity{}
+
+	flag.IntVar(&convergeOpts.MaxRounds, "converge-max-rounds", 10, "maximum number of rounds before the final round")
+	flag.Int64Var(&convergeOpts.Threshold, "converge-threshold", 64*1024*1024, "changed bytes in a round below which the final round starts")
+	flag.StringVar(&convergeOpts.PreFinalHook, "pre-final-hook", "", "command to run before the final round, for instance fsfreeze --freeze")
+	flag.StringVar(&convergeOpts.PostFinalHook, "post-final-hook", "", "command to run after the final round, for instance fsfreeze --unfreeze")
+	flag.Var(&fanOutTargets, "fan-out-target", "sync the source to multiple targets, address[=module], multiple allowed, source only")
+	flag.StringVar(&identity.FilesystemUUID, "expect-fs-uuid", "", "UUID of the file system the target has to contain, checked before any block is written, source or local only")
+	flag.StringVar(&identity.PartitionUUID, "expect-part-uuid", "", "UUID of the partition the target has to be, source or local only")
+	flag.StringVar(&identity.Serial, "expect-serial", "", "serial of the device the target has to be, source or local only")
+	flag.StringVar(&identity.Marker, "expect-marker", "", "marker the target has to have from a previous sync with --set-marker, source or local only")
+	flag.Var(&sshIdentities, "ssh-identity", "private key file used to authenticate, multiple allowed, defaults to the keys in ~/.ssh")
+	opts := blockrsync.BlockRsyncOptions{Cancel: cancelOnSignal()}
+
+	addTargetFlags(&opts, ", target or local only")
+	flag.IntVar(&opts.BlockSize, "block-size", 65536, "block size, must be > 0 and a multiple of 4096")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "Only report the differences as JSON without writing to the target, source or local only")
+	flag.StringVar(&opts.ListenAddress, "listen-address", "", "address to listen on instead of the port, for instance unix:///run/brs.sock, vsock://:9000 or https://:8443/path, target only")
+	flag.StringVar(&opts.TLSCertFile, "tls-cert", "", "certificate to serve when listening on https, target only")
+	flag.StringVar(&opts.TLSKeyFile, "tls-key", "", "private key of the certificate when listening on https, target only")
+	flag.StringVar(&opts.CACertFile, "ca-cert", "", "CA certificate to verify an https target, source only")
+	flag.StringVar(&opts.SourceFormat, "source-format", "raw", "image format of the source, raw, qcow2, vmdk, vhd, vhdx or auto to detect it, source or local only")
+	flag.StringVar(&opts.TargetFormat, "target-format", "raw", "image format of the target, raw, qcow2 or auto to detect it, new targets are raw with auto, target or local only")
+	flag.StringVar(&opts.OverlayFile, "overlay-file", "", "write the changes to a new qcow2 image with the target as its backing file, instead of the target, target or local only")
+	flag.StringVar(&opts.UndoLog, "undo-log", "", "record the original content of the overwritten blocks to this file, so the sync can be undone with rollback, target or local only")
+	flag.BoolVar(&opts.Force, "force", false, "write to the target even if it is mounted, held by another device, or locked by another process, target or local only")
+	flag.StringVar(&opts.TargetMarker, "set-marker", "", "marker to write to a file target after a successful sync, source or local only")
+	flag.StringVar(&opts.Module, "module", "", "name of the module to sync to when the target is a daemon, source or relay only")
+
+	logger := parseFlags(os.Args[1:], os.Stdout)
+	checkTargetOptions(&opts)
+	if identity != (blockrsync.TargetIdentity{}) {
+		opts.TargetIdentity = &identity
+	}
 
 	if opts.BlockSize <= 0 || opts.BlockSize%4096 != 0 {
 		fmt.Fprintf(os.Stderr, "block-size must be > 0 and a multiple of 4096\n")
 		usage()
 	}
-	if *sourceMode && !*targetMode {
-		if targetAddress == nil || *targetAddress == "" {
-			fmt.Fprintf(os.Stderr, "target-address must be specified with source flag\n")
+	if len(pflag.Args()) == 0 {
+		fmt.Fprintf(os.Stderr, "devicepath must be specified\n")
+		usage()
+	}
+	if *localMode {
+		if *sourceMode || *targetMode {
+			fmt.Fprintf(os.Stderr, "local cannot be combined with source or target\n")
+			usage()
+		}
+		if len(pflag.Args()) != 2 {
+			fmt.Fprintf(os.Stderr, "local requires a source and a target path\n")
+			usage()
+		}
+		localSync := blockrsync.NewLocalSync(pflag.Arg(0), pflag.Arg(1), &opts, logger)
+		if err := localSync.Sync(); err != nil {
+			logger.Error(err, "Unable to sync", "source file", pflag.Arg(0), "target file", pflag.Arg(1))
+			os.Exit(exitCode(err))
+		}
+		if size := localSync.SizeDecision(); size != nil {
+			logger.Info("Target size", "source size", size.SourceSize, "target size", size.TargetSize, "action", size.Action)
+		}
+		if opts.DryRun {
+			if err := writeReports([]*blockrsync.DiffReport{localSync.Report()}, *reportFile); err != nil {
+				logger.Error(err, "Unable to write report")
+				os.Exit(exitCode(err))
+			}
+		}
+	} else if *sourceMode && !*targetMode {
+		transports := 0
+		for _, set := range []bool{*stdio, *rsh != "", *sshHost != ""} {
+			if set {
+				transports++
+			}
+		}
+		if transports > 1 {
+			fmt.Fprintf(os.Stderr, "only one of stdio, rsh or ssh can be specified\n")
+			usage()
+		}
+		if (targetAddress == nil || *targetAddress == "") && transports == 0 && len(fanOutTargets) == 0 {
+			fmt.Fprintf(os.Stderr, "target-address, stdio, rsh or ssh must be specified with source flag\n")
 			usage()
 			os.Exit(1)
 		}
-		blockrsyncClient := blockrsync.NewBlockrsyncClient(os.Args[1], *targetAddress, *port, &opts, logger)
-		if err := blockrsyncClient.ConnectToTarget(); err != nil {
-			logger.Error(err, "Unable to connect to target", "source file", os.Args[1], "target address", *targetAddress)
+		if len(fanOutTargets) > 0 {
+			if transports > 0 || *targetAddress != "" {
+				fmt.Fprintf(os.Stderr, "fan-out-target cannot be combined with target-address, stdio, rsh or ssh\n")
+				usage()
+			}
+			if len(pflag.Args()) != 1 {
+				fmt.Fprintf(os.Stderr, "fan-out-target requires a single devicepath\n")
+				usage()
+			}
+			runFanOut(pflag.Arg(0), fanOutTargets, *port, &opts, *reportFile, logger)
+			logger.Info("Successfully completed sync")
+			return
+		}
+		files, err := parseFileMappings(pflag.Args(), opts.Module)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+		}
+		if len(files) != 1 && (opts.TargetIdentity != nil || opts.TargetMarker != "") {
+			fmt.Fprintf(os.Stderr, "the target identity and marker apply to a single file\n")
+			usage()
+		}
+		blockrsyncClient := blockrsync.NewBlockrsyncMultiFileClient(files, *targetAddress, *port, &opts, logger)
+		if *stdio {
+			blockrsyncClient.UseConnectionProvider(blockrsync.NewStdioConnection())
+		} else if *rsh != "" {
+			blockrsyncClient.UseConnectionProvider(blockrsync.NewCommandConnectionProvider(*rsh, logger))
+		} else if *sshHost != "" {
+			blockrsyncClient.UseConnectionProvider(sshConnectionProvider(*sshHost, *sshCommand, *sshKnownHosts, sshIdentities, *targetAddress, *port, logger))
+		}
+		if *extentsFile != "" {
+			if len(files) != 1 || *converge {
+				fmt.Fprintf(os.Stderr, "changed extents apply to a single file and cannot be combined with converge\n")
+				usage()
+			}
+			extents, err := readChangedExtents(*extentsFile, *extentsFormat)
+			if err != nil {
+				logger.Error(err, "Unable to read changed extents", "file", *extentsFile)
+				os.Exit(exitCode(err))
+			}
+			blockrsyncClient.UseChangedExtents(extents, *verifyExtents)
+		}
+		if *converge {
+			if len(files) != 1 || opts.DryRun {
+				fmt.Fprintf(os.Stderr, "converge syncs a single file and cannot be combined with dry-run\n")
+				usage()
+			}
+			if err := blockrsyncClient.Converge(&convergeOpts); err != nil {
+				logger.Error(err, "Unable to converge", "source file", files[0].Source, "rounds", len(blockrsyncClient.Rounds()))
+				os.Exit(exitCode(err))
+			}
+			logger.Info("Successfully completed sync", "rounds", len(blockrsyncClient.Rounds()))
+			return
+		}
+		err = blockrsyncClient.ConnectToTarget()
+		var reports []*blockrsync.DiffReport
+		for _, result := range blockrsyncClient.Results() {
+			if result.Err != nil {
+				logger.Info("Failed to sync file", "source file", result.Source, "module", result.Module, "error", result.Err.Error())
+			} else if result.Size != nil {
+				logger.Info("Synced file", "source file", result.Source, "module", result.Module, "source size", result.Size.SourceSize, "target size", result.Size.TargetSize, "size action", result.Size.Action)
+			} else {
+				logger.Info("Synced file", "source file", result.Source, "module", result.Module)
+			}
+			if result.Report != nil {
+				reports = append(reports, result.Report)
+			}
+		}
+		if opts.DryRun {
+			if err := writeReports(reports, *reportFile); err != nil {
+				logger.Error(err, "Unable to write report")
+				os.Exit(exitCode(err))
+			}
+		}
+		if err != nil {
+			logger.Error(err, "Unable to sync to target", "target address", *targetAddress)
 			// time.Sleep(5 * time.Minute)
-			os.Exit(1)
+			os.Exit(exitCode(err))
+		}
+	} else if *targetMode && !*sourceMode && *relayTo != "" {
+		nextAddress, nextPort, err := parseRelayTo(*relayTo, *port)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+		}
+		relay := blockrsync.NewBlockrsyncRelay(pflag.Arg(0), *port, nextAddress, nextPort, &opts, logger)
+		if *stdio {
+			relay.UseConnectionAcceptor(blockrsync.NewStdioConnection())
+		}
+		if *rsh != "" {
+			relay.UseDownstreamConnectionProvider(blockrsync.NewCommandConnectionProvider(*rsh, logger))
+		} else if *sshHost != "" {
+			relay.UseDownstreamConnectionProvider(sshConnectionProvider(*sshHost, *sshCommand, *sshKnownHosts, sshIdentities, nextAddress, nextPort, logger))
+		}
+		if err := relay.StartServer(); err != nil {
+			logger.Error(err, "Unable to relay to next target", "target file", pflag.Arg(0), "next target", *relayTo)
+			os.Exit(exitCode(err))
 		}
 	} else if *targetMode && !*sourceMode {
-		blockrsyncServer := blockrsync.NewBlockrsyncServer(os.Args[1], *port, &opts, logger)
+		blockrsyncServer := blockrsync.NewBlockrsyncServer(pflag.Arg(0), *port, &opts, logger)
+		if *stdio {
+			blockrsyncServer.UseConnectionAcceptor(blockrsync.NewStdioConnection())
+		}
 		if err := blockrsyncServer.StartServer(); err != nil {
-			logger.Error(err, "Unable to start server to write to file", "target file", os.Args[1])
+			logger.Error(err, "Unable to start server to write to file", "target file", pflag.Arg(0))
 			// time.Sleep(5 * time.Minute)
-			os.Exit(1)
+			os.Exit(exitCode(err))
 		}
 	} else {
 		fmt.Fprintf(os.Stderr, "Either source or target must be defined\n")
@@ -75,3 +362,369 @@ func main() {
 	// time.Sleep(5 * time.Minute)
 	logger.Info("Successfully completed sync")
 }
+
+// parseRelayTo parses the address of the next target with the same parser as the
+// target address of the source, the port defaults to the listen port.
+func parseRelayTo(relayTo string, port int) (string, int, error) {
+	if strings.HasPrefix(relayTo, "http://") || strings.HasPrefix(relayTo, "https://") {
+		return relayTo, port, nil
+	}
+	address, err := transport.ParseAddress(relayTo, port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid relay-to: %w", err)
+	}
+	return address.String(), address.Port, nil
+}
+
+// sshConnectionProvider connects over ssh to [user@]host, and runs the command or
+// forwards the connection to the address.
+func sshConnectionProvider(sshHost, command, knownHosts string, identities []string, address string, port int, logger logr.Logger) blockrsync.ConnectionProvider {
+	sshOpts := &blockrsync.SSHOptions{
+		Host:           sshHost,
+		IdentityFiles:  identities,
+		Command:        command,
+		ForwardAddress: address,
+	}
+	if user, host, found := strings.Cut(sshHost, "@"); found {
+		sshOpts.User, sshOpts.Host = user, host
+	}
+	if knownHosts != "" {
+		sshOpts.KnownHostsFiles = []string{knownHosts}
+	}
+	if sshOpts.Command == "" && sshOpts.ForwardAddress == "" {
+		sshOpts.ForwardAddress = "localhost"
+	}
+	return blockrsync.NewSSHConnectionProvider(sshOpts, port, logger)
+}
+
+func runFanOut(sourceFile string, targetArgs []string, port int, opts *blockrsync.BlockRsyncOptions, reportFile string, logger logr.Logger) {
+	var targets []blockrsync.FanOutTarget
+	for _, arg := range targetArgs {
+		target := blockrsync.FanOutTarget{Address: arg, Port: port}
+		if i := strings.LastIndex(arg, "="); i > 0 && i < len(arg)-1 {
+			target.Address, target.Module = arg[:i], arg[i+1:]
+		}
+		if target.Module == "" {
+			target.Module = opts.Module
+		}
+		targets = append(targets, target)
+	}
+	client := blockrsync.NewFanOutClient(sourceFile, targets, opts, logger)
+	err := client.Sync()
+	var reports []*blockrsync.DiffReport
+	for _, result := range client.Results() {
+		if result.Err != nil {
+			logger.Info("Failed to sync target", "target", result.String(), "error", result.Err.Error())
+		} else {
+			logger.Info("Synced target", "target", result.String())
+		}
+		if result.Report != nil {
+			reports = append(reports, result.Report)
+		}
+	}
+	if opts.DryRun {
+		if err := writeReports(reports, reportFile); err != nil {
+			logger.Error(err, "Unable to write report")
+			os.Exit(exitCode(err))
+		}
+	}
+	if err != nil {
+		logger.Error(err, "Unable to sync to all targets", "source file", sourceFile)
+		os.Exit(exitCode(err))
+	}
+}
+
+type arrayFlags []string
+
+func (i *arrayFlags) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *arrayFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+func readChangedExtents(fileName, format string) ([]blockrsync.Extent, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return blockrsync.ParseChangedExtents(f, format)
+}
+
+func writeReports(reports []*blockrsync.DiffReport, fileName string) error {
+	out := os.Stdout
+	if fileName != "" {
+		f, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(reports)
+}
+
+// parseFileMappings parses the source arguments, either a single file synced to
+// the module passed with --module, or a list of file=module mappings.
+func parseFileMappings(args []string, module string) ([]blockrsync.FileMapping, error) {
+	if len(args) == 1 && !strings.Contains(args[0], "=") {
+		return []blockrsync.FileMapping{{Source: args[0], Module: module}}, nil
+	}
+	if module != "" {
+		return nil, fmt.Errorf("module cannot be specified with multiple files")
+	}
+	var files []blockrsync.FileMapping
+	for _, arg := range args {
+		i := strings.LastIndex(arg, "=")
+		if i <= 0 || i == len(arg)-1 {
+			return nil, fmt.Errorf("invalid mapping %s, expected devicepath=module", arg)
+		}
+		files = append(files, blockrsync.FileMapping{Source: arg[:i], Module: arg[i+1:]})
+	}
+	return files, nil
+}
+
+func runDaemon(args []string) {
+	var (
+		configFile = flag.String("config", "", "path to the daemon configuration file")
+		port       = flag.Int("port", 8000, "port to listen on")
+	)
+	opts := blockrsync.BlockRsyncOptions{Cancel: cancelOnSignal()}
+
+	addTargetFlags(&opts, "")
+	flag.BoolVar(&opts.Force, "force", false, "write to module targets even if they are mounted, held by another device, or locked by another process")
+	flag.StringVar(&opts.ListenAddress, "listen-address", "", "address to listen on instead of the port, for instance unix:///run/brs.sock, vsock://:9000 or https://:8443/path")
+	flag.StringVar(&opts.TLSCertFile, "tls-cert", "", "certificate to serve when listening on https")
+	flag.StringVar(&opts.TLSKeyFile, "tls-key", "", "private key of the certificate when listening on https")
+
+	logger := parseFlags(args, os.Stdout)
+	checkTargetOptions(&opts)
+
+	if configFile == nil || *configFile == "" {
+		fmt.Fprintf(os.Stderr, "config must be specified in daemon mode\n")
+		usage()
+	}
+	config, err := blockrsync.LoadDaemonConfig(*configFile)
+	if err != nil {
+		logger.Error(err, "Unable to load daemon config", "config", *configFile)
+		os.Exit(exitCode(err))
+	}
+	daemon := blockrsync.NewBlockrsyncDaemon(config, *port, &opts, logger)
+	if err := daemon.StartServer(); err != nil {
+		logger.Error(err, "Daemon failed")
+		os.Exit(exitCode(err))
+	}
+}
+
+// addTargetFlags registers the flags that control how the target is written, the
+// scope is appended to the help text of commands that are not only a target.
+func addTargetFlags(opts *blockrsync.BlockRsyncOptions, scope string) {
+	flag.BoolVar(&opts.Preallocation, "preallocate", false, "Preallocate empty file space, the same as --preallocation full"+scope)
+	flag.StringVar(&opts.PreallocationMode, "preallocation", "", "how empty blocks are written, sparse to punch holes or discard, fallocate to keep them allocated, or full to write zeros, defaults to sparse"+scope)
+	flag.StringVar(&opts.SizePolicy, "size-policy", blockrsync.DefaultSizePolicy, "how a target with a different size than the source is handled, a comma separated list of grow and shrink for file targets and zero-tail for larger devices, or fail"+scope)
+	flag.BoolVar(&opts.AtomicReplace, "atomic-replace", false, "write the blocks to a staging copy of a file target, that replaces the target once the sync completes"+scope)
+	flag.StringVar(&opts.VerifyCommand, "verify-command", "", "command to run before the staging file replaces the target, with BLOCKRSYNC_STAGING_FILE and BLOCKRSYNC_TARGET_FILE set, the target is kept if it fails"+scope)
+}
+
+// checkTargetOptions validates how holes, the size of the target and replacing
+// the target are handled.
+func checkTargetOptions(opts *blockrsync.BlockRsyncOptions) {
+	switch opts.PreallocationMode {
+	case "", blockrsync.PreallocationSparse, blockrsync.PreallocationFallocate, blockrsync.PreallocationFull:
+	default:
+		fmt.Fprintf(os.Stderr, "preallocation must be sparse, fallocate or full\n")
+		usage()
+	}
+	if err := blockrsync.ValidateSizePolicy(opts.SizePolicy); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		usage()
+	}
+	if opts.VerifyCommand != "" && !opts.AtomicReplace {
+		fmt.Fprintf(os.Stderr, "verify-command requires atomic-replace\n")
+		usage()
+	}
+}
+
+// openOutput returns stdout if no file name is given, the hash and delta commands
+// log to stderr so their output can be redirected.
+func openOutput(fileName string) (io.WriteCloser, error) {
+	if fileName == "" || fileName == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(fileName)
+}
+
+func runHash(args []string) {
+	exitOnSignal()
+	var (
+		output    = flag.String("output", "", "file to write the hashes to, defaults to stdout")
+		blockSize = flag.Int("block-size", 65536, "block size, must be > 0 and a multiple of 4096")
+	)
+	logger := parseFlags(args, os.Stderr)
+
+	if *blockSize <= 0 || *blockSize%4096 != 0 {
+		fmt.Fprintf(os.Stderr, "block-size must be > 0 and a multiple of 4096\n")
+		usage()
+	}
+	if len(pflag.Args()) != 1 {
+		fmt.Fprintf(os.Stderr, "targetpath must be specified\n")
+		usage()
+	}
+	out, err := openOutput(*output)
+	if err != nil {
+		logger.Error(err, "Unable to open output", "output", *output)
+		os.Exit(exitCode(err))
+	}
+	defer out.Close()
+	if err := blockrsync.WriteHashes(pflag.Arg(0), int64(*blockSize), out, logger); err != nil {
+		logger.Error(err, "Unable to hash file", "target file", pflag.Arg(0))
+		os.Exit(exitCode(err))
+	}
+	logger.Info("Successfully wrote hashes", "target file", pflag.Arg(0))
+}
+
+func runDelta(args []string) {
+	exitOnSignal()
+	var (
+		output     = flag.String("output", "", "file to write the delta to, defaults to stdout")
+		hashesFile = flag.String("hashes", "", "file with the hashes of the target, created with the hash command")
+		format     = flag.String("format", "brd", "format of the delta, brd or rbd-diff for a stream rbd import-diff can apply")
+	)
+	logger := parseFlags(args, os.Stderr)
+
+	if *hashesFile == "" {
+		fmt.Fprintf(os.Stderr, "hashes must be specified\n")
+		usage()
+	}
+	if *format != "brd" && *format != "rbd-diff" {
+		fmt.Fprintf(os.Stderr, "format must be brd or rbd-diff\n")
+		usage()
+	}
+	if len(pflag.Args()) != 1 {
+		fmt.Fprintf(os.Stderr, "sourcepath must be specified\n")
+		usage()
+	}
+	hashes, err := os.Open(*hashesFile)
+	if err != nil {
+		logger.Error(err, "Unable to open hashes", "hashes", *hashesFile)
+		os.Exit(exitCode(err))
+	}
+	defer hashes.Close()
+	out, err := openOutput(*output)
+	if err != nil {
+		logger.Error(err, "Unable to open output", "output", *output)
+		os.Exit(exitCode(err))
+	}
+	defer out.Close()
+	if *format == "rbd-diff" {
+		header, err := blockrsync.CreateRBDDiff(pflag.Arg(0), hashes, out, logger)
+		if err != nil {
+			logger.Error(err, "Unable to create rbd export-diff", "source file", pflag.Arg(0))
+			os.Exit(exitCode(err))
+		}
+		logger.Info("Successfully created rbd export-diff", "source file", pflag.Arg(0), "data records", header.DataRecords, "zero records", header.ZeroRecords)
+		return
+	}
+	header, err := blockrsync.CreateDelta(pflag.Arg(0), hashes, out, logger)
+	if err != nil {
+		logger.Error(err, "Unable to create delta", "source file", pflag.Arg(0))
+		os.Exit(exitCode(err))
+	}
+	logger.Info("Successfully created delta", "source file", pflag.Arg(0), "changed blocks", header.ChangedBlocks)
+}
+
+func runVerify(args []string) {
+	exitOnSignal()
+	logger := parseFlags(args, os.Stdout)
+
+	if len(pflag.Args()) != 1 {
+		fmt.Fprintf(os.Stderr, "deltafile must be specified\n")
+		usage()
+	}
+	f, err := os.Open(pflag.Arg(0))
+	if err != nil {
+		logger.Error(err, "Unable to open delta", "delta file", pflag.Arg(0))
+		os.Exit(exitCode(err))
+	}
+	defer f.Close()
+	header, err := blockrsync.VerifyDelta(f, logger)
+	if err != nil {
+		logger.Error(err, "Delta verification failed", "delta file", pflag.Arg(0))
+		os.Exit(exitCode(err))
+	}
+	logger.Info("Delta is valid", "source", header.Source, "source size", header.SourceSize, "block size", header.BlockSize, "changed blocks", header.ChangedBlocks)
+}
+
+func runApply(args []string) {
+	verifyBase := flag.Bool("verify-base", false, "Hash the target first, and refuse to apply the delta if the target changed since the hashes were created")
+	opts := blockrsync.BlockRsyncOptions{Cancel: cancelOnSignal()}
+
+	addTargetFlags(&opts, "")
+	flag.StringVar(&opts.OverlayFile, "overlay-file", "", "write the changes to a new qcow2 image with the target as its backing file, instead of the target")
+	flag.StringVar(&opts.UndoLog, "undo-log", "", "record the original content of the overwritten blocks to this file, so the delta can be undone with rollback")
+	flag.BoolVar(&opts.Force, "force", false, "write to the target even if it is mounted, held by another device, or locked by another process")
+
+	logger := parseFlags(args, os.Stdout)
+	checkTargetOptions(&opts)
+
+	if len(pflag.Args()) != 2 {
+		fmt.Fprintf(os.Stderr, "deltafile and targetpath must be specified\n")
+		usage()
+	}
+	f, err := os.Open(pflag.Arg(0))
+	if err != nil {
+		logger.Error(err, "Unable to open delta", "delta file", pflag.Arg(0))
+		os.Exit(exitCode(err))
+	}
+	defer f.Close()
+	// rbd export-diff streams are detected by their header
+	magic := make([]byte, 16)
+	n, _ := io.ReadFull(f, magic)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		logger.Error(err, "Unable to read delta", "delta file", pflag.Arg(0))
+		os.Exit(exitCode(err))
+	}
+	if blockrsync.IsRBDDiff(magic[:n]) {
+		if *verifyBase {
+			fmt.Fprintf(os.Stderr, "verify-base cannot be used with an rbd export-diff\n")
+			usage()
+		}
+		header, err := blockrsync.ApplyRBDDiff(f, pflag.Arg(1), &opts, logger)
+		if err != nil {
+			logger.Error(err, "Unable to apply rbd export-diff", "delta file", pflag.Arg(0), "target file", pflag.Arg(1))
+			os.Exit(exitCode(err))
+		}
+		logger.Info("Successfully applied rbd export-diff", "target file", pflag.Arg(1), "from snap", header.FromSnap, "to snap", header.ToSnap)
+		return
+	}
+	if _, err := blockrsync.ApplyDelta(f, pflag.Arg(1), *verifyBase, &opts, logger); err != nil {
+		logger.Error(err, "Unable to apply delta", "delta file", pflag.Arg(0), "target file", pflag.Arg(1))
+		os.Exit(exitCode(err))
+	}
+	logger.Info("Successfully applied delta", "target file", pflag.Arg(1))
+}
+
+func runRollback(args []string) {
+	opts := blockrsync.BlockRsyncOptions{Cancel: cancelOnSignal()}
+
+	flag.BoolVar(&opts.AtomicReplace, "atomic-replace", false, "restore the blocks to a staging copy of a file target, that replaces the target once the rollback completes")
+	flag.BoolVar(&opts.Force, "force", false, "restore the target even if the undo log was recorded for a different path, or the target is mounted, held by another device, or locked by another process")
+
+	logger := parseFlags(args, os.Stdout)
+
+	if len(pflag.Args()) != 2 {
+		fmt.Fprintf(os.Stderr, "undolog and targetpath must be specified\n")
+		usage()
+	}
+	header, err := blockrsync.Rollback(pflag.Arg(0), pflag.Arg(1), &opts, logger)
+	if err != nil {
+		logger.Error(err, "Unable to roll back", "undo log", pflag.Arg(0), "target file", pflag.Arg(1))
+		os.Exit(exitCode(err))
+	}
+	logger.Info("Successfully rolled back", "target file", pflag.Arg(1), "size", header.TargetSize)
+}
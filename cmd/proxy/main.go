@@ -27,15 +27,17 @@ func (i *arrayFlags) Set(value string) error {
 
 func main() {
 	var (
-		sourceMode     = flag.Bool("source", false, "Source mode")
-		targetMode     = flag.Bool("target", false, "Target mode")
-		targetAddress  = flag.String("target-address", "", "address of the server, source only")
-		controlFile    = flag.String("control-file", "", "name and path to file to write when finished")
-		listenPort     = flag.Int("listen-port", 9080, "port to listen on")
-		targetPort     = flag.Int("target-port", 9000, "target port to connect to")
-		blockrsyncPath = flag.String("blockrsync-path", "/blockrsync", "path to blockrsync binary")
-		blockSize      = flag.Int("block-size", 65536, "block size, must be > 0 and a multiple of 4096")
+		sourceMode    = flag.Bool("source", false, "Source mode")
+		targetMode    = flag.Bool("target", false, "Target mode")
+		targetAddress = flag.String("target-address", "", "address of the server, a host, unix:///path or vsock://cid:port, source only")
+		controlFile   = flag.String("control-file", "", "name and path to file to write when finished")
+		listenPort    = flag.Int("listen-port", 9080, "port to listen on")
+		listenAddress = flag.String("listen-address", "", "address to listen on instead of the listen port, for instance unix:///run/brs.sock or vsock://:9000")
+		targetPort    = flag.Int("target-port", 9000, "target port to connect to")
 	)
+	// Ignored, kept so existing deployments keep working
+	flag.String("blockrsync-path", "/blockrsync", "path to blockrsync binary")
+	flag.Int("block-size", 65536, "block size, must be > 0 and a multiple of 4096")
 
 	var identifiers arrayFlags
 
@@ -50,6 +52,8 @@ func main() {
 
 	// Import flags into pflag so they can be bound by viper
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	_ = pflag.CommandLine.MarkDeprecated("blockrsync-path", "the target serves the files itself")
+	_ = pflag.CommandLine.MarkDeprecated("block-size", "the block size of the source is used")
 
 	pflag.Parse()
 	logger := zap.New(zap.UseFlagOptions(&zapopts))
@@ -74,7 +78,7 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Only one identifier must be specified in source mode\n")
 			os.Exit(1)
 		}
-		client := proxy.NewProxyClient(*listenPort, *targetPort, *targetAddress, logger)
+		client := proxy.NewProxyClient(*listenAddress, *listenPort, *targetPort, *targetAddress, logger)
 
 		if err := client.ConnectToTarget(identifiers[0]); err != nil {
 			logger.Error(err, "Unable to connect to target", "identifier", identifiers[0], "target address", *targetAddress)
@@ -85,7 +89,7 @@ func main() {
 			fmt.Fprintf(os.Stderr, "At least one identifier must be specified in target mode\n")
 			os.Exit(1)
 		}
-		server := proxy.NewProxyServer(*blockrsyncPath, *blockSize, *listenPort, identifiers, logger)
+		server := proxy.NewProxyServer(*listenAddress, *listenPort, identifiers, logger)
 
 		if err := server.StartServer(); err != nil {
 			logger.Error(err, "Unable to start server")
@@ -2,6 +2,7 @@ package blockrsync
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/go-logr/logr"
@@ -10,6 +11,8 @@ import (
 const (
 	Hole byte = iota
 	Block
+	// End marks the end of the blocks of a file
+	End
 )
 
 type BlockReader struct {
@@ -17,6 +20,7 @@ type BlockReader struct {
 	buf        []byte
 	offset     int64
 	offsetType byte
+	sourceSize int64
 	log        logr.Logger
 }
 
@@ -28,6 +32,12 @@ func NewBlockReader(source io.Reader, blockSize int, log logr.Logger) *BlockRead
 	}
 }
 
+// SetSourceSize limits the last block to the size of the source, so the end of
+// the file can be read without relying on the stream being closed.
+func (b *BlockReader) SetSourceSize(size int64) {
+	b.sourceSize = size
+}
+
 func (b *BlockReader) Next() (bool, error) {
 	var offset int64
 	if err := binary.Read(b.source, binary.LittleEndian, &offset); err != nil {
@@ -42,8 +52,18 @@ func (b *BlockReader) Next() (bool, error) {
 		return handleReadError(err, nocallback)
 	}
 	b.offsetType = offsetType[0]
+	if b.IsEnd() {
+		return false, nil
+	}
 	if !b.IsHole() {
-		if n, err := io.ReadFull(b.source, b.buf[:cap(b.buf)]); err != nil {
+		b.buf = b.buf[:cap(b.buf)]
+		if b.sourceSize > 0 {
+			if b.offset >= b.sourceSize {
+				return false, fmt.Errorf("block offset %d beyond source size %d", b.offset, b.sourceSize)
+			}
+			b.buf = b.buf[:min(int64(cap(b.buf)), b.sourceSize-b.offset)]
+		}
+		if n, err := io.ReadFull(b.source, b.buf); err != nil {
 			b.log.V(5).Info("Failed to read complete block", "error", err, "bytes", n)
 			return handleReadError(err, func() {
 				b.buf = b.buf[:n]
@@ -61,6 +81,10 @@ func (b *BlockReader) IsHole() bool {
 	return b.offsetType == Hole
 }
 
+func (b *BlockReader) IsEnd() bool {
+	return b.offsetType == End
+}
+
 func (b *BlockReader) Block() []byte {
 	return b.buf
 }
@@ -97,6 +97,47 @@ var _ = Describe(blockReader, func() {
 		Expect(br.Block()).To(HaveLen(1))
 		Expect(br.Block()[0]).To(Equal(byte(255)), "%v", br.Block())
 	})
+
+	It("should stop reading at the end marker", func() {
+		buf := bytes.NewBuffer([]byte{})
+		err := writeEndOfBlocks(buf)
+		Expect(err).ToNot(HaveOccurred())
+		br := NewBlockReader(buf, 4, GinkgoLogr.WithName(blockReader))
+		cont, err := br.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cont).To(BeFalse())
+		Expect(br.IsEnd()).To(BeTrue())
+	})
+
+	It("should limit the last block to the source size", func() {
+		buf := bytes.NewBuffer([]byte{})
+		err := binary.Write(buf, binary.LittleEndian, int64(4))
+		Expect(err).ToNot(HaveOccurred())
+		buf.Write([]byte{Block, 1, 2})
+		err = writeEndOfBlocks(buf)
+		Expect(err).ToNot(HaveOccurred())
+		br := NewBlockReader(buf, 4, GinkgoLogr.WithName(blockReader))
+		br.SetSourceSize(6)
+		cont, err := br.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cont).To(BeTrue())
+		Expect(br.Block()).To(Equal([]byte{1, 2}))
+		cont, err = br.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cont).To(BeFalse())
+		Expect(br.IsEnd()).To(BeTrue())
+	})
+
+	It("should fail on a block beyond the source size", func() {
+		buf := bytes.NewBuffer([]byte{})
+		err := binary.Write(buf, binary.LittleEndian, int64(8))
+		Expect(err).ToNot(HaveOccurred())
+		buf.Write([]byte{Block, 1, 2})
+		br := NewBlockReader(buf, 4, GinkgoLogr.WithName(blockReader))
+		br.SetSourceSize(6)
+		_, err = br.Next()
+		Expect(err).To(HaveOccurred())
+	})
 })
 
 func createBytesReader(blockSize int) io.Reader {
@@ -0,0 +1,45 @@
+//go:build linux
+
+package blockrsync
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// zeroOutBlockDevice makes the device write zeros to the range, without
+// unmapping it.
+func zeroOutBlockDevice(f *os.File, offset, length int64) error {
+	return blockDeviceRangeIoctl(f, unix.BLKZEROOUT, offset, length)
+}
+
+// discardBlockDevice discards the range, it only reads as zeros if the device
+// reports that discarded data reads as zeros.
+func discardBlockDevice(f *os.File, offset, length int64) error {
+	return blockDeviceRangeIoctl(f, unix.BLKDISCARD, offset, length)
+}
+
+// discardZeroesData returns true if discarded ranges of the device read as zeros.
+func discardZeroesData(f *os.File) bool {
+	zeroes, err := unix.IoctlGetUint32(int(f.Fd()), unix.BLKDISCARDZEROES)
+	return err == nil && zeroes == 1
+}
+
+func blockDeviceRangeIoctl(f *os.File, request uint, offset, length int64) error {
+	r := [2]uint64{uint64(offset), uint64(length)}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), uintptr(request), uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// blockDeviceSize returns the size of the device in bytes.
+func blockDeviceSize(f *os.File) (int64, error) {
+	var size uint64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), uintptr(unix.BLKGETSIZE64), uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package blockrsync
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var errBlockDeviceUnsupported = errors.New("zeroing block devices is only supported on linux")
+
+func zeroOutBlockDevice(f *os.File, offset, length int64) error {
+	return errBlockDeviceUnsupported
+}
+
+func discardBlockDevice(f *os.File, offset, length int64) error {
+	return errBlockDeviceUnsupported
+}
+
+func discardZeroesData(f *os.File) bool {
+	return false
+}
+
+func blockDeviceSize(f *os.File) (int64, error) {
+	return f.Seek(0, io.SeekEnd)
+}
@@ -2,29 +2,82 @@ package blockrsync
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"net"
-	"os"
 	"slices"
 	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/golang/snappy"
+
+	"github.com/awels/blockrsync/pkg/image"
+	"github.com/awels/blockrsync/pkg/transport"
 )
 
+// FileMapping maps a source file to the module it should be synced to.
+type FileMapping struct {
+	Source string
+	Module string
+}
+
+// FileSyncResult is the outcome of syncing a single file in a session.
+type FileSyncResult struct {
+	FileMapping
+	Err error
+	// Report of the differences, only set in dry run mode
+	Report *DiffReport
+	// Size is how the target handles the size of the source
+	Size *SizeDecision
+}
+
+// targetFileError is a failure reported by the target for a single file, the
+// session can continue with the next file. The target either rejected the file
+// before sending the hashes, or read all its blocks before reporting the failure.
+type targetFileError struct {
+	msg  string
+	kind error
+}
+
+func (e *targetFileError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the kind of the error reported by the target.
+func (e *targetFileError) Unwrap() error {
+	return e.kind
+}
+
 type BlockrsyncClient struct {
 	sourceFile         string
+	files              []FileMapping
+	results            []FileSyncResult
+	report             *DiffReport
+	sizeDecision       *SizeDecision
 	hasher             Hasher
 	sourceSize         int64
 	opts               *BlockRsyncOptions
 	log                logr.Logger
 	connectionProvider ConnectionProvider
+	// sharedSource is set by the fan out client, the source is already hashed and
+	// blocks are read through a cache shared with the other targets.
+	sharedSource *cachedBlockReader
+	rounds       []RoundStats
+	// changedExtents replaces hashing the source, only the blocks in the extents
+	// are sent, or compared with the target when verifyExtents is set.
+	changedExtents []Extent
+	verifyExtents  bool
 }
 
 func NewBlockrsyncClient(sourceFile, targetAddress string, port int, opts *BlockRsyncOptions, logger logr.Logger) *BlockrsyncClient {
-	return &BlockrsyncClient{
-		sourceFile: sourceFile,
+	return NewBlockrsyncMultiFileClient([]FileMapping{{Source: sourceFile, Module: opts.Module}}, targetAddress, port, opts, logger)
+}
+
+// NewBlockrsyncMultiFileClient creates a client that syncs multiple files to the
+// modules of a daemon over a single connection.
+func NewBlockrsyncMultiFileClient(files []FileMapping, targetAddress string, port int, opts *BlockRsyncOptions, logger logr.Logger) *BlockrsyncClient {
+	client := &BlockrsyncClient{
+		sourceFile: files[0].Source,
+		files:      files,
 		hasher:     NewFileHasher(int64(opts.BlockSize), logger.WithName("hasher")),
 		opts:       opts,
 		log:        logger,
@@ -33,55 +86,211 @@ func NewBlockrsyncClient(sourceFile, targetAddress string, port int, opts *Block
 			port:          port,
 		},
 	}
+	if isHTTPAddress(targetAddress) {
+		client.connectionProvider = NewHTTPConnectionProvider(targetAddress, opts.CACertFile, logger)
+	}
+	return client
+}
+
+// UseConnectionProvider replaces the default tcp connection, for instance with a
+// StdioConnection or a CommandConnectionProvider.
+func (b *BlockrsyncClient) UseConnectionProvider(provider ConnectionProvider) {
+	b.connectionProvider = provider
+}
+
+// UseChangedExtents only sends the blocks in the extents reported by a changed
+// block tracking tool, instead of hashing the complete source. With verify, the
+// blocks in the extents are hashed, and only sent if they differ from the target.
+func (b *BlockrsyncClient) UseChangedExtents(extents []Extent, verify bool) {
+	b.changedExtents = extents
+	if b.changedExtents == nil {
+		b.changedExtents = []Extent{}
+	}
+	b.verifyExtents = verify
+}
+
+// Results returns the result of each file of the last session.
+func (b *BlockrsyncClient) Results() []FileSyncResult {
+	return b.results
 }
 
 func (b *BlockrsyncClient) ConnectToTarget() error {
-	f, err := os.Open(b.sourceFile)
+	b.results = nil
+	if b.changedExtents != nil && len(b.files) != 1 {
+		return newError(ErrProtocol, "changed extents can only be used to sync a single file")
+	}
+	conn, err := b.connectionProvider.Connect()
 	if err != nil {
-		return err
+		return wrapError(ErrConnection, err)
+	}
+	defer conn.Close()
+	defer b.opts.closeOnCancel(conn)()
+	s := newSession(conn)
+	req := &SessionRequest{
+		Version:   protocolVersion,
+		BlockSize: b.hasher.BlockSize(),
+		DryRun:    b.opts.DryRun,
+	}
+	for _, file := range b.files {
+		req.Files = append(req.Files, FileRequest{
+			Module:   file.Module,
+			Size:     b.requestSize(file.Source),
+			Identity: b.opts.TargetIdentity,
+			Marker:   b.opts.TargetMarker,
+		})
+	}
+	if err := s.writeMessage(req); err != nil {
+		return b.opts.cancelError(err)
+	}
+	if err := s.readResponse(); err != nil {
+		return b.opts.cancelError(fmt.Errorf("session rejected by target: %w", err))
+	}
+
+	var errs []error
+	for i, file := range b.files {
+		err := b.opts.cancelError(b.syncSourceFile(s, i, file.Source))
+		if b.report != nil {
+			b.report.Source = file.Source
+			b.report.Module = file.Module
+		}
+		b.results = append(b.results, FileSyncResult{FileMapping: file, Err: err, Report: b.report, Size: b.sizeDecision})
+		if err != nil {
+			b.log.Error(err, "Failed to sync file", "file", file.Source, "module", file.Module)
+			errs = append(errs, fmt.Errorf("%s: %w", file.Source, err))
+			var fileErr *targetFileError
+			if !errors.As(err, &fileErr) {
+				// The session is in an unknown state, cannot continue with the other files
+				for _, skipped := range b.files[i+1:] {
+					b.results = append(b.results, FileSyncResult{FileMapping: skipped, Err: errors.New("skipped")})
+				}
+				break
+			}
+		}
 	}
-	b.log.Info("Opened file", "file", b.sourceFile)
+	return errors.Join(errs...)
+}
+
+func (b *BlockrsyncClient) syncSourceFile(s *session, index int, sourceFile string) error {
+	b.sourceFile = sourceFile
+	b.report = nil
+	b.sizeDecision = nil
+	if b.sharedSource != nil {
+		return b.syncHashedFile(s, index, b.sharedSource)
+	}
+	b.hasher = NewImageHasher(int64(b.opts.BlockSize), b.opts.SourceFormat, b.log.WithName("hasher"))
+	f, err := image.Open(sourceFile, b.opts.SourceFormat)
+	if err != nil {
+		return wrapError(ErrSourceIO, err)
+	}
+	b.log.Info("Opened file", "file", sourceFile, "format", f.Format())
 	defer f.Close()
 
-	size, err := b.hasher.HashFile(b.sourceFile)
+	if b.changedExtents != nil {
+		b.sourceSize = f.Size()
+		b.log.Info("Using changed extents instead of hashing", "extents", len(b.changedExtents), "size", b.sourceSize)
+		return b.syncHashedFile(s, index, f)
+	}
+	size, err := b.hasher.HashFile(sourceFile)
 	if err != nil {
-		return err
+		return wrapError(ErrSourceIO, err)
 	}
 	b.sourceSize = size
-	b.log.V(5).Info("Hashed file", "filename", b.sourceFile, "size", size)
-	conn, err := b.connectionProvider.Connect()
-	if err != nil {
+	b.log.V(5).Info("Hashed file", "filename", sourceFile, "size", size)
+	return b.syncHashedFile(s, index, f)
+}
+
+// syncHashedFile syncs an already hashed source, once the target is ready to send
+// its hashes.
+func (b *BlockrsyncClient) syncHashedFile(s *session, index int, f io.ReaderAt) error {
+	start := FileStart{}
+	if err := s.readMessage(&start); err != nil {
 		return err
 	}
-	defer conn.Close()
-	reader := snappy.NewReader(conn)
+	if start.Index != index {
+		return fmt.Errorf("%w: expected file index %d, target sent %d", ErrProtocol, index, start.Index)
+	}
+	if start.Error != "" {
+		return &targetFileError{msg: start.Error, kind: errorKindByName(start.Kind)}
+	}
+	if start.Size != nil {
+		b.sizeDecision = start.Size
+		b.log.Info("Target size", "source size", start.Size.SourceSize, "target size", start.Size.TargetSize, "action", start.Size.Action)
+	}
+	return b.syncFile(s, index, f)
+}
+
+// requestSize returns the size of the source sent in the request, or 0 if it
+// cannot be determined, the error is reported when the file is synced.
+func (b *BlockrsyncClient) requestSize(sourceFile string) int64 {
+	if b.sharedSource != nil {
+		return b.sourceSize
+	}
+	size, err := sourceFileSize(sourceFile, b.opts.SourceFormat)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+func (b *BlockrsyncClient) syncFile(s *session, index int, f io.ReaderAt) error {
 	var diff []int64
-	if blockSize, sourceHashes, err := b.hasher.DeserializeHashes(reader); err != nil {
-		return err
+	if blockSize, sourceHashes, err := b.hasher.DeserializeHashes(s.reader); err != nil {
+		return streamError(err)
 	} else {
-		diff, err = b.hasher.DiffHashes(blockSize, sourceHashes)
+		if b.changedExtents != nil {
+			diff, err = b.changedBlocks(blockSize, sourceHashes, f)
+		} else {
+			diff, err = b.hasher.DiffHashes(blockSize, sourceHashes)
+		}
 		if err != nil {
-			return err
+			return wrapError(ErrProtocol, err)
 		}
 		if len(diff) == 0 {
 			b.log.Info("No differences found")
-			return nil
 		} else {
 			b.log.Info("Differences found", "count", len(diff))
 		}
 	}
-	writer := snappy.NewBufferedWriter(conn)
-	defer writer.Close()
+	if b.sharedSource != nil {
+		b.sharedSource.expect(diff)
+	}
 
-	syncProgress := &progress{
-		progressType: "sync progress",
-		logger:       b.log,
-		start:        float64(50),
+	if b.opts.DryRun {
+		report, err := newDiffReport(diff, b.hasher.BlockSize(), b.sourceSize, f)
+		if err != nil {
+			return wrapError(ErrSourceIO, err)
+		}
+		report.Size = b.sizeDecision
+		b.report = report
+	} else {
+		syncProgress := &progress{
+			progressType: "sync progress",
+			logger:       b.log,
+			start:        float64(50),
+		}
+		if err := b.writeBlocksToServer(s.writer, diff, f, syncProgress); err != nil {
+			return wrapError(ErrConnection, err)
+		}
+		if err := writeEndOfBlocks(s.writer); err != nil {
+			return wrapError(ErrConnection, err)
+		}
+		if err := s.flush(); err != nil {
+			return err
+		}
 	}
-	if err := b.writeBlocksToServer(writer, diff, f, syncProgress); err != nil {
+	result := FileResult{}
+	if err := s.readMessage(&result); err != nil {
 		return err
 	}
-
+	if result.Index != index {
+		return fmt.Errorf("%w: expected result for file index %d, target sent %d", ErrProtocol, index, result.Index)
+	}
+	if result.Error != "" {
+		if result.Aborted {
+			return fmt.Errorf("target failed to apply blocks and ended the session: %w", remoteError(result.Kind, result.Error))
+		}
+		return &targetFileError{msg: fmt.Sprintf("target failed to apply blocks: %s", result.Error), kind: errorKindByName(result.Kind)}
+	}
 	return nil
 }
 
@@ -105,15 +314,24 @@ func (b *BlockrsyncClient) writeBlocksToServer(writer io.Writer, offsets []int64
 	}
 	buf := make([]byte, b.hasher.BlockSize())
 	for i, offset := range offsets {
+		if err := b.opts.cancelled(); err != nil {
+			return err
+		}
 		b.log.V(5).Info("Sending data", "offset", offset, "index", i, "blocksize", b.hasher.BlockSize())
 		if err := binary.Write(writer, binary.LittleEndian, offset); err != nil {
 			return err
 		}
-		n, err := f.ReadAt(buf, offset)
-		if err != nil && err != io.EOF {
-			return err
+		// Unallocated blocks of an image are holes, without reading them
+		allocated := isAllocated(f, offset, b.hasher.BlockSize())
+		n := 0
+		if allocated {
+			var err error
+			n, err = f.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				return wrapError(ErrSourceIO, err)
+			}
 		}
-		if isEmptyBlock(buf) {
+		if !allocated || isEmptyBlock(buf) {
 			b.log.V(5).Info("Skipping empty block", "offset", offset)
 			if _, err := writer.Write([]byte{Hole}); err != nil {
 				return err
@@ -140,6 +358,30 @@ func (b *BlockrsyncClient) writeBlocksToServer(writer io.Writer, offsets []int64
 	return nil
 }
 
+func writeEndOfBlocks(writer io.Writer) error {
+	if err := binary.Write(writer, binary.LittleEndian, int64(0)); err != nil {
+		return err
+	}
+	_, err := writer.Write([]byte{End})
+	return err
+}
+
+// forwardBlock writes the current record of the block reader to the writer.
+func forwardBlock(writer io.Writer, blockReader *BlockReader) error {
+	if err := binary.Write(writer, binary.LittleEndian, blockReader.Offset()); err != nil {
+		return err
+	}
+	if blockReader.IsHole() {
+		_, err := writer.Write([]byte{Hole})
+		return err
+	}
+	if _, err := writer.Write([]byte{Block}); err != nil {
+		return err
+	}
+	_, err := writer.Write(blockReader.Block())
+	return err
+}
+
 func isEmptyBlock(buf []byte) bool {
 	for _, b := range buf {
 		if b != 0 {
@@ -168,11 +410,14 @@ type NetworkConnectionProvider struct {
 }
 
 func (n *NetworkConnectionProvider) Connect() (io.ReadWriteCloser, error) {
+	address, err := transport.ParseAddress(n.targetAddress, n.port)
+	if err != nil {
+		return nil, err
+	}
 	retryCount := 0
 	var conn io.ReadWriteCloser
-	var err error
 	for conn == nil {
-		conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", n.targetAddress, n.port))
+		conn, err = transport.Dial(address)
 		if err != nil {
 			if retryCount > 30 {
 				return nil, fmt.Errorf("unable to connect to target after %d retries", retryCount)
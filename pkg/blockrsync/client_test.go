@@ -177,8 +177,10 @@ var _ = Describe("blockrsync client tests", func() {
 			}
 			port, err := getFreePort()
 			Expect(err).ToNot(HaveOccurred())
+			// The server opens the target for writing, never give it the shared image
+			targetFile := copyTestImage(GinkgoT().TempDir())
 			client = NewBlockrsyncClient(filepath.Join(testImagePath, testFileName), "localhost", port, &opts, GinkgoLogr.WithName("client"))
-			server := NewBlockrsyncServer(filepath.Join(testImagePath, testFileName), port, &opts, GinkgoLogr.WithName("server"))
+			server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
 			go func() {
 				defer GinkgoRecover()
 				err := server.StartServer()
@@ -190,8 +192,7 @@ var _ = Describe("blockrsync client tests", func() {
 		})
 
 		It("should detect differences between source and empty file", func() {
-			tmpDir, err := os.MkdirTemp("", "blockrsync")
-			Expect(err).ToNot(HaveOccurred())
+			tmpDir := GinkgoT().TempDir()
 			opts := BlockRsyncOptions{
 				BlockSize:     64 * 1024,
 				Preallocation: false,
@@ -207,6 +208,7 @@ var _ = Describe("blockrsync client tests", func() {
 			}()
 			err = client.ConnectToTarget()
 			Expect(err).ToNot(HaveOccurred())
+			expectSameContent(filepath.Join(testImagePath, testFileName), filepath.Join(tmpDir, testFileNameEmpty))
 			md5sum := md5.New()
 			testFile, err := os.Open(filepath.Join(testImagePath, testFileName))
 			Expect(err).ToNot(HaveOccurred())
@@ -219,6 +221,16 @@ var _ = Describe("blockrsync client tests", func() {
 	})
 })
 
+// copyTestImage copies the shared test image to the directory, tests that write
+// to the image use the copy.
+func copyTestImage(dir string) string {
+	data, err := os.ReadFile(filepath.Join(testImagePath, testFileName))
+	Expect(err).ToNot(HaveOccurred())
+	fileName := filepath.Join(dir, testFileName)
+	Expect(os.WriteFile(fileName, data, 0644)).To(Succeed())
+	return fileName
+}
+
 type ErrorWriter struct {
 	buf                  *bytes.Buffer
 	writeUntilErrorCount int
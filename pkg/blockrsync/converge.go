@@ -0,0 +1,217 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/awels/blockrsync/pkg/image"
+)
+
+// ConvergeOptions controls the rounds of a converge sync. Rounds are repeated until
+// the changed bytes of a round drop below the threshold, or the maximum number of
+// rounds is reached. A final round is then run between the hooks.
+type ConvergeOptions struct {
+	MaxRounds int
+	// Threshold in bytes, a round that changes fewer bytes starts the final round
+	Threshold int64
+	// PreFinalHook is run before the final round, for instance to freeze the
+	// file system
+	PreFinalHook string
+	// PostFinalHook is run after the final round, even if it failed or was
+	// cancelled
+	PostFinalHook string
+}
+
+type RoundStats struct {
+	Round         int           `json:"round"`
+	Final         bool          `json:"final,omitempty"`
+	ChangedBlocks int64         `json:"changedBlocks"`
+	ChangedBytes  int64         `json:"changedBytes"`
+	Duration      time.Duration `json:"duration"`
+}
+
+// Rounds returns the statistics of the rounds of the last converge sync.
+func (b *BlockrsyncClient) Rounds() []RoundStats {
+	return b.rounds
+}
+
+// Converge syncs the source in rounds over a single session, so the source can
+// change while it is being synced. The target is only hashed once, the client
+// keeps track of the blocks it sent.
+func (b *BlockrsyncClient) Converge(converge *ConvergeOptions) error {
+	if len(b.files) != 1 {
+		return newError(ErrProtocol, "converge syncs a single file")
+	}
+	if b.opts.DryRun {
+		return newError(ErrProtocol, "converge cannot be a dry run")
+	}
+	if converge.MaxRounds < 1 {
+		return newError(ErrProtocol, "converge needs at least one round before the final round")
+	}
+	b.rounds = nil
+	b.sourceFile = b.files[0].Source
+	conn, err := b.connectionProvider.Connect()
+	if err != nil {
+		return wrapError(ErrConnection, err)
+	}
+	defer conn.Close()
+	defer b.opts.closeOnCancel(conn)()
+	s := newSession(conn)
+	if err := s.writeMessage(&SessionRequest{
+		Version:   protocolVersion,
+		BlockSize: int64(b.opts.BlockSize),
+		Files: []FileRequest{{
+			Module:   b.files[0].Module,
+			Size:     b.requestSize(b.sourceFile),
+			Identity: b.opts.TargetIdentity,
+			Marker:   b.opts.TargetMarker,
+		}},
+		Converge: true,
+	}); err != nil {
+		return b.opts.cancelError(err)
+	}
+	if err := s.readResponse(); err != nil {
+		return b.opts.cancelError(fmt.Errorf("session rejected by target: %w", err))
+	}
+	f, err := image.Open(b.sourceFile, b.opts.SourceFormat)
+	if err != nil {
+		return wrapError(ErrSourceIO, err)
+	}
+	defer f.Close()
+
+	var targetHashes map[int64][]byte
+	for round := 1; ; round++ {
+		stats, err := b.convergeRound(s, f, round, false, &targetHashes)
+		if err != nil {
+			return b.opts.cancelError(err)
+		}
+		if stats.ChangedBytes < converge.Threshold || round >= converge.MaxRounds {
+			break
+		}
+	}
+
+	if err := runHook(converge.PreFinalHook); err != nil {
+		return fmt.Errorf("pre final hook failed: %w", err)
+	}
+	_, err = b.convergeRound(s, f, len(b.rounds)+1, true, &targetHashes)
+	err = b.opts.cancelError(err)
+	if hookErr := runHook(converge.PostFinalHook); hookErr != nil {
+		err = errors.Join(err, fmt.Errorf("post final hook failed: %w", hookErr))
+	}
+	if err != nil {
+		return err
+	}
+	return s.writeMessage(&RoundStart{Done: true})
+}
+
+// convergeRound hashes the source, and sends the blocks that differ from the
+// target. The hashes of the target are updated with the blocks that were sent.
+func (b *BlockrsyncClient) convergeRound(s *session, f io.ReaderAt, round int, final bool, targetHashes *map[int64][]byte) (*RoundStats, error) {
+	if err := b.opts.cancelled(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if round > 1 {
+		if err := s.writeMessage(&RoundStart{Round: round, Final: final}); err != nil {
+			return nil, err
+		}
+	}
+	b.hasher = NewImageHasher(int64(b.opts.BlockSize), b.opts.SourceFormat, b.log.WithName("hasher"))
+	size, err := b.hasher.HashFile(b.sourceFile)
+	if err != nil {
+		return nil, wrapError(ErrSourceIO, err)
+	}
+	b.sourceSize = size
+
+	if round == 1 {
+		fileStart := FileStart{}
+		if err := s.readMessage(&fileStart); err != nil {
+			return nil, err
+		}
+		if fileStart.Error != "" {
+			return nil, remoteError(fileStart.Kind, fileStart.Error)
+		}
+		if _, *targetHashes, err = b.hasher.DeserializeHashes(s.reader); err != nil {
+			return nil, streamError(err)
+		}
+	}
+	diff, err := b.hasher.DiffHashes(b.hasher.BlockSize(), maps.Clone(*targetHashes))
+	if err != nil {
+		return nil, err
+	}
+	// The target is truncated to the size of the source
+	maps.DeleteFunc(*targetHashes, func(offset int64, _ []byte) bool {
+		return offset >= size
+	})
+	reader := &hashingReaderAt{
+		source: f,
+		hashes: *targetHashes,
+	}
+	if err := b.writeBlocksToServer(s.writer, diff, reader, nil); err != nil {
+		return nil, wrapError(ErrConnection, err)
+	}
+	if err := writeEndOfBlocks(s.writer); err != nil {
+		return nil, wrapError(ErrConnection, err)
+	}
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+	result := FileResult{}
+	if err := s.readMessage(&result); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("target failed to apply blocks: %w", remoteError(result.Kind, result.Error))
+	}
+	stats := RoundStats{
+		Round:         round,
+		Final:         final,
+		ChangedBlocks: int64(len(diff)),
+		ChangedBytes:  reader.changedBytes,
+		Duration:      time.Since(start),
+	}
+	b.rounds = append(b.rounds, stats)
+	b.log.Info("Finished round", "round", round, "final", final, "changed blocks", stats.ChangedBlocks, "changed bytes", stats.ChangedBytes, "duration", stats.Duration.String())
+	return &stats, nil
+}
+
+// hashingReaderAt records the hashes of the blocks read, which are the hashes of
+// the blocks written to the target.
+type hashingReaderAt struct {
+	source       io.ReaderAt
+	hashes       map[int64][]byte
+	changedBytes int64
+}
+
+func (h *hashingReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := h.source.ReadAt(p, offset)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	sum := blake2b.Sum512(p[:n])
+	h.hashes[offset] = sum[:]
+	if !isEmptyBlock(p[:n]) {
+		h.changedBytes += int64(n)
+	}
+	return n, err
+}
+
+func runHook(command string, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	cmd := exec.Command("sh", "-c", command)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
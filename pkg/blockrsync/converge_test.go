@@ -0,0 +1,170 @@
+package blockrsync
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("converge tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		targetFile string
+		opts       BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-converge")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		targetFile = createTestFile(tmpDir, "target.raw", 10*4096, 2)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	startServer := func() (int, chan error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		return port, done
+	}
+
+	// modifySource returns a command that changes the source at the offset
+	modifySource := func(offset int) string {
+		return fmt.Sprintf("printf 'changed' | dd of=%s bs=1 seek=%d conv=notrunc status=none", sourceFile, offset)
+	}
+
+	It("should pick up changes made before the final round", func() {
+		port, done := startServer()
+		marker := filepath.Join(tmpDir, "unfrozen")
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.Converge(&ConvergeOptions{
+			MaxRounds:     5,
+			Threshold:     1024 * 1024,
+			PreFinalHook:  modifySource(5 * 4096),
+			PostFinalHook: "touch " + marker,
+		})).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+		Expect(marker).To(BeAnExistingFile())
+
+		rounds := client.Rounds()
+		Expect(rounds).To(HaveLen(2))
+		Expect(rounds[0].Final).To(BeFalse())
+		// The first block is empty in both files
+		Expect(rounds[0].ChangedBlocks).To(Equal(int64(20)))
+		Expect(rounds[1].Final).To(BeTrue())
+		Expect(rounds[1].ChangedBlocks).To(Equal(int64(1)))
+	})
+
+	It("should stop the rounds at the maximum number of rounds", func() {
+		port, done := startServer()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.Converge(&ConvergeOptions{
+			MaxRounds: 3,
+		})).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+		rounds := client.Rounds()
+		Expect(rounds).To(HaveLen(4))
+		for _, round := range rounds[1:] {
+			Expect(round.ChangedBlocks).To(BeZero())
+		}
+		Expect(rounds[3].Final).To(BeTrue())
+	})
+
+	It("should run the post hook when the final round fails", func() {
+		port, done := startServer()
+		marker := filepath.Join(tmpDir, "unfrozen")
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		err := client.Converge(&ConvergeOptions{
+			MaxRounds:     1,
+			PreFinalHook:  "rm " + sourceFile,
+			PostFinalHook: "touch " + marker,
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(marker).To(BeAnExistingFile())
+		Expect(<-done).To(HaveOccurred())
+	})
+
+	It("should run the post hook when cancelled before the final round", func() {
+		port, done := startServer()
+		started := filepath.Join(tmpDir, "frozen")
+		cancelled := filepath.Join(tmpDir, "cancelled")
+		marker := filepath.Join(tmpDir, "unfrozen")
+		cancel := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			// The pre hook returns once the sync is cancelled
+			defer os.WriteFile(cancelled, nil, 0644)
+			Eventually(func() error {
+				_, err := os.Stat(started)
+				return err
+			}, "10s").Should(Succeed())
+			close(cancel)
+		}()
+		clientOpts := opts
+		clientOpts.Cancel = cancel
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &clientOpts, GinkgoLogr.WithName("client"))
+		err := client.Converge(&ConvergeOptions{
+			MaxRounds:     1,
+			PreFinalHook:  fmt.Sprintf("touch %s; while [ ! -e %s ]; do sleep 0.01; done", started, cancelled),
+			PostFinalHook: "touch " + marker,
+		})
+		Expect(err).To(MatchError(ErrCancelled))
+		Expect(marker).To(BeAnExistingFile())
+		Expect(client.Rounds()).To(HaveLen(1))
+		Expect(<-done).To(HaveOccurred())
+	})
+
+	It("should not start the final round if the pre hook fails", func() {
+		port, done := startServer()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.Converge(&ConvergeOptions{
+			MaxRounds:    1,
+			PreFinalHook: "exit 1",
+		})).To(MatchError(ContainSubstring("pre final hook failed")))
+		Expect(<-done).To(HaveOccurred())
+		Expect(client.Rounds()).To(HaveLen(1))
+	})
+
+	It("should converge to a daemon module", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		daemon := NewBlockrsyncDaemon(&DaemonConfig{Modules: []Module{{Name: "disk", Path: targetFile}}}, 0, &BlockRsyncOptions{}, GinkgoLogr.WithName("daemon"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(daemon.Serve(listener)).To(Succeed())
+		}()
+		opts.Module = "disk"
+		client := NewBlockrsyncClient(sourceFile, "localhost", listener.Addr().(*net.TCPAddr).Port, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.Converge(&ConvergeOptions{
+			MaxRounds:    2,
+			PreFinalHook: modifySource(20 * 4096),
+		})).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should reject a converge session with multiple files", func() {
+		client := NewBlockrsyncMultiFileClient([]FileMapping{{Source: sourceFile}, {Source: sourceFile}}, "localhost", 0, &opts, GinkgoLogr.WithName("client"))
+		err := client.Converge(&ConvergeOptions{MaxRounds: 1})
+		Expect(err).To(MatchError(ContainSubstring("single file")))
+		Expect(err).To(MatchError(ErrProtocol))
+	})
+})
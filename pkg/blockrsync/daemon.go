@@ -0,0 +1,331 @@
+package blockrsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/go-logr/logr"
+)
+
+// Module is a named target served by the daemon.
+type Module struct {
+	Name         string   `json:"name"`
+	Path         string   `json:"path"`
+	ReadOnly     bool     `json:"readOnly,omitempty"`
+	AllowedPeers []string `json:"allowedPeers,omitempty"`
+	// Format of the image at the path, raw, qcow2 or auto
+	Format string `json:"format,omitempty"`
+	// UndoLog records the original content of the overwritten blocks, a sync
+	// fails if the log already exists
+	UndoLog string `json:"undoLog,omitempty"`
+}
+
+type DaemonConfig struct {
+	Modules []Module `json:"modules"`
+}
+
+func LoadDaemonConfig(fileName string) (*DaemonConfig, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	config := &DaemonConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("unable to parse daemon config %s: %w", fileName, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *DaemonConfig) validate() error {
+	if len(c.Modules) == 0 {
+		return errors.New("no modules defined")
+	}
+	names := make(map[string]bool)
+	for _, module := range c.Modules {
+		if module.Name == "" {
+			return errors.New("module name cannot be empty")
+		}
+		if module.Path == "" {
+			return fmt.Errorf("module %s has no path", module.Name)
+		}
+		if names[module.Name] {
+			return fmt.Errorf("duplicate module %s", module.Name)
+		}
+		names[module.Name] = true
+		for _, peer := range module.AllowedPeers {
+			if _, _, err := net.ParseCIDR(peer); err != nil && net.ParseIP(peer) == nil {
+				return fmt.Errorf("module %s has invalid allowed peer %s", module.Name, peer)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *DaemonConfig) module(name string) *Module {
+	for i := range c.Modules {
+		if c.Modules[i].Name == name {
+			return &c.Modules[i]
+		}
+	}
+	return nil
+}
+
+func (m *Module) allowsPeer(addr net.Addr) bool {
+	if len(m.AllowedPeers) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, peer := range m.AllowedPeers {
+		if _, cidr, err := net.ParseCIDR(peer); err == nil {
+			if cidr.Contains(tcpAddr.IP) {
+				return true
+			}
+		} else if net.ParseIP(peer).Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockrsyncDaemon serves the modules in its configuration, and handles multiple
+// concurrent sessions. Only one session can write to a module at a time.
+type BlockrsyncDaemon struct {
+	config *DaemonConfig
+	port   int
+	opts   *BlockRsyncOptions
+	log    logr.Logger
+	mu     sync.Mutex
+	active map[string]bool
+	// sessions are waited for when the daemon is cancelled
+	sessions sync.WaitGroup
+}
+
+func NewBlockrsyncDaemon(config *DaemonConfig, port int, opts *BlockRsyncOptions, logger logr.Logger) *BlockrsyncDaemon {
+	return &BlockrsyncDaemon{
+		config: config,
+		port:   port,
+		opts:   opts,
+		log:    logger,
+		active: make(map[string]bool),
+	}
+}
+
+func (d *BlockrsyncDaemon) StartServer() error {
+	if isHTTPAddress(d.opts.ListenAddress) {
+		u, err := url.Parse(d.opts.ListenAddress)
+		if err != nil {
+			return err
+		}
+		server, errChan, err := serveHTTP(u, d, d.opts, d.log)
+		if err != nil {
+			return err
+		}
+		select {
+		case err := <-errChan:
+			return err
+		case <-d.opts.Cancel:
+			server.Close()
+			d.sessions.Wait()
+			return d.opts.cancelled()
+		}
+	}
+	listener, err := listen(d.opts.ListenAddress, d.port, d.log)
+	if err != nil {
+		return err
+	}
+	return d.Serve(listener)
+}
+
+// Serve accepts connections on the listener until it is closed. When the daemon
+// is cancelled, it waits for the sessions to end.
+func (d *BlockrsyncDaemon) Serve(listener net.Listener) error {
+	defer d.opts.closeOnCancel(listener)()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				if err := d.opts.cancelled(); err != nil {
+					d.sessions.Wait()
+					return err
+				}
+				return nil
+			}
+			return err
+		}
+		d.sessions.Add(1)
+		go func() {
+			defer d.sessions.Done()
+			defer conn.Close()
+			defer d.opts.closeOnCancel(conn)()
+			if err := d.handleConnection(conn, conn.RemoteAddr()); err != nil {
+				d.log.Error(err, "Session failed", "peer", conn.RemoteAddr().String())
+			}
+		}()
+	}
+}
+
+// ServeModule handles a session on a connection that already selected a module,
+// like a connection of the proxy. Files without a module are synced to it.
+func (d *BlockrsyncDaemon) ServeModule(conn net.Conn, module string) error {
+	return d.handleSession(conn, conn.RemoteAddr(), module)
+}
+
+func (d *BlockrsyncDaemon) handleConnection(conn io.ReadWriter, peer net.Addr) error {
+	return d.handleSession(conn, peer, "")
+}
+
+func (d *BlockrsyncDaemon) handleSession(conn io.ReadWriter, peer net.Addr, defaultModule string) error {
+	s := newSession(conn)
+	req, err := s.readRequest()
+	if err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	if req.BlockSize <= 0 {
+		err := fmt.Errorf("invalid block size %d", req.BlockSize)
+		_ = s.respond(err)
+		return err
+	}
+	if err := checkSelectedModule(req, defaultModule); err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	if err := s.respond(nil); err != nil {
+		return err
+	}
+	d.log.Info("Starting session", "peer", addrString(peer), "files", len(req.Files))
+	var errs []error
+	for i, file := range req.Files {
+		if err := d.opts.cancelled(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if file.Module == "" {
+			file.Module = defaultModule
+		}
+		if err := d.syncModule(s, i, file, req, peer); err != nil {
+			errs = append(errs, fmt.Errorf("module %s: %w", file.Module, err))
+			if isSessionAborted(err) {
+				d.log.Info("Ending session, cannot continue with the remaining files", "peer", addrString(peer))
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	d.log.Info("Session completed", "peer", addrString(peer))
+	return nil
+}
+
+// syncModule syncs a single file of a session to a module, errors that prevent
+// the sync from starting are reported to the client before the hashes are sent.
+func (d *BlockrsyncDaemon) syncModule(s *session, index int, file FileRequest, req *SessionRequest, peer net.Addr) error {
+	reject := func(err error) error {
+		if writeErr := s.writeMessage(&FileStart{Index: index, Error: err.Error(), Kind: errorKindName(err)}); writeErr != nil {
+			return abortSession(errors.Join(err, writeErr))
+		}
+		return err
+	}
+	module, err := d.lookupModule(file.Module, peer, req.DryRun)
+	if err != nil {
+		return reject(err)
+	}
+	if !d.acquire(module.Name) {
+		return reject(fmt.Errorf("module %s is busy", module.Name))
+	}
+	defer d.release(module.Name)
+
+	log := d.log.WithValues("module", module.Name)
+	log.Info("Syncing module", "index", index, "path", module.Path)
+	opts := *d.opts
+	opts.BlockSize = int(req.BlockSize)
+	if module.Format != "" {
+		opts.TargetFormat = module.Format
+	}
+	opts.UndoLog = module.UndoLog
+	server := NewBlockrsyncServer(module.Path, 0, &opts, log)
+	if err := server.checkIdentity(file); err != nil {
+		return reject(err)
+	}
+	f, err := server.openTargetFile(req.DryRun)
+	if err != nil {
+		return reject(err)
+	}
+	defer server.closeTarget(f)
+	server.dryRun = req.DryRun
+	server.converge = req.Converge
+	if err := <-server.hashTargetFile(); err != nil {
+		return reject(err)
+	}
+	if err := server.checkSize(f, file); err != nil {
+		return reject(err)
+	}
+	return server.syncFile(s, index, f)
+}
+
+// checkSelectedModule makes sure a connection that selected a module only syncs
+// to that module.
+func checkSelectedModule(req *SessionRequest, selected string) error {
+	if selected == "" {
+		return nil
+	}
+	for _, file := range req.Files {
+		if file.Module != "" && file.Module != selected {
+			return fmt.Errorf("%w: module %s requested on a connection for module %s", ErrProtocol, file.Module, selected)
+		}
+	}
+	return nil
+}
+
+func (d *BlockrsyncDaemon) lookupModule(name string, peer net.Addr, dryRun bool) (*Module, error) {
+	if name == "" {
+		return nil, errors.New("no module specified")
+	}
+	module := d.config.module(name)
+	if module == nil {
+		return nil, fmt.Errorf("unknown module %s", name)
+	}
+	if !module.allowsPeer(peer) {
+		return nil, fmt.Errorf("peer %s is not allowed to access module %s", addrString(peer), module.Name)
+	}
+	if module.ReadOnly && !dryRun {
+		return nil, fmt.Errorf("module %s is read-only", module.Name)
+	}
+	return module, nil
+}
+
+func (d *BlockrsyncDaemon) acquire(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active[name] {
+		return false
+	}
+	d.active[name] = true
+	return true
+}
+
+func (d *BlockrsyncDaemon) release(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.active, name)
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	return addr.String()
+}
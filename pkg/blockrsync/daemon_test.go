@@ -0,0 +1,297 @@
+package blockrsync
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("daemon tests", func() {
+	var (
+		tmpDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-daemon")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	writeConfig := func(content string) string {
+		fileName := filepath.Join(tmpDir, "config.json")
+		Expect(os.WriteFile(fileName, []byte(content), 0644)).To(Succeed())
+		return fileName
+	}
+
+	It("should load a valid config", func() {
+		config, err := LoadDaemonConfig(writeConfig(`{"modules":[{"name":"disk0","path":"/dev/vdb","allowedPeers":["10.0.0.0/8","192.168.1.1"]},{"name":"disk1","path":"/dev/vdc","readOnly":true}]}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.Modules).To(HaveLen(2))
+		Expect(config.module("disk1").ReadOnly).To(BeTrue())
+		Expect(config.module("disk2")).To(BeNil())
+	})
+
+	DescribeTable("should reject invalid configs", func(content string) {
+		_, err := LoadDaemonConfig(writeConfig(content))
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("invalid json", `{"modules":`),
+		Entry("no modules", `{"modules":[]}`),
+		Entry("no name", `{"modules":[{"path":"/dev/vdb"}]}`),
+		Entry("no path", `{"modules":[{"name":"disk0"}]}`),
+		Entry("duplicate module", `{"modules":[{"name":"disk0","path":"/dev/vdb"},{"name":"disk0","path":"/dev/vdc"}]}`),
+		Entry("invalid peer", `{"modules":[{"name":"disk0","path":"/dev/vdb","allowedPeers":["invalid"]}]}`),
+	)
+
+	DescribeTable("should check allowed peers", func(allowedPeers []string, addr net.Addr, expected bool) {
+		module := Module{Name: "disk0", Path: "/dev/vdb", AllowedPeers: allowedPeers}
+		Expect(module.allowsPeer(addr)).To(Equal(expected))
+	},
+		Entry("no restrictions", nil, &net.TCPAddr{IP: net.ParseIP("10.1.1.1")}, true),
+		Entry("no restrictions, no address", nil, nil, true),
+		Entry("matching cidr", []string{"10.0.0.0/8"}, &net.TCPAddr{IP: net.ParseIP("10.1.1.1")}, true),
+		Entry("matching ip", []string{"10.1.1.1"}, &net.TCPAddr{IP: net.ParseIP("10.1.1.1")}, true),
+		Entry("not matching", []string{"10.0.0.0/8", "192.168.1.1"}, &net.TCPAddr{IP: net.ParseIP("192.168.1.2")}, false),
+		Entry("no address", []string{"10.0.0.0/8"}, nil, false),
+	)
+
+	Context("with running daemon", func() {
+		var (
+			listener   net.Listener
+			port       int
+			sourceFile string
+			opts       BlockRsyncOptions
+		)
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "localhost:0")
+			Expect(err).ToNot(HaveOccurred())
+			port = listener.Addr().(*net.TCPAddr).Port
+			sourceFile = createTestFile(tmpDir, "source.raw", 10*4096+100, 1)
+			opts = BlockRsyncOptions{
+				BlockSize: 4096,
+			}
+			config := &DaemonConfig{
+				Modules: []Module{
+					{Name: "disk0", Path: filepath.Join(tmpDir, "disk0.raw")},
+					{Name: "disk1", Path: filepath.Join(tmpDir, "disk1.raw")},
+					{Name: "readonly", Path: filepath.Join(tmpDir, "readonly.raw"), ReadOnly: true},
+					{Name: "restricted", Path: filepath.Join(tmpDir, "restricted.raw"), AllowedPeers: []string{"192.168.1.1"}},
+					// Writing the first block fails, the directory of the undo log does not exist
+					{Name: "broken", Path: filepath.Join(tmpDir, "broken.raw"), UndoLog: filepath.Join(tmpDir, "missing", "undo.log")},
+				},
+			}
+			Expect(config.validate()).To(Succeed())
+			daemon := NewBlockrsyncDaemon(config, port, &BlockRsyncOptions{}, GinkgoLogr.WithName("daemon"))
+			go func() {
+				defer GinkgoRecover()
+				Expect(daemon.Serve(listener)).To(Succeed())
+			}()
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("should sync multiple modules", func() {
+			for _, module := range []string{"disk0", "disk1"} {
+				moduleOpts := opts
+				moduleOpts.Module = module
+				client := NewBlockrsyncClient(sourceFile, "localhost", port, &moduleOpts, GinkgoLogr.WithName("client"))
+				Expect(client.ConnectToTarget()).To(Succeed())
+				expectSameContent(sourceFile, filepath.Join(tmpDir, module+".raw"))
+			}
+		})
+
+		It("should sync multiple files in a single session", func() {
+			secondSource := createTestFile(tmpDir, "second.raw", 5*4096, 2)
+			client := NewBlockrsyncMultiFileClient([]FileMapping{
+				{Source: sourceFile, Module: "disk0"},
+				{Source: secondSource, Module: "disk1"},
+			}, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(client.Results()).To(HaveLen(2))
+			for _, result := range client.Results() {
+				Expect(result.Err).ToNot(HaveOccurred())
+			}
+			expectSameContent(sourceFile, filepath.Join(tmpDir, "disk0.raw"))
+			expectSameContent(secondSource, filepath.Join(tmpDir, "disk1.raw"))
+		})
+
+		It("should report per file results and continue after a failed file", func() {
+			secondSource := createTestFile(tmpDir, "second.raw", 5*4096, 2)
+			client := NewBlockrsyncMultiFileClient([]FileMapping{
+				{Source: sourceFile, Module: "disk0"},
+				{Source: sourceFile, Module: "readonly"},
+				{Source: secondSource, Module: "disk1"},
+			}, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			err := client.ConnectToTarget()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("module readonly is read-only"))
+			results := client.Results()
+			Expect(results).To(HaveLen(3))
+			Expect(results[0].Err).ToNot(HaveOccurred())
+			Expect(results[1].Err).To(HaveOccurred())
+			Expect(results[1].Module).To(Equal("readonly"))
+			Expect(results[2].Err).ToNot(HaveOccurred())
+			expectSameContent(sourceFile, filepath.Join(tmpDir, "disk0.raw"))
+			expectSameContent(secondSource, filepath.Join(tmpDir, "disk1.raw"))
+			_, err = os.Stat(filepath.Join(tmpDir, "readonly.raw"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("should continue with the next file after a file fails while writing blocks", func() {
+			// Large enough that the blocks that are not read do not fit in the socket buffers
+			largeSource := createTestFile(tmpDir, "large.raw", 1024*4096, 3)
+			secondSource := createTestFile(tmpDir, "second.raw", 5*4096, 2)
+			client := NewBlockrsyncMultiFileClient([]FileMapping{
+				{Source: largeSource, Module: "broken"},
+				{Source: secondSource, Module: "disk1"},
+			}, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			err := client.ConnectToTarget()
+			Expect(err).To(MatchError(ContainSubstring("unable to create undo log")))
+			results := client.Results()
+			Expect(results).To(HaveLen(2))
+			Expect(results[0].Err).To(MatchError(ErrTargetIO))
+			Expect(results[1].Err).ToNot(HaveOccurred())
+			expectSameContent(secondSource, filepath.Join(tmpDir, "disk1.raw"))
+		})
+
+		It("should skip remaining files if a source cannot be read", func() {
+			client := NewBlockrsyncMultiFileClient([]FileMapping{
+				{Source: filepath.Join(tmpDir, "missing.raw"), Module: "disk0"},
+				{Source: sourceFile, Module: "disk1"},
+			}, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			Expect(client.ConnectToTarget()).ToNot(Succeed())
+			results := client.Results()
+			Expect(results).To(HaveLen(2))
+			Expect(results[0].Err).To(HaveOccurred())
+			Expect(results[1].Err).To(MatchError("skipped"))
+		})
+
+		DescribeTable("should sync connections that selected a module", func(module, requestedModule, expectedError string) {
+			moduleListener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer moduleListener.Close()
+			daemon := NewBlockrsyncDaemon(&DaemonConfig{Modules: []Module{
+				{Name: "disk0", Path: filepath.Join(tmpDir, "disk0.raw")},
+				{Name: "readonly", Path: filepath.Join(tmpDir, "readonly.raw"), ReadOnly: true},
+				{Name: "restricted", Path: filepath.Join(tmpDir, "restricted.raw"), AllowedPeers: []string{"192.168.1.1"}},
+			}}, 0, &BlockRsyncOptions{}, GinkgoLogr.WithName("daemon"))
+			done := make(chan error, 1)
+			go func() {
+				conn, err := moduleListener.Accept()
+				if err != nil {
+					done <- err
+					return
+				}
+				defer conn.Close()
+				done <- daemon.ServeModule(conn, module)
+			}()
+			opts.Module = requestedModule
+			client := NewBlockrsyncClient(sourceFile, "localhost", moduleListener.Addr().(*net.TCPAddr).Port, &opts, GinkgoLogr.WithName("client"))
+			err = client.ConnectToTarget()
+			if expectedError == "" {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(<-done).To(Succeed())
+				expectSameContent(sourceFile, filepath.Join(tmpDir, module+".raw"))
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(expectedError)))
+				Expect(<-done).To(MatchError(ContainSubstring(expectedError)))
+				if requestedModule != "" {
+					Expect(filepath.Join(tmpDir, requestedModule+".raw")).ToNot(BeAnExistingFile())
+				}
+			}
+		},
+			Entry("module", "disk0", "", ""),
+			Entry("same module requested", "disk0", "disk0", ""),
+			Entry("other module requested", "restricted", "disk0", "module disk0 requested on a connection for module restricted"),
+			Entry("read-only module", "readonly", "", "module readonly is read-only"),
+			Entry("not allowed peer", "restricted", "", "is not allowed to access module restricted"),
+			Entry("unknown module", "unknown", "", "unknown module unknown"),
+		)
+
+		DescribeTable("should reject sessions", func(module, expectedError string) {
+			opts.Module = module
+			client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			err := client.ConnectToTarget()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(expectedError))
+		},
+			Entry("no module", "", "no module specified"),
+			Entry("unknown module", "unknown", "unknown module unknown"),
+			Entry("read-only module", "readonly", "module readonly is read-only"),
+			Entry("not allowed peer", "restricted", "is not allowed to access module restricted"),
+		)
+	})
+
+	It("should reject multiple files on a server not running in daemon mode", func() {
+		opts := BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile := createTestFile(tmpDir, "source.raw", 4096, 1)
+		server := NewBlockrsyncServer(filepath.Join(tmpDir, "target.raw"), port, &opts, GinkgoLogr.WithName("server"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.StartServer()).ToNot(Succeed())
+		}()
+		client := NewBlockrsyncMultiFileClient([]FileMapping{{Source: sourceFile}, {Source: sourceFile}}, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		err = client.ConnectToTarget()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("serves a single file"))
+		Expect(err).To(MatchError(ErrProtocol))
+	})
+
+	It("should reject a module on a server not running in daemon mode", func() {
+		opts := BlockRsyncOptions{
+			BlockSize: 4096,
+			Module:    "disk0",
+		}
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile := createTestFile(tmpDir, "source.raw", 4096, 1)
+		server := NewBlockrsyncServer(filepath.Join(tmpDir, "target.raw"), port, &opts, GinkgoLogr.WithName("server"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.StartServer()).ToNot(Succeed())
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		err = client.ConnectToTarget()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not running in daemon mode"))
+		Expect(err).To(MatchError(ErrProtocol))
+	})
+})
+
+// createTestFile creates a file with random data, the first block is left empty
+// so the file contains a hole.
+func createTestFile(dir, name string, size, seed int64) string {
+	data := make([]byte, size)
+	_, err := rand.New(rand.NewSource(seed)).Read(data)
+	Expect(err).ToNot(HaveOccurred())
+	copy(data, make([]byte, min(size, 4096)))
+	fileName := filepath.Join(dir, name)
+	Expect(os.WriteFile(fileName, data, 0644)).To(Succeed())
+	return fileName
+}
+
+func expectSameContent(expectedFile, actualFile string) {
+	expected, err := os.ReadFile(expectedFile)
+	Expect(err).ToNot(HaveOccurred())
+	actual, err := os.ReadFile(actualFile)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(actual).To(HaveLen(len(expected)))
+	Expect(bytes.Equal(expected, actual)).To(BeTrue(), "content of %s differs from %s", actualFile, expectedFile)
+}
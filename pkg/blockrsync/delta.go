@@ -0,0 +1,287 @@
+package blockrsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/snappy"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	deltaMagic   = "BRSDELTA"
+	deltaVersion = uint32(1)
+)
+
+var (
+	ErrInvalidDelta     = errors.New("invalid delta file")
+	ErrChecksumMismatch = newError(ErrVerification, "delta checksum mismatch")
+)
+
+// DeltaHeader describes the content of a delta file. The header is followed by
+// a snappy compressed stream with the blocks in the same format as sent over the
+// network, and a blake2b checksum of the header and blocks.
+type DeltaHeader struct {
+	Source        string `json:"source"`
+	SourceSize    int64  `json:"sourceSize"`
+	BlockSize     int64  `json:"blockSize"`
+	ChangedBlocks int64  `json:"changedBlocks"`
+	// Checksum of the hashes the delta was created against
+	BaseChecksum string `json:"baseChecksum"`
+}
+
+// WriteHashes hashes the target file, and writes the hashes to the writer.
+func WriteHashes(targetFile string, blockSize int64, w io.Writer, logger logr.Logger) error {
+	hasher := NewFileHasher(blockSize, logger.WithName("hasher"))
+	if _, err := hasher.HashFile(targetFile); err != nil {
+		return wrapError(ErrTargetIO, err)
+	}
+	bw := bufio.NewWriter(w)
+	if err := hasher.SerializeHashes(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// CreateDelta writes the blocks of the source file that differ from the hashes to
+// the writer.
+func CreateDelta(sourceFile string, hashes io.Reader, w io.Writer, logger logr.Logger) (*DeltaHeader, error) {
+	base, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	client, diff, err := diffAgainstHashes(sourceFile, io.TeeReader(bufio.NewReader(hashes), base), logger)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := &DeltaHeader{
+		Source:        sourceFile,
+		SourceSize:    client.sourceSize,
+		BlockSize:     client.hasher.BlockSize(),
+		ChangedBlocks: int64(len(diff)),
+		BaseChecksum:  hex.EncodeToString(base.Sum(nil)),
+	}
+	checksum, err := writeDeltaHeader(w, header)
+	if err != nil {
+		return nil, err
+	}
+	writer := snappy.NewBufferedWriter(w)
+	deltaProgress := &progress{
+		progressType: "delta progress",
+		logger:       logger,
+	}
+	blockWriter := io.MultiWriter(writer, checksum)
+	if err := client.writeBlocksToServer(blockWriter, diff, f, deltaProgress); err != nil {
+		return nil, err
+	}
+	if err := writeEndOfBlocks(blockWriter); err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(checksum.Sum(nil)); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// diffAgainstHashes hashes the source file, and returns a client for it and the
+// offsets of the blocks that differ from the hashes.
+func diffAgainstHashes(sourceFile string, hashes io.Reader, logger logr.Logger) (*BlockrsyncClient, []int64, error) {
+	hasher := &FileHasher{log: logger.WithName("hasher")}
+	blockSize, targetHashes, err := hasher.DeserializeHashes(hashes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read hashes: %w", err)
+	}
+	if blockSize <= 0 {
+		return nil, nil, fmt.Errorf("invalid block size %d in hashes", blockSize)
+	}
+	client := NewBlockrsyncClient(sourceFile, "", 0, &BlockRsyncOptions{BlockSize: int(blockSize)}, logger)
+	size, err := client.hasher.HashFile(sourceFile)
+	if err != nil {
+		return nil, nil, wrapError(ErrSourceIO, err)
+	}
+	client.sourceSize = size
+	diff, err := client.hasher.DiffHashes(blockSize, targetHashes)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.Info("Differences found", "count", len(diff))
+	return client, diff, nil
+}
+
+func writeDeltaHeader(w io.Writer, header *DeltaHeader) (hash.Hash, error) {
+	checksum, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte(deltaMagic)); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, deltaVersion); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	checksum.Write(b)
+	return checksum, nil
+}
+
+// readDeltaHeader reads the header of a delta file, and returns a reader for the
+// blocks that follow it, and the checksum that covers the header.
+func readDeltaHeader(r io.Reader) (*DeltaHeader, io.Reader, hash.Hash, error) {
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, []byte(deltaMagic)) {
+		return nil, nil, nil, fmt.Errorf("%w: missing magic", ErrInvalidDelta)
+	}
+	var version, length uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+	}
+	if version != deltaVersion {
+		return nil, nil, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidDelta, version)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+	}
+	if length > maxMessageSize {
+		return nil, nil, nil, fmt.Errorf("%w: header size %d too large", ErrInvalidDelta, length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+	}
+	header := &DeltaHeader{}
+	if err := json.Unmarshal(b, header); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+	}
+	if header.BlockSize <= 0 || header.SourceSize < 0 {
+		return nil, nil, nil, fmt.Errorf("%w: invalid block size %d or source size %d", ErrInvalidDelta, header.BlockSize, header.SourceSize)
+	}
+	checksum, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	checksum.Write(b)
+	return header, bufio.NewReader(snappy.NewReader(r)), checksum, nil
+}
+
+// VerifyDelta reads the complete delta, and checks its structure and checksum.
+func VerifyDelta(r io.Reader, logger logr.Logger) (*DeltaHeader, error) {
+	header, reader, checksum, err := readDeltaHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	blocks := io.TeeReader(reader, checksum)
+	var sourceSize int64
+	if err := binary.Read(blocks, binary.LittleEndian, &sourceSize); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+	}
+	if sourceSize != header.SourceSize {
+		return nil, fmt.Errorf("%w: source size %d does not match header %d", ErrInvalidDelta, sourceSize, header.SourceSize)
+	}
+	blockReader := NewBlockReader(blocks, int(header.BlockSize), logger.WithName("block-reader"))
+	blockReader.SetSourceSize(sourceSize)
+	count := int64(0)
+	for {
+		cont, err := blockReader.Next()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+		}
+		if !cont {
+			break
+		}
+		count++
+	}
+	if !blockReader.IsEnd() {
+		return nil, fmt.Errorf("%w: truncated", ErrInvalidDelta)
+	}
+	if count != header.ChangedBlocks {
+		return nil, fmt.Errorf("%w: found %d blocks, header has %d", ErrInvalidDelta, count, header.ChangedBlocks)
+	}
+	expected := make([]byte, blake2b.Size)
+	if _, err := io.ReadFull(reader, expected); err != nil {
+		return nil, fmt.Errorf("%w: missing checksum", ErrInvalidDelta)
+	}
+	if !bytes.Equal(expected, checksum.Sum(nil)) {
+		return nil, ErrChecksumMismatch
+	}
+	return header, nil
+}
+
+// ApplyDelta verifies the delta, and then writes its blocks to the target file.
+// If verifyBase is true, the target is hashed first to ensure the delta was
+// created against the current content of the target.
+func ApplyDelta(delta io.ReadSeeker, targetFile string, verifyBase bool, opts *BlockRsyncOptions, logger logr.Logger) (*DeltaHeader, error) {
+	header, err := VerifyDelta(delta, logger)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Verified delta", "source", header.Source, "changed blocks", header.ChangedBlocks)
+	if _, err := delta.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header, reader, _, err := readDeltaHeader(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	applyOpts := *opts
+	applyOpts.BlockSize = int(header.BlockSize)
+	server := NewBlockrsyncServer(targetFile, 0, &applyOpts, logger.WithName("target"))
+	f, err := server.openTargetFile(false)
+	if err != nil {
+		return nil, err
+	}
+	defer server.closeTarget(f)
+	if verifyBase {
+		if err := <-server.hashTargetFile(); err != nil {
+			return nil, err
+		}
+		base, err := blake2b.New512(nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := server.hasher.SerializeHashes(base); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(base.Sum(nil)) != header.BaseChecksum {
+			return nil, newError(ErrVerification, "target does not match the hashes the delta was created against")
+		}
+	} else {
+		if server.targetFileSize, err = targetSize(f); err != nil {
+			return nil, err
+		}
+	}
+	if err := server.writeBlocksToFile(f, reader); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, wrapError(ErrTargetIO, err)
+	}
+	return header, server.commitTarget()
+}
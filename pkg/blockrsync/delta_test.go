@@ -0,0 +1,103 @@
+package blockrsync
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("delta tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		targetFile string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-delta")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		targetFile = createTestFile(tmpDir, "target.raw", 30*4096, 2)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	createDelta := func() []byte {
+		hashes := &bytes.Buffer{}
+		Expect(WriteHashes(targetFile, 4096, hashes, GinkgoLogr.WithName("hash"))).To(Succeed())
+		delta := &bytes.Buffer{}
+		header, err := CreateDelta(sourceFile, hashes, delta, GinkgoLogr.WithName("delta"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(header.BlockSize).To(Equal(int64(4096)))
+		Expect(header.SourceSize).To(Equal(int64(20*4096 + 512)))
+		return delta.Bytes()
+	}
+
+	DescribeTable("should apply a delta to the target", func(verifyBase bool) {
+		delta := createDelta()
+		header, err := ApplyDelta(bytes.NewReader(delta), targetFile, verifyBase, &BlockRsyncOptions{}, GinkgoLogr.WithName("apply"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(header.ChangedBlocks).To(BeNumerically(">", 0))
+		expectSameContent(sourceFile, targetFile)
+	},
+		Entry("without verifying the base", false),
+		Entry("verifying the base", true),
+	)
+
+	It("should verify a valid delta", func() {
+		delta := createDelta()
+		header, err := VerifyDelta(bytes.NewReader(delta), GinkgoLogr.WithName("verify"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(header.Source).To(Equal(sourceFile))
+	})
+
+	It("should reject a corrupted delta without touching the target", func() {
+		delta := createDelta()
+		delta[len(delta)-10] ^= 0xff
+		before, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ApplyDelta(bytes.NewReader(delta), targetFile, false, &BlockRsyncOptions{}, GinkgoLogr.WithName("apply"))
+		Expect(err).To(HaveOccurred())
+		after, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(after).To(Equal(before))
+	})
+
+	It("should reject a truncated delta", func() {
+		delta := createDelta()
+		_, err := VerifyDelta(bytes.NewReader(delta[:len(delta)/2]), GinkgoLogr.WithName("verify"))
+		Expect(errors.Is(err, ErrInvalidDelta) || errors.Is(err, ErrChecksumMismatch)).To(BeTrue())
+	})
+
+	It("should reject a file that is not a delta", func() {
+		_, err := VerifyDelta(bytes.NewReader([]byte("not a delta file")), GinkgoLogr.WithName("verify"))
+		Expect(errors.Is(err, ErrInvalidDelta)).To(BeTrue())
+	})
+
+	It("should refuse to apply when the target changed and the base is verified", func() {
+		delta := createDelta()
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt([]byte{1, 2, 3, 4}, 8*4096)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		_, err = ApplyDelta(bytes.NewReader(delta), targetFile, true, &BlockRsyncOptions{}, GinkgoLogr.WithName("apply"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should create a delta that recreates the source on an empty target", func() {
+		targetFile = filepath.Join(tmpDir, "empty.raw")
+		Expect(os.WriteFile(targetFile, nil, 0644)).To(Succeed())
+		delta := createDelta()
+		_, err := ApplyDelta(bytes.NewReader(delta), targetFile, false, &BlockRsyncOptions{Preallocation: true}, GinkgoLogr.WithName("apply"))
+		Expect(err).ToNot(HaveOccurred())
+		expectSameContent(sourceFile, targetFile)
+	})
+})
@@ -0,0 +1,117 @@
+package blockrsync
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// The kinds of errors a sync can fail with, an error of a kind matches it with
+// errors.Is. Errors reported by the target keep their kind on the source.
+var (
+	// ErrConnection is a failure to connect, or a connection that broke during
+	// the sync, retrying may succeed
+	ErrConnection = errors.New("connection error")
+	// ErrProtocol is a message or stream from the other side that is not valid
+	ErrProtocol = errors.New("protocol error")
+	// ErrSourceIO is a failure reading the source
+	ErrSourceIO = errors.New("source I/O error")
+	// ErrTargetIO is a failure opening, reading or writing the target
+	ErrTargetIO = errors.New("target I/O error")
+	// ErrVerification is a target or input that does not match what was
+	// expected, like the identity or size of the target, or a checksum
+	ErrVerification = errors.New("verification mismatch")
+	// ErrCancelled is a sync that was interrupted before it completed
+	ErrCancelled = errors.New("cancelled")
+)
+
+// errorKinds are the names of the kinds in the protocol, the first kind an error
+// matches is its kind.
+var errorKinds = []struct {
+	name string
+	kind error
+}{
+	{"cancelled", ErrCancelled},
+	{"verification", ErrVerification},
+	{"target-io", ErrTargetIO},
+	{"source-io", ErrSourceIO},
+	{"protocol", ErrProtocol},
+	{"connection", ErrConnection},
+}
+
+// SyncError is an error of one of the kinds, the message is the message of the
+// underlying error.
+type SyncError struct {
+	Kind error
+	Err  error
+}
+
+func (e *SyncError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SyncError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+func newError(kind error, msg string) error {
+	return &SyncError{Kind: kind, Err: errors.New(msg)}
+}
+
+// wrapError gives the error the kind, unless it already has one.
+func wrapError(kind, err error) error {
+	if err == nil || ErrorKind(err) != nil {
+		return err
+	}
+	return &SyncError{Kind: kind, Err: err}
+}
+
+// ErrorKind returns the kind of the error, or nil if it has none.
+func ErrorKind(err error) error {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.kind) {
+			return k.kind
+		}
+	}
+	return nil
+}
+
+func errorKindName(err error) string {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.kind) {
+			return k.name
+		}
+	}
+	return ""
+}
+
+func errorKindByName(name string) error {
+	for _, k := range errorKinds {
+		if k.name == name {
+			return k.kind
+		}
+	}
+	return nil
+}
+
+// remoteError recreates an error reported by the other side with its kind.
+func remoteError(kind, msg string) error {
+	if k := errorKindByName(kind); k != nil {
+		return newError(k, msg)
+	}
+	return errors.New(msg)
+}
+
+// streamError gives an error reading from the other side its kind, a closed or
+// broken connection, or data that is not valid.
+func streamError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr) {
+		return wrapError(ErrConnection, err)
+	}
+	return wrapError(ErrProtocol, err)
+}
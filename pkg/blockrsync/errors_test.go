@@ -0,0 +1,210 @@
+package blockrsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/image"
+)
+
+type failingConnectionProvider struct{}
+
+func (f *failingConnectionProvider) Connect() (io.ReadWriteCloser, error) {
+	return nil, errors.New("no route to target")
+}
+
+var _ = Describe("error kind tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		targetPath string
+		opts       BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-errors")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096, 1)
+		targetPath = createTestFile(tmpDir, "target.raw", 20*4096, 2)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	DescribeTable("should keep the kind of errors reported by the other side", func(kind error) {
+		err := remoteError(errorKindName(fmt.Errorf("failed: %w", newError(kind, "reason"))), "failed: reason")
+		Expect(err).To(MatchError(kind))
+		Expect(err).To(MatchError("failed: reason"))
+		Expect(ErrorKind(err)).To(Equal(kind))
+	},
+		Entry("connection", ErrConnection),
+		Entry("protocol", ErrProtocol),
+		Entry("source I/O", ErrSourceIO),
+		Entry("target I/O", ErrTargetIO),
+		Entry("verification", ErrVerification),
+		Entry("cancelled", ErrCancelled),
+	)
+
+	It("should not give a kind to unknown errors", func() {
+		Expect(ErrorKind(errors.New("unknown"))).To(BeNil())
+		Expect(remoteError("", "unknown")).To(MatchError("unknown"))
+		Expect(ErrorKind(remoteError("", "unknown"))).To(BeNil())
+	})
+
+	It("should keep the first kind of an error", func() {
+		err := wrapError(ErrTargetIO, fmt.Errorf("checking: %w", ErrIdentityMismatch))
+		Expect(ErrorKind(err)).To(Equal(ErrVerification))
+		Expect(err).To(MatchError(ErrIdentityMismatch))
+	})
+
+	It("should fail hashing if a worker fails", func() {
+		imageFile := filepath.Join(tmpDir, "broken.qcow2")
+		img, err := image.Create(imageFile, image.FormatQcow2, 20*4096)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = img.WriteAt(bytes.Repeat([]byte{0xaa}, 4096), 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(img.Close()).To(Succeed())
+		// Point the first L2 table beyond the end of the image, so reading blocks fails
+		f, err := os.OpenFile(imageFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		l1Offset := make([]byte, 8)
+		_, err = f.ReadAt(l1Offset, 40)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt(binary.BigEndian.AppendUint64(nil, 1<<40), int64(binary.BigEndian.Uint64(l1Offset)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		hasher := NewImageHasher(4096, image.FormatQcow2, GinkgoLogr.WithName("hasher"))
+		_, err = hasher.HashFile(imageFile)
+		Expect(err).To(MatchError(ContainSubstring("unable to hash block")))
+	})
+
+	It("should fail a connection error", func() {
+		client := NewBlockrsyncClient(sourceFile, "", 0, &opts, GinkgoLogr.WithName("client"))
+		client.UseConnectionProvider(&failingConnectionProvider{})
+		Expect(client.ConnectToTarget()).To(MatchError(ErrConnection))
+	})
+
+	It("should fail a missing source as source I/O", func() {
+		err := NewLocalSync(filepath.Join(tmpDir, "missing.raw"), targetPath, &opts, GinkgoLogr.WithName("local")).Sync()
+		Expect(err).To(MatchError(ErrSourceIO))
+	})
+
+	It("should fail a target that cannot be opened as target I/O", func() {
+		err := NewLocalSync(sourceFile, filepath.Join(tmpDir, "missing", "target.raw"), &opts, GinkgoLogr.WithName("local")).Sync()
+		Expect(err).To(MatchError(ErrTargetIO))
+	})
+
+	It("should report the kind of a target failure to the source", func() {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		serverOpts := opts
+		serverOpts.AtomicReplace = true
+		serverOpts.VerifyCommand = "false"
+		server := NewBlockrsyncServer(targetPath, port, &serverOpts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		err = client.ConnectToTarget()
+		Expect(err).To(MatchError(ContainSubstring("verify command failed")))
+		Expect(ErrorKind(err)).To(Equal(ErrVerification))
+		Expect(<-done).To(MatchError(ErrVerification))
+	})
+
+	It("should report the kind of a rejected session to the source", func() {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetPath, port, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		clientOpts := opts
+		clientOpts.TargetIdentity = &TargetIdentity{Serial: "does-not-exist"}
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &clientOpts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(MatchError(ErrVerification))
+		Expect(<-done).To(MatchError(ErrIdentityMismatch))
+	})
+
+	Context("when writing blocks", func() {
+		var (
+			server *BlockrsyncServer
+			target targetFile
+		)
+
+		BeforeEach(func() {
+			var err error
+			server = NewBlockrsyncServer(targetPath, 0, &opts, GinkgoLogr.WithName("server"))
+			target, err = server.openTargetFile(false)
+			Expect(err).ToNot(HaveOccurred())
+			server.targetFileSize = 20 * 4096
+		})
+
+		AfterEach(func() {
+			Expect(server.closeTarget(target)).To(Succeed())
+		})
+
+		blockStream := func(sourceSize int64, offsets ...int64) *bytes.Buffer {
+			buf := &bytes.Buffer{}
+			Expect(binary.Write(buf, binary.LittleEndian, sourceSize)).To(Succeed())
+			for _, offset := range offsets {
+				Expect(binary.Write(buf, binary.LittleEndian, offset)).To(Succeed())
+				buf.WriteByte(Block)
+				buf.Write(bytes.Repeat([]byte{0xaa}, 4096))
+			}
+			return buf
+		}
+
+		It("should write the blocks up to the end", func() {
+			stream := blockStream(20*4096, 0, 4096)
+			Expect(writeEndOfBlocks(stream)).To(Succeed())
+			Expect(server.writeBlocksToFile(target, stream)).To(Succeed())
+		})
+
+		It("should fail a stream that ends before the end of the blocks", func() {
+			stream := blockStream(20*4096, 0, 4096)
+			err := server.writeBlocksToFile(target, stream)
+			Expect(err).To(MatchError(ErrConnection))
+			Expect(isSessionAborted(err)).To(BeTrue())
+		})
+
+		It("should fail a stream that ends in the middle of a block", func() {
+			stream := blockStream(20*4096, 0, 4096)
+			stream.Truncate(stream.Len() - 100)
+			err := server.writeBlocksToFile(target, stream)
+			Expect(err).To(MatchError(ErrConnection))
+			Expect(isSessionAborted(err)).To(BeTrue())
+		})
+
+		It("should read the remaining blocks after failing to write a block", func() {
+			server.opts.UndoLog = filepath.Join(tmpDir, "missing", "undo.log")
+			Expect(server.startUndoLog(target, "raw")).To(Succeed())
+			stream := blockStream(20*4096, 0, 4096, 8192)
+			Expect(writeEndOfBlocks(stream)).To(Succeed())
+			err := server.writeBlocksToFile(target, stream)
+			Expect(err).To(MatchError(ErrTargetIO))
+			Expect(isSessionAborted(err)).To(BeFalse())
+			Expect(stream.Len()).To(BeZero())
+		})
+
+		It("should fail a block beyond the size of the source", func() {
+			stream := blockStream(4096, 8192)
+			Expect(server.writeBlocksToFile(target, stream)).To(MatchError(ErrProtocol))
+		})
+	})
+})
@@ -0,0 +1,241 @@
+package blockrsync
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	ExtentsFormatJSON      = "json"
+	ExtentsFormatCSV       = "csv"
+	ExtentsFormatThinDelta = "thin-delta"
+	ExtentsFormatRBDDiff   = "rbd-diff"
+
+	sectorSize = 512
+)
+
+// ParseChangedExtents reads a list of changed extents in the given format. If the
+// format is empty, it is detected from the content.
+func ParseChangedExtents(r io.Reader, format string) ([]Extent, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = detectExtentsFormat(b)
+	}
+	var extents []Extent
+	switch format {
+	case ExtentsFormatJSON:
+		extents, err = parseExtentsJSON(b)
+	case ExtentsFormatCSV:
+		extents, err = parseExtentsCSV(b)
+	case ExtentsFormatThinDelta:
+		extents, err = parseThinDelta(b)
+	case ExtentsFormatRBDDiff:
+		extents, err = parseRBDDiff(b)
+	default:
+		return nil, fmt.Errorf("unknown changed extents format %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s changed extents: %w", format, err)
+	}
+	for _, extent := range extents {
+		if extent.Offset < 0 || extent.Length < 0 {
+			return nil, fmt.Errorf("invalid extent, offset %d length %d", extent.Offset, extent.Length)
+		}
+	}
+	return extents, nil
+}
+
+func detectExtentsFormat(b []byte) string {
+	trimmed := bytes.TrimSpace(b)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return ExtentsFormatThinDelta
+	case bytes.HasPrefix(trimmed, []byte("[")), bytes.HasPrefix(trimmed, []byte("{")):
+		// rbd diff output is a json list of extents as well
+		return ExtentsFormatJSON
+	default:
+		return ExtentsFormatCSV
+	}
+}
+
+// parseExtentsJSON parses a list of extents, or the report of a dry run.
+func parseExtentsJSON(b []byte) ([]Extent, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		report := &DiffReport{}
+		if err := json.Unmarshal(b, report); err != nil {
+			return nil, err
+		}
+		return report.ChangedExtents, nil
+	}
+	var extents []Extent
+	if err := json.Unmarshal(b, &extents); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// parseExtentsCSV parses offset,length lines, a header line and lines starting
+// with # are skipped.
+func parseExtentsCSV(b []byte) ([]Extent, error) {
+	reader := csv.NewReader(bytes.NewReader(b))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	var extents []Extent
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return extents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			if line == 0 {
+				// header
+				continue
+			}
+			return nil, fmt.Errorf("invalid offset %s", record[0])
+		}
+		length, err := strconv.ParseInt(record[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid length %s", record[1])
+		}
+		extents = append(extents, Extent{Offset: offset, Length: length})
+	}
+}
+
+// parseThinDelta parses the output of thin_delta. Ranges are in data blocks, the
+// size of a data block is in sectors. Blocks that only exist in one of the
+// snapshots are changed as well.
+func parseThinDelta(b []byte) ([]Extent, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	dataBlockSize := int64(0)
+	var extents []Extent
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch element.Name.Local {
+		case "superblock":
+			value, err := xmlIntAttr(element, "data_block_size")
+			if err != nil {
+				return nil, err
+			}
+			dataBlockSize = value * sectorSize
+		case "different", "left_only", "right_only":
+			if dataBlockSize <= 0 {
+				return nil, errors.New("missing data block size in superblock")
+			}
+			begin, err := xmlIntAttr(element, "begin")
+			if err != nil {
+				return nil, err
+			}
+			length, err := xmlIntAttr(element, "length")
+			if err != nil {
+				return nil, err
+			}
+			extents = append(extents, Extent{Offset: begin * dataBlockSize, Length: length * dataBlockSize})
+		}
+	}
+	return extents, nil
+}
+
+func xmlIntAttr(element xml.StartElement, name string) (int64, error) {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			value, err := strconv.ParseInt(attr.Value, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s %s in %s", name, attr.Value, element.Name.Local)
+			}
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("missing %s in %s", name, element.Name.Local)
+}
+
+// parseRBDDiff parses the output of rbd diff --format json. Extents that no
+// longer exist were discarded, and are changed as well.
+func parseRBDDiff(b []byte) ([]Extent, error) {
+	var entries []struct {
+		Offset *int64       `json:"offset"`
+		Length *int64       `json:"length"`
+		Exists *interface{} `json:"exists"`
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	extents := make([]Extent, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Offset == nil || entry.Length == nil || entry.Exists == nil {
+			return nil, errors.New("entries must have an offset, length and exists field")
+		}
+		extents = append(extents, Extent{Offset: *entry.Offset, Length: *entry.Length})
+	}
+	return extents, nil
+}
+
+// extentsToOffsets returns the sorted offsets of the blocks that overlap the
+// extents, limited to the size of the source.
+func extentsToOffsets(extents []Extent, blockSize, sourceSize int64) []int64 {
+	set := make(map[int64]struct{})
+	for _, extent := range extents {
+		end := min(extent.Offset+extent.Length, sourceSize)
+		for offset := extent.Offset / blockSize * blockSize; offset < end; offset += blockSize {
+			set[offset] = struct{}{}
+		}
+	}
+	offsets := make([]int64, 0, len(set))
+	for offset := range set {
+		offsets = append(offsets, offset)
+	}
+	slices.Sort(offsets)
+	return offsets
+}
+
+// changedBlocks returns the blocks in the changed extents. When verifying, only
+// the blocks whose hash differs from the target hash are returned.
+func (b *BlockrsyncClient) changedBlocks(blockSize int64, targetHashes map[int64][]byte, f io.ReaderAt) ([]int64, error) {
+	if blockSize != b.hasher.BlockSize() {
+		return nil, errors.New("block size mismatch")
+	}
+	offsets := extentsToOffsets(b.changedExtents, blockSize, b.sourceSize)
+	if !b.verifyExtents {
+		return offsets, nil
+	}
+	var diff []int64
+	buf := make([]byte, blockSize)
+	for _, offset := range offsets {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return nil, wrapError(ErrSourceIO, err)
+		}
+		hash := blake2b.Sum512(buf[:n])
+		if targetHash, ok := targetHashes[offset]; !ok || !bytes.Equal(targetHash, hash[:]) {
+			diff = append(diff, offset)
+		}
+	}
+	b.log.Info("Verified changed extents", "listed blocks", len(offsets), "changed blocks", len(diff))
+	return diff, nil
+}
@@ -0,0 +1,159 @@
+package blockrsync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("changed extents tests", func() {
+	expectedExtents := []Extent{
+		{Offset: 8192, Length: 8192},
+		{Offset: 57344, Length: 16384},
+		{Offset: 98304, Length: 4096},
+	}
+
+	parseFixture := func(name, format string) ([]Extent, error) {
+		f, err := os.Open(filepath.Join("testdata", "extents", name))
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		return ParseChangedExtents(f, format)
+	}
+
+	DescribeTable("should parse changed extents", func(name, format string) {
+		extents, err := parseFixture(name, format)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(extents).To(Equal(expectedExtents))
+		// The format is detected as well
+		extents, err = parseFixture(name, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(extents).To(Equal(expectedExtents))
+	},
+		Entry("json", "extents.json", ExtentsFormatJSON),
+		Entry("csv", "extents.csv", ExtentsFormatCSV),
+		Entry("rbd diff", "rbd_diff.json", ExtentsFormatRBDDiff),
+	)
+
+	It("should parse thin_delta output in data blocks", func() {
+		extents, err := parseFixture("thin_delta.xml", ExtentsFormatThinDelta)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(extents).To(Equal([]Extent{
+			{Offset: 8192, Length: 8192},
+			{Offset: 57344, Length: 16384},
+			{Offset: 98304, Length: 8192},
+		}))
+	})
+
+	It("should parse the report of a dry run", func() {
+		extents, err := ParseChangedExtents(strings.NewReader(`{"changedBlocks": 1, "changedExtents": [{"offset": 4096, "length": 4096}]}`), "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(extents).To(Equal([]Extent{{Offset: 4096, Length: 4096}}))
+	})
+
+	DescribeTable("should reject invalid changed extents", func(content, format string) {
+		_, err := ParseChangedExtents(strings.NewReader(content), format)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("unknown format", "0,4096", "lvm"),
+		Entry("negative offset", "-4096,4096", ExtentsFormatCSV),
+		Entry("invalid length", "0,4096\n4096,abc", ExtentsFormatCSV),
+		Entry("missing data block size", `<superblock><diff><different begin="1" length="1"/></diff></superblock>`, ExtentsFormatThinDelta),
+		Entry("rbd diff without exists", `[{"offset": 0, "length": 4096}]`, ExtentsFormatRBDDiff),
+	)
+
+	It("should convert extents to block offsets", func() {
+		offsets := extentsToOffsets([]Extent{
+			{Offset: 5000, Length: 4000},
+			{Offset: 0, Length: 100},
+			{Offset: 8192, Length: 1},
+			{Offset: 16384, Length: 16384},
+		}, 4096, 20000)
+		Expect(offsets).To(Equal([]int64{0, 4096, 8192, 16384}))
+	})
+
+	Context("syncing", func() {
+		var (
+			tmpDir     string
+			sourceFile string
+			targetFile string
+			opts       BlockRsyncOptions
+		)
+
+		writeSource := func(offset int64) {
+			f, err := os.OpenFile(sourceFile, os.O_RDWR, 0)
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			_, err = f.WriteAt([]byte("changed"), offset)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = os.MkdirTemp("", "blockrsync-extents")
+			Expect(err).ToNot(HaveOccurred())
+			sourceFile = createTestFile(tmpDir, "source.raw", 30*4096, 1)
+			targetFile = createTestFile(tmpDir, "target.raw", 30*4096, 1)
+			// Changes within the extents
+			writeSource(8192)
+			writeSource(61440)
+			writeSource(98304)
+			opts = BlockRsyncOptions{
+				BlockSize: 4096,
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		sync := func(extents []Extent, verify bool) *BlockrsyncClient {
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+			done := make(chan error, 1)
+			go func() {
+				done <- server.StartServer()
+			}()
+			client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			client.UseChangedExtents(extents, verify)
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-done).To(Succeed())
+			return client
+		}
+
+		It("should only send the blocks in the extents", func() {
+			// Change outside of the extents is not picked up
+			writeSource(40960)
+			sync(expectedExtents, false)
+			source, err := os.ReadFile(sourceFile)
+			Expect(err).ToNot(HaveOccurred())
+			target, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(source[:40960], target[:40960])).To(BeTrue())
+			Expect(bytes.Equal(source[40960:45056], target[40960:45056])).To(BeFalse())
+			Expect(bytes.Equal(source[45056:], target[45056:])).To(BeTrue())
+		})
+
+		DescribeTable("should report the blocks in the extents in a dry run", func(verify bool, expectedBlocks int) {
+			opts.DryRun = true
+			client := sync(expectedExtents, verify)
+			Expect(client.Results()).To(HaveLen(1))
+			Expect(client.Results()[0].Report.ChangedBlocks).To(Equal(int64(expectedBlocks)))
+		},
+			Entry("without verifying", false, 7),
+			Entry("only the changed blocks when verifying", true, 3),
+		)
+
+		It("should sync a grown source when verifying", func() {
+			Expect(os.Truncate(targetFile, 20*4096)).To(Succeed())
+			// The grown part is changed as well
+			client := sync(append(expectedExtents, Extent{Offset: 20 * 4096, Length: 10 * 4096}), true)
+			Expect(client.Results()[0].Err).ToNot(HaveOccurred())
+			expectSameContent(sourceFile, targetFile)
+		})
+	})
+})
@@ -0,0 +1,285 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/image"
+)
+
+// Maximum number of bytes of source blocks cached for targets that have not
+// read them yet.
+const fanOutCacheSize = 256 * 1024 * 1024
+
+// FanOutTarget is one of the targets of a fan out, Module is only needed if the
+// target is a daemon.
+type FanOutTarget struct {
+	Address string
+	Port    int
+	Module  string
+}
+
+func (t FanOutTarget) String() string {
+	if t.Module != "" {
+		return fmt.Sprintf("%s=%s", t.Address, t.Module)
+	}
+	return t.Address
+}
+
+type FanOutResult struct {
+	FanOutTarget
+	Err error
+	// Report of the differences, only set in dry run mode
+	Report *DiffReport
+}
+
+// FanOutClient syncs a single source to multiple targets concurrently. The source
+// is hashed once, and blocks needed by several targets are read once.
+type FanOutClient struct {
+	sourceFile string
+	targets    []FanOutTarget
+	results    []FanOutResult
+	opts       *BlockRsyncOptions
+	log        logr.Logger
+}
+
+func NewFanOutClient(sourceFile string, targets []FanOutTarget, opts *BlockRsyncOptions, logger logr.Logger) *FanOutClient {
+	return &FanOutClient{
+		sourceFile: sourceFile,
+		targets:    targets,
+		opts:       opts,
+		log:        logger,
+	}
+}
+
+// Results returns the result of each target of the last sync.
+func (f *FanOutClient) Results() []FanOutResult {
+	return f.results
+}
+
+// Sync syncs the source to all targets, a failing target does not stop the sync
+// to the other targets.
+func (f *FanOutClient) Sync() error {
+	f.results = nil
+	file, err := image.Open(f.sourceFile, f.opts.SourceFormat)
+	if err != nil {
+		return wrapError(ErrSourceIO, err)
+	}
+	defer file.Close()
+	hasher := NewImageHasher(int64(f.opts.BlockSize), f.opts.SourceFormat, f.log.WithName("hasher"))
+	size, err := hasher.HashFile(f.sourceFile)
+	if err != nil {
+		return wrapError(ErrSourceIO, err)
+	}
+	f.log.Info("Hashed source", "file", f.sourceFile, "size", size, "targets", len(f.targets))
+
+	cache := newBlockCache(file, fanOutCacheSize/max(f.opts.BlockSize, 1))
+	results := make([]FanOutResult, len(f.targets))
+	wg := sync.WaitGroup{}
+	for i, target := range f.targets {
+		wg.Add(1)
+		go func(i int, target FanOutTarget) {
+			defer wg.Done()
+			opts := *f.opts
+			opts.Module = target.Module
+			client := NewBlockrsyncClient(f.sourceFile, target.Address, target.Port, &opts, f.log.WithValues("target", target.String()))
+			client.hasher = hasher
+			client.sourceSize = size
+			client.sharedSource = cache.newReader()
+			err := client.ConnectToTarget()
+			client.sharedSource.close()
+			results[i] = FanOutResult{FanOutTarget: target, Err: err, Report: client.report}
+		}(i, target)
+	}
+	wg.Wait()
+	f.results = results
+	reads, hits := cache.stats()
+	f.log.Info("Finished fan out", "source reads", reads, "shared reads", hits)
+
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.String(), result.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// blockCache shares the blocks read from the source between targets. A block
+// is kept while other targets still need it, up to a maximum number of blocks
+// so a slow target cannot make the cache grow without limit. Unallocated blocks
+// are kept as holes, without reading them.
+type blockCache struct {
+	source    io.ReaderAt
+	maxBlocks int
+	mu        sync.Mutex
+	refs      map[int64]int
+	blocks    map[int64][]byte
+	holes     map[int64]bool
+	reads     int64
+	hits      int64
+}
+
+func newBlockCache(source io.ReaderAt, maxBlocks int) *blockCache {
+	return &blockCache{
+		source:    source,
+		maxBlocks: maxBlocks,
+		refs:      make(map[int64]int),
+		blocks:    make(map[int64][]byte),
+		holes:     make(map[int64]bool),
+	}
+}
+
+func (c *blockCache) newReader() *cachedBlockReader {
+	return &cachedBlockReader{
+		cache:   c,
+		pending: make(map[int64]bool),
+	}
+}
+
+func (c *blockCache) stats() (int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads, c.hits
+}
+
+func (c *blockCache) expect(offsets []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, offset := range offsets {
+		c.refs[offset]++
+	}
+}
+
+// release drops a reference, and evicts the block once no target needs it.
+// Must be called with the lock held.
+func (c *blockCache) release(offset int64) {
+	c.refs[offset]--
+	if c.refs[offset] <= 0 {
+		delete(c.refs, offset)
+		delete(c.blocks, offset)
+		delete(c.holes, offset)
+	}
+}
+
+// allocated returns false if the block is not allocated in the source, the
+// block is released as it will not be read.
+func (c *blockCache) allocated(offset, length int64) (bool, error) {
+	c.mu.Lock()
+	if c.holes[offset] {
+		c.hits++
+		c.release(offset)
+		c.mu.Unlock()
+		return false, nil
+	}
+	c.mu.Unlock()
+	a, ok := c.source.(allocationReader)
+	if !ok {
+		return true, nil
+	}
+	allocated, err := a.Allocated(offset, length)
+	if err != nil || allocated {
+		return true, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.release(offset)
+	if c.refs[offset] > 0 {
+		c.holes[offset] = true
+	}
+	return false, nil
+}
+
+func (c *blockCache) readAt(p []byte, offset int64) (int, error) {
+	c.mu.Lock()
+	if block, ok := c.blocks[offset]; ok {
+		c.hits++
+		c.release(offset)
+		c.mu.Unlock()
+		n := copy(p, block)
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	c.reads++
+	c.release(offset)
+	c.mu.Unlock()
+
+	n, err := c.source.ReadAt(p, offset)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	c.mu.Lock()
+	if c.refs[offset] > 0 && len(c.blocks) < c.maxBlocks {
+		c.blocks[offset] = append([]byte(nil), p[:n]...)
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// cachedBlockReader is the view of a single target on the block cache.
+type cachedBlockReader struct {
+	cache   *blockCache
+	mu      sync.Mutex
+	pending map[int64]bool
+}
+
+// expect registers the blocks the target will read.
+func (r *cachedBlockReader) expect(offsets []int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var added []int64
+	for _, offset := range offsets {
+		if !r.pending[offset] {
+			r.pending[offset] = true
+			added = append(added, offset)
+		}
+	}
+	r.cache.expect(added)
+}
+
+func (r *cachedBlockReader) ReadAt(p []byte, offset int64) (int, error) {
+	r.mu.Lock()
+	pending := r.pending[offset]
+	delete(r.pending, offset)
+	r.mu.Unlock()
+	if !pending {
+		return r.cache.source.ReadAt(p, offset)
+	}
+	return r.cache.readAt(p, offset)
+}
+
+// Allocated passes the allocation of the source through the cache, so the holes
+// of an image stay holes on every target.
+func (r *cachedBlockReader) Allocated(offset, length int64) (bool, error) {
+	r.mu.Lock()
+	pending := r.pending[offset]
+	r.mu.Unlock()
+	if !pending {
+		return isAllocated(r.cache.source, offset, length), nil
+	}
+	allocated, err := r.cache.allocated(offset, length)
+	if !allocated {
+		r.mu.Lock()
+		delete(r.pending, offset)
+		r.mu.Unlock()
+	}
+	return allocated, err
+}
+
+// close releases the blocks the target did not read, for instance because it failed.
+func (r *cachedBlockReader) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+	for offset := range r.pending {
+		r.cache.release(offset)
+	}
+	r.pending = make(map[int64]bool)
+}
@@ -0,0 +1,193 @@
+package blockrsync
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("fan out tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		opts       BlockRsyncOptions
+		listener   net.Listener
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-fanout")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	startDaemon := func(modules ...Module) FanOutTarget {
+		daemon := NewBlockrsyncDaemon(&DaemonConfig{Modules: modules}, 0, &BlockRsyncOptions{}, GinkgoLogr.WithName("daemon"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(daemon.Serve(listener)).To(Succeed())
+		}()
+		return FanOutTarget{Address: "localhost", Port: listener.Addr().(*net.TCPAddr).Port}
+	}
+
+	It("should sync the source to multiple targets", func() {
+		target := startDaemon(
+			Module{Name: "empty", Path: filepath.Join(tmpDir, "empty.raw")},
+			Module{Name: "different", Path: createTestFile(tmpDir, "different.raw", 10*4096, 2)},
+			Module{Name: "same", Path: createTestFile(tmpDir, "same.raw", 20*4096+512, 1)},
+		)
+		var targets []FanOutTarget
+		for _, module := range []string{"empty", "different", "same"} {
+			target.Module = module
+			targets = append(targets, target)
+		}
+		client := NewFanOutClient(sourceFile, targets, &opts, GinkgoLogr.WithName("fan-out"))
+		Expect(client.Sync()).To(Succeed())
+		Expect(client.Results()).To(HaveLen(3))
+		for _, result := range client.Results() {
+			Expect(result.Err).ToNot(HaveOccurred())
+			expectSameContent(sourceFile, filepath.Join(tmpDir, result.Module+".raw"))
+		}
+	})
+
+	It("should continue with the other targets when one fails", func() {
+		target := startDaemon(
+			Module{Name: "first", Path: filepath.Join(tmpDir, "first.raw")},
+			Module{Name: "second", Path: filepath.Join(tmpDir, "second.raw")},
+		)
+		var targets []FanOutTarget
+		for _, module := range []string{"first", "missing", "second"} {
+			target.Module = module
+			targets = append(targets, target)
+		}
+		client := NewFanOutClient(sourceFile, targets, &opts, GinkgoLogr.WithName("fan-out"))
+		err := client.Sync()
+		Expect(err).To(MatchError(ContainSubstring("unknown module missing")))
+		results := client.Results()
+		Expect(results).To(HaveLen(3))
+		Expect(results[0].Err).ToNot(HaveOccurred())
+		Expect(results[1].Err).To(HaveOccurred())
+		Expect(results[2].Err).ToNot(HaveOccurred())
+		expectSameContent(sourceFile, filepath.Join(tmpDir, "first.raw"))
+		expectSameContent(sourceFile, filepath.Join(tmpDir, "second.raw"))
+	})
+
+	It("should report the differences of each target in dry run mode", func() {
+		target := startDaemon(
+			Module{Name: "empty", Path: createTestFile(tmpDir, "empty.raw", 0, 0)},
+			Module{Name: "same", Path: createTestFile(tmpDir, "same.raw", 20*4096+512, 1)},
+		)
+		opts.DryRun = true
+		client := NewFanOutClient(sourceFile, []FanOutTarget{
+			{Address: target.Address, Port: target.Port, Module: "empty"},
+			{Address: target.Address, Port: target.Port, Module: "same"},
+		}, &opts, GinkgoLogr.WithName("fan-out"))
+		Expect(client.Sync()).To(Succeed())
+		Expect(client.Results()[0].Report.ChangedBlocks).To(Equal(int64(21)))
+		Expect(client.Results()[1].Report.ChangedBlocks).To(BeZero())
+		fi, err := os.Stat(filepath.Join(tmpDir, "empty.raw"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fi.Size()).To(BeZero())
+	})
+
+	Context("block cache", func() {
+		var source *bytes.Reader
+
+		BeforeEach(func() {
+			data := make([]byte, 4*4096+10)
+			for i := range data {
+				data[i] = byte(i / 4096)
+			}
+			source = bytes.NewReader(data)
+		})
+
+		readBlock := func(r io.ReaderAt, offset int64) []byte {
+			buf := make([]byte, 4096)
+			n, err := r.ReadAt(buf, offset)
+			if err != io.EOF {
+				Expect(err).ToNot(HaveOccurred())
+			}
+			return buf[:n]
+		}
+
+		It("should read blocks needed by several targets once", func() {
+			cache := newBlockCache(source, 10)
+			first, second := cache.newReader(), cache.newReader()
+			first.expect([]int64{0, 4096, 4 * 4096})
+			second.expect([]int64{0, 4 * 4096})
+			Expect(readBlock(first, 0)).To(Equal(bytes.Repeat([]byte{0}, 4096)))
+			Expect(readBlock(first, 4*4096)).To(HaveLen(10))
+			Expect(readBlock(first, 4096)).To(Equal(bytes.Repeat([]byte{1}, 4096)))
+			Expect(cache.blocks).To(HaveLen(2))
+			Expect(readBlock(second, 0)).To(Equal(bytes.Repeat([]byte{0}, 4096)))
+			Expect(readBlock(second, 4*4096)).To(Equal(bytes.Repeat([]byte{4}, 10)))
+			reads, hits := cache.stats()
+			Expect(reads).To(Equal(int64(3)))
+			Expect(hits).To(Equal(int64(2)))
+			Expect(cache.blocks).To(BeEmpty())
+			Expect(cache.refs).To(BeEmpty())
+		})
+
+		It("should not cache more than the maximum number of blocks", func() {
+			cache := newBlockCache(source, 1)
+			first, second := cache.newReader(), cache.newReader()
+			first.expect([]int64{0, 4096})
+			second.expect([]int64{0, 4096})
+			readBlock(first, 0)
+			readBlock(first, 4096)
+			Expect(cache.blocks).To(HaveLen(1))
+			Expect(readBlock(second, 4096)).To(Equal(bytes.Repeat([]byte{1}, 4096)))
+			Expect(readBlock(second, 0)).To(Equal(bytes.Repeat([]byte{0}, 4096)))
+			reads, hits := cache.stats()
+			Expect(reads).To(Equal(int64(3)))
+			Expect(hits).To(Equal(int64(1)))
+		})
+
+		It("should pass the holes of the source to every target without reading them", func() {
+			source := &unallocatedSource{unallocated: 4096}
+			cache := newBlockCache(source, 10)
+			first, second := cache.newReader(), cache.newReader()
+			first.expect([]int64{0, 4096})
+			second.expect([]int64{0, 4096})
+			Expect(isAllocated(first, 4096, 4096)).To(BeFalse())
+			Expect(isAllocated(first, 0, 4096)).To(BeTrue())
+			readBlock(first, 0)
+			Expect(isAllocated(second, 4096, 4096)).To(BeFalse())
+			Expect(readBlock(second, 0)).To(Equal(bytes.Repeat([]byte{2}, 4096)))
+			Expect(source.reads).To(Equal([]int64{0}))
+			reads, hits := cache.stats()
+			Expect(reads).To(Equal(int64(1)))
+			Expect(hits).To(Equal(int64(2)))
+			Expect(cache.holes).To(BeEmpty())
+			Expect(cache.refs).To(BeEmpty())
+		})
+
+		It("should release the blocks of a target that is closed", func() {
+			cache := newBlockCache(source, 10)
+			first, second := cache.newReader(), cache.newReader()
+			first.expect([]int64{0, 4096})
+			second.expect([]int64{0, 4096})
+			readBlock(first, 0)
+			readBlock(first, 4096)
+			Expect(cache.blocks).To(HaveLen(2))
+			second.close()
+			Expect(cache.blocks).To(BeEmpty())
+			Expect(cache.refs).To(BeEmpty())
+		})
+	})
+})
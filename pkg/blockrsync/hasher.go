@@ -16,6 +16,8 @@ import (
 
 	"github.com/go-logr/logr"
 	"golang.org/x/crypto/blake2b"
+
+	"github.com/awels/blockrsync/pkg/image"
 )
 
 const (
@@ -43,11 +45,20 @@ type FileHasher struct {
 	res       chan OffsetHash
 	blockSize int64
 	fileSize  int64
-	log       logr.Logger
+	// format of the image, the virtual disk is hashed
+	format string
+	log    logr.Logger
 }
 
 func NewFileHasher(blockSize int64, log logr.Logger) Hasher {
+	return NewImageHasher(blockSize, image.FormatRaw, log)
+}
+
+// NewImageHasher creates a hasher that hashes the virtual disk of an image in the
+// format, for instance qcow2.
+func NewImageHasher(blockSize int64, format string, log logr.Logger) Hasher {
 	return &FileHasher{
+		format:    format,
 		blockSize: blockSize,
 		queue:     make(chan int64, defaultConcurrency),
 		res:       make(chan OffsetHash, defaultConcurrency),
@@ -71,52 +82,96 @@ func (f *FileHasher) HashFile(fileName string) (int64, error) {
 	go f.calculateOffsets(f.fileSize)
 
 	count := f.concurrentHashCount(f.fileSize)
+	// Every worker reports at most one error
+	errs := make(chan error, count)
 	wg := sync.WaitGroup{}
-	go func() {
-		wg.Wait()
-		done <- struct{}{}
-	}()
-
 	for i := 0; i < count; i++ {
-		wg.Add(1)
 		h, err := blake2b.New512(nil)
 		if err != nil {
 			return 0, err
 		}
+		wg.Add(1)
 		go func(h hash.Hash) {
 			defer wg.Done()
-			osFile, err := os.Open(fileName)
+			osFile, err := f.open(fileName)
 			if err != nil {
 				f.log.Info("Failed to open file", "error", err)
-				return
+			} else {
+				defer osFile.Close()
 			}
 			for offset := range f.queue {
+				if err != nil {
+					// Keep taking offsets, so the queue is not blocked
+					continue
+				}
 				h.Reset()
-				defer osFile.Close()
-				if err := f.calculateHash(offset, osFile, h); err != nil {
+				if err = f.calculateHash(offset, osFile, h); err != nil {
 					f.log.Info("Failed to calculate hash", "offset", offset, "error", err)
-					return
+					err = fmt.Errorf("unable to hash block at offset %d: %w", offset, err)
 				}
 			}
+			if err != nil {
+				errs <- err
+			}
 		}(h)
 	}
+	go func() {
+		wg.Wait()
+		done <- struct{}{}
+	}()
 	for {
 		select {
 		case offsetHash := <-f.res:
 			f.hashes[offsetHash.Offset] = offsetHash.Hash
 		case <-done:
-			return f.fileSize, nil
+			// All workers are finished, collect the results still in the channel
+			for {
+				select {
+				case offsetHash := <-f.res:
+					f.hashes[offsetHash.Offset] = offsetHash.Hash
+				default:
+					return f.hashResult(errs)
+				}
+			}
 		}
 	}
 }
 
+// hashResult returns the size of the file, or the first error of the workers,
+// the hashes are incomplete if any worker failed.
+func (f *FileHasher) hashResult(errs <-chan error) (int64, error) {
+	select {
+	case err := <-errs:
+		return 0, err
+	default:
+		return f.fileSize, nil
+	}
+}
+
+// open opens the file, images that are not raw are opened as their virtual disk.
+func (f *FileHasher) open(fileName string) (io.ReadSeekCloser, error) {
+	if f.format == "" || f.format == image.FormatRaw {
+		return os.Open(fileName)
+	}
+	img, err := image.Open(fileName, f.format)
+	if err != nil {
+		return nil, err
+	}
+	return newImageReadSeeker(img), nil
+}
+
 func (f *FileHasher) getFileSize(fileName string) (int64, error) {
-	file, err := os.Open(fileName)
+	file, err := f.open(fileName)
 	if err != nil {
 		return int64(0), err
 	}
 	defer file.Close()
-	size, err := file.Seek(0, io.SeekEnd)
+	var size int64
+	if osFile, ok := file.(*os.File); ok {
+		size, err = fileSize(osFile)
+	} else {
+		size, err = file.Seek(0, io.SeekEnd)
+	}
 	if err != nil {
 		return int64(0), err
 	}
@@ -142,18 +197,21 @@ func (f *FileHasher) calculateOffsets(size int64) {
 }
 
 func (f *FileHasher) calculateHash(offset int64, rs io.ReadSeeker, h hash.Hash) error {
-	_, err := rs.Seek(int64(offset), 0)
-	if err != nil {
-		f.log.V(5).Info("Failed to seek")
-		return err
-	}
 	buf := make([]byte, f.blockSize)
-	n, err := rs.Read(buf)
-	if err != nil {
-		f.log.V(5).Info("Failed to read")
-		return err
+	n := int(min(f.blockSize, f.fileSize-offset))
+	if isAllocated(rs, offset, f.blockSize) {
+		_, err := rs.Seek(int64(offset), 0)
+		if err != nil {
+			f.log.V(5).Info("Failed to seek")
+			return err
+		}
+		n, err = rs.Read(buf)
+		if err != nil {
+			f.log.V(5).Info("Failed to read")
+			return err
+		}
 	}
-	n, err = h.Write(buf[:n])
+	n, err := h.Write(buf[:n])
 	if err != nil {
 		f.log.V(5).Info("Failed to write to hash")
 		return err
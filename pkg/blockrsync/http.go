@@ -0,0 +1,254 @@
+package blockrsync
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// The sync protocol is bidirectional, so http connections are upgraded to a raw
+// stream, similar to websockets. This passes through L7 proxies and ingress
+// controllers that support upgrades.
+const httpUpgradeProtocol = "blockrsync/1"
+
+func isHTTPAddress(address string) bool {
+	return strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://")
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeHTTP switches the request to the blockrsync protocol, and returns the
+// underlying connection.
+func upgradeHTTP(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), httpUpgradeProtocol) {
+		w.Header().Set("Upgrade", httpUpgradeProtocol)
+		http.Error(w, "expected upgrade to "+httpUpgradeProtocol, http.StatusUpgradeRequired)
+		return nil, errors.New("request is not an upgrade to " + httpUpgradeProtocol)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Clear the deadlines set while reading the request, syncs can take a long time
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: " + httpUpgradeProtocol + "\r\nConnection: Upgrade\r\n\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &bufferedConn{Conn: conn, reader: rw.Reader}, nil
+}
+
+// bufferedConn reads through the buffer of the hijacked connection, which may
+// already contain data sent by the client.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func httpPeerAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+// serveHTTP serves the handler on the path of the http or https url.
+func serveHTTP(u *url.URL, handler http.Handler, opts *BlockRsyncOptions, log logr.Logger) (*http.Server, <-chan error, error) {
+	if u.Scheme == "https" && (opts.TLSCertFile == "" || opts.TLSKeyFile == "") {
+		return nil, nil, errors.New("a tls certificate and key are required for https")
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	listener, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Info("Listening for http connection", "address", listener.Addr().String(), "scheme", u.Scheme, "path", path)
+	errChan := make(chan error, 1)
+	go func() {
+		if u.Scheme == "https" {
+			errChan <- server.ServeTLS(listener, opts.TLSCertFile, opts.TLSKeyFile)
+		} else {
+			errChan <- server.Serve(listener)
+		}
+	}()
+	return server, errChan, nil
+}
+
+// HTTPConnectionAcceptor accepts a single upgraded http connection.
+type HTTPConnectionAcceptor struct {
+	address string
+	opts    *BlockRsyncOptions
+	log     logr.Logger
+}
+
+func (h *HTTPConnectionAcceptor) Accept() (io.ReadWriteCloser, error) {
+	u, err := url.Parse(h.address)
+	if err != nil {
+		return nil, err
+	}
+	conns := make(chan net.Conn, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeHTTP(w, r)
+		if err != nil {
+			h.log.Info("Rejected http request", "peer", r.RemoteAddr, "error", err.Error())
+			return
+		}
+		select {
+		case conns <- conn:
+		default:
+			// Only a single client is served
+			conn.Close()
+		}
+	})
+	server, errChan, err := serveHTTP(u, handler, h.opts, h.log)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the server does not close hijacked connections
+	defer server.Close()
+	select {
+	case conn := <-conns:
+		return conn, nil
+	case err := <-errChan:
+		return nil, err
+	case <-h.opts.Cancel:
+		return nil, h.opts.cancelled()
+	}
+}
+
+// ServeHTTP upgrades the request and runs a daemon session over it.
+func (d *BlockrsyncDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeHTTP(w, r)
+	if err != nil {
+		d.log.Info("Rejected http request", "peer", r.RemoteAddr, "error", err.Error())
+		return
+	}
+	d.sessions.Add(1)
+	defer d.sessions.Done()
+	defer conn.Close()
+	defer d.opts.closeOnCancel(conn)()
+	if err := d.handleConnection(conn, httpPeerAddr(r)); err != nil {
+		d.log.Error(err, "Session failed", "peer", r.RemoteAddr)
+	}
+}
+
+// HTTPConnectionProvider connects to an http or https url, and upgrades the
+// connection to the blockrsync protocol. Proxies are taken from the environment.
+type HTTPConnectionProvider struct {
+	url        string
+	caCertFile string
+	log        logr.Logger
+}
+
+func NewHTTPConnectionProvider(url, caCertFile string, logger logr.Logger) *HTTPConnectionProvider {
+	return &HTTPConnectionProvider{
+		url:        url,
+		caCertFile: caCertFile,
+		log:        logger,
+	}
+}
+
+func (h *HTTPConnectionProvider) Connect() (io.ReadWriteCloser, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Upgrades are only possible with HTTP/1.1
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if h.caCertFile != "" {
+		b, err := os.ReadFile(h.caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", h.caCertFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	client := &http.Client{Transport: transport}
+
+	retryCount := 0
+	for {
+		conn, err := h.upgrade(client)
+		if err == nil {
+			return conn, nil
+		}
+		// Only retry if the target is not listening yet
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) || opErr.Op != "dial" || retryCount > 30 {
+			return nil, err
+		}
+		h.log.Info("Unable to connect to target, retrying", "url", h.url, "error", err.Error())
+		time.Sleep(time.Second)
+		retryCount++
+	}
+}
+
+func (h *HTTPConnectionProvider) upgrade(client *http.Client) (io.ReadWriteCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", httpUpgradeProtocol)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("target did not upgrade the connection: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, errors.New("upgraded connection is not writable")
+	}
+	return conn, nil
+}
@@ -0,0 +1,101 @@
+package blockrsync
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("http transport tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		targetFile string
+		opts       BlockRsyncOptions
+		daemon     *BlockrsyncDaemon
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-http")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		targetFile = createTestFile(tmpDir, "target.raw", 10*4096, 2)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+		config := &DaemonConfig{
+			Modules: []Module{{Name: "disk", Path: targetFile}},
+		}
+		daemon = NewBlockrsyncDaemon(config, 0, &BlockRsyncOptions{}, GinkgoLogr.WithName("daemon"))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should sync to a server listening on http", func() {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		opts.ListenAddress = fmt.Sprintf("http://127.0.0.1:%d/blockrsync", port)
+		server := NewBlockrsyncServer(targetFile, 0, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		client := NewBlockrsyncClient(sourceFile, opts.ListenAddress, 0, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should sync to a daemon module over https", func() {
+		server := httptest.NewTLSServer(daemon)
+		defer server.Close()
+		caFile := filepath.Join(tmpDir, "ca.crt")
+		Expect(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)).To(Succeed())
+		opts.Module = "disk"
+		opts.CACertFile = caFile
+		client := NewBlockrsyncClient(sourceFile, server.URL, 0, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should fail to connect over https with an untrusted certificate", func() {
+		server := httptest.NewTLSServer(daemon)
+		defer server.Close()
+		opts.Module = "disk"
+		client := NewBlockrsyncClient(sourceFile, server.URL, 0, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(MatchError(ContainSubstring("certificate")))
+	})
+
+	It("should sync through a reverse proxy", func() {
+		server := httptest.NewServer(daemon)
+		defer server.Close()
+		target, err := url.Parse(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		proxy := httptest.NewServer(httputil.NewSingleHostReverseProxy(target))
+		defer proxy.Close()
+		opts.Module = "disk"
+		client := NewBlockrsyncClient(sourceFile, proxy.URL, 0, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should reject requests that are not an upgrade", func() {
+		server := httptest.NewServer(daemon)
+		defer server.Close()
+		resp, err := http.Get(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUpgradeRequired))
+	})
+})
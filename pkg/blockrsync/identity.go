@@ -0,0 +1,210 @@
+package blockrsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/awels/blockrsync/pkg/image"
+)
+
+var (
+	ErrIdentityMismatch = newError(ErrVerification, "target identity mismatch")
+
+	// diskLinkDir has the by-uuid and by-partuuid links udev creates for devices
+	diskLinkDir = "/dev/disk"
+	// sysBlockDir has the sysfs directories of block devices and partitions
+	sysBlockDir = "/sys/class/block"
+)
+
+// TargetIdentity is what the source expects the target to be, it is checked by
+// the target before any block is written. Every field that is set has to match.
+type TargetIdentity struct {
+	// FilesystemUUID is read from the ext2/3/4, xfs or btrfs superblock of the
+	// target, or matched with the udev by-uuid links for other filesystems
+	FilesystemUUID string `json:"filesystemUUID,omitempty"`
+	// PartitionUUID is matched with the udev by-partuuid links
+	PartitionUUID string `json:"partitionUUID,omitempty"`
+	// Serial of the device, or of the disk of a partition, from sysfs
+	Serial string `json:"serial,omitempty"`
+	// Marker written to the target by a previous sync
+	Marker string `json:"marker,omitempty"`
+}
+
+func (id *TargetIdentity) isEmpty() bool {
+	return id == nil || *id == TargetIdentity{}
+}
+
+// check compares the identity with the target, the file system is read from the
+// virtual disk of an image.
+func (id *TargetIdentity) check(fileName, format string) error {
+	if id.isEmpty() {
+		return nil
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return fmt.Errorf("%w: %v", ErrIdentityMismatch, err)
+	}
+	if id.FilesystemUUID != "" {
+		uuid, err := filesystemUUID(fileName, format)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(uuid, id.FilesystemUUID) && !linksTo("by-uuid", id.FilesystemUUID, fileName) {
+			return fmt.Errorf("%w: filesystem UUID %q, expected %q", ErrIdentityMismatch, uuid, id.FilesystemUUID)
+		}
+	}
+	if id.PartitionUUID != "" && !linksTo("by-partuuid", id.PartitionUUID, fileName) {
+		return fmt.Errorf("%w: target is not the partition with UUID %q", ErrIdentityMismatch, id.PartitionUUID)
+	}
+	if id.Serial != "" {
+		serial := deviceSerial(fileName)
+		if serial == "" {
+			return fmt.Errorf("%w: target has no device serial, expected %q", ErrIdentityMismatch, id.Serial)
+		}
+		if serial != id.Serial {
+			return fmt.Errorf("%w: device serial %q, expected %q", ErrIdentityMismatch, serial, id.Serial)
+		}
+	}
+	if id.Marker != "" {
+		marker, err := readMarker(fileName)
+		if err != nil {
+			return fmt.Errorf("%w: unable to read marker: %v", ErrIdentityMismatch, err)
+		}
+		if marker != id.Marker {
+			return fmt.Errorf("%w: marker %q, expected %q", ErrIdentityMismatch, marker, id.Marker)
+		}
+	}
+	return nil
+}
+
+// filesystemUUID returns the UUID in the superblock of the file system on the
+// target, or an empty string if it is not a known file system.
+func filesystemUUID(fileName, format string) (string, error) {
+	img, err := image.Open(fileName, format)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+	superblocks := []struct {
+		magicOffset int64
+		magic       []byte
+		uuidOffset  int64
+	}{
+		// ext2/3/4, the superblock is at 1024
+		{1024 + 56, []byte{0x53, 0xef}, 1024 + 104},
+		{0, []byte("XFSB"), 32},
+		// btrfs, the superblock is at 64k
+		{0x10000 + 0x40, []byte("_BHRfS_M"), 0x10000 + 0x20},
+	}
+	for _, sb := range superblocks {
+		magic := make([]byte, len(sb.magic))
+		if _, err := img.ReadAt(magic, sb.magicOffset); err != nil && err != io.EOF {
+			return "", err
+		}
+		if !bytes.Equal(magic, sb.magic) {
+			continue
+		}
+		uuid := make([]byte, 16)
+		if _, err := img.ReadAt(uuid, sb.uuidOffset); err != nil {
+			return "", err
+		}
+		return formatUUID(uuid), nil
+	}
+	return "", nil
+}
+
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// linksTo returns true if the udev link of the kind with the name resolves to
+// the target.
+func linksTo(kind, name, fileName string) bool {
+	target, err := filepath.EvalSymlinks(fileName)
+	if err != nil {
+		return false
+	}
+	for _, link := range []string{name, strings.ToLower(name)} {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(diskLinkDir, kind, link))
+		if err == nil && resolved == target {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceSerial returns the serial of the device from sysfs, for partitions the
+// serial of the disk, or an empty string if the device has none. Virtio disks
+// have a serial file, scsi disks the unit serial number vpd page, and nvme and
+// other devices a serial file in the device directory.
+func deviceSerial(fileName string) string {
+	target, err := filepath.EvalSymlinks(fileName)
+	if err != nil {
+		return ""
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysBlockDir, filepath.Base(target)))
+	if err != nil {
+		return ""
+	}
+	dirs := []string{dir}
+	// Only partitions are in the directory of their disk, the parent of device
+	// mapper and loop devices is the directory of all virtual devices
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		dirs = append(dirs, filepath.Dir(dir))
+	}
+	for _, d := range dirs {
+		for _, name := range []string{"serial", "device/serial"} {
+			if b, err := os.ReadFile(filepath.Join(d, name)); err == nil && len(bytes.TrimSpace(b)) > 0 {
+				return string(bytes.TrimSpace(b))
+			}
+		}
+		// The page has a 4 byte header, followed by the serial
+		if b, err := os.ReadFile(filepath.Join(d, "device/vpd_pg80")); err == nil && len(b) > 4 {
+			length := min(int(binary.BigEndian.Uint16(b[2:4])), len(b)-4)
+			return string(bytes.TrimSpace(b[4 : 4+length]))
+		}
+	}
+	return ""
+}
+
+// checkIdentity checks the identity of the target the source expects, before
+// any block is written. A marker to write after the sync can only be written
+// to file targets, so that is checked as well.
+func (b *BlockrsyncServer) checkIdentity(file FileRequest) error {
+	format, err := b.targetFormat()
+	if err != nil {
+		return err
+	}
+	if err := file.Identity.check(b.targetFile, format); err != nil {
+		return err
+	}
+	if file.Marker != "" {
+		if info, err := os.Stat(b.targetFile); err == nil && !info.Mode().IsRegular() {
+			return fmt.Errorf("markers can only be written to file targets, %s is not", b.targetFile)
+		}
+		b.marker = file.Marker
+	}
+	if !file.Identity.isEmpty() {
+		b.log.Info("Target identity matches", "identity", file.Identity)
+	}
+	return nil
+}
+
+// writeMarker writes the marker the source asked for to the target, after the
+// sync completed.
+func (b *BlockrsyncServer) writeMarker() error {
+	if b.marker == "" {
+		return nil
+	}
+	if err := writeMarker(b.targetFile, b.marker); err != nil {
+		return fmt.Errorf("unable to write marker: %w", err)
+	}
+	b.log.Info("Wrote marker to target", "marker", b.marker)
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package blockrsync
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+const markerAttribute = "user.blockrsync.marker"
+
+// readMarker returns the marker written to the target by a previous sync, or an
+// empty string if there is none.
+func readMarker(fileName string) (string, error) {
+	for {
+		// Probe the size first, the marker can be of any length
+		size, err := unix.Getxattr(fileName, markerAttribute, nil)
+		if errors.Is(err, unix.ENODATA) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		buf := make([]byte, size)
+		n, err := unix.Getxattr(fileName, markerAttribute, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// The marker grew since the probe
+			continue
+		} else if errors.Is(err, unix.ENODATA) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	}
+}
+
+func writeMarker(fileName, marker string) error {
+	return unix.Setxattr(fileName, markerAttribute, []byte(marker), 0)
+}
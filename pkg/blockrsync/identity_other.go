@@ -0,0 +1,15 @@
+//go:build !linux
+
+package blockrsync
+
+import "errors"
+
+var errMarkerUnsupported = errors.New("target markers are only supported on linux")
+
+func readMarker(fileName string) (string, error) {
+	return "", errMarkerUnsupported
+}
+
+func writeMarker(fileName, marker string) error {
+	return errMarkerUnsupported
+}
@@ -0,0 +1,213 @@
+package blockrsync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("target identity tests", func() {
+	const fsUUID = "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"
+	var (
+		tmpDir     string
+		sourceFile string
+		targetFile string
+		opts       BlockRsyncOptions
+	)
+
+	writeAt := func(fileName string, data []byte, offset int64) {
+		f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt(data, offset)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+	}
+
+	// writeExt4Superblock writes the magic and UUID of an ext4 superblock
+	writeExt4Superblock := func(fileName string) {
+		writeAt(fileName, []byte{0x53, 0xef}, 1024+56)
+		writeAt(fileName, []byte{0x0f, 0x1e, 0x2d, 0x3c, 0x4b, 0x5a, 0x69, 0x78, 0x87, 0x96, 0xa5, 0xb4, 0xc3, 0xd2, 0xe1, 0xf0}, 1024+104)
+	}
+
+	expectUnchanged := func(fileName string, expected []byte) {
+		actual, err := os.ReadFile(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-identity")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096, 1)
+		targetFile = createTestFile(tmpDir, "target.raw", 20*4096, 2)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should read the filesystem UUID from the superblock", func() {
+		writeExt4Superblock(targetFile)
+		Expect(filesystemUUID(targetFile, "raw")).To(Equal(fsUUID))
+		xfsFile := createTestFile(tmpDir, "xfs.raw", 4096, 3)
+		writeAt(xfsFile, []byte("XFSB"), 0)
+		writeAt(xfsFile, bytes.Repeat([]byte{0xab}, 16), 32)
+		Expect(filesystemUUID(xfsFile, "raw")).To(Equal("abababab-abab-abab-abab-abababababab"))
+		Expect(filesystemUUID(sourceFile, "raw")).To(BeEmpty())
+	})
+
+	It("should sync to a target with the expected filesystem UUID", func() {
+		writeExt4Superblock(targetFile)
+		opts.TargetIdentity = &TargetIdentity{FilesystemUUID: "0F1E2D3C-4B5A-6978-8796-A5B4C3D2E1F0"}
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should refuse a target with a different filesystem UUID", func() {
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		opts.TargetIdentity = &TargetIdentity{FilesystemUUID: fsUUID}
+		err = NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()
+		Expect(err).To(MatchError(ErrIdentityMismatch))
+		expectUnchanged(targetFile, expected)
+	})
+
+	It("should reject the session if the target does not match", func() {
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		clientOpts := opts
+		clientOpts.TargetIdentity = &TargetIdentity{Serial: "does-not-exist"}
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &clientOpts, GinkgoLogr.WithName("client"))
+		err = client.ConnectToTarget()
+		Expect(err).To(MatchError(ContainSubstring(ErrIdentityMismatch.Error())))
+		Expect(<-done).To(MatchError(ErrIdentityMismatch))
+		expectUnchanged(targetFile, expected)
+	})
+
+	It("should check the identity before creating the target", func() {
+		newTarget := filepath.Join(tmpDir, "new.raw")
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(newTarget, port, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		clientOpts := opts
+		clientOpts.TargetIdentity = &TargetIdentity{FilesystemUUID: fsUUID}
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &clientOpts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(HaveOccurred())
+		Expect(<-done).To(HaveOccurred())
+		Expect(newTarget).ToNot(BeAnExistingFile())
+	})
+
+	It("should write a marker, and expect it in the next sync", func() {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.StartServer()).To(Succeed())
+		}()
+		clientOpts := opts
+		clientOpts.TargetMarker = "job-1"
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &clientOpts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(readMarker(targetFile)).To(Equal("job-1"))
+
+		opts.TargetIdentity = &TargetIdentity{Marker: "job-1"}
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		opts.TargetIdentity = &TargetIdentity{Marker: "job-2"}
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(MatchError(ErrIdentityMismatch))
+	})
+
+	It("should read a marker longer than a small buffer", func() {
+		marker := strings.Repeat("job-", 300)
+		Expect(writeMarker(targetFile, marker)).To(Succeed())
+		Expect(readMarker(targetFile)).To(Equal(marker))
+	})
+
+	It("should write the marker to the replaced target", func() {
+		opts.AtomicReplace = true
+		opts.TargetMarker = "job-1"
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		Expect(readMarker(targetFile)).To(Equal("job-1"))
+	})
+
+	It("should not write the marker in a dry run", func() {
+		opts.DryRun = true
+		opts.TargetMarker = "job-1"
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		Expect(readMarker(targetFile)).To(BeEmpty())
+	})
+
+	Context("with device links", func() {
+		var savedDiskLinkDir, savedSysBlockDir string
+
+		BeforeEach(func() {
+			savedDiskLinkDir, savedSysBlockDir = diskLinkDir, sysBlockDir
+			diskLinkDir = filepath.Join(tmpDir, "disk")
+			sysBlockDir = filepath.Join(tmpDir, "sys")
+			Expect(os.MkdirAll(filepath.Join(diskLinkDir, "by-partuuid"), 0755)).To(Succeed())
+			Expect(os.Symlink(targetFile, filepath.Join(diskLinkDir, "by-partuuid", "a1b2c3d4-01"))).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(sysBlockDir, "target.raw", "device"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(sysBlockDir, "target.raw", "device", "serial"), []byte("  SER123\n"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			diskLinkDir, sysBlockDir = savedDiskLinkDir, savedSysBlockDir
+		})
+
+		DescribeTable("should check the identity", func(identity TargetIdentity, matches bool) {
+			err := identity.check(targetFile, "raw")
+			if matches {
+				Expect(err).ToNot(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(ErrIdentityMismatch))
+			}
+		},
+			Entry("partition UUID", TargetIdentity{PartitionUUID: "A1B2C3D4-01"}, true),
+			Entry("other partition UUID", TargetIdentity{PartitionUUID: "a1b2c3d4-02"}, false),
+			Entry("serial", TargetIdentity{Serial: "SER123"}, true),
+			Entry("other serial", TargetIdentity{Serial: "SER124"}, false),
+			Entry("serial and other partition UUID", TargetIdentity{Serial: "SER123", PartitionUUID: "a1b2c3d4-02"}, false),
+			Entry("empty", TargetIdentity{}, true),
+		)
+
+		It("should use the serial of the disk of a partition", func() {
+			disk := filepath.Join(tmpDir, "devices", "vdb")
+			Expect(os.MkdirAll(filepath.Join(disk, "part.raw"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(disk, "part.raw", "partition"), []byte("1\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(disk, "serial"), []byte("DISK1\n"), 0644)).To(Succeed())
+			Expect(os.Symlink(filepath.Join(disk, "part.raw"), filepath.Join(sysBlockDir, "part.raw"))).To(Succeed())
+			partFile := createTestFile(tmpDir, "part.raw", 4096, 3)
+			Expect((&TargetIdentity{Serial: "DISK1"}).check(partFile, "raw")).To(Succeed())
+		})
+
+		It("should not use the serial of the parent of a virtual device", func() {
+			virtual := filepath.Join(tmpDir, "devices", "virtual", "block")
+			Expect(os.MkdirAll(filepath.Join(virtual, "dm.raw"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(virtual, "serial"), []byte("OTHER\n"), 0644)).To(Succeed())
+			Expect(os.Symlink(filepath.Join(virtual, "dm.raw"), filepath.Join(sysBlockDir, "dm.raw"))).To(Succeed())
+			dmFile := createTestFile(tmpDir, "dm.raw", 4096, 3)
+			err := (&TargetIdentity{Serial: "OTHER"}).check(dmFile, "raw")
+			Expect(err).To(MatchError(ErrIdentityMismatch))
+			Expect(err).To(MatchError(ContainSubstring("target has no device serial")))
+		})
+	})
+})
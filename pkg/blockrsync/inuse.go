@@ -0,0 +1,167 @@
+package blockrsync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrTargetInUse = newError(ErrTargetIO, "target is in use")
+
+	// mountInfoFile lists the mounts with the device numbers of the mounted devices
+	mountInfoFile = "/proc/self/mountinfo"
+)
+
+// claimTarget refuses to write to a target that is in use. Block devices cannot
+// be mounted, or held by device mapper, md or other devices, and files cannot
+// back a loop device. An advisory lock is taken on file targets, that also
+// fails if another process like qemu holds a lock on the file.
+func (b *BlockrsyncServer) claimTarget() error {
+	if b.opts.Force {
+		return nil
+	}
+	path, err := filepath.EvalSymlinks(b.targetFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var users []string
+	switch {
+	case info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0:
+		users, err = blockDeviceUsers(path, deviceNumber(info))
+	case info.Mode().IsRegular():
+		users, err = loopDevicesBackedBy(path)
+	}
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("%w: %s", ErrTargetInUse, strings.Join(users, ", "))
+	}
+	if info.Mode().IsRegular() {
+		if b.lock, err = lockTarget(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BlockrsyncServer) releaseTarget() error {
+	if b.lock == nil {
+		return nil
+	}
+	err := b.lock.Close()
+	b.lock = nil
+	return err
+}
+
+// blockDeviceUsers returns the mounts and holders of the device and of its
+// partitions.
+func blockDeviceUsers(path, devNum string) ([]string, error) {
+	name := filepath.Base(path)
+	devices := map[string]string{}
+	if devNum != "" {
+		devices[devNum] = name
+	} else if dev, err := os.ReadFile(filepath.Join(sysBlockDir, name, "dev")); err == nil {
+		devices[strings.TrimSpace(string(dev))] = name
+	}
+	entries, err := os.ReadDir(filepath.Join(sysBlockDir, name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(sysBlockDir, name, entry.Name(), "partition")); err != nil {
+			continue
+		}
+		if dev, err := os.ReadFile(filepath.Join(sysBlockDir, name, entry.Name(), "dev")); err == nil {
+			devices[strings.TrimSpace(string(dev))] = entry.Name()
+		}
+	}
+	var users []string
+	for _, device := range devices {
+		holders, err := os.ReadDir(filepath.Join(sysBlockDir, device, "holders"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, holder := range holders {
+			users = append(users, fmt.Sprintf("%s is held by %s", device, holder.Name()))
+		}
+	}
+	mounts, err := mountedDevices(devices, path)
+	if err != nil {
+		return nil, err
+	}
+	return append(users, mounts...), nil
+}
+
+// mountedDevices returns the mounts of the devices from mountinfo, matched by
+// device number or by the mount source.
+func mountedDevices(devices map[string]string, path string) ([]string, error) {
+	f, err := os.Open(mountInfoFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		source := ""
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) {
+				source = fields[i+2]
+				break
+			}
+		}
+		if device, ok := devices[fields[2]]; ok {
+			mounts = append(mounts, fmt.Sprintf("%s is mounted on %s", device, fields[4]))
+		} else if source != "" && resolvesTo(source, path) {
+			mounts = append(mounts, fmt.Sprintf("%s is mounted on %s", filepath.Base(path), fields[4]))
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// loopDevicesBackedBy returns the loop devices the file is the backing file of.
+func loopDevicesBackedBy(path string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(sysBlockDir, "loop*", "loop", "backing_file"))
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, file := range files {
+		backingFile, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if resolvesTo(strings.TrimSpace(string(backingFile)), path) {
+			loop := filepath.Base(filepath.Dir(filepath.Dir(file)))
+			users = append(users, fmt.Sprintf("%s is the backing file of %s", filepath.Base(path), loop))
+		}
+	}
+	return users, nil
+}
+
+func resolvesTo(name, path string) bool {
+	if !filepath.IsAbs(name) {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	return err == nil && resolved == path
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func deviceNumber(info os.FileInfo) string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)))
+}
+
+// lockTarget takes an exclusive advisory lock on the file, and checks no other
+// process holds a record lock on it, like qemu does on the images it uses.
+func lockTarget(fileName string) (*os.File, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); errors.Is(err, unix.EWOULDBLOCK) {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s is locked by another process", ErrTargetInUse, fileName)
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+	lk := unix.Flock_t{Type: unix.F_WRLCK}
+	if err := unix.FcntlFlock(f.Fd(), unix.F_OFD_GETLK, &lk); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if lk.Type != unix.F_UNLCK {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s has a lock held by another process", ErrTargetInUse, fileName)
+	}
+	return f, nil
+}
+
+// openExclusive opens a block device exclusively, the kernel refuses it if the
+// device is mounted or claimed by another exclusive user.
+func openExclusive(fileName string) (*os.File, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|unix.O_EXCL, 0)
+	if errors.Is(err, unix.EBUSY) {
+		return nil, fmt.Errorf("%w: %s is busy", ErrTargetInUse, fileName)
+	}
+	return f, err
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package blockrsync
+
+import "os"
+
+func deviceNumber(info os.FileInfo) string {
+	return ""
+}
+
+func lockTarget(fileName string) (*os.File, error) {
+	return nil, nil
+}
+
+func openExclusive(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_RDWR, 0)
+}
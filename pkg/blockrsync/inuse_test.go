@@ -0,0 +1,171 @@
+package blockrsync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+var _ = Describe("target in use tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		targetFile string
+		opts       BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-inuse")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096, 1)
+		targetFile = createTestFile(tmpDir, "target.raw", 20*4096, 2)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	expectUnchanged := func(expected []byte) {
+		actual, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+	}
+
+	It("should refuse a target locked by another process", func() {
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		f, err := os.Open(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)).To(Succeed())
+
+		err = NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()
+		Expect(err).To(MatchError(ErrTargetInUse))
+		expectUnchanged(expected)
+
+		opts.Force = true
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should refuse a target with a record lock, like qemu takes", func() {
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		lk := unix.Flock_t{Type: unix.F_RDLCK, Start: 100, Len: 1}
+		Expect(unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &lk)).To(Succeed())
+
+		err = NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()
+		Expect(err).To(MatchError(ErrTargetInUse))
+	})
+
+	It("should release the lock after the sync", func() {
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		f, err := os.Open(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)).To(Succeed())
+	})
+
+	It("should not lock the target in a dry run", func() {
+		f, err := os.Open(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)).To(Succeed())
+		opts.DryRun = true
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+	})
+
+	It("should fail to start a server on a locked target", func() {
+		f, err := os.Open(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(MatchError(ErrTargetIO))
+		Expect(<-done).To(MatchError(ErrTargetInUse))
+	})
+
+	It("should not lock the target of a server in a dry run", func() {
+		f, err := os.Open(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		clientOpts := opts
+		clientOpts.DryRun = true
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &clientOpts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+	})
+
+	Context("with a fake sysfs and mountinfo", func() {
+		var savedSysBlockDir, savedMountInfoFile string
+
+		writeFile := func(name, content string) {
+			Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+			Expect(os.WriteFile(name, []byte(content), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			savedSysBlockDir, savedMountInfoFile = sysBlockDir, mountInfoFile
+			sysBlockDir = filepath.Join(tmpDir, "sys")
+			mountInfoFile = filepath.Join(tmpDir, "mountinfo")
+			writeFile(filepath.Join(sysBlockDir, "vdb", "dev"), "252:16\n")
+			writeFile(filepath.Join(sysBlockDir, "vdb", "vdb1", "dev"), "252:17\n")
+			writeFile(filepath.Join(sysBlockDir, "vdb", "vdb1", "partition"), "1\n")
+			writeFile(filepath.Join(sysBlockDir, "vdb", "vdb2", "dev"), "252:18\n")
+			writeFile(filepath.Join(sysBlockDir, "vdb", "vdb2", "partition"), "2\n")
+			writeFile(mountInfoFile, "22 1 252:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw\n")
+		})
+
+		AfterEach(func() {
+			sysBlockDir, mountInfoFile = savedSysBlockDir, savedMountInfoFile
+		})
+
+		It("should find no users of an unused device", func() {
+			Expect(blockDeviceUsers("/dev/vdb", "252:16")).To(BeEmpty())
+		})
+
+		It("should find mounted partitions", func() {
+			writeFile(mountInfoFile, "22 1 252:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw\n"+
+				"40 22 252:17 / /mnt/data rw,relatime shared:2 - xfs /dev/vdb1 rw\n")
+			Expect(blockDeviceUsers("/dev/vdb", "252:16")).To(ConsistOf("vdb1 is mounted on /mnt/data"))
+			Expect(blockDeviceUsers("/dev/vdb2", "252:18")).To(BeEmpty())
+		})
+
+		It("should find holders of the device and its partitions", func() {
+			Expect(os.MkdirAll(filepath.Join(sysBlockDir, "vdb2", "holders", "dm-0"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(sysBlockDir, "vdb", "holders", "md0"), 0755)).To(Succeed())
+			Expect(blockDeviceUsers("/dev/vdb", "252:16")).To(ConsistOf("vdb2 is held by dm-0", "vdb is held by md0"))
+		})
+
+		It("should find loop devices backed by a file target", func() {
+			writeFile(filepath.Join(sysBlockDir, "loop3", "loop", "backing_file"), targetFile+"\n")
+			err := NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()
+			Expect(err).To(MatchError(ContainSubstring("target.raw is the backing file of loop3")))
+			Expect(err).To(MatchError(ErrTargetInUse))
+		})
+	})
+})
@@ -0,0 +1,154 @@
+package blockrsync
+
+import (
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/image"
+)
+
+// LocalSync syncs a source file to a target file on the same host without
+// going through the network. Blocks are written with the same semantics as
+// the BlockrsyncServer.
+type LocalSync struct {
+	sourceFile string
+	targetFile string
+	opts       *BlockRsyncOptions
+	report     *DiffReport
+	// sizeDecision is how the size of the target is handled
+	sizeDecision *SizeDecision
+	log          logr.Logger
+}
+
+func NewLocalSync(sourceFile, targetFile string, opts *BlockRsyncOptions, logger logr.Logger) *LocalSync {
+	return &LocalSync{
+		sourceFile: sourceFile,
+		targetFile: targetFile,
+		opts:       opts,
+		log:        logger,
+	}
+}
+
+// Report returns the differences found in dry run mode.
+func (l *LocalSync) Report() *DiffReport {
+	return l.report
+}
+
+// SizeDecision returns how the size of the target is handled.
+func (l *LocalSync) SizeDecision() *SizeDecision {
+	return l.sizeDecision
+}
+
+func (l *LocalSync) Sync() error {
+	source, err := image.Open(l.sourceFile, l.opts.SourceFormat)
+	if err != nil {
+		return wrapError(ErrSourceIO, err)
+	}
+	defer source.Close()
+	server := NewBlockrsyncServer(l.targetFile, 0, l.opts, l.log.WithName("target"))
+	if err := server.checkIdentity(FileRequest{Identity: l.opts.TargetIdentity, Marker: l.opts.TargetMarker}); err != nil {
+		return err
+	}
+	target, err := server.openTargetFile(l.opts.DryRun)
+	if err != nil {
+		return err
+	}
+	defer server.closeTarget(target)
+	l.log.Info("Opened files", "source", l.sourceFile, "target", l.targetFile)
+
+	sourceHasher := NewImageHasher(int64(l.opts.BlockSize), l.opts.SourceFormat, l.log.WithName("source-hasher"))
+	var sourceSize int64
+	var sourceErr, targetErr error
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sourceSize, sourceErr = sourceHasher.HashFile(l.sourceFile)
+	}()
+	targetErr = <-server.hashTargetFile()
+	wg.Wait()
+	if sourceErr != nil {
+		return wrapError(ErrSourceIO, sourceErr)
+	}
+	if targetErr != nil {
+		return targetErr
+	}
+
+	diff, err := sourceHasher.DiffHashes(server.hasher.BlockSize(), server.hasher.GetHashes())
+	if err != nil {
+		return err
+	}
+	l.log.Info("Differences found", "count", len(diff))
+	decision, err := server.decideSize(target, sourceSize)
+	if err != nil {
+		return err
+	}
+	l.sizeDecision = decision
+	if l.opts.DryRun {
+		report, err := newDiffReport(diff, sourceHasher.BlockSize(), sourceSize, source)
+		if err != nil {
+			return wrapError(ErrSourceIO, err)
+		}
+		report.Source = l.sourceFile
+		report.Size = decision
+		l.report = report
+		return nil
+	}
+	if err := server.resizeTarget(target, sourceSize); err != nil {
+		return wrapError(ErrTargetIO, err)
+	}
+	syncProgress := &progress{
+		progressType: "sync progress",
+		logger:       l.log,
+	}
+	if err := l.copyBlocks(server, diff, source, target, syncProgress); err != nil {
+		return err
+	}
+	if err := target.Sync(); err != nil {
+		return wrapError(ErrTargetIO, err)
+	}
+	return server.commitTarget()
+}
+
+func (l *LocalSync) copyBlocks(server *BlockrsyncServer, offsets []int64, source io.ReaderAt, target targetFile, syncProgress Progress) error {
+	l.log.V(3).Info("Copying blocks to target")
+	t := time.Now()
+	defer func() {
+		l.log.V(3).Info("Copying blocks took", "milliseconds", time.Since(t).Milliseconds())
+	}()
+
+	slices.SortFunc(offsets, int64SortFunc)
+	blockSize := server.hasher.BlockSize()
+	syncProgress.Start(int64(len(offsets)) * blockSize)
+	buf := make([]byte, blockSize)
+	for i, offset := range offsets {
+		if err := l.opts.cancelled(); err != nil {
+			return err
+		}
+		// Unallocated blocks of an image are holes, without reading them
+		allocated := isAllocated(source, offset, blockSize)
+		n := 0
+		if allocated {
+			var err error
+			n, err = source.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				return wrapError(ErrSourceIO, err)
+			}
+		}
+		if !allocated || isEmptyBlock(buf[:n]) {
+			if err := server.handleEmptyBlock(offset, target); err != nil {
+				return err
+			}
+		} else {
+			if err := server.writeBlockToOffset(buf[:n], offset, target); err != nil {
+				return err
+			}
+		}
+		syncProgress.Update(int64(i+1) * blockSize)
+	}
+	return nil
+}
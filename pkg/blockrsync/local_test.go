@@ -0,0 +1,212 @@
+package blockrsync
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/awels/blockrsync/pkg/image"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("local sync tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		opts       BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-local")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	DescribeTable("should sync a source file to a target file", func(preallocation bool) {
+		opts.Preallocation = preallocation
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	},
+		Entry("without preallocation", false),
+		Entry("with preallocation", true),
+	)
+
+	It("should only update changed blocks, and shrink a larger target", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 30*4096, 1)
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt([]byte{1, 2, 3, 4}, 5*4096)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt([]byte{1, 2, 3, 4}, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should produce the same result as a sync over the network", func() {
+		localTarget := createTestFile(tmpDir, "local.raw", 10*4096, 3)
+		networkTarget := createTestFile(tmpDir, "network.raw", 10*4096, 3)
+		Expect(NewLocalSync(sourceFile, localTarget, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(networkTarget, port, &opts, GinkgoLogr.WithName("server"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.StartServer()).To(Succeed())
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		expectSameContent(localTarget, networkTarget)
+		expectSameContent(sourceFile, localTarget)
+	})
+
+	It("should sync to a qcow2 target, leaving holes unallocated", func() {
+		// Holes deallocate whole clusters of the image, 64k by default
+		opts.BlockSize = 65536
+		sourceFile = createTestFile(tmpDir, "large.raw", 8*65536+512, 2)
+		targetFile := filepath.Join(tmpDir, "target.qcow2")
+		opts.TargetFormat = image.FormatQcow2
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameImageContent(sourceFile, targetFile)
+
+		// The format of the existing target is detected, and only changes are written
+		f, err := os.OpenFile(sourceFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt(make([]byte, 65536), 5*65536)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt([]byte{1, 2, 3, 4}, 100)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		opts.TargetFormat = image.FormatAuto
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameImageContent(sourceFile, targetFile)
+
+		img, err := image.Open(targetFile, image.FormatAuto)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(img.Format()).To(Equal(image.FormatQcow2))
+		allocated, err := img.Allocated(5*65536, 65536)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(allocated).To(BeFalse())
+	})
+
+	It("should sync to a qcow2 target over the network", func() {
+		targetFile := filepath.Join(tmpDir, "target.qcow2")
+		img, err := image.Create(targetFile, image.FormatQcow2, 40*4096)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = img.WriteAt(bytes.Repeat([]byte{1}, 40*4096), 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(img.Close()).To(Succeed())
+
+		opts.TargetFormat = image.FormatAuto
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.StartServer()).To(Succeed())
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		expectSameImageContent(sourceFile, targetFile)
+	})
+
+	It("should write the changes to a qcow2 overlay, leaving the target unchanged", func() {
+		opts.BlockSize = 65536
+		sourceFile = createTestFile(tmpDir, "large.raw", 16*65536, 2)
+		baseline, err := os.ReadFile(sourceFile)
+		Expect(err).ToNot(HaveOccurred())
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		Expect(os.WriteFile(targetFile, baseline, 0644)).To(Succeed())
+		f, err := os.OpenFile(sourceFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt(bytes.Repeat([]byte{1}, 65536), 3*65536)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt(make([]byte, 65536), 7*65536)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		opts.OverlayFile = filepath.Join(tmpDir, "overlay.qcow2")
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(baseline))
+		expectSameImageContent(sourceFile, opts.OverlayFile)
+
+		img, err := image.Open(opts.OverlayFile, image.FormatQcow2)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		allocated, err := img.Allocated(7*65536, 65536)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(allocated).To(BeFalse())
+		// The header, refcount and L1 and L2 table clusters, and only the changed block
+		info, err := os.Stat(opts.OverlayFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(Equal(int64(6 * 65536)))
+	})
+
+	It("should write unallocated source blocks as holes without reading them", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 3*4096, 1)
+		server := NewBlockrsyncServer(targetFile, 0, &opts, GinkgoLogr.WithName("target"))
+		f, err := server.openTargetFile(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(<-server.hashTargetFile()).To(Succeed())
+		source := &unallocatedSource{unallocated: 4096}
+		local := NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local"))
+		Expect(local.copyBlocks(server, []int64{0, 4096, 8192}, source, f, &progress{logger: GinkgoLogr})).To(Succeed())
+		Expect(server.closeTarget(f)).To(Succeed())
+
+		content, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(content[:4096]).To(Equal(bytes.Repeat([]byte{2}, 4096)))
+		Expect(content[4096:8192]).To(Equal(make([]byte, 4096)))
+		Expect(content[8192:]).To(Equal(bytes.Repeat([]byte{2}, 4096)))
+		Expect(source.reads).ToNot(ContainElement(int64(4096)))
+	})
+
+	It("should fail if the source does not exist", func() {
+		Expect(NewLocalSync(filepath.Join(tmpDir, "missing.raw"), filepath.Join(tmpDir, "target.raw"), &opts, GinkgoLogr.WithName("local")).Sync()).ToNot(Succeed())
+	})
+})
+
+// expectSameImageContent compares the source with the virtual disk of the target image.
+func expectSameImageContent(sourceFile, targetFile string) {
+	source, err := os.ReadFile(sourceFile)
+	Expect(err).ToNot(HaveOccurred())
+	img, err := image.Open(targetFile, image.FormatAuto)
+	Expect(err).ToNot(HaveOccurred())
+	defer img.Close()
+	Expect(img.Size()).To(Equal(int64(len(source))))
+	target, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	Expect(err).ToNot(HaveOccurred())
+	Expect(bytes.Equal(source, target)).To(BeTrue())
+}
+
+// unallocatedSource reads as blocks of 2s, except for the unallocated block.
+type unallocatedSource struct {
+	unallocated int64
+	reads       []int64
+}
+
+func (u *unallocatedSource) ReadAt(p []byte, offset int64) (int, error) {
+	u.reads = append(u.reads, offset)
+	copy(p, bytes.Repeat([]byte{2}, len(p)))
+	return len(p), nil
+}
+
+func (u *unallocatedSource) Allocated(offset, length int64) (bool, error) {
+	return offset != u.unallocated, nil
+}
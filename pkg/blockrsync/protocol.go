@@ -0,0 +1,162 @@
+package blockrsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	protocolVersion = 1
+	// Upper bound for a single handshake message, protects against garbage on the wire
+	maxMessageSize = 1024 * 1024
+)
+
+// SessionRequest is the first message a client sends after connecting, it lists
+// the files that will be synced in the session in order.
+type SessionRequest struct {
+	Version   int           `json:"version"`
+	BlockSize int64         `json:"blockSize"`
+	Files     []FileRequest `json:"files"`
+	// DryRun sessions only exchange hashes, no blocks are sent to the target
+	DryRun bool `json:"dryRun,omitempty"`
+	// Converge sessions sync a single file in multiple rounds, see RoundStart
+	Converge bool `json:"converge,omitempty"`
+}
+
+type FileRequest struct {
+	Module string `json:"module,omitempty"`
+	// Size of the source, 0 if unknown, the target checks it against its own size
+	// before sending the hashes
+	Size int64 `json:"size,omitempty"`
+	// Identity the target has to match before any block is written
+	Identity *TargetIdentity `json:"identity,omitempty"`
+	// Marker to write to the target after a successful sync
+	Marker string `json:"marker,omitempty"`
+}
+
+// SessionResponse is the answer of the server to a SessionRequest, a non empty
+// Error means the session was rejected.
+type SessionResponse struct {
+	Error string `json:"error,omitempty"`
+	// Kind of the error, like target-io or verification
+	Kind string `json:"kind,omitempty"`
+}
+
+// FileStart is sent by the server before the hashes of a file, a non empty Error
+// means the file cannot be synced, and the session continues with the next file.
+type FileStart struct {
+	Index int    `json:"index"`
+	Error string `json:"error,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+	// Size is how the target will handle the size of the source
+	Size *SizeDecision `json:"size,omitempty"`
+}
+
+// FileResult is sent by the server after all blocks of a file have been received.
+// After an error the session continues with the next file, unless Aborted is set
+// because the target could not read the rest of the blocks.
+type FileResult struct {
+	Index   int    `json:"index"`
+	Error   string `json:"error,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	Aborted bool   `json:"aborted,omitempty"`
+}
+
+// RoundStart is sent by the client before the blocks of each round of a converge
+// session after the first. The target does not send hashes again, the client keeps
+// track of the content of the target. Done ends the session.
+type RoundStart struct {
+	Round int  `json:"round"`
+	Final bool `json:"final,omitempty"`
+	Done  bool `json:"done,omitempty"`
+}
+
+// session wraps both directions of a connection in snappy streams and provides
+// framing for the handshake messages exchanged between client and server.
+type session struct {
+	reader *bufio.Reader
+	writer *snappy.Writer
+}
+
+func newSession(rw io.ReadWriter) *session {
+	return &session{
+		reader: bufio.NewReader(snappy.NewReader(rw)),
+		writer: snappy.NewBufferedWriter(rw),
+	}
+}
+
+func (s *session) writeMessage(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(s.writer, binary.LittleEndian, uint32(len(b))); err != nil {
+		return wrapError(ErrConnection, err)
+	}
+	if _, err := s.writer.Write(b); err != nil {
+		return wrapError(ErrConnection, err)
+	}
+	return s.flush()
+}
+
+func (s *session) readMessage(v interface{}) error {
+	var length uint32
+	if err := binary.Read(s.reader, binary.LittleEndian, &length); err != nil {
+		return streamError(err)
+	}
+	if length > maxMessageSize {
+		return fmt.Errorf("%w: message size %d exceeds maximum %d", ErrProtocol, length, maxMessageSize)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, b); err != nil {
+		return streamError(err)
+	}
+	return wrapError(ErrProtocol, json.Unmarshal(b, v))
+}
+
+func (s *session) readRequest() (*SessionRequest, error) {
+	req := &SessionRequest{}
+	if err := s.readMessage(req); err != nil {
+		return nil, err
+	}
+	if req.Version != protocolVersion {
+		return nil, fmt.Errorf("%w: unsupported protocol version %d, expected %d", ErrProtocol, req.Version, protocolVersion)
+	}
+	if len(req.Files) == 0 {
+		return nil, newError(ErrProtocol, "no files requested")
+	}
+	if req.Converge && (len(req.Files) != 1 || req.DryRun) {
+		return nil, newError(ErrProtocol, "converge sessions sync a single file and cannot be a dry run")
+	}
+	return req, nil
+}
+
+// respond sends the response to the session request, rejecting the session if err is not nil.
+func (s *session) respond(err error) error {
+	resp := SessionResponse{}
+	if err != nil {
+		resp.Error = err.Error()
+		resp.Kind = errorKindName(err)
+	}
+	return s.writeMessage(&resp)
+}
+
+func (s *session) readResponse() error {
+	resp := SessionResponse{}
+	if err := s.readMessage(&resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return remoteError(resp.Kind, resp.Error)
+	}
+	return nil
+}
+
+func (s *session) flush() error {
+	return wrapError(ErrConnection, s.writer.Flush())
+}
@@ -0,0 +1,322 @@
+package blockrsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	rbdDiffV1Magic = "rbd diff v1\n"
+	rbdDiffV2Magic = "rbd diff v2\n"
+
+	rbdDiffFromSnap = 'f'
+	rbdDiffToSnap   = 't'
+	rbdDiffSize     = 's'
+	rbdDiffData     = 'w'
+	rbdDiffZero     = 'z'
+	rbdDiffEnd      = 'e'
+)
+
+var ErrInvalidRBDDiff = errors.New("invalid rbd export-diff stream")
+
+// RBDDiffHeader describes an rbd export-diff stream, the metadata records and the
+// number of data and zero records.
+type RBDDiffHeader struct {
+	Version     int    `json:"version"`
+	FromSnap    string `json:"fromSnap,omitempty"`
+	ToSnap      string `json:"toSnap,omitempty"`
+	Size        int64  `json:"size"`
+	DataRecords int64  `json:"dataRecords"`
+	ZeroRecords int64  `json:"zeroRecords"`
+}
+
+// IsRBDDiff returns true if the data starts with the header of an rbd
+// export-diff stream.
+func IsRBDDiff(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(rbdDiffV1Magic)) || bytes.HasPrefix(data, []byte(rbdDiffV2Magic))
+}
+
+// CreateRBDDiff writes the blocks of the source file that differ from the hashes
+// to the writer as an rbd export-diff v1 stream, that rbd import-diff can apply
+// to an image. Empty blocks are written as zero records.
+func CreateRBDDiff(sourceFile string, hashes io.Reader, w io.Writer, logger logr.Logger) (*RBDDiffHeader, error) {
+	client, diff, err := diffAgainstHashes(sourceFile, bufio.NewReader(hashes), logger)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The blocks are written in the network format, and converted to records
+	reader, writer := io.Pipe()
+	go func() {
+		deltaProgress := &progress{
+			progressType: "delta progress",
+			logger:       logger,
+		}
+		err := client.writeBlocksToServer(writer, diff, f, deltaProgress)
+		if err == nil {
+			err = writeEndOfBlocks(writer)
+		}
+		writer.CloseWithError(err)
+	}()
+	defer reader.Close()
+
+	header := &RBDDiffHeader{Version: 1, Size: client.sourceSize}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(rbdDiffV1Magic); err != nil {
+		return nil, err
+	}
+	if err := writeRBDRecord(bw, rbdDiffSize, uint64(header.Size)); err != nil {
+		return nil, err
+	}
+	var sourceSize int64
+	if err := binary.Read(reader, binary.LittleEndian, &sourceSize); err != nil {
+		return nil, err
+	}
+	blockReader := NewBlockReader(reader, int(client.hasher.BlockSize()), logger.WithName("block-reader"))
+	blockReader.SetSourceSize(sourceSize)
+	for {
+		cont, err := blockReader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !cont {
+			break
+		}
+		offset := uint64(blockReader.Offset())
+		if blockReader.IsHole() {
+			length := min(client.hasher.BlockSize(), sourceSize-blockReader.Offset())
+			if err := writeRBDRecord(bw, rbdDiffZero, offset, uint64(length)); err != nil {
+				return nil, err
+			}
+			header.ZeroRecords++
+			continue
+		}
+		block := blockReader.Block()
+		if err := writeRBDRecord(bw, rbdDiffData, offset, uint64(len(block))); err != nil {
+			return nil, err
+		}
+		if _, err := bw.Write(block); err != nil {
+			return nil, err
+		}
+		header.DataRecords++
+	}
+	if !blockReader.IsEnd() {
+		return nil, errors.New("blocks ended before the end marker")
+	}
+	if err := bw.WriteByte(rbdDiffEnd); err != nil {
+		return nil, err
+	}
+	return header, bw.Flush()
+}
+
+func writeRBDRecord(w *bufio.Writer, tag byte, values ...uint64) error {
+	if err := w.WriteByte(tag); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, values)
+}
+
+// rbdDiffReader reads the records of a v1 or v2 stream. In v2 every record but
+// the end has the length of its payload, so unknown records can be skipped.
+type rbdDiffReader struct {
+	r       *bufio.Reader
+	version int
+}
+
+func newRBDDiffReader(r io.Reader) (*rbdDiffReader, error) {
+	reader := &rbdDiffReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(rbdDiffV1Magic))
+	if _, err := io.ReadFull(reader.r, magic); err != nil {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidRBDDiff)
+	}
+	switch string(magic) {
+	case rbdDiffV1Magic:
+		reader.version = 1
+	case rbdDiffV2Magic:
+		reader.version = 2
+	default:
+		return nil, fmt.Errorf("%w: unknown header %q", ErrInvalidRBDDiff, magic)
+	}
+	return reader, nil
+}
+
+// next returns the tag of the next record, and the length of its payload in v2.
+func (d *rbdDiffReader) next() (byte, int64, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: missing end record", ErrInvalidRBDDiff)
+	}
+	if tag == rbdDiffEnd || d.version == 1 {
+		return tag, -1, nil
+	}
+	var length uint64
+	if err := binary.Read(d.r, binary.LittleEndian, &length); err != nil {
+		return 0, 0, fmt.Errorf("%w: %v", ErrInvalidRBDDiff, err)
+	}
+	if length > 1<<62 {
+		return 0, 0, fmt.Errorf("%w: record length %d", ErrInvalidRBDDiff, length)
+	}
+	return tag, int64(length), nil
+}
+
+func (d *rbdDiffReader) readUint64s(values ...*uint64) error {
+	for _, v := range values {
+		if err := binary.Read(d.r, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRBDDiff, err)
+		}
+	}
+	return nil
+}
+
+func (d *rbdDiffReader) readSnapName(recordLength int64) (string, error) {
+	var length uint32
+	if err := binary.Read(d.r, binary.LittleEndian, &length); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidRBDDiff, err)
+	}
+	if length > maxMessageSize || (recordLength >= 0 && recordLength != 4+int64(length)) {
+		return "", fmt.Errorf("%w: invalid snapshot name length %d", ErrInvalidRBDDiff, length)
+	}
+	name := make([]byte, length)
+	if _, err := io.ReadFull(d.r, name); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidRBDDiff, err)
+	}
+	return string(name), nil
+}
+
+// checkLength checks the length of a v2 record with a fixed size payload.
+func checkLength(tag byte, recordLength, expected int64) error {
+	if recordLength >= 0 && recordLength != expected {
+		return fmt.Errorf("%w: record %c has length %d, expected %d", ErrInvalidRBDDiff, tag, recordLength, expected)
+	}
+	return nil
+}
+
+// ApplyRBDDiff writes the data and zero records of an rbd export-diff stream to
+// the target file, and resizes it to the size in the stream. The records are
+// applied as they are read, a stream that turns out to be invalid can leave the
+// target partially updated.
+func ApplyRBDDiff(r io.Reader, targetFile string, opts *BlockRsyncOptions, logger logr.Logger) (*RBDDiffHeader, error) {
+	reader, err := newRBDDiffReader(r)
+	if err != nil {
+		return nil, err
+	}
+	applyOpts := *opts
+	if applyOpts.BlockSize <= 0 {
+		applyOpts.BlockSize = int(DefaultBlockSize)
+	}
+	server := NewBlockrsyncServer(targetFile, 0, &applyOpts, logger.WithName("target"))
+	f, err := server.openTargetFile(false)
+	if err != nil {
+		return nil, err
+	}
+	defer server.closeTarget(f)
+	if server.targetFileSize, err = targetSize(f); err != nil {
+		return nil, err
+	}
+	header, err := server.applyRBDDiff(f, reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return header, server.commitTarget()
+}
+
+func (b *BlockrsyncServer) applyRBDDiff(f targetFile, reader *rbdDiffReader) (*RBDDiffHeader, error) {
+	header := &RBDDiffHeader{Version: reader.version, Size: -1}
+	buf := make([]byte, b.hasher.BlockSize())
+	for {
+		if err := b.opts.cancelled(); err != nil {
+			return nil, err
+		}
+		tag, recordLength, err := reader.next()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case rbdDiffEnd:
+			if header.Size < 0 {
+				header.Size = b.targetFileSize
+			}
+			return header, nil
+		case rbdDiffFromSnap:
+			if header.FromSnap, err = reader.readSnapName(recordLength); err != nil {
+				return nil, err
+			}
+		case rbdDiffToSnap:
+			if header.ToSnap, err = reader.readSnapName(recordLength); err != nil {
+				return nil, err
+			}
+		case rbdDiffSize:
+			var size uint64
+			if err := checkLength(tag, recordLength, 8); err != nil {
+				return nil, err
+			}
+			if err := reader.readUint64s(&size); err != nil {
+				return nil, err
+			}
+			if size > 1<<62 {
+				return nil, fmt.Errorf("%w: size %d", ErrInvalidRBDDiff, size)
+			}
+			header.Size = int64(size)
+			b.log.V(3).Info("Image size", "size", size)
+			if err := b.resizeTarget(f, header.Size); err != nil {
+				return nil, err
+			}
+		case rbdDiffData, rbdDiffZero:
+			var offset, length uint64
+			if err := reader.readUint64s(&offset, &length); err != nil {
+				return nil, err
+			}
+			if offset > 1<<62 || length > 1<<62 || (header.Size >= 0 && int64(offset+length) > header.Size) {
+				return nil, fmt.Errorf("%w: record %c at %d with length %d beyond the image size", ErrInvalidRBDDiff, tag, offset, length)
+			}
+			if tag == rbdDiffZero {
+				if err := checkLength(tag, recordLength, 16); err != nil {
+					return nil, err
+				}
+				if err := b.handleEmptyRange(int64(offset), int64(length), f); err != nil {
+					return nil, err
+				}
+				header.ZeroRecords++
+				continue
+			}
+			if err := checkLength(tag, recordLength, 16+int64(length)); err != nil {
+				return nil, err
+			}
+			for done := int64(0); done < int64(length); {
+				chunk := buf[:min(int64(len(buf)), int64(length)-done)]
+				if _, err := io.ReadFull(reader.r, chunk); err != nil {
+					return nil, fmt.Errorf("%w: %v", ErrInvalidRBDDiff, err)
+				}
+				if err := b.writeBlockToOffset(chunk, int64(offset)+done, f); err != nil {
+					return nil, err
+				}
+				done += int64(len(chunk))
+			}
+			header.DataRecords++
+		default:
+			if recordLength < 0 {
+				return nil, fmt.Errorf("%w: unknown record %c", ErrInvalidRBDDiff, tag)
+			}
+			// Records added in later versions, like the snapshot protection status
+			b.log.V(3).Info("Skipping record", "tag", string(tag), "length", recordLength)
+			if _, err := io.CopyN(io.Discard, reader.r, recordLength); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidRBDDiff, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package blockrsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// rbdDiffBuilder builds export-diff streams like rbd export-diff does, v2
+// records have the length of their payload after the tag.
+type rbdDiffBuilder struct {
+	bytes.Buffer
+	version int
+}
+
+func newRBDDiffBuilder(version int) *rbdDiffBuilder {
+	d := &rbdDiffBuilder{version: version}
+	if version == 1 {
+		d.WriteString(rbdDiffV1Magic)
+	} else {
+		d.WriteString(rbdDiffV2Magic)
+	}
+	return d
+}
+
+func (d *rbdDiffBuilder) record(tag byte, payload []byte) *rbdDiffBuilder {
+	d.WriteByte(tag)
+	if d.version == 2 {
+		d.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(payload))))
+	}
+	d.Write(payload)
+	return d
+}
+
+func (d *rbdDiffBuilder) snap(tag byte, name string) *rbdDiffBuilder {
+	return d.record(tag, append(binary.LittleEndian.AppendUint32(nil, uint32(len(name))), name...))
+}
+
+func (d *rbdDiffBuilder) size(size int64) *rbdDiffBuilder {
+	return d.record(rbdDiffSize, binary.LittleEndian.AppendUint64(nil, uint64(size)))
+}
+
+func (d *rbdDiffBuilder) data(offset int64, data []byte) *rbdDiffBuilder {
+	payload := binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, uint64(offset)), uint64(len(data)))
+	return d.record(rbdDiffData, append(payload, data...))
+}
+
+func (d *rbdDiffBuilder) zero(offset, length int64) *rbdDiffBuilder {
+	return d.record(rbdDiffZero, binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, uint64(offset)), uint64(length)))
+}
+
+func (d *rbdDiffBuilder) end() []byte {
+	d.WriteByte(rbdDiffEnd)
+	return d.Bytes()
+}
+
+var _ = Describe("rbd export-diff tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		targetFile string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-rbddiff")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		targetFile = createTestFile(tmpDir, "target.raw", 30*4096, 2)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	DescribeTable("should apply an export-diff stream", func(version int) {
+		target, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		expected := make([]byte, 25*4096)
+		copy(expected, target)
+		data := bytes.Repeat([]byte{7}, 3*4096+100)
+		copy(expected[1000:], data)
+		copy(expected[10*4096+10:], make([]byte, 5*4096))
+		copy(expected[24*4096:], []byte{1, 2, 3})
+		diff := newRBDDiffBuilder(version).
+			snap(rbdDiffFromSnap, "snap1").
+			snap(rbdDiffToSnap, "snap2").
+			size(25*4096).
+			data(1000, data).
+			zero(10*4096+10, 5*4096).
+			data(24*4096, []byte{1, 2, 3})
+		if version == 2 {
+			// The snapshot protection status, skipped by its length
+			diff.record('p', []byte{1})
+		}
+		header, err := ApplyRBDDiff(bytes.NewReader(diff.end()), targetFile, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("apply"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*header).To(Equal(RBDDiffHeader{Version: version, FromSnap: "snap1", ToSnap: "snap2", Size: 25 * 4096, DataRecords: 2, ZeroRecords: 1}))
+		Expect(os.ReadFile(targetFile)).To(Equal(expected))
+	},
+		Entry("version 1", 1),
+		Entry("version 2", 2),
+	)
+
+	It("should create an export-diff stream that applies to the target", func() {
+		f, err := os.OpenFile(sourceFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt(make([]byte, 4096), 5*4096)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		hashes := &bytes.Buffer{}
+		Expect(WriteHashes(targetFile, 4096, hashes, GinkgoLogr.WithName("hash"))).To(Succeed())
+		diff := &bytes.Buffer{}
+		header, err := CreateRBDDiff(sourceFile, hashes, diff, GinkgoLogr.WithName("delta"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(header.Size).To(Equal(int64(20*4096 + 512)))
+		Expect(header.ZeroRecords).To(Equal(int64(1)))
+		Expect(header.DataRecords).To(BeNumerically(">", 0))
+		Expect(IsRBDDiff(diff.Bytes())).To(BeTrue())
+		Expect(diff.Bytes()).To(HavePrefix(rbdDiffV1Magic))
+
+		applied, err := ApplyRBDDiff(bytes.NewReader(diff.Bytes()), targetFile, &BlockRsyncOptions{}, GinkgoLogr.WithName("apply"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*applied).To(Equal(*header))
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	DescribeTable("should reject invalid streams", func(diff []byte) {
+		_, err := ApplyRBDDiff(bytes.NewReader(diff), targetFile, &BlockRsyncOptions{}, GinkgoLogr.WithName("apply"))
+		Expect(errors.Is(err, ErrInvalidRBDDiff)).To(BeTrue(), "error %v", err)
+	},
+		Entry("unknown header", []byte("rbd diff v3\ne")),
+		Entry("missing end record", newRBDDiffBuilder(1).size(4096).Bytes()),
+		Entry("unknown version 1 record", newRBDDiffBuilder(1).record('p', []byte{1}).end()),
+		Entry("data beyond the size", newRBDDiffBuilder(2).size(4096).data(4090, make([]byte, 10)).end()),
+		Entry("wrong record length", newRBDDiffBuilder(2).record(rbdDiffSize, make([]byte, 4)).end()),
+		Entry("truncated data", newRBDDiffBuilder(1).size(4096).Bytes()[:len(rbdDiffV1Magic)+4]),
+	)
+
+	It("should not create a target for an invalid stream", func() {
+		missing := filepath.Join(tmpDir, "missing.raw")
+		_, err := ApplyRBDDiff(bytes.NewReader([]byte("not a diff")), missing, &BlockRsyncOptions{}, GinkgoLogr.WithName("apply"))
+		Expect(err).To(HaveOccurred())
+		Expect(missing).ToNot(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,15 @@
+//go:build linux
+
+package blockrsync
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes dst share the extents of src, on filesystems that support
+// reflinks like xfs and btrfs.
+func cloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package blockrsync
+
+import (
+	"errors"
+	"os"
+)
+
+func cloneFile(dst, src *os.File) error {
+	return errors.New("reflinks are only supported on linux")
+}
@@ -0,0 +1,215 @@
+package blockrsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/blake2b"
+)
+
+// BlockrsyncRelay accepts a source like a target, writes the received blocks to
+// its own copy, and forwards them to the next target in the chain. The next
+// target can be a relay itself.
+type BlockrsyncRelay struct {
+	server     *BlockrsyncServer
+	downstream ConnectionProvider
+	// module of the next target, if it is a daemon
+	module string
+	log    logr.Logger
+}
+
+func NewBlockrsyncRelay(targetFile string, port int, downstreamAddress string, downstreamPort int, opts *BlockRsyncOptions, logger logr.Logger) *BlockrsyncRelay {
+	client := NewBlockrsyncClient(targetFile, downstreamAddress, downstreamPort, opts, logger)
+	return &BlockrsyncRelay{
+		server:     NewBlockrsyncServer(targetFile, port, opts, logger.WithName("target")),
+		downstream: client.connectionProvider,
+		module:     opts.Module,
+		log:        logger,
+	}
+}
+
+// UseConnectionAcceptor replaces the default listener for the upstream source.
+func (r *BlockrsyncRelay) UseConnectionAcceptor(acceptor ConnectionAcceptor) {
+	r.server.UseConnectionAcceptor(acceptor)
+}
+
+// UseDownstreamConnectionProvider replaces the default connection to the next target.
+func (r *BlockrsyncRelay) UseDownstreamConnectionProvider(provider ConnectionProvider) {
+	r.downstream = provider
+}
+
+func (r *BlockrsyncRelay) StartServer() error {
+	b := r.server
+	conn, err := b.connectionAcceptor.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer b.opts.closeOnCancel(conn)()
+	s := newSession(conn)
+	req, err := s.readRequest()
+	if err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	if err := b.validateRequest(req); err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	if err := b.checkIdentity(req.Files[0]); err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	f, err := b.openTargetFile(req.DryRun)
+	if err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	defer b.closeTarget(f)
+	readyChan := b.hashTargetFile()
+	if req.Converge {
+		err := errors.New("converge sessions cannot be relayed")
+		_ = s.respond(err)
+		return err
+	}
+	if err := <-readyChan; err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	if err := b.checkSize(f, req.Files[0]); err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	down, downConn, downHashes, err := r.connectDownstream(req)
+	if err != nil {
+		err = fmt.Errorf("unable to start sync to next target: %w", err)
+		_ = s.respond(err)
+		return err
+	}
+	defer downConn.Close()
+	if err := s.respond(nil); err != nil {
+		return err
+	}
+	b.dryRun = req.DryRun
+	return b.opts.cancelError(r.relayFile(s, down, f, downHashes))
+}
+
+// connectDownstream starts a session with the next target, and returns its hashes.
+func (r *BlockrsyncRelay) connectDownstream(req *SessionRequest) (*session, io.Closer, map[int64][]byte, error) {
+	conn, err := r.downstream.Connect()
+	if err != nil {
+		return nil, nil, nil, wrapError(ErrConnection, err)
+	}
+	down, hashes, err := r.startDownstreamFile(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return down, conn, hashes, nil
+}
+
+func (r *BlockrsyncRelay) startDownstreamFile(conn io.ReadWriter, req *SessionRequest) (*session, map[int64][]byte, error) {
+	down := newSession(conn)
+	// The next target checks the same identity, and gets the same marker
+	file := req.Files[0]
+	file.Module = r.module
+	if err := down.writeMessage(&SessionRequest{
+		Version:   protocolVersion,
+		BlockSize: req.BlockSize,
+		Files:     []FileRequest{file},
+		DryRun:    req.DryRun,
+	}); err != nil {
+		return nil, nil, err
+	}
+	if err := down.readResponse(); err != nil {
+		return nil, nil, fmt.Errorf("session rejected by next target: %w", err)
+	}
+	start := FileStart{}
+	if err := down.readMessage(&start); err != nil {
+		return nil, nil, err
+	}
+	if start.Error != "" {
+		return nil, nil, remoteError(start.Kind, start.Error)
+	}
+	blockSize, hashes, err := r.server.hasher.DeserializeHashes(down.reader)
+	if err != nil {
+		return nil, nil, streamError(err)
+	}
+	if blockSize != req.BlockSize {
+		return nil, nil, fmt.Errorf("%w: block size mismatch, source %d, next target %d", ErrProtocol, req.BlockSize, blockSize)
+	}
+	return down, hashes, nil
+}
+
+// relayFile sends the source the hashes of the blocks that are the same in this
+// copy and the next target, so any block that differs in either is sent. The
+// received blocks are written to the file and forwarded.
+func (r *BlockrsyncRelay) relayFile(s *session, down *session, f targetFile, downHashes map[int64][]byte) error {
+	b := r.server
+	if err := s.writeMessage(&FileStart{Size: b.sizeDecision}); err != nil {
+		return err
+	}
+	merged := &FileHasher{
+		hashes:    mergeHashes(b.hasher.GetHashes(), downHashes),
+		blockSize: b.hasher.BlockSize(),
+		log:       r.log.WithName("hasher"),
+	}
+	if err := merged.SerializeHashes(s.writer); err != nil {
+		return wrapError(ErrConnection, err)
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	r.log.Info("Wrote merged hashes to source", "blocks", len(merged.hashes))
+
+	var err error
+	if !b.dryRun {
+		b.forward = down.writer
+		err = b.writeBlocksToFile(f, s.reader)
+		b.forward = nil
+		if err == nil {
+			err = wrapError(ErrTargetIO, f.Sync())
+		}
+		if err == nil {
+			err = down.flush()
+		}
+	}
+	if err == nil {
+		downResult := FileResult{}
+		if err = down.readMessage(&downResult); err == nil && downResult.Error != "" {
+			err = fmt.Errorf("next target failed: %w", remoteError(downResult.Kind, downResult.Error))
+		}
+	}
+	// The own copy is only replaced once the next target applied the blocks
+	if err == nil && !b.dryRun {
+		err = b.commitTarget()
+	}
+	return writeFileResult(s, 0, err)
+}
+
+// mismatchHash is the hash of a block that differs between the copies, a block
+// never hashes to all zeros so the source always sends it.
+var mismatchHash = make([]byte, blake2b.Size)
+
+// mergeHashes returns the hashes of the blocks in either map, with the hashes of
+// the blocks that are not the same in both replaced by mismatchHash. Every offset
+// is kept, the source expects the offsets of the hashes to be contiguous.
+func mergeHashes(own, downstream map[int64][]byte) map[int64][]byte {
+	merged := make(map[int64][]byte)
+	for offset, hash := range own {
+		if downstreamHash, ok := downstream[offset]; ok && bytes.Equal(hash, downstreamHash) {
+			merged[offset] = hash
+		} else {
+			merged[offset] = mismatchHash
+		}
+	}
+	for offset := range downstream {
+		if _, ok := merged[offset]; !ok {
+			merged[offset] = mismatchHash
+		}
+	}
+	return merged
+}
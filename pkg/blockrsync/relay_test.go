@@ -0,0 +1,277 @@
+package blockrsync
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("relay tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		opts       BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-relay")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	startServer := func(targetFile string) int {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.StartServer()).To(Succeed())
+		}()
+		return port
+	}
+
+	startRelay := func(targetFile string, downstreamPort int, relayOpts BlockRsyncOptions) (int, chan error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		relay := NewBlockrsyncRelay(targetFile, port, "localhost", downstreamPort, &relayOpts, GinkgoLogr.WithName("relay"))
+		done := make(chan error, 1)
+		go func() {
+			done <- relay.StartServer()
+		}()
+		return port, done
+	}
+
+	It("should write to the relay and forward to the next target", func() {
+		// The relay and the target each have a different part of the source already
+		relayFile := createTestFile(tmpDir, "relay.raw", 20*4096+512, 1)
+		targetFile := createTestFile(tmpDir, "target.raw", 10*4096, 1)
+		f, err := os.OpenFile(relayFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt([]byte{1, 2, 3}, 2*4096)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		relayPort, done := startRelay(relayFile, startServer(targetFile), opts)
+		client := NewBlockrsyncClient(sourceFile, "localhost", relayPort, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, relayFile)
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should send the blocks that differ at the start of the next target", func() {
+		relayFile := createTestFile(tmpDir, "relay.raw", 20*4096+512, 1)
+		targetFile := createTestFile(tmpDir, "target.raw", 20*4096+512, 1)
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		for _, offset := range []int64{1 * 4096, 2 * 4096, 3 * 4096} {
+			_, err = f.WriteAt([]byte{1, 2, 3}, offset)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(f.Close()).To(Succeed())
+
+		relayPort, done := startRelay(relayFile, startServer(targetFile), opts)
+		client := NewBlockrsyncClient(sourceFile, "localhost", relayPort, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, relayFile)
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should forward to a next target on a unix socket", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 10*4096, 2)
+		socket := "unix://" + filepath.Join(tmpDir, "next.sock")
+		targetOpts := opts
+		targetOpts.ListenAddress = socket
+		server := NewBlockrsyncServer(targetFile, 0, &targetOpts, GinkgoLogr.WithName("server"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.StartServer()).To(Succeed())
+		}()
+		relayFile := filepath.Join(tmpDir, "relay.raw")
+		relayPort, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		relay := NewBlockrsyncRelay(relayFile, relayPort, socket, 0, &opts, GinkgoLogr.WithName("relay"))
+		done := make(chan error, 1)
+		go func() {
+			done <- relay.StartServer()
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", relayPort, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, relayFile)
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should check the identity and write the marker on the next target", func() {
+		relayFile := createTestFile(tmpDir, "relay.raw", 10*4096, 2)
+		targetFile := createTestFile(tmpDir, "target.raw", 10*4096, 3)
+		markerOpts := opts
+		markerOpts.TargetMarker = "job-1"
+		relayPort, done := startRelay(relayFile, startServer(targetFile), opts)
+		client := NewBlockrsyncClient(sourceFile, "localhost", relayPort, &markerOpts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+		Expect(readMarker(relayFile)).To(Equal("job-1"))
+		Expect(readMarker(targetFile)).To(Equal("job-1"))
+
+		// Only the next target was synced by another job
+		Expect(writeMarker(targetFile, "job-2")).To(Succeed())
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		relayPort, done = startRelay(relayFile, port, opts)
+		identityOpts := opts
+		identityOpts.TargetIdentity = &TargetIdentity{Marker: "job-1"}
+		client = NewBlockrsyncClient(sourceFile, "localhost", relayPort, &identityOpts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(MatchError(ContainSubstring(ErrIdentityMismatch.Error())))
+		Expect(<-done).To(HaveOccurred())
+		Expect(<-serverDone).To(MatchError(ErrIdentityMismatch))
+		content, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(content).To(Equal(expected))
+	})
+
+	It("should forward through a chain of relays", func() {
+		firstRelay := filepath.Join(tmpDir, "first.raw")
+		secondRelay := createTestFile(tmpDir, "second.raw", 5*4096, 3)
+		targetFile := createTestFile(tmpDir, "target.raw", 30*4096, 4)
+
+		secondPort, secondDone := startRelay(secondRelay, startServer(targetFile), opts)
+		firstPort, firstDone := startRelay(firstRelay, secondPort, opts)
+		client := NewBlockrsyncClient(sourceFile, "localhost", firstPort, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-firstDone).To(Succeed())
+		Expect(<-secondDone).To(Succeed())
+		expectSameContent(sourceFile, firstRelay)
+		expectSameContent(sourceFile, secondRelay)
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	Context("with a daemon as the next target", func() {
+		var (
+			listener   net.Listener
+			targetFile string
+		)
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "localhost:0")
+			Expect(err).ToNot(HaveOccurred())
+			targetFile = filepath.Join(tmpDir, "target.raw")
+			daemon := NewBlockrsyncDaemon(&DaemonConfig{Modules: []Module{{Name: "disk", Path: targetFile}}}, 0, &BlockRsyncOptions{}, GinkgoLogr.WithName("daemon"))
+			go func() {
+				defer GinkgoRecover()
+				Expect(daemon.Serve(listener)).To(Succeed())
+			}()
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("should forward to the module of the daemon", func() {
+			relayOpts := opts
+			relayOpts.Module = "disk"
+			relayFile := filepath.Join(tmpDir, "relay.raw")
+			relayPort, done := startRelay(relayFile, listener.Addr().(*net.TCPAddr).Port, relayOpts)
+			client := NewBlockrsyncClient(sourceFile, "localhost", relayPort, &opts, GinkgoLogr.WithName("client"))
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-done).To(Succeed())
+			expectSameContent(sourceFile, relayFile)
+			expectSameContent(sourceFile, targetFile)
+		})
+
+		It("should reject the session if the next target rejects the file", func() {
+			relayOpts := opts
+			relayOpts.Module = "missing"
+			relayPort, done := startRelay(filepath.Join(tmpDir, "relay.raw"), listener.Addr().(*net.TCPAddr).Port, relayOpts)
+			client := NewBlockrsyncClient(sourceFile, "localhost", relayPort, &opts, GinkgoLogr.WithName("client"))
+			Expect(client.ConnectToTarget()).To(MatchError(ContainSubstring("unknown module missing")))
+			Expect(<-done).To(HaveOccurred())
+		})
+
+		It("should not write to the relay or next target in dry run mode", func() {
+			relayOpts := opts
+			relayOpts.Module = "disk"
+			relayFile := createTestFile(tmpDir, "relay.raw", 20*4096+512, 1)
+			Expect(os.WriteFile(targetFile, nil, 0644)).To(Succeed())
+			relayPort, done := startRelay(relayFile, listener.Addr().(*net.TCPAddr).Port, relayOpts)
+			opts.DryRun = true
+			client := NewBlockrsyncClient(sourceFile, "localhost", relayPort, &opts, GinkgoLogr.WithName("client"))
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-done).To(Succeed())
+			Expect(client.Results()[0].Report.ChangedBlocks).To(Equal(int64(21)))
+			fi, err := os.Stat(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fi.Size()).To(BeZero())
+		})
+	})
+
+	It("should not replace the relay copy if the next target fails", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		// Writing the first block fails, the directory of the undo log does not exist
+		daemon := NewBlockrsyncDaemon(&DaemonConfig{Modules: []Module{{
+			Name:    "broken",
+			Path:    filepath.Join(tmpDir, "target.raw"),
+			UndoLog: filepath.Join(tmpDir, "missing", "undo.log"),
+		}}}, 0, &BlockRsyncOptions{}, GinkgoLogr.WithName("daemon"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(daemon.Serve(listener)).To(Succeed())
+		}()
+		relayFile := createTestFile(tmpDir, "relay.raw", 10*4096, 2)
+		original, err := os.ReadFile(relayFile)
+		Expect(err).ToNot(HaveOccurred())
+		relayOpts := opts
+		relayOpts.Module = "broken"
+		relayOpts.AtomicReplace = true
+		relayPort, done := startRelay(relayFile, listener.Addr().(*net.TCPAddr).Port, relayOpts)
+		client := NewBlockrsyncClient(sourceFile, "localhost", relayPort, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(MatchError(ContainSubstring("next target failed")))
+		Expect(<-done).To(HaveOccurred())
+		content, err := os.ReadFile(relayFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(content).To(Equal(original))
+		staging, err := filepath.Glob(filepath.Join(tmpDir, ".relay.raw.staging-*"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(staging).To(BeEmpty())
+	})
+
+	It("should merge the hashes that are the same in both copies", func() {
+		merged := mergeHashes(map[int64][]byte{
+			0:    {1},
+			4096: {2},
+			8192: {3},
+		}, map[int64][]byte{
+			0:     {1},
+			4096:  {4},
+			12288: {5},
+		})
+		Expect(merged).To(Equal(map[int64][]byte{
+			0:     {1},
+			4096:  mismatchHash,
+			8192:  mismatchHash,
+			12288: mismatchHash,
+		}))
+	})
+})
@@ -0,0 +1,58 @@
+package blockrsync
+
+import (
+	"io"
+	"slices"
+)
+
+// Extent is a contiguous range of bytes.
+type Extent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// DiffReport describes the changes a sync would make to a target, without
+// writing anything.
+type DiffReport struct {
+	Source         string   `json:"source"`
+	Module         string   `json:"module,omitempty"`
+	SourceSize     int64    `json:"sourceSize"`
+	BlockSize      int64    `json:"blockSize"`
+	ChangedBlocks  int64    `json:"changedBlocks"`
+	ChangedBytes   int64    `json:"changedBytes"`
+	HoleBlocks     int64    `json:"holeBlocks"`
+	ChangedExtents []Extent `json:"changedExtents"`
+	// Size is how the target would handle the size of the source
+	Size *SizeDecision `json:"size,omitempty"`
+}
+
+// newDiffReport creates a report from the changed offsets, the changed blocks are
+// read from the source to determine which are holes.
+func newDiffReport(offsets []int64, blockSize, sourceSize int64, source io.ReaderAt) (*DiffReport, error) {
+	report := &DiffReport{
+		SourceSize:     sourceSize,
+		BlockSize:      blockSize,
+		ChangedExtents: []Extent{},
+	}
+	slices.SortFunc(offsets, int64SortFunc)
+	buf := make([]byte, blockSize)
+	for _, offset := range offsets {
+		n, err := source.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		length := min(blockSize, sourceSize-offset)
+		report.ChangedBlocks++
+		if isEmptyBlock(buf[:n]) {
+			report.HoleBlocks++
+		} else {
+			report.ChangedBytes += int64(n)
+		}
+		if last := len(report.ChangedExtents) - 1; last >= 0 && report.ChangedExtents[last].Offset+report.ChangedExtents[last].Length == offset {
+			report.ChangedExtents[last].Length += length
+		} else {
+			report.ChangedExtents = append(report.ChangedExtents, Extent{Offset: offset, Length: length})
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,152 @@
+package blockrsync
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("diff report tests", func() {
+	It("should count blocks, holes and coalesce extents", func() {
+		source := bytes.NewReader([]byte{1, 1, 0, 0, 2, 2, 3, 3, 0, 0, 4})
+		report, err := newDiffReport([]int64{10, 6, 0, 2, 4}, 2, 11, source)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.ChangedBlocks).To(Equal(int64(5)))
+		Expect(report.HoleBlocks).To(Equal(int64(1)))
+		Expect(report.ChangedBytes).To(Equal(int64(7)))
+		Expect(report.ChangedExtents).To(Equal([]Extent{{Offset: 0, Length: 8}, {Offset: 10, Length: 1}}))
+	})
+
+	It("should report no extents without differences", func() {
+		report, err := newDiffReport(nil, 2, 4, bytes.NewReader([]byte{1, 2, 3, 4}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.ChangedBlocks).To(BeZero())
+		Expect(report.ChangedExtents).To(BeEmpty())
+	})
+
+	Context("dry run", func() {
+		var (
+			tmpDir     string
+			sourceFile string
+			targetFile string
+			opts       BlockRsyncOptions
+		)
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = os.MkdirTemp("", "blockrsync-report")
+			Expect(err).ToNot(HaveOccurred())
+			sourceFile = createTestFile(tmpDir, "source.raw", 8*4096, 1)
+			targetFile = createTestFile(tmpDir, "target.raw", 8*4096, 1)
+			f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+			Expect(err).ToNot(HaveOccurred())
+			// Change the hole and two consecutive blocks
+			for _, offset := range []int64{0, 3 * 4096, 4 * 4096} {
+				_, err = f.WriteAt([]byte{1, 2, 3, 4}, offset)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(f.Close()).To(Succeed())
+			opts = BlockRsyncOptions{
+				BlockSize: 4096,
+				DryRun:    true,
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		expectReport := func(report *DiffReport) {
+			Expect(report).ToNot(BeNil())
+			Expect(report.Source).To(Equal(sourceFile))
+			Expect(report.ChangedBlocks).To(Equal(int64(3)))
+			Expect(report.HoleBlocks).To(Equal(int64(1)))
+			Expect(report.ChangedBytes).To(Equal(int64(2 * 4096)))
+			Expect(report.ChangedExtents).To(Equal([]Extent{{Offset: 0, Length: 4096}, {Offset: 3 * 4096, Length: 2 * 4096}}))
+		}
+
+		It("should report differences without writing to the target", func() {
+			before, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("server"))
+			go func() {
+				defer GinkgoRecover()
+				Expect(server.StartServer()).To(Succeed())
+			}()
+			client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(client.Results()).To(HaveLen(1))
+			expectReport(client.Results()[0].Report)
+			after, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(before, after)).To(BeTrue())
+		})
+
+		It("should not stage the target or record an undo log in a dry run", func() {
+			before, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			// The undo log of an earlier sync does not stop a dry run
+			undoLog := filepath.Join(tmpDir, "undo.log")
+			Expect(os.WriteFile(undoLog, []byte("earlier sync"), 0600)).To(Succeed())
+			server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{
+				BlockSize:     4096,
+				AtomicReplace: true,
+				UndoLog:       undoLog,
+			}, GinkgoLogr.WithName("server"))
+			done := make(chan error, 1)
+			go func() {
+				done <- server.StartServer()
+			}()
+			client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-done).To(Succeed())
+			expectReport(client.Results()[0].Report)
+			Expect(os.ReadFile(undoLog)).To(Equal([]byte("earlier sync")))
+			entries, err := os.ReadDir(tmpDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(3))
+			after, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(before, after)).To(BeTrue())
+		})
+
+		It("should allow dry runs against read-only modules", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			port := listener.Addr().(*net.TCPAddr).Port
+			daemon := NewBlockrsyncDaemon(&DaemonConfig{
+				Modules: []Module{{Name: "readonly", Path: targetFile, ReadOnly: true}},
+			}, port, &BlockRsyncOptions{}, GinkgoLogr.WithName("daemon"))
+			go func() {
+				defer GinkgoRecover()
+				Expect(daemon.Serve(listener)).To(Succeed())
+			}()
+			opts.Module = "readonly"
+			client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			Expect(client.ConnectToTarget()).To(Succeed())
+			report := client.Results()[0].Report
+			expectReport(report)
+			Expect(report.Module).To(Equal("readonly"))
+		})
+
+		It("should report differences in local mode", func() {
+			before, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			localSync := NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local"))
+			Expect(localSync.Sync()).To(Succeed())
+			expectReport(localSync.Report())
+			after, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(before, after)).To(BeTrue())
+		})
+	})
+})
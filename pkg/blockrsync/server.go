@@ -1,118 +1,416 @@
 package blockrsync
 
 import (
-	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
 
 	"github.com/go-logr/logr"
 	"github.com/golang/snappy"
 )
 
+const (
+	// PreallocationSparse deallocates holes, punching holes in files and
+	// discarding block devices when discarded data reads as zeros
+	PreallocationSparse = "sparse"
+	// PreallocationFallocate keeps holes allocated, without writing the zeros
+	PreallocationFallocate = "fallocate"
+	// PreallocationFull writes zeros to holes
+	PreallocationFull = "full"
+)
+
 type BlockRsyncOptions struct {
+	// Preallocation writes zeros to holes, the same as PreallocationFull
 	Preallocation bool
-	BlockSize     int
+	// PreallocationMode is how holes are written, sparse, fallocate or full
+	PreallocationMode string
+	BlockSize         int
+	// Module to sync to when the target is running in daemon mode, source only
+	Module string
+	// DryRun only reports the differences, without writing to the target
+	DryRun bool
+	// ListenAddress overrides the tcp port to listen on, for instance
+	// unix:///run/brs.sock, vsock://:9000 or https://:8443/path, target and daemon only
+	ListenAddress string
+	// TLSCertFile and TLSKeyFile are used when listening on https
+	TLSCertFile string
+	TLSKeyFile  string
+	// CACertFile verifies the certificate of an https target, source only
+	CACertFile string
+	// SourceFormat is the image format of the source, raw, qcow2 or auto to detect
+	// it, the virtual disk of the image is synced
+	SourceFormat string
+	// TargetFormat is the image format of the target, raw, qcow2 or auto to detect
+	// the format of an existing target
+	TargetFormat string
+	// OverlayFile is a new qcow2 image the changes are written to instead of the
+	// target, with the target as its backing file
+	OverlayFile string
+	// SizePolicy is how a target with a different size than the source is
+	// handled, a comma separated list of grow, shrink and zero-tail, or fail
+	SizePolicy string
+	// AtomicReplace writes the blocks to a staging copy of a file target, that
+	// replaces the target once the sync completes
+	AtomicReplace bool
+	// VerifyCommand is run before the staging file replaces the target, with the
+	// BLOCKRSYNC_STAGING_FILE and BLOCKRSYNC_TARGET_FILE environment variables
+	VerifyCommand string
+	// UndoLog records the original content of the blocks that are overwritten in
+	// the target to this file, so the sync can be rolled back
+	UndoLog string
+	// TargetIdentity is checked by the target before any block is written, source
+	// or local only
+	TargetIdentity *TargetIdentity
+	// TargetMarker is written to the target after a successful sync, later syncs
+	// can expect it in the TargetIdentity, source or local only
+	TargetMarker string
+	// Force writes to targets that are mounted or in use by another process
+	Force bool
+	// Cancel stops the sync when it is closed, the sync cleans up and fails with
+	// ErrCancelled
+	Cancel <-chan struct{}
+}
+
+// cancelled returns ErrCancelled once the sync is cancelled.
+func (o *BlockRsyncOptions) cancelled() error {
+	select {
+	case <-o.Cancel:
+		return newError(ErrCancelled, "sync was cancelled")
+	default:
+		return nil
+	}
+}
+
+// cancelError returns ErrCancelled instead of the error once the sync is
+// cancelled, the error is caused by closing the connection.
+func (o *BlockRsyncOptions) cancelError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if cancelErr := o.cancelled(); cancelErr != nil {
+		return cancelErr
+	}
+	return err
+}
+
+// closeOnCancel closes the connection or listener when the sync is cancelled, so
+// blocked reads and accepts return. The returned function stops watching.
+func (o *BlockRsyncOptions) closeOnCancel(c io.Closer) func() {
+	cancel := o.Cancel
+	if cancel == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-cancel:
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// preallocationMode returns how holes are written, Preallocation is the same as
+// full, and sparse is the default.
+func (o *BlockRsyncOptions) preallocationMode() string {
+	if o.PreallocationMode != "" {
+		return o.PreallocationMode
+	}
+	if o.Preallocation {
+		return PreallocationFull
+	}
+	return PreallocationSparse
 }
 
 type BlockrsyncServer struct {
-	targetFile     string
-	targetFileSize int64
-	port           int
-	hasher         Hasher
-	opts           *BlockRsyncOptions
-	log            logr.Logger
+	targetFile         string
+	targetFileSize     int64
+	port               int
+	dryRun             bool
+	converge           bool
+	hasher             Hasher
+	opts               *BlockRsyncOptions
+	log                logr.Logger
+	connectionAcceptor ConnectionAcceptor
+	sizeDecision       *SizeDecision
+	// stagingFile is written instead of the target with atomic replace
+	stagingFile string
+	undo        *undoLog
+	// lock is the advisory lock held on a file target during the sync
+	lock *os.File
+	// marker is written to the target after the sync
+	marker string
+	// forward receives a copy of the blocks written to the file, used when relaying
+	forward io.Writer
 }
 
 func NewBlockrsyncServer(targetFile string, port int, opts *BlockRsyncOptions, logger logr.Logger) *BlockrsyncServer {
-	return &BlockrsyncServer{
+	server := &BlockrsyncServer{
 		targetFile: targetFile,
 		port:       port,
 		opts:       opts,
 		log:        logger,
 		hasher:     NewFileHasher(int64(opts.BlockSize), logger.WithName("hasher")),
+		connectionAcceptor: &NetworkConnectionAcceptor{
+			address: opts.ListenAddress,
+			port:    port,
+			opts:    opts,
+			log:     logger,
+		},
+	}
+	if isHTTPAddress(opts.ListenAddress) {
+		server.connectionAcceptor = &HTTPConnectionAcceptor{
+			address: opts.ListenAddress,
+			opts:    opts,
+			log:     logger,
+		}
 	}
+	return server
+}
+
+// UseConnectionAcceptor replaces the default tcp listener, for instance with a
+// StdioConnection.
+func (b *BlockrsyncServer) UseConnectionAcceptor(acceptor ConnectionAcceptor) {
+	b.connectionAcceptor = acceptor
 }
 
 func (b *BlockrsyncServer) StartServer() error {
-	f, err := os.OpenFile(b.targetFile, os.O_RDWR|os.O_CREATE, 0666)
+	conn, err := b.connectionAcceptor.Accept()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	readyChan := make(chan struct{})
+	defer conn.Close()
+	defer b.opts.closeOnCancel(conn)()
+	return b.opts.cancelError(b.serveSession(conn))
+}
 
+// serveSession syncs the target file for a single session. The target is opened
+// once the request is known, a dry run opens it read-only, without claiming,
+// staging or recording an undo log.
+func (b *BlockrsyncServer) serveSession(conn io.ReadWriter) error {
+	s := newSession(conn)
+	req, err := s.readRequest()
+	if err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	if err := b.validateRequest(req); err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	if err := b.checkIdentity(req.Files[0]); err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	f, err := b.openTargetFile(req.DryRun)
+	if err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	defer b.closeTarget(f)
+	readyChan := b.hashTargetFile()
+	if err := <-readyChan; err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	if err := b.checkSize(f, req.Files[0]); err != nil {
+		_ = s.respond(err)
+		return err
+	}
+	if err := s.respond(nil); err != nil {
+		return err
+	}
+	b.dryRun = req.DryRun
+	b.converge = req.Converge
+	return b.syncFile(s, 0, f)
+}
+
+// hashTargetFile hashes the target file in the background, the returned channel
+// receives the result once hashing is done.
+func (b *BlockrsyncServer) hashTargetFile() <-chan error {
+	readyChan := make(chan error, 1)
+	fileName := b.targetFile
+	if b.stagingFile != "" {
+		// A new target only exists as the staging file
+		fileName = b.stagingFile
+	}
 	go func() {
-		defer func() { readyChan <- struct{}{} }()
-		size, err := b.hasher.HashFile(b.targetFile)
+		size, err := b.hasher.HashFile(fileName)
 		if err != nil {
 			b.log.Error(err, "Failed to hash file")
+			readyChan <- wrapError(ErrTargetIO, err)
 			return
 		}
 		b.targetFileSize = size
-		b.log.Info("Hashed file with size", "filename", b.targetFile, "size", b.targetFileSize)
+		b.log.Info("Hashed file with size", "filename", fileName, "size", b.targetFileSize)
+		readyChan <- nil
 	}()
+	return readyChan
+}
 
-	b.log.Info("Listening for tcp connection", "port", fmt.Sprintf(":%d", b.port))
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", b.port))
-	if err != nil {
-		return err
+func (b *BlockrsyncServer) validateRequest(req *SessionRequest) error {
+	if len(req.Files) != 1 {
+		return fmt.Errorf("%w: requested %d files, server is not running in daemon mode and serves a single file", ErrProtocol, len(req.Files))
 	}
-	conn, err := listener.Accept()
-	if err != nil {
-		return err
+	if req.Files[0].Module != "" {
+		return fmt.Errorf("%w: unknown module %s, server is not running in daemon mode", ErrProtocol, req.Files[0].Module)
 	}
-	defer conn.Close()
-	writer := snappy.NewBufferedWriter(conn)
-	<-readyChan
+	if req.BlockSize != b.hasher.BlockSize() {
+		return fmt.Errorf("%w: block size mismatch, source %d, target %d", ErrProtocol, req.BlockSize, b.hasher.BlockSize())
+	}
+	return nil
+}
 
-	if err := b.writeHashes(writer); err != nil {
-		return err
+// checkSize checks the size of the source in the request against the target
+// before the hashes are sent. Without a size in the request the size is only
+// checked when the blocks are received.
+func (b *BlockrsyncServer) checkSize(f targetFile, file FileRequest) error {
+	if file.Size <= 0 {
+		return nil
 	}
-	b.log.Info("Wrote hashes to client, starting diff reader")
-	reader := bufio.NewReader(snappy.NewReader(conn))
-	if err := b.writeBlocksToFile(f, reader); err != nil {
+	decision, err := b.decideSize(f, file.Size)
+	if err != nil {
 		return err
 	}
+	b.sizeDecision = decision
+	return nil
+}
 
-	if err := f.Sync(); err != nil {
+// syncFile sends the hashes of the target file, and writes the blocks received
+// from the client. The result is reported back to the client.
+func (b *BlockrsyncServer) syncFile(s *session, index int, f targetFile) error {
+	if err := s.writeMessage(&FileStart{Index: index, Size: b.sizeDecision}); err != nil {
+		return abortSession(err)
+	}
+	if err := b.writeHashes(s.writer); err != nil {
+		return abortSession(err)
+	}
+	var err error
+	if b.dryRun {
+		b.log.Info("Wrote hashes to client, dry run so not writing to file")
+	} else {
+		b.log.Info("Wrote hashes to client, starting diff reader")
+		err = b.writeBlocksToFile(f, s.reader)
+		if err == nil {
+			err = wrapError(ErrTargetIO, f.Sync())
+		}
+		if err == nil && !b.converge {
+			err = b.commitTarget()
+		}
+	}
+	if err := writeFileResult(s, index, err); err != nil {
 		return err
 	}
+	if b.converge {
+		return b.convergeRounds(s, index, f)
+	}
 	return nil
 }
 
-func (b *BlockrsyncServer) writeHashes(writer io.WriteCloser) error {
-	defer writer.Close()
+// convergeRounds applies the blocks of the rounds following the first one in a
+// converge session, until the client ends the session.
+func (b *BlockrsyncServer) convergeRounds(s *session, index int, f targetFile) error {
+	for {
+		round := RoundStart{}
+		if err := s.readMessage(&round); err != nil {
+			return err
+		}
+		if round.Done {
+			b.log.Info("Converge session done")
+			return nil
+		}
+		b.log.Info("Starting round", "round", round.Round, "final", round.Final)
+		err := b.writeBlocksToFile(f, s.reader)
+		if err == nil {
+			err = wrapError(ErrTargetIO, f.Sync())
+		}
+		if err == nil && round.Final {
+			err = b.commitTarget()
+		}
+		if err := writeFileResult(s, index, err); err != nil {
+			return err
+		}
+	}
+}
+
+// writeFileResult reports the result of a file to the client, and returns the
+// error of the file, or the error writing the result.
+func writeFileResult(s *session, index int, err error) error {
+	result := FileResult{Index: index}
+	if err != nil {
+		result.Error = err.Error()
+		result.Kind = errorKindName(err)
+		result.Aborted = isSessionAborted(err)
+	}
+	if writeErr := s.writeMessage(&result); writeErr != nil {
+		return abortSession(errors.Join(err, writeErr))
+	}
+	return err
+}
+
+func (b *BlockrsyncServer) writeHashes(writer *snappy.Writer) error {
 	if err := b.hasher.SerializeHashes(writer); err != nil {
-		return err
+		return wrapError(ErrConnection, err)
+	}
+	if err := writer.Flush(); err != nil {
+		return wrapError(ErrConnection, err)
 	}
 	b.log.Info("Wrote hashes to client")
 	return nil
 }
 
-func (b *BlockrsyncServer) writeBlocksToFile(f *os.File, reader io.Reader) error {
+// writeBlocksToFile writes the blocks of a file to the target. If writing to the
+// target fails, the rest of the blocks are read up to the end, so the session
+// can continue with the next file. Errors reading the blocks abort the session.
+func (b *BlockrsyncServer) writeBlocksToFile(f targetFile, reader io.Reader) error {
 	// Read the size of the source file
 	var sourceSize int64
 	if err := binary.Read(reader, binary.LittleEndian, &sourceSize); err != nil {
-		_, err = handleReadError(err, nocallback)
-		return err
+		return abortSession(streamError(err))
 	}
-	b.targetFileSize = max(b.targetFileSize, sourceSize)
-	if err := b.truncateFileIfNeeded(f, sourceSize, b.targetFileSize); err != nil {
-		_, err = handleReadError(err, nocallback)
-		return err
+	blockReader := NewBlockReader(reader, int(b.hasher.BlockSize()), b.log.WithName("block-reader"))
+	blockReader.SetSourceSize(sourceSize)
+	err := b.writeBlocks(f, sourceSize, blockReader)
+	if err != nil && !isSessionAborted(err) {
+		b.log.Info("Failed to write blocks, skipping the remaining blocks", "error", err.Error())
+		if drainErr := drainBlocks(blockReader); drainErr != nil {
+			return abortSession(err)
+		}
 	}
+	return err
+}
 
-	blockReader := NewBlockReader(reader, int(b.hasher.BlockSize()), b.log.WithName("block-reader"))
-	cont := true
-	var err error
-	for cont {
-		cont, err = blockReader.Next()
+func (b *BlockrsyncServer) writeBlocks(f targetFile, sourceSize int64, blockReader *BlockReader) error {
+	if err := b.resizeTarget(f, sourceSize); err != nil {
+		return wrapError(ErrTargetIO, err)
+	}
+	if b.forward != nil {
+		if err := binary.Write(b.forward, binary.LittleEndian, sourceSize); err != nil {
+			return wrapError(ErrConnection, err)
+		}
+	}
+	for {
+		if err := b.opts.cancelled(); err != nil {
+			return abortSession(err)
+		}
+		cont, err := blockReader.Next()
 		if err != nil {
-			// Ignore error
-			return nil
+			return abortSession(streamError(err))
+		}
+		if blockReader.IsEnd() {
+			break
+		}
+		if !cont {
+			// Without the end of the blocks, the source stopped in the middle of the file
+			return abortSession(newError(ErrConnection, "blocks ended before the end of the file"))
+		}
+		if b.forward != nil {
+			if err := forwardBlock(b.forward, blockReader); err != nil {
+				return wrapError(ErrConnection, err)
+			}
 		}
 		if blockReader.IsHole() {
 			if err := b.handleEmptyBlock(blockReader.Offset(), f); err != nil {
@@ -124,53 +422,76 @@ func (b *BlockrsyncServer) writeBlocksToFile(f *os.File, reader io.Reader) error
 			}
 		}
 	}
+	if b.forward != nil {
+		return wrapError(ErrConnection, writeEndOfBlocks(b.forward))
+	}
 	return nil
 }
 
-func (b *BlockrsyncServer) truncateFileIfNeeded(f *os.File, sourceSize, targetSize int64) error {
-	info, err := f.Stat()
-	if err != nil {
-		return err
-	}
-	b.log.V(5).Info("Source size", "size", sourceSize)
-	if info.Mode()&(os.ModeDevice|os.ModeCharDevice) == 0 {
-		// Not a block device, set the file size to the received size
-		b.log.V(3).Info("Setting target file size", "size", targetSize)
-		if err := f.Truncate(sourceSize); err != nil {
+// drainBlocks reads the remaining blocks up to the end of the blocks.
+func drainBlocks(blockReader *BlockReader) error {
+	for {
+		cont, err := blockReader.Next()
+		if err != nil {
 			return err
 		}
-	} else {
-		if targetSize > sourceSize {
-			// empty out existing blocks
-			PunchHole(f, sourceSize, targetSize-sourceSize)
+		if blockReader.IsEnd() {
+			return nil
+		}
+		if !cont {
+			return io.ErrUnexpectedEOF
 		}
 	}
-	return nil
 }
 
-func (b *BlockrsyncServer) handleEmptyBlock(offset int64, f *os.File) error {
-	b.log.V(5).Info("Skipping hole", "offset", offset)
-	emptySize := min(b.targetFileSize-offset, b.hasher.BlockSize())
-	if b.opts.Preallocation {
-		b.log.V(5).Info("Preallocating hole", "offset", offset)
-		preallocBuffer := make([]byte, emptySize)
-		if n, err := f.WriteAt(preallocBuffer, offset); err != nil || int64(n) != emptySize {
-			return err
-		}
-	} else {
-		b.log.V(5).Info("Punching hole", "offset", offset, "size", b.hasher.BlockSize())
-		PunchHole(f, offset, b.hasher.BlockSize())
-	}
-	return nil
+// sessionAbortedError is a failure that leaves the session in an unknown state,
+// like blocks that cannot be read. The session ends instead of continuing with
+// the next file.
+type sessionAbortedError struct {
+	err error
 }
 
-func (b *BlockrsyncServer) writeBlockToOffset(block []byte, offset int64, ws io.WriteSeeker) error {
-	_, err := ws.Seek(offset, io.SeekStart)
-	if err != nil {
+func (e *sessionAbortedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sessionAbortedError) Unwrap() error {
+	return e.err
+}
+
+func abortSession(err error) error {
+	if err == nil || isSessionAborted(err) {
 		return err
 	}
-	if n, err := ws.Write(block); err != nil {
-		return err
+	return &sessionAbortedError{err: err}
+}
+
+func isSessionAborted(err error) bool {
+	var aborted *sessionAbortedError
+	return errors.As(err, &aborted)
+}
+
+func (b *BlockrsyncServer) handleEmptyBlock(offset int64, f targetFile) error {
+	return b.handleEmptyRange(offset, b.hasher.BlockSize(), f)
+}
+
+func (b *BlockrsyncServer) handleEmptyRange(offset, length int64, f targetFile) error {
+	emptySize := min(b.targetFileSize-offset, length)
+	if emptySize <= 0 {
+		return nil
+	}
+	b.log.V(5).Info("Zeroing hole", "offset", offset, "size", emptySize, "preallocation", b.opts.preallocationMode())
+	return wrapError(ErrTargetIO, b.zeroRange(f, offset, emptySize))
+}
+
+func (b *BlockrsyncServer) writeBlockToOffset(block []byte, offset int64, w io.WriterAt) error {
+	if b.undo != nil {
+		if err := b.undo.save(offset, int64(len(block))); err != nil {
+			return wrapError(ErrTargetIO, err)
+		}
+	}
+	if n, err := w.WriteAt(block, offset); err != nil {
+		return wrapError(ErrTargetIO, err)
 	} else {
 		b.log.V(5).Info("Wrote", "bytes", n)
 	}
@@ -0,0 +1,170 @@
+package blockrsync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/awels/blockrsync/pkg/image"
+)
+
+const (
+	// SizePolicyFail fails the sync if the sizes of the source and target differ
+	SizePolicyFail = "fail"
+	// SizePolicyGrow grows file targets that are smaller than the source
+	SizePolicyGrow = "grow"
+	// SizePolicyShrink shrinks file targets that are larger than the source
+	SizePolicyShrink = "shrink"
+	// SizePolicyZeroTail zeroes the part of a device target beyond the size of
+	// the source
+	SizePolicyZeroTail = "zero-tail"
+	// DefaultSizePolicy resizes file targets to the size of the source, and
+	// zeroes the tail of larger devices
+	DefaultSizePolicy = SizePolicyGrow + "," + SizePolicyShrink + "," + SizePolicyZeroTail
+
+	SizeActionNone     = "none"
+	SizeActionGrow     = "grow"
+	SizeActionShrink   = "shrink"
+	SizeActionZeroTail = "zero-tail"
+)
+
+var ErrSizeMismatch = newError(ErrVerification, "size mismatch")
+
+// SizeDecision is how the target is made the size of the source.
+type SizeDecision struct {
+	SourceSize int64  `json:"sourceSize"`
+	TargetSize int64  `json:"targetSize"`
+	Action     string `json:"action"`
+}
+
+type sizePolicy struct {
+	grow     bool
+	shrink   bool
+	zeroTail bool
+}
+
+// ValidateSizePolicy checks a comma separated list of fail, grow, shrink and
+// zero-tail, fail cannot be combined with the others.
+func ValidateSizePolicy(policy string) error {
+	_, err := parseSizePolicy(policy)
+	return err
+}
+
+func parseSizePolicy(policy string) (*sizePolicy, error) {
+	if policy == "" {
+		policy = DefaultSizePolicy
+	}
+	p := &sizePolicy{}
+	for _, value := range strings.Split(policy, ",") {
+		switch strings.TrimSpace(value) {
+		case SizePolicyFail:
+			if policy != SizePolicyFail {
+				return nil, fmt.Errorf("size policy %s cannot be combined with other values", SizePolicyFail)
+			}
+		case SizePolicyGrow:
+			p.grow = true
+		case SizePolicyShrink:
+			p.shrink = true
+		case SizePolicyZeroTail:
+			p.zeroTail = true
+		default:
+			return nil, fmt.Errorf("unknown size policy %q, expected fail, grow, shrink or zero-tail", value)
+		}
+	}
+	return p, nil
+}
+
+// decideSize compares the size of the target with the size of the source, and
+// returns how the target is made the size of the source with the size policy.
+// Devices cannot be resized, a device smaller than the source always fails.
+func (b *BlockrsyncServer) decideSize(f targetFile, sourceSize int64) (*SizeDecision, error) {
+	policy, err := parseSizePolicy(b.opts.SizePolicy)
+	if err != nil {
+		return nil, err
+	}
+	size, err := targetSize(f)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	decision := &SizeDecision{SourceSize: sourceSize, TargetSize: size, Action: SizeActionNone}
+	device := info.Mode()&os.ModeDevice != 0
+	switch {
+	case sourceSize == size:
+		return decision, nil
+	case device && sourceSize > size:
+		return nil, fmt.Errorf("%w: target device size %d is smaller than the source size %d", ErrSizeMismatch, size, sourceSize)
+	case device && policy.zeroTail:
+		decision.Action = SizeActionZeroTail
+	case !device && sourceSize > size && policy.grow:
+		decision.Action = SizeActionGrow
+	case !device && sourceSize < size && policy.shrink:
+		decision.Action = SizeActionShrink
+	default:
+		return nil, fmt.Errorf("%w: source size %d, target size %d, not allowed by size policy %q", ErrSizeMismatch, sourceSize, size, b.opts.SizePolicy)
+	}
+	return decision, nil
+}
+
+// resizeTarget makes the target the size of the source. Files are truncated to
+// the size of the source, and the tail of a larger device is zeroed.
+func (b *BlockrsyncServer) resizeTarget(f targetFile, sourceSize int64) error {
+	decision, err := b.decideSize(f, sourceSize)
+	if err != nil {
+		return err
+	}
+	b.sizeDecision = decision
+	b.log.Info("Target size", "source size", decision.SourceSize, "target size", decision.TargetSize, "action", decision.Action)
+	switch decision.Action {
+	case SizeActionGrow, SizeActionShrink:
+		if b.undo != nil && decision.Action == SizeActionShrink {
+			if err := b.undo.save(sourceSize, decision.TargetSize-sourceSize); err != nil {
+				return err
+			}
+		}
+		if err := f.Truncate(sourceSize); err != nil {
+			return err
+		}
+	case SizeActionZeroTail:
+		b.targetFileSize = decision.TargetSize
+		return b.zeroRange(f, sourceSize, decision.TargetSize-sourceSize)
+	}
+	b.targetFileSize = sourceSize
+	return nil
+}
+
+// SizeDecision returns how the size of the target was handled in the last sync.
+func (b *BlockrsyncServer) SizeDecision() *SizeDecision {
+	return b.sizeDecision
+}
+
+// fileSize returns the size of a file, or of a block device.
+func fileSize(f *os.File) (int64, error) {
+	if isBlockDevice(f) {
+		return blockDeviceSize(f)
+	}
+	return f.Seek(0, io.SeekEnd)
+}
+
+// sourceFileSize returns the size of the virtual disk of the source, it is sent
+// to the target to check the sizes before hashing.
+func sourceFileSize(fileName, format string) (int64, error) {
+	if format == "" || format == image.FormatRaw {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return fileSize(f)
+	}
+	img, err := image.Open(fileName, format)
+	if err != nil {
+		return 0, err
+	}
+	defer img.Close()
+	return img.Size(), nil
+}
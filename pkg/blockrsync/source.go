@@ -0,0 +1,43 @@
+package blockrsync
+
+import (
+	"io"
+
+	"github.com/awels/blockrsync/pkg/image"
+)
+
+// allocationReader is implemented by sources that know which ranges are not
+// allocated, these ranges are not read and sent as holes.
+type allocationReader interface {
+	Allocated(offset, length int64) (bool, error)
+}
+
+// isAllocated returns false only if the reader knows the range is not allocated.
+func isAllocated(r any, offset, length int64) bool {
+	if a, ok := r.(allocationReader); ok {
+		allocated, err := a.Allocated(offset, length)
+		return err != nil || allocated
+	}
+	return true
+}
+
+// imageReadSeeker reads the virtual disk of an image for the hasher.
+type imageReadSeeker struct {
+	*io.SectionReader
+	img image.Image
+}
+
+func newImageReadSeeker(img image.Image) *imageReadSeeker {
+	return &imageReadSeeker{
+		SectionReader: io.NewSectionReader(img, 0, img.Size()),
+		img:           img,
+	}
+}
+
+func (i *imageReadSeeker) Allocated(offset, length int64) (bool, error) {
+	return i.img.Allocated(offset, length)
+}
+
+func (i *imageReadSeeker) Close() error {
+	return i.img.Close()
+}
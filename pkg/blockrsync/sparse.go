@@ -1,26 +1,14 @@
 package blockrsync
 
-import (
-	"errors"
-	"os"
-	"syscall"
-)
+import "errors"
 
 const (
 	FALLOC_FL_KEEP_SIZE  = 0x01 /* default is extend size */
 	FALLOC_FL_PUNCH_HOLE = 0x02 /* de-allocates range */
+	FALLOC_FL_ZERO_RANGE = 0x10 /* zeroes range, keeping it allocated */
 )
 
 var (
 	ErrPunchHoleNotSupported = errors.New("this filesystem does not support punching holes. Use xfs, ext4, btrfs or such")
+	ErrZeroRangeNotSupported = errors.New("this filesystem does not support zeroing ranges. Use xfs, ext4 or such")
 )
-
-func PunchHole(f *os.File, offset, size int64) error {
-	err := syscall.Fallocate(int(f.Fd()), FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, offset, size)
-
-	if err == syscall.ENOTSUP {
-		err = ErrPunchHoleNotSupported
-	}
-
-	return err
-}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package blockrsync
+
+import (
+	"os"
+	"syscall"
+)
+
+func PunchHole(f *os.File, offset, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, offset, size)
+
+	if err == syscall.ENOTSUP {
+		err = ErrPunchHoleNotSupported
+	}
+
+	return err
+}
+
+// AllocateZeroRange makes the range read as zeros while keeping it allocated.
+func AllocateZeroRange(f *os.File, offset, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), FALLOC_FL_KEEP_SIZE|FALLOC_FL_ZERO_RANGE, offset, size)
+
+	if err == syscall.ENOTSUP {
+		err = ErrZeroRangeNotSupported
+	}
+
+	return err
+}
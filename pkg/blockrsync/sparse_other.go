@@ -0,0 +1,14 @@
+//go:build !linux
+
+package blockrsync
+
+import "os"
+
+func PunchHole(f *os.File, offset, size int64) error {
+	return ErrPunchHoleNotSupported
+}
+
+// AllocateZeroRange makes the range read as zeros while keeping it allocated.
+func AllocateZeroRange(f *os.File, offset, size int64) error {
+	return ErrZeroRangeNotSupported
+}
@@ -0,0 +1,226 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+const defaultSSHPort = 22
+
+type SSHOptions struct {
+	User string
+	// Host is host[:port] of the ssh server
+	Host string
+	// IdentityFiles are private keys used to authenticate, defaults to the keys in ~/.ssh
+	IdentityFiles []string
+	// KnownHostsFiles are used to verify the host key, defaults to ~/.ssh/known_hosts
+	KnownHostsFiles []string
+	// Command is run on the remote host, and should start blockrsync with --stdio.
+	// If empty, ForwardAddress is used instead.
+	Command string
+	// ForwardAddress is the address of a running blockrsync target or daemon the
+	// ssh server connects to, either host:port or unix:///path
+	ForwardAddress string
+}
+
+// SSHConnectionProvider connects to the target over ssh, either by running the
+// remote blockrsync in stdio mode, or by forwarding a connection to a running
+// target through the ssh server.
+type SSHConnectionProvider struct {
+	opts *SSHOptions
+	port int
+	log  logr.Logger
+}
+
+func NewSSHConnectionProvider(opts *SSHOptions, port int, logger logr.Logger) *SSHConnectionProvider {
+	return &SSHConnectionProvider{
+		opts: opts,
+		port: port,
+		log:  logger,
+	}
+}
+
+func (s *SSHConnectionProvider) Connect() (io.ReadWriteCloser, error) {
+	config, closeAgent, err := s.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	host, port, err := net.SplitHostPort(s.opts.Host)
+	if err != nil {
+		host, port = s.opts.Host, strconv.Itoa(defaultSSHPort)
+	}
+	s.log.Info("Connecting to ssh server", "host", host, "port", port, "user", config.User)
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, port), config)
+	if err != nil {
+		return nil, err
+	}
+	var conn io.ReadWriteCloser
+	if s.opts.Command != "" {
+		conn, err = s.runCommand(client)
+	} else {
+		conn, err = s.forward(client)
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *SSHConnectionProvider) clientConfig() (*ssh.ClientConfig, func(), error) {
+	closeAgent := func() {}
+	user := s.opts.User
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	knownHostsFiles := s.opts.KnownHostsFiles
+	if len(knownHostsFiles) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, closeAgent, err
+		}
+		knownHostsFiles = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFiles...)
+	if err != nil {
+		return nil, closeAgent, fmt.Errorf("unable to load known hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err != nil {
+			s.log.Info("Unable to connect to ssh agent", "error", err.Error())
+		} else {
+			closeAgent = func() { conn.Close() }
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	signers, err := s.loadIdentities()
+	if err != nil {
+		closeAgent()
+		return nil, func() {}, err
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if len(auth) == 0 {
+		return nil, closeAgent, errors.New("no ssh agent or identity files available")
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}, closeAgent, nil
+}
+
+// loadIdentities loads the configured identity files, or the default keys that
+// exist in ~/.ssh.
+func (s *SSHConnectionProvider) loadIdentities() ([]ssh.Signer, error) {
+	files := s.opts.IdentityFiles
+	explicit := len(files) > 0
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			files = append(files, filepath.Join(home, ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			if !explicit && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse identity %s: %w", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func (s *SSHConnectionProvider) runCommand(client *ssh.Client) (io.ReadWriteCloser, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	session.Stderr = os.Stderr
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("Starting remote command", "command", s.opts.Command)
+	if err := session.Start(s.opts.Command); err != nil {
+		return nil, err
+	}
+	return &sshConnection{
+		Reader: stdout,
+		Writer: stdin,
+		close: func() error {
+			err := stdin.Close()
+			if waitErr := session.Wait(); waitErr != nil {
+				err = errors.Join(err, fmt.Errorf("remote command %q failed: %w", s.opts.Command, waitErr))
+			}
+			return errors.Join(err, client.Close())
+		},
+	}, nil
+}
+
+func (s *SSHConnectionProvider) forward(client *ssh.Client) (io.ReadWriteCloser, error) {
+	address, err := transport.ParseAddress(s.opts.ForwardAddress, s.port)
+	if err != nil {
+		return nil, err
+	}
+	if address.Network == transport.NetworkVsock {
+		return nil, errors.New("vsock addresses cannot be forwarded over ssh")
+	}
+	dialAddress := address.String()
+	if address.Network == transport.NetworkUnix {
+		dialAddress = address.Host
+	}
+	s.log.Info("Forwarding connection over ssh", "address", address.String())
+	conn, err := client.Dial(address.Network, dialAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &sshConnection{
+		Reader: conn,
+		Writer: conn,
+		close: func() error {
+			return errors.Join(conn.Close(), client.Close())
+		},
+	}, nil
+}
+
+type sshConnection struct {
+	io.Reader
+	io.Writer
+	close func() error
+}
+
+func (c *sshConnection) Close() error {
+	return c.close()
+}
@@ -0,0 +1,219 @@
+package blockrsync
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var _ = Describe("ssh transport tests", func() {
+	var (
+		tmpDir       string
+		sourceFile   string
+		targetFile   string
+		identityFile string
+		knownHosts   string
+		listener     net.Listener
+		sshOpts      *SSHOptions
+		opts         BlockRsyncOptions
+		hostKey      ssh.Signer
+		userKey      ssh.Signer
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-ssh")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		targetFile = createTestFile(tmpDir, "target.raw", 10*4096, 2)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+		if socket, ok := os.LookupEnv("SSH_AUTH_SOCK"); ok {
+			os.Unsetenv("SSH_AUTH_SOCK")
+			DeferCleanup(os.Setenv, "SSH_AUTH_SOCK", socket)
+		}
+
+		hostKey = generateSigner()
+		var userPrivate ed25519.PrivateKey
+		userKey, userPrivate = generateSignerWithKey()
+		block, err := ssh.MarshalPrivateKey(userPrivate, "")
+		Expect(err).ToNot(HaveOccurred())
+		identityFile = filepath.Join(tmpDir, "id_ed25519")
+		Expect(os.WriteFile(identityFile, pem.EncodeToMemory(block), 0600)).To(Succeed())
+
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		knownHosts = filepath.Join(tmpDir, "known_hosts")
+		line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostKey.PublicKey())
+		Expect(os.WriteFile(knownHosts, []byte(line+"\n"), 0600)).To(Succeed())
+
+		sshOpts = &SSHOptions{
+			User:            "test",
+			Host:            listener.Addr().String(),
+			IdentityFiles:   []string{identityFile},
+			KnownHostsFiles: []string{knownHosts},
+		}
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should sync by running blockrsync on the remote host", func() {
+		go serveSSH(listener, hostKey, userKey.PublicKey(), func(command string, channel ssh.Channel) uint32 {
+			defer GinkgoRecover()
+			Expect(command).To(Equal("blockrsync --target --stdio " + targetFile))
+			server := NewBlockrsyncServer(targetFile, 0, &opts, GinkgoLogr.WithName("server"))
+			// Hide Close, the channel is closed after sending the exit status
+			server.UseConnectionAcceptor(&StdioConnection{Reader: channel, Writer: struct{ io.Writer }{channel}})
+			if err := server.StartServer(); err != nil {
+				return 1
+			}
+			return 0
+		})
+		sshOpts.Command = "blockrsync --target --stdio " + targetFile
+		client := NewBlockrsyncClient(sourceFile, "", 0, &opts, GinkgoLogr.WithName("client"))
+		client.UseConnectionProvider(NewSSHConnectionProvider(sshOpts, 0, GinkgoLogr.WithName("ssh")))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should sync by forwarding a connection to a running target", func() {
+		go serveSSH(listener, hostKey, userKey.PublicKey(), nil)
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.StartServer()).To(Succeed())
+		}()
+		sshOpts.ForwardAddress = "localhost"
+		client := NewBlockrsyncClient(sourceFile, "", 0, &opts, GinkgoLogr.WithName("client"))
+		client.UseConnectionProvider(NewSSHConnectionProvider(sshOpts, port, GinkgoLogr.WithName("ssh")))
+		Eventually(func() error {
+			return client.ConnectToTarget()
+		}, "10s", "100ms").Should(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should refuse a host key that does not match known hosts", func() {
+		go serveSSH(listener, generateSigner(), userKey.PublicKey(), nil)
+		sshOpts.Command = "blockrsync --target --stdio " + targetFile
+		_, err := NewSSHConnectionProvider(sshOpts, 0, GinkgoLogr.WithName("ssh")).Connect()
+		Expect(err).To(MatchError(ContainSubstring("key mismatch")))
+	})
+
+	It("should fail with an unknown identity", func() {
+		go serveSSH(listener, hostKey, generateSigner().PublicKey(), nil)
+		sshOpts.Command = "blockrsync --target --stdio " + targetFile
+		_, err := NewSSHConnectionProvider(sshOpts, 0, GinkgoLogr.WithName("ssh")).Connect()
+		Expect(err).To(MatchError(ContainSubstring("unable to authenticate")))
+	})
+})
+
+func generateSignerWithKey() (ssh.Signer, ed25519.PrivateKey) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(private)
+	Expect(err).ToNot(HaveOccurred())
+	return signer, private
+}
+
+func generateSigner() ssh.Signer {
+	signer, _ := generateSignerWithKey()
+	return signer
+}
+
+// serveSSH accepts ssh connections until the listener is closed, exec requests
+// are passed to the handler, and direct-tcpip channels are forwarded.
+func serveSSH(listener net.Listener, hostKey ssh.Signer, userKey ssh.PublicKey, handler func(string, ssh.Channel) uint32) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(userKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handleSSHConnection(conn, config, handler)
+	}
+}
+
+func handleSSHConnection(conn net.Conn, config *ssh.ServerConfig, handler func(string, ssh.Channel) uint32) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, channelRequests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for req := range channelRequests {
+					if req.Type != "exec" {
+						_ = req.Reply(false, nil)
+						continue
+					}
+					payload := struct{ Command string }{}
+					_ = ssh.Unmarshal(req.Payload, &payload)
+					_ = req.Reply(true, nil)
+					status := handler(payload.Command, channel)
+					_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+					channel.Close()
+				}
+			}()
+		case "direct-tcpip":
+			payload := struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}{}
+			_ = ssh.Unmarshal(newChannel.ExtraData(), &payload)
+			target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+			if err != nil {
+				_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			channel, channelRequests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(channelRequests)
+			go func() {
+				_, _ = io.Copy(target, channel)
+				target.Close()
+			}()
+			go func() {
+				_, _ = io.Copy(channel, target)
+				channel.Close()
+			}()
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// createStagingFile creates a copy of the target in the same directory, the
+// blocks are written to the copy, and it replaces the target once the sync
+// completes. The copy is a reflink if the filesystem supports it.
+func (b *BlockrsyncServer) createStagingFile() (string, error) {
+	info, err := os.Stat(b.targetFile)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if exists && !info.Mode().IsRegular() {
+		return "", fmt.Errorf("atomic replace needs a regular file target, %s is not", b.targetFile)
+	}
+	staging, err := os.CreateTemp(filepath.Dir(b.targetFile), "."+filepath.Base(b.targetFile)+".staging-*")
+	if err != nil {
+		return "", err
+	}
+	defer staging.Close()
+	b.stagingFile = staging.Name()
+	mode := os.FileMode(0644)
+	if exists {
+		mode = info.Mode().Perm()
+		if err := b.copyToStaging(staging); err != nil {
+			b.removeStagingFile()
+			return "", err
+		}
+	}
+	if err := staging.Chmod(mode); err != nil {
+		b.removeStagingFile()
+		return "", err
+	}
+	return b.stagingFile, nil
+}
+
+func (b *BlockrsyncServer) copyToStaging(staging *os.File) error {
+	f, err := os.Open(b.targetFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = cloneFile(staging, f)
+	if err == nil {
+		b.log.Info("Cloned target to staging file", "staging file", staging.Name())
+		return nil
+	}
+	b.log.V(3).Info("Unable to clone target, copying", "error", err.Error())
+	// Empty blocks are skipped, so the copy stays sparse
+	buf := make([]byte, max(b.hasher.BlockSize(), DefaultBlockSize))
+	size := int64(0)
+	for {
+		n, err := f.ReadAt(buf, size)
+		if n > 0 && !isEmptyBlock(buf[:n]) {
+			if _, err := staging.WriteAt(buf[:n], size); err != nil {
+				return err
+			}
+		}
+		size += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	b.log.Info("Copied target to staging file", "staging file", staging.Name(), "size", size)
+	return staging.Truncate(size)
+}
+
+// commitTarget replaces the target with the staging file after the blocks are
+// written and synced. The verify command is run first, and the target is not
+// replaced if it fails. The marker is written to the target once it is complete.
+func (b *BlockrsyncServer) commitTarget() error {
+	if b.stagingFile == "" {
+		return wrapError(ErrTargetIO, b.writeMarker())
+	}
+	if b.opts.VerifyCommand != "" {
+		b.log.Info("Verifying staging file", "staging file", b.stagingFile)
+		if err := runHook(b.opts.VerifyCommand, "BLOCKRSYNC_STAGING_FILE="+b.stagingFile, "BLOCKRSYNC_TARGET_FILE="+b.targetFile); err != nil {
+			return fmt.Errorf("%w: verify command failed, target not replaced: %w", ErrVerification, err)
+		}
+	}
+	if err := os.Rename(b.stagingFile, b.targetFile); err != nil {
+		return wrapError(ErrTargetIO, err)
+	}
+	b.log.Info("Replaced target with staging file", "target", b.targetFile)
+	b.stagingFile = ""
+	if err := syncDir(filepath.Dir(b.targetFile)); err != nil {
+		return wrapError(ErrTargetIO, err)
+	}
+	return wrapError(ErrTargetIO, b.writeMarker())
+}
+
+// closeTarget closes the target, and removes the staging file if the target was
+// not replaced.
+func (b *BlockrsyncServer) closeTarget(f targetFile) error {
+	err := f.Close()
+	b.removeStagingFile()
+	if b.undo != nil {
+		err = errors.Join(err, b.undo.close())
+		b.undo = nil
+	}
+	return errors.Join(err, b.releaseTarget())
+}
+
+func (b *BlockrsyncServer) removeStagingFile() {
+	if b.stagingFile == "" {
+		return
+	}
+	b.log.Info("Removing staging file, target not replaced", "staging file", b.stagingFile)
+	if err := os.Remove(b.stagingFile); err != nil {
+		b.log.Error(err, "Unable to remove staging file", "staging file", b.stagingFile)
+	}
+	b.stagingFile = ""
+}
+
+// syncDir makes a rename in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
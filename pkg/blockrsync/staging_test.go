@@ -0,0 +1,113 @@
+package blockrsync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("atomic replace tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		targetFile string
+		opts       BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-staging")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		targetFile = createTestFile(tmpDir, "target.raw", 16*4096, 2)
+		opts = BlockRsyncOptions{
+			BlockSize:     4096,
+			AtomicReplace: true,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	expectNoStagingFiles := func() {
+		entries, err := os.ReadDir(tmpDir)
+		Expect(err).ToNot(HaveOccurred())
+		for _, entry := range entries {
+			Expect(entry.Name()).ToNot(ContainSubstring("staging"))
+		}
+	}
+
+	It("should replace the target with the synced staging file", func() {
+		before, err := os.Stat(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+		after, err := os.Stat(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.SameFile(before, after)).To(BeFalse())
+		Expect(after.Mode().Perm()).To(Equal(before.Mode().Perm()))
+		expectNoStagingFiles()
+	})
+
+	It("should create a missing target", func() {
+		newTarget := filepath.Join(tmpDir, "new.raw")
+		Expect(NewLocalSync(sourceFile, newTarget, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameContent(sourceFile, newTarget)
+		expectNoStagingFiles()
+	})
+
+	It("should run the verify command with the staging file", func() {
+		opts.VerifyCommand = `cmp "$BLOCKRSYNC_STAGING_FILE" ` + sourceFile + ` && test "$BLOCKRSYNC_TARGET_FILE" = ` + targetFile
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should not replace the target if the verify command fails", func() {
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		opts.VerifyCommand = "exit 1"
+		err = NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()
+		Expect(err).To(MatchError(ContainSubstring("verify command failed")))
+		actual, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+		expectNoStagingFiles()
+	})
+
+	It("should leave the target unchanged if the sync is interrupted", func() {
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		diff := newRBDDiffBuilder(1).size(16*4096).data(0, bytes.Repeat([]byte{7}, 4096)).Bytes()
+		_, err = ApplyRBDDiff(bytes.NewReader(diff), targetFile, &opts, GinkgoLogr.WithName("apply"))
+		Expect(err).To(MatchError(ErrInvalidRBDDiff))
+		actual, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+		expectNoStagingFiles()
+	})
+
+	It("should replace the target after a sync over the network", func() {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+		expectNoStagingFiles()
+	})
+
+	It("should refuse a target that is not a regular file", func() {
+		server := NewBlockrsyncServer(tmpDir, 0, &opts, GinkgoLogr.WithName("server"))
+		_, err := server.openTargetFile(false)
+		Expect(err).To(MatchError(ContainSubstring("regular file")))
+	})
+})
@@ -0,0 +1,214 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/awels/blockrsync/pkg/image"
+)
+
+// targetFile is what the received blocks are written to, a raw file or block
+// device, or the virtual disk of an image.
+type targetFile interface {
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// openTargetFile opens the target in the target format, and hashes it in that
+// format. With auto, the format of an existing target is detected, and new
+// targets are raw. In dry run mode the target is only read. With an overlay file
+// the target is only read, and the overlay is written. With atomic replace a
+// staging copy of the target is written.
+func (b *BlockrsyncServer) openTargetFile(readOnly bool) (targetFile, error) {
+	f, err := b.openTarget(readOnly)
+	if err != nil {
+		return nil, wrapError(ErrTargetIO, err)
+	}
+	return f, nil
+}
+
+func (b *BlockrsyncServer) openTarget(readOnly bool) (targetFile, error) {
+	format, err := b.targetFormat()
+	if err != nil {
+		return nil, err
+	}
+	b.hasher = NewImageHasher(b.hasher.BlockSize(), format, b.log.WithName("hasher"))
+	b.log.Info("Opening target", "file", b.targetFile, "format", format)
+	if readOnly {
+		return os.Open(b.targetFile)
+	}
+	if b.opts.OverlayFile != "" {
+		return b.createOverlay(format)
+	}
+	switch format {
+	case image.FormatRaw, image.FormatQcow2:
+	default:
+		return nil, fmt.Errorf("writing %s targets is not supported", format)
+	}
+	if err := b.claimTarget(); err != nil {
+		return nil, err
+	}
+	fileName := b.targetFile
+	if b.opts.AtomicReplace {
+		if fileName, err = b.createStagingFile(); err != nil {
+			b.releaseTarget()
+			return nil, err
+		}
+	}
+	f, err := openWritable(fileName, format, !b.opts.Force)
+	if err != nil {
+		b.removeStagingFile()
+		b.releaseTarget()
+		return nil, err
+	}
+	if b.opts.UndoLog != "" {
+		if err := b.startUndoLog(f, format); err != nil {
+			f.Close()
+			b.removeStagingFile()
+			b.releaseTarget()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// openWritable opens or creates the target, block devices are opened
+// exclusively unless forced.
+func openWritable(fileName, format string, exclusive bool) (targetFile, error) {
+	if format == image.FormatRaw {
+		if info, err := os.Stat(fileName); exclusive && err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0 {
+			return openExclusive(fileName)
+		}
+		return os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
+	}
+	if info, err := os.Stat(fileName); err == nil && info.Size() > 0 {
+		return image.OpenWritable(fileName, format)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return image.Create(fileName, format, 0)
+}
+
+// createOverlay creates the overlay file with the target as the baseline, blocks
+// that are not sent are read from the target.
+func (b *BlockrsyncServer) createOverlay(format string) (targetFile, error) {
+	baseline, err := image.Open(b.targetFile, format)
+	if err != nil {
+		return nil, err
+	}
+	size := baseline.Size()
+	if err := baseline.Close(); err != nil {
+		return nil, err
+	}
+	backingFile, err := filepath.Abs(b.targetFile)
+	if err != nil {
+		return nil, err
+	}
+	b.log.Info("Writing changes to overlay", "overlay", b.opts.OverlayFile, "backing file", backingFile)
+	return image.CreateOverlay(b.opts.OverlayFile, backingFile, format, size)
+}
+
+func (b *BlockrsyncServer) targetFormat() (string, error) {
+	switch b.opts.TargetFormat {
+	case "", image.FormatRaw:
+		return image.FormatRaw, nil
+	case image.FormatAuto:
+		format, err := image.DetectFormat(b.targetFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			return image.FormatRaw, nil
+		}
+		return format, err
+	default:
+		return b.opts.TargetFormat, nil
+	}
+}
+
+// targetSize returns the size of the target, the virtual size of an image.
+func targetSize(f targetFile) (int64, error) {
+	if img, ok := f.(image.Image); ok {
+		return img.Size(), nil
+	}
+	if file, ok := f.(*os.File); ok {
+		return fileSize(file)
+	}
+	if seeker, ok := f.(io.Seeker); ok {
+		return seeker.Seek(0, io.SeekEnd)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// zeroRange makes the range of the target read as zeros with the preallocation
+// mode. Images deallocate the range. Files punch a hole or zero the range with
+// fallocate, and block devices are discarded or zeroed out. If that fails zeros
+// are written.
+func (b *BlockrsyncServer) zeroRange(f targetFile, offset, length int64) error {
+	if b.undo != nil {
+		if err := b.undo.save(offset, length); err != nil {
+			return err
+		}
+	}
+	mode := b.opts.preallocationMode()
+	if mode != PreallocationFull {
+		var err error
+		switch t := f.(type) {
+		case image.WritableImage:
+			return t.Zero(offset, length)
+		case *os.File:
+			if isBlockDevice(t) {
+				err = zeroBlockDevice(t, offset, length, mode)
+			} else if mode == PreallocationSparse {
+				err = PunchHole(t, offset, length)
+			} else {
+				err = AllocateZeroRange(t, offset, length)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		b.log.V(3).Info("Unable to zero range, writing zeros", "offset", offset, "size", length, "error", err.Error())
+	}
+	return writeZeros(f, offset, length, b.hasher.BlockSize())
+}
+
+// zeroBlockDevice discards the range in sparse mode if discarded data reads as
+// zeros, otherwise the device writes the zeros.
+func zeroBlockDevice(f *os.File, offset, length int64, mode string) error {
+	if mode == PreallocationSparse && discardZeroesData(f) {
+		if err := discardBlockDevice(f, offset, length); err == nil {
+			return nil
+		}
+	}
+	return zeroOutBlockDevice(f, offset, length)
+}
+
+func writeZeros(w io.WriterAt, offset, length, bufferSize int64) error {
+	zeros := make([]byte, min(length, bufferSize))
+	for done := int64(0); done < length; {
+		chunk := zeros[:min(int64(len(zeros)), length-done)]
+		n, err := w.WriteAt(chunk, offset+done)
+		if err != nil {
+			return err
+		}
+		if n != len(chunk) {
+			return io.ErrShortWrite
+		}
+		done += int64(n)
+	}
+	return nil
+}
+
+func isBlockDevice(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+}
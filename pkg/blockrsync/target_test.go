@@ -0,0 +1,174 @@
+package blockrsync
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("target tests", func() {
+	var (
+		tmpDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-target")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	allocatedBlocks := func(fileName string) int64 {
+		info, err := os.Stat(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		return info.Sys().(*syscall.Stat_t).Blocks
+	}
+
+	DescribeTable("should zero a range of a file", func(mode string, deallocates bool) {
+		targetFile := createTestFile(tmpDir, "target.raw", 16*4096, 2)
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		copy(expected[4*4096:8*4096], make([]byte, 4*4096))
+		before := allocatedBlocks(targetFile)
+
+		server := NewBlockrsyncServer(targetFile, 0, &BlockRsyncOptions{BlockSize: 4096, PreallocationMode: mode}, GinkgoLogr.WithName("server"))
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.zeroRange(f, 4*4096, 4*4096)).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+
+		actual, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+		if deallocates {
+			Expect(allocatedBlocks(targetFile)).To(BeNumerically("<", before))
+		} else {
+			Expect(allocatedBlocks(targetFile)).To(Equal(before))
+		}
+	},
+		Entry("sparse", PreallocationSparse, true),
+		Entry("fallocate", PreallocationFallocate, false),
+		Entry("full", PreallocationFull, false),
+	)
+
+	DescribeTable("should return the preallocation mode", func(opts BlockRsyncOptions, expected string) {
+		Expect(opts.preallocationMode()).To(Equal(expected))
+	},
+		Entry("default", BlockRsyncOptions{}, PreallocationSparse),
+		Entry("preallocate", BlockRsyncOptions{Preallocation: true}, PreallocationFull),
+		Entry("mode", BlockRsyncOptions{PreallocationMode: PreallocationFallocate}, PreallocationFallocate),
+		Entry("mode overrides preallocate", BlockRsyncOptions{Preallocation: true, PreallocationMode: PreallocationSparse}, PreallocationSparse),
+	)
+})
+
+var _ = Describe("size policy tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		opts       BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-size")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 8*4096, 1)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	DescribeTable("should validate the size policy", func(policy string, valid bool) {
+		if valid {
+			Expect(ValidateSizePolicy(policy)).To(Succeed())
+		} else {
+			Expect(ValidateSizePolicy(policy)).ToNot(Succeed())
+		}
+	},
+		Entry("default", "", true),
+		Entry("fail", SizePolicyFail, true),
+		Entry("grow and shrink", "grow,shrink", true),
+		Entry("zero-tail", SizePolicyZeroTail, true),
+		Entry("fail combined", "fail,grow", false),
+		Entry("unknown", "truncate", false),
+	)
+
+	DescribeTable("should handle the size of a file target", func(policy string, targetSize int64, action string) {
+		opts.SizePolicy = policy
+		targetFile := createTestFile(tmpDir, "target.raw", targetSize, 2)
+		localSync := NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local"))
+		Expect(localSync.Sync()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+		Expect(localSync.SizeDecision()).To(Equal(&SizeDecision{SourceSize: 8 * 4096, TargetSize: targetSize, Action: action}))
+	},
+		Entry("same size", SizePolicyFail, int64(8*4096), SizeActionNone),
+		Entry("grow", "", int64(4*4096), SizeActionGrow),
+		Entry("shrink", "", int64(12*4096), SizeActionShrink),
+		Entry("grow only", SizePolicyGrow, int64(4*4096), SizeActionGrow),
+	)
+
+	DescribeTable("should refuse a size not allowed by the policy, without changing the target", func(policy string, targetSize int64) {
+		opts.SizePolicy = policy
+		targetFile := createTestFile(tmpDir, "target.raw", targetSize, 2)
+		before, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		err = NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()
+		Expect(err).To(MatchError(ErrSizeMismatch))
+		after, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(before, after)).To(BeTrue())
+	},
+		Entry("fail on larger", SizePolicyFail, int64(12*4096)),
+		Entry("fail on smaller", SizePolicyFail, int64(4*4096)),
+		Entry("grow only on larger", SizePolicyGrow, int64(12*4096)),
+		Entry("shrink only on smaller", SizePolicyShrink, int64(4*4096)),
+		Entry("zero-tail on a file", SizePolicyZeroTail, int64(12*4096)),
+	)
+
+	It("should report the size decision of the target in the results", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 12*4096, 2)
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.StartServer()).To(Succeed())
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+		Expect(client.Results()).To(HaveLen(1))
+		Expect(client.Results()[0].Size).To(Equal(&SizeDecision{SourceSize: 8 * 4096, TargetSize: 12 * 4096, Action: SizeActionShrink}))
+	})
+
+	It("should reject the session before sending the hashes if the policy does not allow the size", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 12*4096, 2)
+		targetOpts := opts
+		targetOpts.SizePolicy = SizePolicyFail
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &targetOpts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+		err = client.ConnectToTarget()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("size mismatch"))
+		Expect(<-done).To(MatchError(ErrSizeMismatch))
+		info, err := os.Stat(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(Equal(int64(12 * 4096)))
+	})
+})
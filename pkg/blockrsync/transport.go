@@ -0,0 +1,137 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+// ConnectionAcceptor is the server side of a ConnectionProvider, it waits for a
+// single client connection.
+type ConnectionAcceptor interface {
+	Accept() (io.ReadWriteCloser, error)
+}
+
+type NetworkConnectionAcceptor struct {
+	address string
+	port    int
+	opts    *BlockRsyncOptions
+	log     logr.Logger
+}
+
+func (n *NetworkConnectionAcceptor) Accept() (io.ReadWriteCloser, error) {
+	listener, err := listen(n.address, n.port, n.log)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	defer n.opts.closeOnCancel(listener)()
+	conn, err := listener.Accept()
+	return conn, n.opts.cancelError(err)
+}
+
+// listen listens on the address, or on all interfaces on the port if the
+// address is empty.
+func listen(address string, port int, log logr.Logger) (net.Listener, error) {
+	addr, err := transport.ParseAddress(address, port)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Listening for connection", "address", addr.String())
+	return transport.Listen(addr)
+}
+
+// StdioConnection uses a reader and a writer, normally stdin and stdout, as the
+// connection. This allows running the target or source over any pipe, for
+// instance ssh or kubectl exec. It can be used as both a ConnectionProvider and a
+// ConnectionAcceptor.
+type StdioConnection struct {
+	io.Reader
+	io.Writer
+}
+
+func NewStdioConnection() *StdioConnection {
+	return &StdioConnection{
+		Reader: os.Stdin,
+		Writer: os.Stdout,
+	}
+}
+
+func (s *StdioConnection) Connect() (io.ReadWriteCloser, error) {
+	return s, nil
+}
+
+func (s *StdioConnection) Accept() (io.ReadWriteCloser, error) {
+	return s, nil
+}
+
+// Close closes the writer so the other side sees the end of the stream.
+func (s *StdioConnection) Close() error {
+	if closer, ok := s.Writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// CommandConnectionProvider runs a command, and uses its stdin and stdout as the
+// connection. The command is run with sh -c, for instance
+// "ssh host blockrsync --target --stdio /dev/vdb".
+type CommandConnectionProvider struct {
+	command string
+	log     logr.Logger
+}
+
+func NewCommandConnectionProvider(command string, logger logr.Logger) *CommandConnectionProvider {
+	return &CommandConnectionProvider{
+		command: command,
+		log:     logger,
+	}
+}
+
+func (c *CommandConnectionProvider) Connect() (io.ReadWriteCloser, error) {
+	cmd := exec.Command("sh", "-c", c.command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.log.Info("Starting command", "command", c.command)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &commandConnection{
+		Reader: stdout,
+		stdin:  stdin,
+		cmd:    cmd,
+	}, nil
+}
+
+type commandConnection struct {
+	io.Reader
+	stdin io.WriteCloser
+	cmd   *exec.Cmd
+}
+
+func (c *commandConnection) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close closes stdin of the command and waits for it to exit.
+func (c *commandConnection) Close() error {
+	err := c.stdin.Close()
+	if waitErr := c.cmd.Wait(); waitErr != nil {
+		err = errors.Join(err, fmt.Errorf("command %q failed: %w", c.cmd.String(), waitErr))
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package blockrsync
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("transport tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		targetFile string
+		opts       BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-transport")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		targetFile = createTestFile(tmpDir, "target.raw", 10*4096, 2)
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should sync over a pair of pipes", func() {
+		clientReader, serverWriter := io.Pipe()
+		serverReader, clientWriter := io.Pipe()
+
+		server := NewBlockrsyncServer(targetFile, 0, &opts, GinkgoLogr.WithName("server"))
+		server.UseConnectionAcceptor(&StdioConnection{Reader: serverReader, Writer: serverWriter})
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		client := NewBlockrsyncClient(sourceFile, "", 0, &opts, GinkgoLogr.WithName("client"))
+		client.UseConnectionProvider(&StdioConnection{Reader: clientReader, Writer: clientWriter})
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should sync over a unix socket", func() {
+		opts.ListenAddress = "unix://" + filepath.Join(tmpDir, "brs.sock")
+		server := NewBlockrsyncServer(targetFile, 0, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		client := NewBlockrsyncClient(sourceFile, opts.ListenAddress, 0, &opts, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should use the stdin and stdout of a command as the connection", func() {
+		provider := NewCommandConnectionProvider("cat", GinkgoLogr.WithName("command"))
+		conn, err := provider.Connect()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = conn.Write([]byte("hello"))
+		Expect(err).ToNot(HaveOccurred())
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(b)).To(Equal("hello"))
+		Expect(conn.Close()).To(Succeed())
+	})
+
+	It("should fail if the command fails", func() {
+		client := NewBlockrsyncClient(sourceFile, "", 0, &opts, GinkgoLogr.WithName("client"))
+		client.UseConnectionProvider(NewCommandConnectionProvider("exit 1", GinkgoLogr.WithName("command")))
+		Expect(client.ConnectToTarget()).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,318 @@
+package blockrsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	undoMagic   = "BRSUNDOL"
+	undoVersion = uint32(1)
+)
+
+var (
+	ErrInvalidUndoLog = errors.New("invalid undo log")
+	// ErrUndoTargetMismatch is an undo log recorded for a different target
+	ErrUndoTargetMismatch = newError(ErrVerification, "undo log was recorded for a different target")
+)
+
+// UndoHeader describes the target an undo log was recorded for. The header is
+// followed by records with the original content of every block of the target
+// before it was first overwritten, an offset, length, crc32 and the data.
+type UndoHeader struct {
+	Target     string `json:"target"`
+	Format     string `json:"format"`
+	TargetSize int64  `json:"targetSize"`
+	BlockSize  int64  `json:"blockSize"`
+}
+
+// undoLog records the original content of the blocks of the target. A block is
+// only recorded the first time it is overwritten, and the record is written to
+// the log before the block is written to the target. The log is created when
+// the first block is recorded.
+type undoLog struct {
+	fileName string
+	f        *os.File
+	w        *bufio.Writer
+	target   io.ReaderAt
+	header   *UndoHeader
+	saved    map[int64]bool
+	buf      []byte
+}
+
+// startUndoLog prepares recording the original content of the target to the
+// undo log. An existing log is never overwritten, it may be needed to roll back
+// an earlier sync.
+func (b *BlockrsyncServer) startUndoLog(f targetFile, format string) error {
+	target, ok := f.(io.ReaderAt)
+	if !ok {
+		return errors.New("undo log needs a readable target")
+	}
+	if _, err := os.Stat(b.opts.UndoLog); err == nil {
+		return fmt.Errorf("undo log %s already exists", b.opts.UndoLog)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	size, err := targetSize(f)
+	if err != nil {
+		return err
+	}
+	path, err := filepath.Abs(b.targetFile)
+	if err != nil {
+		return err
+	}
+	b.undo = &undoLog{
+		fileName: b.opts.UndoLog,
+		target:   target,
+		header: &UndoHeader{
+			Target:     path,
+			Format:     format,
+			TargetSize: size,
+			BlockSize:  b.hasher.BlockSize(),
+		},
+		saved: make(map[int64]bool),
+		buf:   make([]byte, b.hasher.BlockSize()),
+	}
+	b.log.Info("Recording original blocks to undo log", "undo log", b.opts.UndoLog)
+	return nil
+}
+
+func (u *undoLog) create() error {
+	f, err := os.OpenFile(u.fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	u.f = f
+	u.w = bufio.NewWriter(f)
+	b, err := json.Marshal(u.header)
+	if err != nil {
+		return err
+	}
+	if _, err := u.w.WriteString(undoMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(u.w, binary.LittleEndian, undoVersion); err != nil {
+		return err
+	}
+	if err := binary.Write(u.w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err = u.w.Write(b)
+	return err
+}
+
+// save records the original content of the blocks in the range that have not
+// been recorded yet. Ranges beyond the original size of the target have no
+// original content.
+func (u *undoLog) save(offset, length int64) error {
+	if u.f == nil {
+		if err := u.create(); err != nil {
+			return fmt.Errorf("unable to create undo log: %w", err)
+		}
+	}
+	blockSize := u.header.BlockSize
+	for block := offset / blockSize * blockSize; block < offset+length && block < u.header.TargetSize; block += blockSize {
+		if u.saved[block] {
+			continue
+		}
+		data := u.buf[:min(blockSize, u.header.TargetSize-block)]
+		if _, err := u.target.ReadAt(data, block); err != nil && err != io.EOF {
+			return fmt.Errorf("unable to read original block at %d: %w", block, err)
+		}
+		if err := writeUndoRecord(u.w, block, data); err != nil {
+			return err
+		}
+		u.saved[block] = true
+	}
+	if err := u.w.Flush(); err != nil {
+		return err
+	}
+	// The original blocks have to be on disk before they are overwritten
+	return u.f.Sync()
+}
+
+func writeUndoRecord(w io.Writer, offset int64, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, offset); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(data)); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (u *undoLog) close() error {
+	if u.f == nil {
+		return nil
+	}
+	err := u.w.Flush()
+	if err == nil {
+		err = u.f.Sync()
+	}
+	return errors.Join(err, u.f.Close())
+}
+
+func readUndoHeader(r io.Reader) (*UndoHeader, error) {
+	magic := make([]byte, len(undoMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, []byte(undoMagic)) {
+		return nil, fmt.Errorf("%w: missing magic", ErrInvalidUndoLog)
+	}
+	var version, length uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUndoLog, err)
+	}
+	if version != undoVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidUndoLog, version)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUndoLog, err)
+	}
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("%w: header size %d too large", ErrInvalidUndoLog, length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUndoLog, err)
+	}
+	header := &UndoHeader{}
+	if err := json.Unmarshal(b, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUndoLog, err)
+	}
+	if header.BlockSize <= 0 || header.TargetSize < 0 {
+		return nil, fmt.Errorf("%w: invalid block size %d or target size %d", ErrInvalidUndoLog, header.BlockSize, header.TargetSize)
+	}
+	return header, nil
+}
+
+// readUndoRecords calls fn with every record of the log. A record cut short at
+// the end of the log is ignored, the sync was interrupted before its block was
+// overwritten.
+func readUndoRecords(r io.Reader, header *UndoHeader, log logr.Logger, fn func(offset int64, data []byte) error) error {
+	buf := make([]byte, header.BlockSize)
+	recordHeader := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, recordHeader); err == io.EOF {
+			return nil
+		} else if err != nil {
+			log.Info("Ignoring incomplete record at the end of the undo log")
+			return nil
+		}
+		offset := int64(binary.LittleEndian.Uint64(recordHeader))
+		length := int64(binary.LittleEndian.Uint32(recordHeader[8:]))
+		checksum := binary.LittleEndian.Uint32(recordHeader[12:])
+		if offset < 0 || length > header.BlockSize || offset+length > header.TargetSize {
+			return fmt.Errorf("%w: record at %d with length %d outside the target", ErrInvalidUndoLog, offset, length)
+		}
+		data := buf[:length]
+		if _, err := io.ReadFull(r, data); err != nil {
+			log.Info("Ignoring incomplete record at the end of the undo log", "offset", offset)
+			return nil
+		}
+		if crc32.ChecksumIEEE(data) != checksum {
+			return fmt.Errorf("%w: checksum mismatch in record at %d", ErrInvalidUndoLog, offset)
+		}
+		if err := fn(offset, data); err != nil {
+			return err
+		}
+	}
+}
+
+// Rollback verifies the undo log, and then restores the original content of the
+// blocks recorded in it to the target, and the original size of a file target.
+func Rollback(undoFile, targetFile string, opts *BlockRsyncOptions, logger logr.Logger) (*UndoHeader, error) {
+	f, err := os.Open(undoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	header, err := readUndoHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	records := int64(0)
+	if err := readUndoRecords(reader, header, logger, func(int64, []byte) error {
+		records++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info("Verified undo log", "target", header.Target, "records", records)
+	if !samePath(header.Target, targetFile) {
+		if !opts.Force {
+			return nil, fmt.Errorf("%w: recorded for %s, not %s", ErrUndoTargetMismatch, header.Target, targetFile)
+		}
+		logger.Info("Undo log was recorded for a different path, forced to roll back", "recorded target", header.Target, "target", targetFile)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader.Reset(f)
+	if _, err := readUndoHeader(reader); err != nil {
+		return nil, err
+	}
+
+	rollbackOpts := *opts
+	rollbackOpts.BlockSize = int(header.BlockSize)
+	rollbackOpts.TargetFormat = header.Format
+	rollbackOpts.UndoLog = ""
+	rollbackOpts.OverlayFile = ""
+	server := NewBlockrsyncServer(targetFile, 0, &rollbackOpts, logger.WithName("target"))
+	target, err := server.openTargetFile(false)
+	if err != nil {
+		return nil, err
+	}
+	defer server.closeTarget(target)
+	info, err := target.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeDevice == 0 {
+		logger.Info("Restoring target size", "size", header.TargetSize)
+		if err := target.Truncate(header.TargetSize); err != nil {
+			return nil, err
+		}
+	}
+	if err := readUndoRecords(reader, header, logger, func(offset int64, data []byte) error {
+		if err := opts.cancelled(); err != nil {
+			return err
+		}
+		return server.writeBlockToOffset(data, offset, target)
+	}); err != nil {
+		return nil, err
+	}
+	if err := target.Sync(); err != nil {
+		return nil, wrapError(ErrTargetIO, err)
+	}
+	return header, server.commitTarget()
+}
+
+// samePath returns true if both paths resolve to the same file, following
+// symbolic links like the links in /dev/disk.
+func samePath(a, b string) bool {
+	resolve := func(path string) string {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		return path
+	}
+	return resolve(a) == resolve(b)
+}
@@ -0,0 +1,173 @@
+package blockrsync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("undo log tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		undoFile   string
+		opts       BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "blockrsync-undo")
+		Expect(err).ToNot(HaveOccurred())
+		sourceFile = createTestFile(tmpDir, "source.raw", 20*4096+512, 1)
+		undoFile = filepath.Join(tmpDir, "undo.log")
+		opts = BlockRsyncOptions{
+			BlockSize: 4096,
+			UndoLog:   undoFile,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	DescribeTable("should roll back a sync to the original content", func(targetSize int64) {
+		targetFile := createTestFile(tmpDir, "target.raw", targetSize, 2)
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+
+		header, err := Rollback(undoFile, targetFile, &BlockRsyncOptions{}, GinkgoLogr.WithName("rollback"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(header.TargetSize).To(Equal(targetSize))
+		actual, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(actual).To(HaveLen(len(expected)))
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+	},
+		Entry("smaller target", int64(10*4096)),
+		Entry("larger target", int64(30*4096+100)),
+		Entry("same size target", int64(20*4096+512)),
+	)
+
+	It("should roll back a sync over the network", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 20*4096, 2)
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &opts, GinkgoLogr.WithName("server"))
+		done := make(chan error, 1)
+		go func() {
+			done <- server.StartServer()
+		}()
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-done).To(Succeed())
+		expectSameContent(sourceFile, targetFile)
+
+		_, err = Rollback(undoFile, targetFile, &BlockRsyncOptions{}, GinkgoLogr.WithName("rollback"))
+		Expect(err).ToNot(HaveOccurred())
+		actual, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+	})
+
+	It("should not create a log if nothing is overwritten", func() {
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		source, err := os.ReadFile(sourceFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(targetFile, source, 0644)).To(Succeed())
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		_, err = os.Stat(undoFile)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should refuse to overwrite an existing undo log", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 20*4096, 2)
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(undoFile, []byte("earlier sync"), 0600)).To(Succeed())
+		err = NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()
+		Expect(err).To(MatchError(ContainSubstring("already exists")))
+		actual, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+	})
+
+	It("should refuse a corrupted undo log without changing the target", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 20*4096, 2)
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		log, err := os.ReadFile(undoFile)
+		Expect(err).ToNot(HaveOccurred())
+		log[len(log)-1] ^= 0xff
+		Expect(os.WriteFile(undoFile, log, 0600)).To(Succeed())
+
+		_, err = Rollback(undoFile, targetFile, &BlockRsyncOptions{}, GinkgoLogr.WithName("rollback"))
+		Expect(err).To(MatchError(ErrInvalidUndoLog))
+		expectSameContent(sourceFile, targetFile)
+	})
+
+	It("should refuse to roll back a different target unless forced", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 20*4096, 2)
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		otherFile := createTestFile(tmpDir, "other.raw", 20*4096, 3)
+		otherContent, err := os.ReadFile(otherFile)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = Rollback(undoFile, otherFile, &BlockRsyncOptions{}, GinkgoLogr.WithName("rollback"))
+		Expect(err).To(MatchError(ErrUndoTargetMismatch))
+		Expect(err).To(MatchError(ErrVerification))
+		actual, err := os.ReadFile(otherFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(otherContent, actual)).To(BeTrue())
+
+		// A link to the recorded target is the same target
+		link := filepath.Join(tmpDir, "link.raw")
+		Expect(os.Symlink(targetFile, link)).To(Succeed())
+		_, err = Rollback(undoFile, link, &BlockRsyncOptions{}, GinkgoLogr.WithName("rollback"))
+		Expect(err).ToNot(HaveOccurred())
+		actual, err = os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+	})
+
+	It("should roll back a different target when forced", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 20*4096, 2)
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		copyFile := filepath.Join(tmpDir, "copy.raw")
+		source, err := os.ReadFile(sourceFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(copyFile, source, 0644)).To(Succeed())
+
+		_, err = Rollback(undoFile, copyFile, &BlockRsyncOptions{Force: true}, GinkgoLogr.WithName("rollback"))
+		Expect(err).ToNot(HaveOccurred())
+		actual, err := os.ReadFile(copyFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected, actual)).To(BeTrue())
+	})
+
+	It("should ignore an incomplete record at the end of the log", func() {
+		targetFile := createTestFile(tmpDir, "target.raw", 20*4096, 2)
+		expected, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(NewLocalSync(sourceFile, targetFile, &opts, GinkgoLogr.WithName("local")).Sync()).To(Succeed())
+		info, err := os.Stat(undoFile)
+		Expect(err).ToNot(HaveOccurred())
+		// Cut the last block in half, as if the sync was interrupted while recording it
+		Expect(os.Truncate(undoFile, info.Size()-2048)).To(Succeed())
+
+		_, err = Rollback(undoFile, targetFile, &BlockRsyncOptions{}, GinkgoLogr.WithName("rollback"))
+		Expect(err).ToNot(HaveOccurred())
+		actual, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(expected[:19*4096], actual[:19*4096])).To(BeTrue())
+	})
+})
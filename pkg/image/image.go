@@ -0,0 +1,180 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	FormatRaw   = "raw"
+	FormatQcow2 = "qcow2"
+	FormatVMDK  = "vmdk"
+	FormatVHD   = "vhd"
+	FormatVHDX  = "vhdx"
+	// FormatAuto detects the format from the content of the file
+	FormatAuto = "auto"
+)
+
+// Image presents the virtual disk of an image file.
+type Image interface {
+	io.ReaderAt
+	io.Closer
+	// Size is the size of the virtual disk
+	Size() int64
+	Format() string
+	// Allocated returns false if no data is allocated in the range in the image or
+	// its backing files, the range reads as zeros.
+	Allocated(offset, length int64) (bool, error)
+}
+
+// Open opens the image read only. An empty format is raw.
+func Open(fileName, format string) (Image, error) {
+	if format == FormatAuto {
+		detected, err := DetectFormat(fileName)
+		if err != nil {
+			return nil, err
+		}
+		format = detected
+	}
+	switch format {
+	case "", FormatRaw:
+		return openRaw(fileName)
+	case FormatQcow2:
+		return openQcow2(fileName)
+	case FormatVMDK:
+		return openVMDK(fileName)
+	case FormatVHD:
+		return openVHD(fileName)
+	case FormatVHDX:
+		return openVHDX(fileName)
+	default:
+		return nil, fmt.Errorf("unsupported image format %s", format)
+	}
+}
+
+// DetectFormat returns the format of the image from its header, files that are
+// not recognized are raw. Fixed size VHD images are detected by their footer.
+func DetectFormat(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, len(vmdkDescriptorMagic))
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte(qcow2Magic)):
+		return FormatQcow2, nil
+	case bytes.HasPrefix(header, []byte(vmdkMagic)), bytes.HasPrefix(header, []byte(vmdkDescriptorMagic)):
+		return FormatVMDK, nil
+	case bytes.HasPrefix(header, []byte(vhdxMagic)):
+		return FormatVHDX, nil
+	case bytes.HasPrefix(header, []byte(vhdCookie)):
+		return FormatVHD, nil
+	}
+	if _, err := readVHDFooter(f); err == nil {
+		return FormatVHD, nil
+	}
+	return FormatRaw, nil
+}
+
+type rawImage struct {
+	*os.File
+	size int64
+}
+
+func openRaw(fileName string) (*rawImage, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rawImage{File: f, size: size}, nil
+}
+
+func (r *rawImage) Size() int64 {
+	return r.size
+}
+
+func (r *rawImage) Format() string {
+	return FormatRaw
+}
+
+func (r *rawImage) Allocated(offset, length int64) (bool, error) {
+	return offset < r.size, nil
+}
+
+// readBlocks splits a read of the virtual disk of the size into reads within
+// single blocks.
+func readBlocks(p []byte, offset, size, blockSize int64, readBlock func(buf []byte, blockOffset, inBlock int64) error) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset >= size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	var eof error
+	if offset+n > size {
+		n = size - offset
+		eof = io.EOF
+	}
+	for done := int64(0); done < n; {
+		pos := offset + done
+		inBlock := pos % blockSize
+		chunk := min(blockSize-inBlock, n-done)
+		if err := readBlock(p[done:done+chunk], pos-inBlock, inBlock); err != nil {
+			return int(done), err
+		}
+		done += chunk
+	}
+	return int(n), eof
+}
+
+// allocatedBlocks returns true if any block in the range is allocated.
+func allocatedBlocks(offset, length, size, blockSize int64, allocated func(blockOffset int64) (bool, error)) (bool, error) {
+	end := min(offset+length, size)
+	for blockOffset := offset / blockSize * blockSize; blockOffset < end; blockOffset += blockSize {
+		if ok, err := allocated(blockOffset); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// number of entries kept in a blockCache
+const blockCacheSize = 64
+
+// blockCache keeps a limited number of tables or decompressed blocks in memory.
+type blockCache[V any] struct {
+	mu      sync.Mutex
+	entries map[int64]V
+}
+
+func (c *blockCache[V]) get(key int64) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.entries[key]
+	return v, ok
+}
+
+func (c *blockCache[V]) put(key int64, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= blockCacheSize {
+		c.entries = make(map[int64]V)
+	}
+	c.entries[key] = v
+}
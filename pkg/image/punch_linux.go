@@ -0,0 +1,17 @@
+//go:build linux
+
+package image
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+func punchHole(f *os.File, offset, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, offset, length)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package image
+
+import (
+	"errors"
+	"os"
+)
+
+var errPunchHoleUnsupported = errors.New("punching holes is only supported on linux")
+
+func punchHole(f *os.File, offset, length int64) error {
+	return errPunchHoleUnsupported
+}
@@ -0,0 +1,438 @@
+package image
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	qcow2Magic         = "QFI\xfb"
+	qcow2HeaderV2Size  = 72
+	qcow2HeaderV3Size  = 104
+	qcow2MinClusterBit = 9
+	qcow2MaxClusterBit = 21
+	qcow2MaxL1Size     = 32 * 1024 * 1024
+
+	qcow2OffsetMask     = uint64(0x00fffffffffffe00)
+	qcow2CompressedFlag = uint64(1) << 62
+	qcow2ZeroFlag       = uint64(1)
+
+	qcow2IncompatDirty       = uint64(1) << 0
+	qcow2IncompatCorrupt     = uint64(1) << 1
+	qcow2IncompatDataFile    = uint64(1) << 2
+	qcow2IncompatCompression = uint64(1) << 3
+	qcow2IncompatExtendedL2  = uint64(1) << 4
+
+	qcow2ExtEnd           = uint32(0)
+	qcow2ExtBackingFormat = uint32(0xe2792aca)
+
+	// maxBackingDepth limits the length of a backing file chain
+	maxBackingDepth = 16
+	// number of L2 tables and decompressed clusters kept in memory
+	qcow2CacheSize = 64
+)
+
+var ErrUnsupportedImage = errors.New("unsupported image")
+
+// qcow2Header is the header of a qcow2 image, the fields after SnapshotsOffset are
+// only present in version 3.
+type qcow2Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	IncompatibleFeatures  uint64
+	CompatibleFeatures    uint64
+	AutoclearFeatures     uint64
+	RefcountOrder         uint32
+	HeaderLength          uint32
+}
+
+// qcow2Image reads the virtual disk of a qcow2 image. Clusters that are not
+// allocated are read from the backing file, or as zeros without a backing file.
+type qcow2Image struct {
+	file        *os.File
+	header      qcow2Header
+	clusterSize int64
+	l2Entries   int64
+	l1          []uint64
+	backing     Image
+
+	mu           sync.Mutex
+	l2Cache      map[uint64][]uint64
+	clusterCache map[uint64][]byte
+	compression  byte
+}
+
+func openQcow2(fileName string) (*qcow2Image, error) {
+	return openQcow2Chain(fileName, os.O_RDONLY, 0)
+}
+
+// openQcow2Chain opens the image with the flag, backing files are always opened
+// read only.
+func openQcow2Chain(fileName string, flag, depth int) (*qcow2Image, error) {
+	if depth > maxBackingDepth {
+		return nil, fmt.Errorf("%w: backing file chain of %s is longer than %d", ErrUnsupportedImage, fileName, maxBackingDepth)
+	}
+	f, err := os.OpenFile(fileName, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	q := &qcow2Image{
+		file:         f,
+		l2Cache:      make(map[uint64][]uint64),
+		clusterCache: make(map[uint64][]byte),
+	}
+	if err := q.readHeader(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	backingFormat, err := q.readHeaderExtensions()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	if err := q.readL1Table(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	if q.header.BackingFileOffset != 0 {
+		if err := q.openBackingFile(fileName, backingFormat, depth); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *qcow2Image) readHeader() error {
+	buf := make([]byte, qcow2HeaderV3Size+1)
+	n, err := q.file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n < qcow2HeaderV2Size || !bytes.Equal(buf[:4], []byte(qcow2Magic)) {
+		return fmt.Errorf("%w: not a qcow2 image", ErrUnsupportedImage)
+	}
+	h := &q.header
+	if err := binary.Read(bytes.NewReader(buf[:qcow2HeaderV3Size]), binary.BigEndian, h); err != nil {
+		return err
+	}
+	switch h.Version {
+	case 2:
+		h.IncompatibleFeatures, h.CompatibleFeatures, h.AutoclearFeatures = 0, 0, 0
+		h.RefcountOrder, h.HeaderLength = 4, qcow2HeaderV2Size
+	case 3:
+		if n < qcow2HeaderV3Size || h.HeaderLength < qcow2HeaderV3Size {
+			return fmt.Errorf("%w: truncated header", ErrUnsupportedImage)
+		}
+		if h.HeaderLength > qcow2HeaderV3Size && n > qcow2HeaderV3Size {
+			q.compression = buf[qcow2HeaderV3Size]
+		}
+	default:
+		return fmt.Errorf("%w: qcow2 version %d", ErrUnsupportedImage, h.Version)
+	}
+	if h.ClusterBits < qcow2MinClusterBit || h.ClusterBits > qcow2MaxClusterBit {
+		return fmt.Errorf("%w: cluster bits %d", ErrUnsupportedImage, h.ClusterBits)
+	}
+	if h.CryptMethod != 0 {
+		return fmt.Errorf("%w: encrypted images", ErrUnsupportedImage)
+	}
+	if h.IncompatibleFeatures&qcow2IncompatCorrupt != 0 {
+		return fmt.Errorf("%w: image is marked corrupt", ErrUnsupportedImage)
+	}
+	if h.IncompatibleFeatures&qcow2IncompatDataFile != 0 {
+		return fmt.Errorf("%w: external data files", ErrUnsupportedImage)
+	}
+	if h.IncompatibleFeatures&qcow2IncompatExtendedL2 != 0 {
+		return fmt.Errorf("%w: extended L2 entries", ErrUnsupportedImage)
+	}
+	if h.IncompatibleFeatures&^(qcow2IncompatDirty|qcow2IncompatCompression) != 0 {
+		return fmt.Errorf("%w: incompatible features %#x", ErrUnsupportedImage, h.IncompatibleFeatures)
+	}
+	if q.compression != 0 {
+		return fmt.Errorf("%w: compression type %d", ErrUnsupportedImage, q.compression)
+	}
+	if h.Size > uint64(1)<<62 {
+		return fmt.Errorf("%w: size %d", ErrUnsupportedImage, h.Size)
+	}
+	q.clusterSize = int64(1) << h.ClusterBits
+	q.l2Entries = q.clusterSize / 8
+	return nil
+}
+
+// readHeaderExtensions returns the format of the backing file, if it is set.
+func (q *qcow2Image) readHeaderExtensions() (string, error) {
+	offset := int64(q.header.HeaderLength)
+	backingFormat := ""
+	for offset+8 <= q.clusterSize {
+		var ext struct {
+			Type   uint32
+			Length uint32
+		}
+		if err := binary.Read(io.NewSectionReader(q.file, offset, 8), binary.BigEndian, &ext); err != nil {
+			return "", fmt.Errorf("%w: invalid header extension", ErrUnsupportedImage)
+		}
+		if ext.Type == qcow2ExtEnd {
+			return backingFormat, nil
+		}
+		offset += 8
+		if offset+int64(ext.Length) > q.clusterSize {
+			return "", fmt.Errorf("%w: header extension %#x too large", ErrUnsupportedImage, ext.Type)
+		}
+		if ext.Type == qcow2ExtBackingFormat {
+			data := make([]byte, ext.Length)
+			if _, err := q.file.ReadAt(data, offset); err != nil {
+				return "", err
+			}
+			backingFormat = string(data)
+		}
+		offset += (int64(ext.Length) + 7) &^ 7
+	}
+	return backingFormat, nil
+}
+
+func (q *qcow2Image) readL1Table() error {
+	clusters := (int64(q.header.Size) + q.clusterSize - 1) / q.clusterSize
+	required := (clusters + q.l2Entries - 1) / q.l2Entries
+	if int64(q.header.L1Size) < required || int64(q.header.L1Size)*8 > qcow2MaxL1Size {
+		return fmt.Errorf("%w: invalid L1 table size %d", ErrUnsupportedImage, q.header.L1Size)
+	}
+	q.l1 = make([]uint64, q.header.L1Size)
+	reader := io.NewSectionReader(q.file, int64(q.header.L1TableOffset), int64(q.header.L1Size)*8)
+	if err := binary.Read(reader, binary.BigEndian, q.l1); err != nil {
+		return fmt.Errorf("unable to read L1 table: %w", err)
+	}
+	return nil
+}
+
+func (q *qcow2Image) openBackingFile(fileName, format string, depth int) error {
+	if q.header.BackingFileSize == 0 || q.header.BackingFileSize > 1023 {
+		return fmt.Errorf("%s: %w: invalid backing file name size %d", fileName, ErrUnsupportedImage, q.header.BackingFileSize)
+	}
+	name := make([]byte, q.header.BackingFileSize)
+	if _, err := q.file.ReadAt(name, int64(q.header.BackingFileOffset)); err != nil {
+		return fmt.Errorf("%s: unable to read backing file name: %w", fileName, err)
+	}
+	backingFile := string(name)
+	if !filepath.IsAbs(backingFile) {
+		backingFile = filepath.Join(filepath.Dir(fileName), backingFile)
+	}
+	if format == "" {
+		detected, err := DetectFormat(backingFile)
+		if err != nil {
+			return err
+		}
+		format = detected
+	}
+	var err error
+	switch format {
+	case FormatQcow2:
+		q.backing, err = openQcow2Chain(backingFile, os.O_RDONLY, depth+1)
+	case FormatRaw:
+		q.backing, err = openRaw(backingFile)
+	default:
+		err = fmt.Errorf("%w: backing file format %s", ErrUnsupportedImage, format)
+	}
+	return err
+}
+
+func (q *qcow2Image) Size() int64 {
+	return int64(q.header.Size)
+}
+
+func (q *qcow2Image) Format() string {
+	return FormatQcow2
+}
+
+func (q *qcow2Image) Close() error {
+	var errs []error
+	if q.backing != nil {
+		errs = append(errs, q.backing.Close())
+	}
+	errs = append(errs, q.file.Close())
+	return errors.Join(errs...)
+}
+
+// ReadAt reads the virtual disk, it is safe for concurrent use.
+func (q *qcow2Image) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	size := q.Size()
+	if offset >= size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	var eof error
+	if offset+n > size {
+		n = size - offset
+		eof = io.EOF
+	}
+	for done := int64(0); done < n; {
+		pos := offset + done
+		inCluster := pos % q.clusterSize
+		chunk := min(q.clusterSize-inCluster, n-done)
+		if err := q.readCluster(p[done:done+chunk], pos-inCluster, inCluster); err != nil {
+			return int(done), err
+		}
+		done += chunk
+	}
+	return int(n), eof
+}
+
+func (q *qcow2Image) readCluster(buf []byte, clusterOffset, inCluster int64) error {
+	entry, err := q.l2Entry(clusterOffset)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry&qcow2CompressedFlag != 0:
+		data, err := q.readCompressedCluster(entry)
+		if err != nil {
+			return err
+		}
+		copy(buf, data[inCluster:])
+	case q.isZero(entry):
+		clear(buf)
+	case entry&qcow2OffsetMask != 0:
+		n, err := q.file.ReadAt(buf, int64(entry&qcow2OffsetMask)+inCluster)
+		if err == io.EOF {
+			// The last cluster in the file can be shorter than a cluster
+			clear(buf[n:])
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read cluster at %d: %w", clusterOffset, err)
+		}
+	case q.backing != nil:
+		n, err := q.backing.ReadAt(buf, clusterOffset+inCluster)
+		if err == io.EOF {
+			// The backing file is smaller than the image
+			clear(buf[n:])
+			err = nil
+		}
+		return err
+	default:
+		clear(buf)
+	}
+	return nil
+}
+
+// isZero returns true if the cluster is marked as reading zeros, version 3 only.
+func (q *qcow2Image) isZero(entry uint64) bool {
+	return q.header.Version >= 3 && entry&qcow2CompressedFlag == 0 && entry&qcow2ZeroFlag != 0
+}
+
+// l2Entry returns the L2 entry of the cluster, 0 if it is not allocated.
+func (q *qcow2Image) l2Entry(clusterOffset int64) (uint64, error) {
+	index := clusterOffset / q.clusterSize
+	l1Index := index / q.l2Entries
+	if l1Index >= int64(len(q.l1)) {
+		return 0, nil
+	}
+	l2Offset := q.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	table, err := q.l2Table(l2Offset)
+	if err != nil {
+		return 0, err
+	}
+	return table[index%q.l2Entries], nil
+}
+
+func (q *qcow2Image) l2Table(offset uint64) ([]uint64, error) {
+	q.mu.Lock()
+	table, ok := q.l2Cache[offset]
+	q.mu.Unlock()
+	if ok {
+		return table, nil
+	}
+	table = make([]uint64, q.l2Entries)
+	if err := binary.Read(io.NewSectionReader(q.file, int64(offset), q.clusterSize), binary.BigEndian, table); err != nil {
+		return nil, fmt.Errorf("unable to read L2 table at %d: %w", offset, err)
+	}
+	q.mu.Lock()
+	if len(q.l2Cache) >= qcow2CacheSize {
+		clear(q.l2Cache)
+	}
+	q.l2Cache[offset] = table
+	q.mu.Unlock()
+	return table, nil
+}
+
+// readCompressedCluster reads and inflates a compressed cluster. The entry holds
+// the host offset and the number of additional 512 byte sectors.
+func (q *qcow2Image) readCompressedCluster(entry uint64) ([]byte, error) {
+	offsetBits := 62 - (q.header.ClusterBits - 8)
+	hostOffset := entry & (uint64(1)<<offsetBits - 1)
+	sectors := (entry >> offsetBits) & (uint64(1)<<(62-offsetBits) - 1)
+	q.mu.Lock()
+	data, ok := q.clusterCache[hostOffset]
+	q.mu.Unlock()
+	if ok {
+		return data, nil
+	}
+	compressed := make([]byte, (sectors+1)*512-hostOffset%512)
+	n, err := q.file.ReadAt(compressed, int64(hostOffset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = make([]byte, q.clusterSize)
+	reader := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer reader.Close()
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("unable to inflate compressed cluster at %d: %w", hostOffset, err)
+	}
+	q.mu.Lock()
+	if len(q.clusterCache) >= qcow2CacheSize {
+		clear(q.clusterCache)
+	}
+	q.clusterCache[hostOffset] = data
+	q.mu.Unlock()
+	return data, nil
+}
+
+// Allocated returns true if any cluster in the range has data in the image or
+// one of its backing files.
+func (q *qcow2Image) Allocated(offset, length int64) (bool, error) {
+	end := min(offset+length, q.Size())
+	for clusterOffset := offset / q.clusterSize * q.clusterSize; clusterOffset < end; clusterOffset += q.clusterSize {
+		entry, err := q.l2Entry(clusterOffset)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case entry&qcow2CompressedFlag != 0:
+			return true, nil
+		case q.isZero(entry):
+			continue
+		case entry&qcow2OffsetMask != 0:
+			return true, nil
+		case q.backing != nil:
+			start := max(clusterOffset, offset)
+			allocated, err := q.backing.Allocated(start, min(clusterOffset+q.clusterSize, end)-start)
+			if err != nil || allocated {
+				return allocated, err
+			}
+		}
+	}
+	return false, nil
+}
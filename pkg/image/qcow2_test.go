@@ -0,0 +1,317 @@
+package image
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// testQcow2 builds small qcow2 images for the tests, the refcounts are not
+// written since the reader does not use them.
+type testQcow2 struct {
+	version       uint32
+	clusterBits   uint32
+	size          int64
+	backingFile   string
+	backingFormat string
+	incompatible  uint64
+	cryptMethod   uint32
+	snapshots     uint32
+	// virtual cluster offset to data
+	clusters   map[int64][]byte
+	compressed map[int64][]byte
+	zero       []int64
+}
+
+func (t *testQcow2) write(fileName string) {
+	clusterSize := int64(1) << t.clusterBits
+	l2Entries := clusterSize / 8
+	l1Size := (t.size/clusterSize + l2Entries - 1) / l2Entries
+	l1 := make([]uint64, l1Size)
+	l2 := make(map[int64][]uint64)
+	// cluster 0 is the header, cluster 1 the L1 table
+	next := 2 * clusterSize
+	out := &bytes.Buffer{}
+	out.Write(make([]byte, next))
+
+	l2Table := func(clusterOffset int64) []uint64 {
+		l1Index := clusterOffset / clusterSize / l2Entries
+		if l2[l1Index] == nil {
+			l2[l1Index] = make([]uint64, l2Entries)
+			l1[l1Index] = uint64(next) | uint64(1)<<63
+			out.Write(make([]byte, clusterSize))
+			next += clusterSize
+		}
+		return l2[l1Index]
+	}
+	for offset, data := range t.clusters {
+		l2Table(offset)[offset/clusterSize%l2Entries] = uint64(next) | uint64(1)<<63
+		out.Write(data)
+		out.Write(make([]byte, clusterSize-int64(len(data))))
+		next += clusterSize
+	}
+	for _, offset := range t.zero {
+		l2Table(offset)[offset/clusterSize%l2Entries] = qcow2ZeroFlag
+	}
+	for offset, data := range t.compressed {
+		table := l2Table(offset)
+		compressed := &bytes.Buffer{}
+		w, err := flate.NewWriter(compressed, flate.BestCompression)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = w.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.Close()).To(Succeed())
+		// Compressed clusters do not have to start at a sector boundary
+		hostOffset := next + 100
+		sectors := (hostOffset%512+int64(compressed.Len())+511)/512 - 1
+		offsetBits := 62 - (t.clusterBits - 8)
+		table[offset/clusterSize%l2Entries] = qcow2CompressedFlag | uint64(sectors)<<offsetBits | uint64(hostOffset)
+		out.Write(make([]byte, 100))
+		out.Write(compressed.Bytes())
+		next += 100 + int64(compressed.Len())
+	}
+	b := out.Bytes()
+	for l1Index, table := range l2 {
+		offset := l1[l1Index] & qcow2OffsetMask
+		for i, entry := range table {
+			binary.BigEndian.PutUint64(b[offset+uint64(i)*8:], entry)
+		}
+	}
+	for i, entry := range l1 {
+		binary.BigEndian.PutUint64(b[clusterSize+int64(i)*8:], entry)
+	}
+
+	header := qcow2Header{
+		Version:       t.version,
+		ClusterBits:   t.clusterBits,
+		Size:          uint64(t.size),
+		CryptMethod:   t.cryptMethod,
+		NbSnapshots:   t.snapshots,
+		L1Size:        uint32(l1Size),
+		L1TableOffset: uint64(clusterSize),
+		// Version 3
+		IncompatibleFeatures: t.incompatible,
+		RefcountOrder:        4,
+		HeaderLength:         qcow2HeaderV3Size,
+	}
+	copy(header.Magic[:], qcow2Magic)
+	headerBuf := &bytes.Buffer{}
+	Expect(binary.Write(headerBuf, binary.BigEndian, &header)).To(Succeed())
+	headerBytes := headerBuf.Bytes()
+	if t.version == 2 {
+		headerBytes = headerBytes[:qcow2HeaderV2Size]
+	}
+	if t.backingFormat != "" {
+		ext := make([]byte, 8+(len(t.backingFormat)+7)&^7)
+		binary.BigEndian.PutUint32(ext, qcow2ExtBackingFormat)
+		binary.BigEndian.PutUint32(ext[4:], uint32(len(t.backingFormat)))
+		copy(ext[8:], t.backingFormat)
+		headerBytes = append(headerBytes, ext...)
+	}
+	// End of extensions
+	headerBytes = append(headerBytes, make([]byte, 8)...)
+	if t.backingFile != "" {
+		binary.BigEndian.PutUint64(headerBytes[8:], uint64(len(headerBytes)))
+		binary.BigEndian.PutUint32(headerBytes[16:], uint32(len(t.backingFile)))
+		headerBytes = append(headerBytes, t.backingFile...)
+	}
+	copy(b, headerBytes)
+	Expect(os.WriteFile(fileName, b, 0644)).To(Succeed())
+}
+
+const testClusterSize = 4096
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	_, err := rand.New(rand.NewSource(seed)).Read(data)
+	Expect(err).ToNot(HaveOccurred())
+	return data
+}
+
+func readAll(img Image) []byte {
+	data, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	Expect(err).ToNot(HaveOccurred())
+	return data
+}
+
+// newTestImage returns a 16 cluster image with data in clusters 1 and 5, a
+// compressed cluster 3, a zero cluster 7, and its expected content.
+func newTestImage(version uint32) (*testQcow2, []byte) {
+	expected := make([]byte, 16*testClusterSize)
+	t := &testQcow2{
+		version:     version,
+		clusterBits: 12,
+		size:        int64(len(expected)),
+		clusters: map[int64][]byte{
+			1 * testClusterSize: randomData(testClusterSize, 1),
+			5 * testClusterSize: randomData(testClusterSize, 5),
+		},
+		compressed: map[int64][]byte{
+			3 * testClusterSize: bytes.Repeat([]byte("compressed"), testClusterSize/10+1)[:testClusterSize],
+		},
+	}
+	if version >= 3 {
+		t.zero = []int64{7 * testClusterSize}
+	}
+	for offset, data := range t.clusters {
+		copy(expected[offset:], data)
+	}
+	for offset, data := range t.compressed {
+		copy(expected[offset:], data)
+	}
+	return t, expected
+}
+
+var _ = Describe("qcow2 tests", func() {
+	const clusterSize = 4096
+
+	var (
+		tmpDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "image-qcow2")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	DescribeTable("should read the virtual disk", func(version uint32) {
+		t, expected := newTestImage(version)
+		fileName := filepath.Join(tmpDir, "image.qcow2")
+		t.write(fileName)
+		img, err := Open(fileName, FormatQcow2)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(img.Size()).To(Equal(int64(len(expected))))
+		Expect(img.Format()).To(Equal(FormatQcow2))
+		Expect(readAll(img)).To(Equal(expected))
+
+		// Reads that are not aligned to clusters
+		buf := make([]byte, clusterSize+200)
+		n, err := img.ReadAt(buf, 3*clusterSize-100)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(len(buf)))
+		Expect(buf).To(Equal(expected[3*clusterSize-100 : 4*clusterSize+100]))
+		n, err = img.ReadAt(buf, img.Size()-100)
+		Expect(err).To(Equal(io.EOF))
+		Expect(n).To(Equal(100))
+	},
+		Entry("version 2", uint32(2)),
+		Entry("version 3", uint32(3)),
+	)
+
+	It("should report allocated clusters", func() {
+		t, _ := newTestImage(3)
+		fileName := filepath.Join(tmpDir, "image.qcow2")
+		t.write(fileName)
+		img, err := Open(fileName, FormatQcow2)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		for cluster, expected := range map[int64]bool{0: false, 1: true, 2: false, 3: true, 5: true, 7: false, 15: false} {
+			allocated, err := img.Allocated(cluster*clusterSize, clusterSize)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allocated).To(Equal(expected), "cluster %d", cluster)
+		}
+		allocated, err := img.Allocated(0, 2*clusterSize)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(allocated).To(BeTrue())
+	})
+
+	It("should read unallocated clusters from a raw backing file", func() {
+		// The backing file is smaller than the image
+		backing := randomData(10*clusterSize, 10)
+		Expect(os.WriteFile(filepath.Join(tmpDir, "base.raw"), backing, 0644)).To(Succeed())
+		t, expected := newTestImage(3)
+		t.backingFile = "base.raw"
+		t.backingFormat = FormatRaw
+		fileName := filepath.Join(tmpDir, "image.qcow2")
+		t.write(fileName)
+		for _, cluster := range []int64{0, 2, 4, 6, 8, 9} {
+			copy(expected[cluster*clusterSize:(cluster+1)*clusterSize], backing[cluster*clusterSize:])
+		}
+
+		img, err := Open(fileName, FormatQcow2)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(readAll(img)).To(Equal(expected))
+		allocated, err := img.Allocated(0, clusterSize)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(allocated).To(BeTrue())
+		allocated, err = img.Allocated(12*clusterSize, clusterSize)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(allocated).To(BeFalse())
+	})
+
+	It("should read a chain of qcow2 backing files", func() {
+		base := &testQcow2{
+			version:     3,
+			clusterBits: 12,
+			size:        16 * clusterSize,
+			clusters: map[int64][]byte{
+				0:               randomData(clusterSize, 20),
+				1 * clusterSize: randomData(clusterSize, 21),
+			},
+		}
+		base.write(filepath.Join(tmpDir, "base.qcow2"))
+		t, expected := newTestImage(3)
+		// Detected without the backing format extension
+		t.backingFile = filepath.Join(tmpDir, "base.qcow2")
+		fileName := filepath.Join(tmpDir, "image.qcow2")
+		t.write(fileName)
+		copy(expected, base.clusters[0])
+
+		img, err := Open(fileName, FormatAuto)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(readAll(img)).To(Equal(expected))
+	})
+
+	It("should detect the format", func() {
+		t, _ := newTestImage(3)
+		fileName := filepath.Join(tmpDir, "image.qcow2")
+		t.write(fileName)
+		Expect(DetectFormat(fileName)).To(Equal(FormatQcow2))
+		rawFile := filepath.Join(tmpDir, "image.raw")
+		Expect(os.WriteFile(rawFile, randomData(clusterSize, 1), 0644)).To(Succeed())
+		Expect(DetectFormat(rawFile)).To(Equal(FormatRaw))
+		img, err := Open(rawFile, FormatAuto)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(img.Format()).To(Equal(FormatRaw))
+		Expect(img.Size()).To(Equal(int64(clusterSize)))
+	})
+
+	DescribeTable("should reject unsupported images", func(modify func(*testQcow2)) {
+		t, _ := newTestImage(3)
+		modify(t)
+		fileName := filepath.Join(tmpDir, "image.qcow2")
+		t.write(fileName)
+		_, err := Open(fileName, FormatQcow2)
+		Expect(errors.Is(err, ErrUnsupportedImage)).To(BeTrue(), "error %v", err)
+	},
+		Entry("encrypted", func(t *testQcow2) { t.cryptMethod = 1 }),
+		Entry("unknown version", func(t *testQcow2) { t.version = 4 }),
+		Entry("corrupt", func(t *testQcow2) { t.incompatible = qcow2IncompatCorrupt }),
+		Entry("extended L2 entries", func(t *testQcow2) { t.incompatible = qcow2IncompatExtendedL2 }),
+		Entry("external data file", func(t *testQcow2) { t.incompatible = qcow2IncompatDataFile }),
+	)
+
+	It("should reject a file that is not qcow2", func() {
+		rawFile := filepath.Join(tmpDir, "image.raw")
+		Expect(os.WriteFile(rawFile, randomData(clusterSize, 1), 0644)).To(Succeed())
+		_, err := Open(rawFile, FormatQcow2)
+		Expect(errors.Is(err, ErrUnsupportedImage)).To(BeTrue())
+	})
+})
@@ -0,0 +1,599 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	qcow2CopiedFlag         = uint64(1) << 63
+	qcow2RefcountOffsetMask = ^uint64(511)
+	// only 16 bit refcounts are supported when writing
+	qcow2RefcountOrder = 4
+	qcow2RefcountBytes = 2
+
+	// DefaultClusterBits is used for new qcow2 images, 64KiB clusters
+	DefaultClusterBits = 16
+
+	headerSizeOffset           = 24
+	headerL1SizeOffset         = 36
+	headerL1TableOffset        = 40
+	headerRefcountTableOffset  = 48
+	headerRefcountTableCluster = 56
+	headerAutoclearOffset      = 88
+)
+
+// WritableImage is an image the virtual disk of which can be written.
+type WritableImage interface {
+	Image
+	io.WriterAt
+	// Zero makes the range read as zeros, whole clusters are deallocated
+	Zero(offset, length int64) error
+	// Truncate sets the size of the virtual disk
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+// OpenWritable opens an existing image for writing.
+func OpenWritable(fileName, format string) (WritableImage, error) {
+	if format == FormatAuto {
+		detected, err := DetectFormat(fileName)
+		if err != nil {
+			return nil, err
+		}
+		format = detected
+	}
+	switch format {
+	case FormatQcow2:
+		return openQcow2Writer(fileName)
+	default:
+		return nil, fmt.Errorf("writing %s images is not supported", format)
+	}
+}
+
+// Create creates a new empty image of the size, an existing file is overwritten.
+func Create(fileName, format string, size int64) (WritableImage, error) {
+	switch format {
+	case FormatQcow2:
+		if err := createQcow2(fileName, size, DefaultClusterBits, "", ""); err != nil {
+			return nil, err
+		}
+		return openQcow2Writer(fileName)
+	default:
+		return nil, fmt.Errorf("creating %s images is not supported", format)
+	}
+}
+
+// CreateOverlay creates a new empty qcow2 image of the size on top of the
+// backing file, the backing file is only read. A relative backing file name is
+// relative to the directory of the image.
+func CreateOverlay(fileName, backingFile, backingFormat string, size int64) (WritableImage, error) {
+	if backingFormat != FormatRaw && backingFormat != FormatQcow2 {
+		return nil, fmt.Errorf("%w: backing file format %s", ErrUnsupportedImage, backingFormat)
+	}
+	if err := createQcow2(fileName, size, DefaultClusterBits, backingFile, backingFormat); err != nil {
+		return nil, err
+	}
+	return openQcow2Writer(fileName)
+}
+
+// qcow2Writer writes the virtual disk of a qcow2 image. New clusters are
+// allocated at the end of the file, and the refcounts are kept up to date.
+type qcow2Writer struct {
+	*qcow2Image
+	refcountTable []uint64
+	fileEnd       int64
+}
+
+func openQcow2Writer(fileName string) (*qcow2Writer, error) {
+	q, err := openQcow2Chain(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	w := &qcow2Writer{qcow2Image: q}
+	if err := w.init(); err != nil {
+		q.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return w, nil
+}
+
+func (w *qcow2Writer) init() error {
+	h := &w.header
+	if info, err := w.file.Stat(); err != nil {
+		return err
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: qcow2 images can only be written to regular files", ErrUnsupportedImage)
+	} else {
+		w.fileEnd = (info.Size() + w.clusterSize - 1) / w.clusterSize * w.clusterSize
+	}
+	if h.RefcountOrder != qcow2RefcountOrder {
+		return fmt.Errorf("%w: writing refcount order %d", ErrUnsupportedImage, h.RefcountOrder)
+	}
+	if h.NbSnapshots != 0 {
+		return fmt.Errorf("%w: writing images with internal snapshots", ErrUnsupportedImage)
+	}
+	if h.IncompatibleFeatures&qcow2IncompatDirty != 0 {
+		return fmt.Errorf("%w: image was not closed cleanly, repair it with qemu-img check -r all", ErrUnsupportedImage)
+	}
+	w.refcountTable = make([]uint64, int64(h.RefcountTableClusters)*w.clusterSize/8)
+	reader := io.NewSectionReader(w.file, int64(h.RefcountTableOffset), int64(len(w.refcountTable))*8)
+	if err := binary.Read(reader, binary.BigEndian, w.refcountTable); err != nil {
+		return fmt.Errorf("unable to read refcount table: %w", err)
+	}
+	if h.AutoclearFeatures != 0 {
+		// Bitmaps and other auto clear features are not updated by the writes
+		h.AutoclearFeatures = 0
+		return w.writeHeaderField(headerAutoclearOffset, uint64(0))
+	}
+	return nil
+}
+
+func (w *qcow2Writer) Stat() (os.FileInfo, error) {
+	return w.file.Stat()
+}
+
+func (w *qcow2Writer) Sync() error {
+	return w.file.Sync()
+}
+
+func (w *qcow2Writer) writeHeaderField(offset int64, value any) error {
+	return binary.Write(io.NewOffsetWriter(w.file, offset), binary.BigEndian, value)
+}
+
+// WriteAt writes to the virtual disk, clusters are allocated as needed.
+func (w *qcow2Writer) WriteAt(p []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(p)) > w.Size() {
+		return 0, fmt.Errorf("write of %d bytes at %d is beyond the size %d", len(p), offset, w.Size())
+	}
+	for done := int64(0); done < int64(len(p)); {
+		pos := offset + done
+		inCluster := pos % w.clusterSize
+		chunk := min(w.clusterSize-inCluster, int64(len(p))-done)
+		host, err := w.clusterForWrite(pos-inCluster, chunk == w.clusterSize)
+		if err != nil {
+			return int(done), err
+		}
+		if _, err := w.file.WriteAt(p[done:done+chunk], host+inCluster); err != nil {
+			return int(done), err
+		}
+		done += chunk
+	}
+	return len(p), nil
+}
+
+// clusterForWrite returns the host offset of the cluster, allocating it if it is
+// not allocated, compressed or a zero cluster. If the write does not cover the
+// whole cluster, the current content of the cluster is copied to it.
+func (w *qcow2Writer) clusterForWrite(clusterOffset int64, full bool) (int64, error) {
+	table, l2Offset, index, err := w.l2TableForWrite(clusterOffset)
+	if err != nil {
+		return 0, err
+	}
+	entry := table[index]
+	if entry&qcow2CompressedFlag == 0 && entry&qcow2OffsetMask != 0 {
+		host := int64(entry & qcow2OffsetMask)
+		if w.isZero(entry) {
+			// Preallocated zero cluster
+			if !full {
+				if _, err := w.file.WriteAt(make([]byte, w.clusterSize), host); err != nil {
+					return 0, err
+				}
+			}
+			if err := w.setL2Entry(table, l2Offset, index, uint64(host)|qcow2CopiedFlag); err != nil {
+				return 0, err
+			}
+		}
+		return host, nil
+	}
+	host, err := w.allocateClusters(1)
+	if err != nil {
+		return 0, err
+	}
+	data := make([]byte, w.clusterSize)
+	if !full {
+		if err := w.readCluster(data, clusterOffset, 0); err != nil {
+			return 0, err
+		}
+	}
+	// The complete cluster is written, so the file is never shorter than its clusters
+	if _, err := w.file.WriteAt(data, host); err != nil {
+		return 0, err
+	}
+	if err := w.setL2Entry(table, l2Offset, index, uint64(host)|qcow2CopiedFlag); err != nil {
+		return 0, err
+	}
+	if entry&qcow2CompressedFlag != 0 {
+		if err := w.freeCompressed(entry); err != nil {
+			return 0, err
+		}
+	}
+	return host, nil
+}
+
+// Zero makes the range read as zeros. Whole clusters are deallocated, and marked
+// as zero clusters if they would otherwise be read from the backing file.
+func (w *qcow2Writer) Zero(offset, length int64) error {
+	end := min(offset+length, w.Size())
+	for pos := offset; pos < end; {
+		inCluster := pos % w.clusterSize
+		clusterOffset := pos - inCluster
+		chunk := min(w.clusterSize-inCluster, end-pos)
+		if err := w.zeroCluster(clusterOffset, inCluster, chunk); err != nil {
+			return err
+		}
+		pos += chunk
+	}
+	return nil
+}
+
+func (w *qcow2Writer) zeroCluster(clusterOffset, inCluster, length int64) error {
+	entry, err := w.l2Entry(clusterOffset)
+	if err != nil {
+		return err
+	}
+	if w.isZero(entry) || (entry == 0 && w.backing == nil) {
+		return nil
+	}
+	// The last cluster can be partially beyond the end of the disk
+	full := inCluster == 0 && (length == w.clusterSize || clusterOffset+length == w.Size())
+	if !full || w.header.Version < 3 {
+		_, err := w.WriteAt(make([]byte, length), clusterOffset+inCluster)
+		return err
+	}
+	table, l2Offset, index, err := w.l2TableForWrite(clusterOffset)
+	if err != nil {
+		return err
+	}
+	newEntry := uint64(0)
+	if w.backing != nil {
+		newEntry = qcow2ZeroFlag
+	}
+	if err := w.setL2Entry(table, l2Offset, index, newEntry); err != nil {
+		return err
+	}
+	return w.freeEntry(entry)
+}
+
+// freeEntry releases the host clusters of an L2 entry that is no longer used.
+func (w *qcow2Writer) freeEntry(entry uint64) error {
+	if entry&qcow2CompressedFlag != 0 {
+		return w.freeCompressed(entry)
+	}
+	if host := int64(entry & qcow2OffsetMask); host != 0 {
+		return w.freeClusters(host, 1)
+	}
+	return nil
+}
+
+// freeCompressed decreases the refcount of the host clusters that contain the
+// compressed data, they can be shared with other compressed clusters.
+func (w *qcow2Writer) freeCompressed(entry uint64) error {
+	offsetBits := 62 - (w.header.ClusterBits - 8)
+	hostOffset := int64(entry & (uint64(1)<<offsetBits - 1))
+	sectors := int64((entry >> offsetBits) & (uint64(1)<<(62-offsetBits) - 1))
+	last := (hostOffset&^511 + (sectors+1)*512 - 1) / w.clusterSize * w.clusterSize
+	for host := hostOffset / w.clusterSize * w.clusterSize; host <= last; host += w.clusterSize {
+		refcount, err := w.refcount(host)
+		if err != nil {
+			return err
+		}
+		if refcount > 0 {
+			if err := w.setRefcount(host, refcount-1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *qcow2Writer) freeClusters(host, count int64) error {
+	for i := int64(0); i < count; i++ {
+		if err := w.setRefcount(host+i*w.clusterSize, 0); err != nil {
+			return err
+		}
+	}
+	// Release the space in the file, not all filesystems support it
+	_ = punchHole(w.file, host, count*w.clusterSize)
+	return nil
+}
+
+// l2TableForWrite returns the L2 table of the cluster and the index of the
+// cluster in it, the table is allocated if it does not exist yet.
+func (w *qcow2Writer) l2TableForWrite(clusterOffset int64) ([]uint64, int64, int64, error) {
+	index := clusterOffset / w.clusterSize
+	l1Index := index / w.l2Entries
+	if l1Index >= int64(len(w.l1)) {
+		return nil, 0, 0, fmt.Errorf("offset %d is beyond the L1 table", clusterOffset)
+	}
+	l2Offset := int64(w.l1[l1Index] & qcow2OffsetMask)
+	if l2Offset == 0 {
+		var err error
+		if l2Offset, err = w.allocateClusters(1); err != nil {
+			return nil, 0, 0, err
+		}
+		if _, err := w.file.WriteAt(make([]byte, w.clusterSize), l2Offset); err != nil {
+			return nil, 0, 0, err
+		}
+		w.l1[l1Index] = uint64(l2Offset) | qcow2CopiedFlag
+		if err := binary.Write(io.NewOffsetWriter(w.file, int64(w.header.L1TableOffset)+l1Index*8), binary.BigEndian, w.l1[l1Index]); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	table, err := w.l2Table(uint64(l2Offset))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return table, l2Offset, index % w.l2Entries, nil
+}
+
+func (w *qcow2Writer) setL2Entry(table []uint64, l2Offset, index int64, entry uint64) error {
+	table[index] = entry
+	return binary.Write(io.NewOffsetWriter(w.file, l2Offset+index*8), binary.BigEndian, entry)
+}
+
+// allocateClusters allocates contiguous clusters at the end of the file.
+func (w *qcow2Writer) allocateClusters(count int64) (int64, error) {
+	host := w.fileEnd
+	w.fileEnd += count * w.clusterSize
+	for i := int64(0); i < count; i++ {
+		if err := w.setRefcount(host+i*w.clusterSize, 1); err != nil {
+			return 0, err
+		}
+	}
+	return host, nil
+}
+
+// refcountLocation returns the index in the refcount table, and the index in the
+// refcount block of the host cluster.
+func (w *qcow2Writer) refcountLocation(host int64) (int64, int64) {
+	cluster := host / w.clusterSize
+	blockEntries := w.clusterSize / qcow2RefcountBytes
+	return cluster / blockEntries, cluster % blockEntries
+}
+
+func (w *qcow2Writer) refcount(host int64) (uint16, error) {
+	tableIndex, blockIndex := w.refcountLocation(host)
+	if tableIndex >= int64(len(w.refcountTable)) {
+		return 0, nil
+	}
+	block := int64(w.refcountTable[tableIndex] & qcow2RefcountOffsetMask)
+	if block == 0 {
+		return 0, nil
+	}
+	var refcount uint16
+	err := binary.Read(io.NewSectionReader(w.file, block+blockIndex*qcow2RefcountBytes, qcow2RefcountBytes), binary.BigEndian, &refcount)
+	return refcount, err
+}
+
+// setRefcount sets the refcount of the host cluster, the refcount table is grown
+// and refcount blocks are allocated as needed.
+func (w *qcow2Writer) setRefcount(host int64, refcount uint16) error {
+	tableIndex, blockIndex := w.refcountLocation(host)
+	if tableIndex >= int64(len(w.refcountTable)) {
+		if refcount == 0 {
+			return nil
+		}
+		if err := w.growRefcountTable(tableIndex + 1); err != nil {
+			return err
+		}
+	}
+	block := int64(w.refcountTable[tableIndex] & qcow2RefcountOffsetMask)
+	if block == 0 {
+		if refcount == 0 {
+			return nil
+		}
+		block = w.fileEnd
+		w.fileEnd += w.clusterSize
+		if _, err := w.file.WriteAt(make([]byte, w.clusterSize), block); err != nil {
+			return err
+		}
+		w.refcountTable[tableIndex] = uint64(block)
+		if err := binary.Write(io.NewOffsetWriter(w.file, int64(w.header.RefcountTableOffset)+tableIndex*8), binary.BigEndian, uint64(block)); err != nil {
+			return err
+		}
+		// The new refcount block is referenced as well
+		if err := w.setRefcount(block, 1); err != nil {
+			return err
+		}
+	}
+	return binary.Write(io.NewOffsetWriter(w.file, block+blockIndex*qcow2RefcountBytes), binary.BigEndian, refcount)
+}
+
+// growRefcountTable moves the refcount table to a larger table at the end of the
+// file, and frees the old table.
+func (w *qcow2Writer) growRefcountTable(entries int64) error {
+	clusters := 2 * ((entries*8 + w.clusterSize - 1) / w.clusterSize)
+	table := make([]uint64, clusters*w.clusterSize/8)
+	copy(table, w.refcountTable)
+	offset := w.fileEnd
+	w.fileEnd += clusters * w.clusterSize
+	if err := binary.Write(io.NewOffsetWriter(w.file, offset), binary.BigEndian, table); err != nil {
+		return err
+	}
+	oldOffset, oldClusters := int64(w.header.RefcountTableOffset), int64(w.header.RefcountTableClusters)
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.writeHeaderField(headerRefcountTableOffset, uint64(offset)); err != nil {
+		return err
+	}
+	if err := w.writeHeaderField(headerRefcountTableCluster, uint32(clusters)); err != nil {
+		return err
+	}
+	w.header.RefcountTableOffset, w.header.RefcountTableClusters = uint64(offset), uint32(clusters)
+	w.refcountTable = table
+	for i := int64(0); i < clusters; i++ {
+		if err := w.setRefcount(offset+i*w.clusterSize, 1); err != nil {
+			return err
+		}
+	}
+	return w.freeClusters(oldOffset, oldClusters)
+}
+
+// Truncate resizes the virtual disk. When shrinking, the clusters beyond the new
+// size are freed, so they read as zeros if the image grows again.
+func (w *qcow2Writer) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	if size < w.Size() {
+		if tail := size % w.clusterSize; tail != 0 {
+			if err := w.Zero(size, min(w.clusterSize-tail, w.Size()-size)); err != nil {
+				return err
+			}
+		}
+		if err := w.freeBeyond(size); err != nil {
+			return err
+		}
+	}
+	clusters := (size + w.clusterSize - 1) / w.clusterSize
+	if required := (clusters + w.l2Entries - 1) / w.l2Entries; required > int64(len(w.l1)) {
+		if err := w.growL1Table(required); err != nil {
+			return err
+		}
+	}
+	if err := w.writeHeaderField(headerSizeOffset, uint64(size)); err != nil {
+		return err
+	}
+	w.header.Size = uint64(size)
+	return nil
+}
+
+// freeBeyond frees the clusters that start at or after the size.
+func (w *qcow2Writer) freeBeyond(size int64) error {
+	first := (size + w.clusterSize - 1) / w.clusterSize
+	for l1Index, l1Entry := range w.l1 {
+		l2Offset := int64(l1Entry & qcow2OffsetMask)
+		if l2Offset == 0 || (int64(l1Index)+1)*w.l2Entries <= first {
+			continue
+		}
+		table, err := w.l2Table(uint64(l2Offset))
+		if err != nil {
+			return err
+		}
+		for index := max(first-int64(l1Index)*w.l2Entries, 0); index < w.l2Entries; index++ {
+			if entry := table[index]; entry != 0 {
+				if err := w.setL2Entry(table, l2Offset, index, 0); err != nil {
+					return err
+				}
+				if err := w.freeEntry(entry); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// growL1Table moves the L1 table to a larger table at the end of the file.
+func (w *qcow2Writer) growL1Table(entries int64) error {
+	if entries*8 > qcow2MaxL1Size {
+		return fmt.Errorf("%w: size requires an L1 table of %d entries", ErrUnsupportedImage, entries)
+	}
+	clusters := (entries*8 + w.clusterSize - 1) / w.clusterSize
+	l1 := make([]uint64, entries)
+	copy(l1, w.l1)
+	offset, err := w.allocateClusters(clusters)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, clusters*w.clusterSize)
+	for i, entry := range l1 {
+		binary.BigEndian.PutUint64(buf[i*8:], entry)
+	}
+	if _, err := w.file.WriteAt(buf, offset); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	oldOffset := int64(w.header.L1TableOffset)
+	oldClusters := (int64(w.header.L1Size)*8 + w.clusterSize - 1) / w.clusterSize
+	if err := w.writeHeaderField(headerL1SizeOffset, uint32(entries)); err != nil {
+		return err
+	}
+	if err := w.writeHeaderField(headerL1TableOffset, uint64(offset)); err != nil {
+		return err
+	}
+	w.header.L1Size, w.header.L1TableOffset = uint32(entries), uint64(offset)
+	w.l1 = l1
+	if oldOffset != 0 && oldClusters > 0 {
+		return w.freeClusters(oldOffset, oldClusters)
+	}
+	return nil
+}
+
+// createQcow2 writes an empty version 3 image. The header is in the first
+// cluster with the backing file name, followed by the refcount table, the first
+// refcount block and the L1 table.
+func createQcow2(fileName string, size int64, clusterBits uint32, backingFile, backingFormat string) error {
+	clusterSize := int64(1) << clusterBits
+	l2Entries := clusterSize / 8
+	l1Size := max(((size+clusterSize-1)/clusterSize+l2Entries-1)/l2Entries, 1)
+	l1Clusters := max((l1Size*8+clusterSize-1)/clusterSize, 1)
+	if l1Size*8 > qcow2MaxL1Size {
+		return fmt.Errorf("%w: size %d is too large", ErrUnsupportedImage, size)
+	}
+	clusters := 3 + l1Clusters
+	if clusters > clusterSize/qcow2RefcountBytes {
+		return fmt.Errorf("%w: size %d is too large", ErrUnsupportedImage, size)
+	}
+	header := qcow2Header{
+		Version:               3,
+		ClusterBits:           clusterBits,
+		Size:                  uint64(size),
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         uint64(3 * clusterSize),
+		RefcountTableOffset:   uint64(clusterSize),
+		RefcountTableClusters: 1,
+		RefcountOrder:         qcow2RefcountOrder,
+		HeaderLength:          qcow2HeaderV3Size,
+	}
+	copy(header.Magic[:], qcow2Magic)
+	// The header extensions follow the header, the end extension is all zeros
+	extensions := &bytes.Buffer{}
+	if backingFormat != "" {
+		extensions.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, qcow2ExtBackingFormat), uint32(len(backingFormat))))
+		extensions.WriteString(backingFormat)
+		extensions.Write(make([]byte, (8-len(backingFormat)%8)%8))
+	}
+	extensions.Write(make([]byte, 8))
+	if backingFile != "" {
+		header.BackingFileOffset = uint64(qcow2HeaderV3Size + extensions.Len())
+		header.BackingFileSize = uint32(len(backingFile))
+		extensions.WriteString(backingFile)
+	}
+	if qcow2HeaderV3Size+int64(extensions.Len()) > clusterSize || len(backingFile) > 1023 {
+		return fmt.Errorf("%w: backing file name %s is too long", ErrUnsupportedImage, backingFile)
+	}
+	headerBuf := &bytes.Buffer{}
+	if err := binary.Write(headerBuf, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	buf := make([]byte, clusters*clusterSize)
+	copy(buf, headerBuf.Bytes())
+	copy(buf[qcow2HeaderV3Size:], extensions.Bytes())
+	binary.BigEndian.PutUint64(buf[clusterSize:], uint64(2*clusterSize))
+	for i := int64(0); i < clusters; i++ {
+		binary.BigEndian.PutUint16(buf[2*clusterSize+i*qcow2RefcountBytes:], 1)
+	}
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,292 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// expectConsistentRefcounts checks that the refcount of every cluster in the file
+// matches the number of references to it, like qemu-img check.
+func expectConsistentRefcounts(fileName string) {
+	w, err := openQcow2Writer(fileName)
+	Expect(err).ToNot(HaveOccurred())
+	defer w.Close()
+	expected := make(map[int64]uint16)
+	reference := func(offset, length int64) {
+		for host := offset / w.clusterSize * w.clusterSize; host < offset+length; host += w.clusterSize {
+			expected[host]++
+		}
+	}
+	reference(0, w.clusterSize)
+	reference(int64(w.header.RefcountTableOffset), int64(w.header.RefcountTableClusters)*w.clusterSize)
+	for _, block := range w.refcountTable {
+		if block != 0 {
+			reference(int64(block&qcow2RefcountOffsetMask), w.clusterSize)
+		}
+	}
+	reference(int64(w.header.L1TableOffset), int64(w.header.L1Size)*8)
+	for _, l1Entry := range w.l1 {
+		l2Offset := l1Entry & qcow2OffsetMask
+		if l2Offset == 0 {
+			continue
+		}
+		reference(int64(l2Offset), w.clusterSize)
+		table, err := w.l2Table(l2Offset)
+		Expect(err).ToNot(HaveOccurred())
+		for _, entry := range table {
+			if entry&qcow2CompressedFlag != 0 {
+				offsetBits := 62 - (w.header.ClusterBits - 8)
+				hostOffset := int64(entry & (uint64(1)<<offsetBits - 1))
+				sectors := int64((entry >> offsetBits) & (uint64(1)<<(62-offsetBits) - 1))
+				reference(hostOffset, hostOffset&^511+(sectors+1)*512-hostOffset)
+			} else if host := entry & qcow2OffsetMask; host != 0 {
+				reference(int64(host), w.clusterSize)
+			}
+		}
+	}
+	info, err := w.file.Stat()
+	Expect(err).ToNot(HaveOccurred())
+	for host := int64(0); host < max(info.Size(), w.fileEnd); host += w.clusterSize {
+		refcount, err := w.refcount(host)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refcount).To(Equal(expected[host]), "refcount of cluster at %d", host)
+	}
+}
+
+var _ = Describe("qcow2 writer tests", func() {
+	const clusterSize = 4096
+
+	var (
+		tmpDir   string
+		fileName string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "image-qcow2-writer")
+		Expect(err).ToNot(HaveOccurred())
+		fileName = filepath.Join(tmpDir, "image.qcow2")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	expectContent := func(expected []byte) {
+		img, err := Open(fileName, FormatAuto)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(img.Size()).To(Equal(int64(len(expected))))
+		Expect(readAll(img)).To(Equal(expected))
+		expectConsistentRefcounts(fileName)
+	}
+
+	It("should write to a new image", func() {
+		Expect(createQcow2(fileName, 64*clusterSize, 12, "", "")).To(Succeed())
+		img, err := OpenWritable(fileName, FormatAuto)
+		Expect(err).ToNot(HaveOccurred())
+		expected := make([]byte, 64*clusterSize)
+		write := func(offset int64, data []byte) {
+			n, err := img.WriteAt(data, offset)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(len(data)))
+			copy(expected[offset:], data)
+		}
+		write(0, randomData(clusterSize, 1))
+		// Across clusters, partially
+		write(3*clusterSize-100, randomData(clusterSize+200, 2))
+		write(40*clusterSize+10, randomData(10, 3))
+		// Over already allocated clusters
+		write(100, randomData(200, 4))
+		Expect(img.Sync()).To(Succeed())
+		Expect(img.Close()).To(Succeed())
+		expectContent(expected)
+
+		img, err = OpenWritable(fileName, FormatQcow2)
+		Expect(err).ToNot(HaveOccurred())
+		allocated, err := img.Allocated(10*clusterSize, clusterSize)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(allocated).To(BeFalse())
+		_, err = img.WriteAt(make([]byte, 10), 64*clusterSize-5)
+		Expect(err).To(HaveOccurred())
+		Expect(img.Close()).To(Succeed())
+	})
+
+	It("should zero ranges, deallocating whole clusters", func() {
+		Expect(createQcow2(fileName, 16*clusterSize, 12, "", "")).To(Succeed())
+		img, err := OpenWritable(fileName, FormatQcow2)
+		Expect(err).ToNot(HaveOccurred())
+		expected := randomData(16*clusterSize, 1)
+		_, err = img.WriteAt(expected, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(img.Zero(2*clusterSize, 3*clusterSize)).To(Succeed())
+		Expect(img.Zero(8*clusterSize+100, 100)).To(Succeed())
+		copy(expected[2*clusterSize:], make([]byte, 3*clusterSize))
+		copy(expected[8*clusterSize+100:], make([]byte, 100))
+		for _, cluster := range []int64{2, 3, 4} {
+			allocated, err := img.Allocated(cluster*clusterSize, clusterSize)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allocated).To(BeFalse())
+		}
+		Expect(img.Close()).To(Succeed())
+		expectContent(expected)
+	})
+
+	It("should resize the virtual disk", func() {
+		img, err := Create(fileName, FormatQcow2, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(img.Size()).To(BeZero())
+		// Larger than a single L2 table covers
+		size := int64(600 * 1024 * 1024)
+		Expect(img.Truncate(size)).To(Succeed())
+		data := randomData(3*65536, 1)
+		_, err = img.WriteAt(data, size-int64(len(data)))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = img.WriteAt(data, 0)
+		Expect(err).ToNot(HaveOccurred())
+		// Shrink into the middle of a cluster, the rest reads as zeros when grown again
+		Expect(img.Truncate(65536 + 100)).To(Succeed())
+		Expect(img.Truncate(3 * 65536)).To(Succeed())
+		Expect(img.Close()).To(Succeed())
+		expected := make([]byte, 3*65536)
+		copy(expected, data[:65536+100])
+		expectContent(expected)
+	})
+
+	It("should grow the refcount table", func() {
+		// With 512 byte clusters a refcount table cluster covers 8MiB
+		Expect(createQcow2(fileName, 10*1024*1024, 9, "", "")).To(Succeed())
+		img, err := OpenWritable(fileName, FormatQcow2)
+		Expect(err).ToNot(HaveOccurred())
+		expected := randomData(10*1024*1024, 1)
+		_, err = img.WriteAt(expected, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(img.Close()).To(Succeed())
+		expectContent(expected)
+	})
+
+	It("should write over a backing file and compressed clusters", func() {
+		backing := randomData(16*clusterSize, 10)
+		Expect(os.WriteFile(filepath.Join(tmpDir, "base.raw"), backing, 0644)).To(Succeed())
+		t, expected := newTestImage(3)
+		t.backingFile = "base.raw"
+		t.backingFormat = FormatRaw
+		t.write(fileName)
+		// The test images do not have refcounts, add them like qemu-img check -r all
+		repairRefcounts(fileName)
+		for _, cluster := range []int64{0, 2, 4, 6, 8, 9, 10, 11, 12, 13, 14, 15} {
+			copy(expected[cluster*clusterSize:(cluster+1)*clusterSize], backing[cluster*clusterSize:])
+		}
+
+		img, err := OpenWritable(fileName, FormatQcow2)
+		Expect(err).ToNot(HaveOccurred())
+		// Partial write over the backing file, and the compressed cluster
+		data := randomData(100, 1)
+		for _, offset := range []int64{2*clusterSize + 10, 3*clusterSize + 10} {
+			_, err = img.WriteAt(data, offset)
+			Expect(err).ToNot(HaveOccurred())
+			copy(expected[offset:], data)
+		}
+		// Zeroing a cluster with data in the backing file
+		Expect(img.Zero(4*clusterSize, clusterSize)).To(Succeed())
+		copy(expected[4*clusterSize:], make([]byte, clusterSize))
+		Expect(img.Close()).To(Succeed())
+		expectContent(expected)
+	})
+
+	It("should create an overlay on top of a backing file", func() {
+		backing := randomData(16*65536, 10)
+		backingFile := filepath.Join(tmpDir, "base.raw")
+		Expect(os.WriteFile(backingFile, backing, 0644)).To(Succeed())
+		img, err := CreateOverlay(fileName, backingFile, FormatRaw, int64(len(backing)))
+		Expect(err).ToNot(HaveOccurred())
+		expected := bytes.Clone(backing)
+		data := randomData(65536, 1)
+		_, err = img.WriteAt(data, 2*65536)
+		Expect(err).ToNot(HaveOccurred())
+		copy(expected[2*65536:], data)
+		Expect(img.Zero(5*65536, 65536)).To(Succeed())
+		copy(expected[5*65536:], make([]byte, 65536))
+		for cluster, allocated := range map[int64]bool{2: true, 5: false} {
+			ok, err := img.Allocated(cluster*65536, 65536)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(Equal(allocated))
+		}
+		Expect(img.Close()).To(Succeed())
+		expectContent(expected)
+
+		// The backing file is not modified
+		Expect(os.ReadFile(backingFile)).To(Equal(backing))
+		_, err = CreateOverlay(fileName, backingFile, FormatVMDK, int64(len(backing)))
+		Expect(errors.Is(err, ErrUnsupportedImage)).To(BeTrue())
+	})
+
+	DescribeTable("should refuse to write unsupported images", func(modify func(*testQcow2)) {
+		t, _ := newTestImage(3)
+		modify(t)
+		t.write(fileName)
+		_, err := OpenWritable(fileName, FormatQcow2)
+		Expect(errors.Is(err, ErrUnsupportedImage)).To(BeTrue(), "error %v", err)
+	},
+		Entry("dirty", func(t *testQcow2) { t.incompatible = qcow2IncompatDirty }),
+		Entry("internal snapshots", func(t *testQcow2) { t.snapshots = 1 }),
+	)
+})
+
+// repairRefcounts writes a refcount table and block for the clusters referenced
+// by a test image.
+func repairRefcounts(fileName string) {
+	q, err := openQcow2Chain(fileName, os.O_RDWR, 0)
+	Expect(err).ToNot(HaveOccurred())
+	defer q.Close()
+	info, err := q.file.Stat()
+	Expect(err).ToNot(HaveOccurred())
+	end := (info.Size() + q.clusterSize - 1) / q.clusterSize * q.clusterSize
+	refcounts := make([]uint16, end/q.clusterSize+2)
+	reference := func(offset, length int64) {
+		for host := offset / q.clusterSize * q.clusterSize; host < offset+length; host += q.clusterSize {
+			refcounts[host/q.clusterSize]++
+		}
+	}
+	reference(0, q.clusterSize)
+	reference(int64(q.header.L1TableOffset), int64(q.header.L1Size)*8)
+	for _, l1Entry := range q.l1 {
+		if l2Offset := l1Entry & qcow2OffsetMask; l2Offset != 0 {
+			reference(int64(l2Offset), q.clusterSize)
+			table, err := q.l2Table(l2Offset)
+			Expect(err).ToNot(HaveOccurred())
+			for _, entry := range table {
+				if entry&qcow2CompressedFlag != 0 {
+					offsetBits := 62 - (q.header.ClusterBits - 8)
+					hostOffset := int64(entry & (uint64(1)<<offsetBits - 1))
+					sectors := int64((entry >> offsetBits) & (uint64(1)<<(62-offsetBits) - 1))
+					reference(hostOffset, hostOffset&^511+(sectors+1)*512-hostOffset)
+				} else if host := entry & qcow2OffsetMask; host != 0 {
+					reference(int64(host), q.clusterSize)
+				}
+			}
+		}
+	}
+	// The refcount table and block are the last two clusters
+	tableOffset, blockOffset := end, end+q.clusterSize
+	refcounts[tableOffset/q.clusterSize]++
+	refcounts[blockOffset/q.clusterSize]++
+	Expect(int64(len(refcounts))).To(BeNumerically("<=", q.clusterSize/qcow2RefcountBytes))
+	table := make([]byte, q.clusterSize)
+	binary.BigEndian.PutUint64(table, uint64(blockOffset))
+	block := make([]byte, q.clusterSize)
+	for i, refcount := range refcounts {
+		binary.BigEndian.PutUint16(block[i*2:], refcount)
+	}
+	_, err = q.file.WriteAt(append(table, block...), tableOffset)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(binary.Write(io.NewOffsetWriter(q.file, headerRefcountTableOffset), binary.BigEndian, uint64(tableOffset))).To(Succeed())
+	Expect(binary.Write(io.NewOffsetWriter(q.file, headerRefcountTableCluster), binary.BigEndian, uint32(1))).To(Succeed())
+}
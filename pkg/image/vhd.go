@@ -0,0 +1,231 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	vhdCookie        = "conectix"
+	vhdDynamicCookie = "cxsparse"
+	vhdFooterSize    = 512
+	vhdSectorSize    = 512
+	vhdMaxBlockSize  = 256 * 1024 * 1024
+	vhdMaxTableSize  = 1 << 24
+
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+	// block allocation table entry of a block that is not allocated
+	vhdUnallocated = ^uint32(0)
+)
+
+// vhdFooter is the big endian footer at the end of a VHD image, dynamic images
+// have a copy at the start.
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      uint32
+	OriginalSize       uint64
+	CurrentSize        uint64
+	DiskGeometry       uint32
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// vhdDynamicHeader follows the footer copy in dynamic and differencing images.
+type vhdDynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    [16]byte
+	ParentTimeStamp   uint32
+	Reserved          uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [8][24]byte
+	Reserved2         [256]byte
+}
+
+// vhdImage reads the virtual disk of a fixed or dynamic VHD image. Blocks that
+// are not allocated in a dynamic image read as zeros.
+type vhdImage struct {
+	file      *os.File
+	footer    vhdFooter
+	blockSize int64
+	// bitmapSize is the size of the sector bitmap in front of every block
+	bitmapSize int64
+	bat        []uint32
+}
+
+func openVHD(fileName string) (*vhdImage, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	v := &vhdImage{file: f}
+	if err := v.init(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return v, nil
+}
+
+// readVHDFooter reads the footer at the end of the file.
+func readVHDFooter(f *os.File) (*vhdFooter, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < vhdFooterSize {
+		return nil, fmt.Errorf("%w: not a vhd image", ErrUnsupportedImage)
+	}
+	return parseVHDFooter(io.NewSectionReader(f, info.Size()-vhdFooterSize, vhdFooterSize))
+}
+
+func parseVHDFooter(r io.Reader) (*vhdFooter, error) {
+	buf := make([]byte, vhdFooterSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	footer := &vhdFooter{}
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, footer); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer.Cookie[:], []byte(vhdCookie)) {
+		return nil, fmt.Errorf("%w: not a vhd image", ErrUnsupportedImage)
+	}
+	// The checksum field itself is not part of the checksum
+	binary.BigEndian.PutUint32(buf[64:], 0)
+	if vhdChecksum(buf) != footer.Checksum {
+		return nil, fmt.Errorf("%w: invalid vhd footer checksum", ErrUnsupportedImage)
+	}
+	return footer, nil
+}
+
+// vhdChecksum is the ones complement of the sum of the bytes.
+func vhdChecksum(buf []byte) uint32 {
+	var sum uint32
+	for _, b := range buf {
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+func (v *vhdImage) init() error {
+	footer, err := readVHDFooter(v.file)
+	if err != nil {
+		// Fall back to the copy of the footer at the start of dynamic images
+		if footer, err = parseVHDFooter(io.NewSectionReader(v.file, 0, vhdFooterSize)); err != nil {
+			return err
+		}
+	}
+	v.footer = *footer
+	if v.footer.CurrentSize > uint64(1)<<62 {
+		return fmt.Errorf("%w: size %d", ErrUnsupportedImage, v.footer.CurrentSize)
+	}
+	switch v.footer.DiskType {
+	case vhdTypeFixed:
+		return nil
+	case vhdTypeDynamic:
+		return v.readDynamicHeader()
+	case vhdTypeDifferencing:
+		return fmt.Errorf("%w: differencing vhd images", ErrUnsupportedImage)
+	default:
+		return fmt.Errorf("%w: vhd disk type %d", ErrUnsupportedImage, v.footer.DiskType)
+	}
+}
+
+func (v *vhdImage) readDynamicHeader() error {
+	buf := make([]byte, binary.Size(vhdDynamicHeader{}))
+	if _, err := v.file.ReadAt(buf, int64(v.footer.DataOffset)); err != nil {
+		return fmt.Errorf("unable to read dynamic header: %w", err)
+	}
+	var h vhdDynamicHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &h); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(buf[36:], 0)
+	if !bytes.Equal(h.Cookie[:], []byte(vhdDynamicCookie)) || vhdChecksum(buf) != h.Checksum {
+		return fmt.Errorf("%w: invalid dynamic header", ErrUnsupportedImage)
+	}
+	if h.BlockSize == 0 || h.BlockSize%vhdSectorSize != 0 || h.BlockSize > vhdMaxBlockSize {
+		return fmt.Errorf("%w: block size %d", ErrUnsupportedImage, h.BlockSize)
+	}
+	v.blockSize = int64(h.BlockSize)
+	blocks := (int64(v.footer.CurrentSize) + v.blockSize - 1) / v.blockSize
+	if int64(h.MaxTableEntries) < blocks || h.MaxTableEntries > vhdMaxTableSize {
+		return fmt.Errorf("%w: invalid block allocation table size %d", ErrUnsupportedImage, h.MaxTableEntries)
+	}
+	sectorsPerBlock := v.blockSize / vhdSectorSize
+	v.bitmapSize = ((sectorsPerBlock+7)/8 + vhdSectorSize - 1) / vhdSectorSize * vhdSectorSize
+	v.bat = make([]uint32, blocks)
+	reader := io.NewSectionReader(v.file, int64(h.TableOffset), blocks*4)
+	if err := binary.Read(reader, binary.BigEndian, v.bat); err != nil {
+		return fmt.Errorf("unable to read block allocation table: %w", err)
+	}
+	return nil
+}
+
+func (v *vhdImage) Size() int64 {
+	return int64(v.footer.CurrentSize)
+}
+
+func (v *vhdImage) Format() string {
+	return FormatVHD
+}
+
+func (v *vhdImage) Close() error {
+	return v.file.Close()
+}
+
+// ReadAt reads the virtual disk, it is safe for concurrent use.
+func (v *vhdImage) ReadAt(p []byte, offset int64) (int, error) {
+	if v.footer.DiskType == vhdTypeFixed {
+		// The data of a fixed image is stored as is in front of the footer
+		return io.NewSectionReader(v.file, 0, v.Size()).ReadAt(p, offset)
+	}
+	return readBlocks(p, offset, v.Size(), v.blockSize, v.readBlock)
+}
+
+func (v *vhdImage) readBlock(buf []byte, blockOffset, inBlock int64) error {
+	sector := v.bat[blockOffset/v.blockSize]
+	if sector == vhdUnallocated {
+		clear(buf)
+		return nil
+	}
+	n, err := v.file.ReadAt(buf, int64(sector)*vhdSectorSize+v.bitmapSize+inBlock)
+	if err == io.EOF {
+		clear(buf[n:])
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read block at %d: %w", blockOffset, err)
+	}
+	return nil
+}
+
+// Allocated returns true if any block in the range is allocated, all of a fixed
+// image is allocated.
+func (v *vhdImage) Allocated(offset, length int64) (bool, error) {
+	if v.footer.DiskType == vhdTypeFixed {
+		return offset < v.Size(), nil
+	}
+	return allocatedBlocks(offset, length, v.Size(), v.blockSize, func(blockOffset int64) (bool, error) {
+		return v.bat[blockOffset/v.blockSize] != vhdUnallocated, nil
+	})
+}
@@ -0,0 +1,181 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// testVHD builds small fixed and dynamic VHD images for the tests.
+type testVHD struct {
+	diskType  uint32
+	size      int64
+	blockSize int64
+	// virtual block offset to data
+	blocks      map[int64][]byte
+	badChecksum bool
+}
+
+func (t *testVHD) footer(dataOffset uint64) []byte {
+	f := vhdFooter{
+		FileFormatVersion: 0x00010000,
+		DataOffset:        dataOffset,
+		OriginalSize:      uint64(t.size),
+		CurrentSize:       uint64(t.size),
+		DiskType:          t.diskType,
+	}
+	copy(f.Cookie[:], vhdCookie)
+	buf := &bytes.Buffer{}
+	Expect(binary.Write(buf, binary.BigEndian, f)).To(Succeed())
+	b := buf.Bytes()
+	checksum := vhdChecksum(b)
+	if t.badChecksum {
+		checksum++
+	}
+	binary.BigEndian.PutUint32(b[64:], checksum)
+	return b
+}
+
+func (t *testVHD) write(fileName string) {
+	out := &bytes.Buffer{}
+	if t.diskType == vhdTypeFixed {
+		data := make([]byte, t.size)
+		for offset, block := range t.blocks {
+			copy(data[offset:], block)
+		}
+		out.Write(data)
+		out.Write(t.footer(^uint64(0)))
+		Expect(os.WriteFile(fileName, out.Bytes(), 0644)).To(Succeed())
+		return
+	}
+	// The footer copy, the dynamic header and the block allocation table
+	out.Write(t.footer(vhdFooterSize))
+	blocks := (t.size + t.blockSize - 1) / t.blockSize
+	tableOffset := int64(vhdFooterSize + 1024)
+	bat := make([]uint32, blocks)
+	next := tableOffset + (blocks*4+vhdSectorSize-1)/vhdSectorSize*vhdSectorSize
+	for i := range bat {
+		bat[i] = vhdUnallocated
+	}
+	data := &bytes.Buffer{}
+	for i := range bat {
+		block, ok := t.blocks[int64(i)*t.blockSize]
+		if !ok {
+			continue
+		}
+		bat[i] = uint32((next + int64(data.Len())) / vhdSectorSize)
+		data.Write(bytes.Repeat([]byte{0xff}, vhdSectorSize))
+		data.Write(block)
+		data.Write(make([]byte, t.blockSize-int64(len(block))))
+	}
+	h := vhdDynamicHeader{
+		DataOffset:      ^uint64(0),
+		TableOffset:     uint64(tableOffset),
+		HeaderVersion:   0x00010000,
+		MaxTableEntries: uint32(blocks),
+		BlockSize:       uint32(t.blockSize),
+	}
+	copy(h.Cookie[:], vhdDynamicCookie)
+	header := &bytes.Buffer{}
+	Expect(binary.Write(header, binary.BigEndian, h)).To(Succeed())
+	binary.BigEndian.PutUint32(header.Bytes()[36:], vhdChecksum(header.Bytes()))
+	out.Write(header.Bytes())
+	Expect(binary.Write(out, binary.BigEndian, bat)).To(Succeed())
+	out.Write(make([]byte, next-int64(out.Len())))
+	out.Write(data.Bytes())
+	out.Write(t.footer(vhdFooterSize))
+	Expect(os.WriteFile(fileName, out.Bytes(), 0644)).To(Succeed())
+}
+
+// newTestVHD returns a 10 block image with data in blocks 2, 3 and the partial
+// last block, and its expected content.
+func newTestVHD(diskType uint32) (*testVHD, []byte) {
+	expected := make([]byte, 9*testClusterSize+vhdSectorSize)
+	t := &testVHD{
+		diskType:  diskType,
+		size:      int64(len(expected)),
+		blockSize: testClusterSize,
+		blocks: map[int64][]byte{
+			2 * testClusterSize: randomData(testClusterSize, 2),
+			3 * testClusterSize: randomData(100, 3),
+			9 * testClusterSize: randomData(vhdSectorSize, 9),
+		},
+	}
+	for offset, data := range t.blocks {
+		copy(expected[offset:], data)
+	}
+	return t, expected
+}
+
+var _ = Describe("vhd tests", func() {
+	var (
+		tmpDir   string
+		fileName string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "image-vhd")
+		Expect(err).ToNot(HaveOccurred())
+		fileName = filepath.Join(tmpDir, "image.vhd")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	DescribeTable("should read the virtual disk", func(diskType uint32, allocated map[int64]bool) {
+		t, expected := newTestVHD(diskType)
+		t.write(fileName)
+		Expect(DetectFormat(fileName)).To(Equal(FormatVHD))
+		img, err := Open(fileName, FormatAuto)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(img.Format()).To(Equal(FormatVHD))
+		Expect(img.Size()).To(Equal(int64(len(expected))))
+		Expect(readAll(img)).To(Equal(expected))
+		for block, expectedAllocated := range allocated {
+			ok, err := img.Allocated(block*testClusterSize, testClusterSize)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(Equal(expectedAllocated), "block %d", block)
+		}
+	},
+		Entry("fixed", uint32(vhdTypeFixed), map[int64]bool{0: true, 2: true, 5: true}),
+		Entry("dynamic", uint32(vhdTypeDynamic), map[int64]bool{0: false, 2: true, 3: true, 5: false, 9: true}),
+	)
+
+	It("should read a dynamic image with a damaged footer from the copy at the start", func() {
+		t, expected := newTestVHD(vhdTypeDynamic)
+		t.write(fileName)
+		data, err := os.ReadFile(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		copy(data[len(data)-vhdFooterSize:], make([]byte, vhdFooterSize))
+		Expect(os.WriteFile(fileName, data, 0644)).To(Succeed())
+		img, err := Open(fileName, FormatAuto)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(readAll(img)).To(Equal(expected))
+	})
+
+	DescribeTable("should reject unsupported images", func(modify func(*testVHD)) {
+		t, _ := newTestVHD(vhdTypeDynamic)
+		modify(t)
+		t.write(fileName)
+		_, err := Open(fileName, FormatVHD)
+		Expect(errors.Is(err, ErrUnsupportedImage)).To(BeTrue(), "error %v", err)
+	},
+		Entry("differencing", func(t *testVHD) { t.diskType = vhdTypeDifferencing }),
+		Entry("invalid checksum", func(t *testVHD) { t.badChecksum = true }),
+	)
+
+	It("should not detect a raw file as a fixed image", func() {
+		rawFile := filepath.Join(tmpDir, "image.raw")
+		Expect(os.WriteFile(rawFile, append(randomData(testClusterSize, 1), []byte(vhdCookie)...), 0644)).To(Succeed())
+		Expect(DetectFormat(rawFile)).To(Equal(FormatRaw))
+	})
+})
@@ -0,0 +1,325 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	vhdxMagic             = "vhdxfile"
+	vhdxHeaderSignature   = "head"
+	vhdxRegionSignature   = "regi"
+	vhdxMetadataSignature = "metadata"
+	vhdxHeaderSize        = 4096
+	vhdxRegionTableSize   = 64 * 1024
+	vhdxMaxEntries        = 2047
+	vhdxMinBlockSize      = 1024 * 1024
+	vhdxMaxBlockSize      = 256 * 1024 * 1024
+	vhdxMaxBATSize        = 1 << 30
+
+	vhdxBATStateMask     = uint64(7)
+	vhdxBATFullyPresent  = uint64(6)
+	vhdxBATOffsetShift   = 20
+	vhdxHasParent        = uint32(1) << 1
+	vhdxRequired         = uint32(1) << 2
+	vhdxRegionRequired   = uint32(1)
+	vhdxSectorBitmapSize = int64(1) << 23
+
+	vhdxBATRegion          = "2DC27766-F623-4200-9D64-115E9BFD4A08"
+	vhdxMetadataRegion     = "8B7CA206-4790-4B9A-B8FE-575F050F886E"
+	vhdxFileParameters     = "CAA16737-FA36-4D43-B3B6-33F0AA44E76B"
+	vhdxVirtualDiskSize    = "2FA54224-CD1B-4876-B211-5DBED83BF4B8"
+	vhdxLogicalSectorSize  = "8141BF1D-A96F-4709-BA47-F233A8FAAB5F"
+	vhdxPhysicalSectorSize = "CDA348C7-445D-4471-9CC9-E9885251C556"
+	vhdxPage83Data         = "BECA12AB-B2E6-4523-93EF-C309E000C746"
+)
+
+// vhdxHeaderOffsets are the offsets of the two copies of the header, and the
+// two copies of the region table.
+var (
+	vhdxHeaderOffsets = []int64{64 * 1024, 128 * 1024}
+	vhdxRegionOffsets = []int64{192 * 1024, 256 * 1024}
+	vhdxCRCTable      = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// vhdxHeader is the little endian header, the copy with the highest sequence
+// number is current.
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxTableEntry struct {
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataEntry struct {
+	ItemID   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// vhdxImage reads the virtual disk of a fixed or dynamic VHDX image. Blocks that
+// are not fully present read as zeros.
+type vhdxImage struct {
+	file      *os.File
+	size      int64
+	blockSize int64
+	// chunkRatio is the number of blocks between sector bitmap entries in the BAT
+	chunkRatio int64
+	bat        []uint64
+}
+
+func openVHDX(fileName string) (*vhdxImage, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	v := &vhdxImage{file: f}
+	if err := v.init(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return v, nil
+}
+
+func (v *vhdxImage) init() error {
+	magic := make([]byte, len(vhdxMagic))
+	if _, err := v.file.ReadAt(magic, 0); err != nil || !bytes.Equal(magic, []byte(vhdxMagic)) {
+		return fmt.Errorf("%w: not a vhdx image", ErrUnsupportedImage)
+	}
+	header, err := v.readHeader()
+	if err != nil {
+		return err
+	}
+	if header.LogGUID != [16]byte{} {
+		return fmt.Errorf("%w: vhdx log needs to be replayed", ErrUnsupportedImage)
+	}
+	regions, err := v.readRegionTable()
+	if err != nil {
+		return err
+	}
+	metadata, ok := regions[vhdxMetadataRegion]
+	if !ok {
+		return fmt.Errorf("%w: missing metadata region", ErrUnsupportedImage)
+	}
+	if err := v.readMetadata(metadata); err != nil {
+		return err
+	}
+	batRegion, ok := regions[vhdxBATRegion]
+	if !ok {
+		return fmt.Errorf("%w: missing BAT region", ErrUnsupportedImage)
+	}
+	return v.readBAT(batRegion)
+}
+
+func (v *vhdxImage) readHeader() (*vhdxHeader, error) {
+	var current *vhdxHeader
+	for _, offset := range vhdxHeaderOffsets {
+		buf := make([]byte, vhdxHeaderSize)
+		if _, err := v.file.ReadAt(buf, offset); err != nil {
+			continue
+		}
+		h := &vhdxHeader{}
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, h); err != nil {
+			continue
+		}
+		if !bytes.Equal(h.Signature[:], []byte(vhdxHeaderSignature)) || !vhdxChecksumValid(buf, h.Checksum) {
+			continue
+		}
+		if current == nil || h.SequenceNumber > current.SequenceNumber {
+			current = h
+		}
+	}
+	if current == nil {
+		return nil, fmt.Errorf("%w: no valid vhdx header", ErrUnsupportedImage)
+	}
+	if current.Version != 1 {
+		return nil, fmt.Errorf("%w: vhdx version %d", ErrUnsupportedImage, current.Version)
+	}
+	return current, nil
+}
+
+// readRegionTable returns the regions by GUID from the first valid copy of the
+// region table.
+func (v *vhdxImage) readRegionTable() (map[string]vhdxTableEntry, error) {
+	for _, offset := range vhdxRegionOffsets {
+		buf := make([]byte, vhdxRegionTableSize)
+		if _, err := v.file.ReadAt(buf, offset); err != nil {
+			continue
+		}
+		if !bytes.Equal(buf[:4], []byte(vhdxRegionSignature)) || !vhdxChecksumValid(buf, binary.LittleEndian.Uint32(buf[4:])) {
+			continue
+		}
+		count := binary.LittleEndian.Uint32(buf[8:])
+		if count > vhdxMaxEntries {
+			return nil, fmt.Errorf("%w: %d regions", ErrUnsupportedImage, count)
+		}
+		entries := make([]vhdxTableEntry, count)
+		if err := binary.Read(bytes.NewReader(buf[16:]), binary.LittleEndian, entries); err != nil {
+			return nil, err
+		}
+		regions := make(map[string]vhdxTableEntry)
+		for _, entry := range entries {
+			id := formatGUID(entry.GUID)
+			if id != vhdxBATRegion && id != vhdxMetadataRegion && entry.Required&vhdxRegionRequired != 0 {
+				return nil, fmt.Errorf("%w: required region %s", ErrUnsupportedImage, id)
+			}
+			regions[id] = entry
+		}
+		return regions, nil
+	}
+	return nil, fmt.Errorf("%w: no valid vhdx region table", ErrUnsupportedImage)
+}
+
+func (v *vhdxImage) readMetadata(region vhdxTableEntry) error {
+	table := make([]byte, 64*1024)
+	if _, err := v.file.ReadAt(table, int64(region.FileOffset)); err != nil {
+		return fmt.Errorf("unable to read metadata table: %w", err)
+	}
+	if !bytes.Equal(table[:8], []byte(vhdxMetadataSignature)) {
+		return fmt.Errorf("%w: invalid metadata table", ErrUnsupportedImage)
+	}
+	count := binary.LittleEndian.Uint16(table[10:])
+	if count > vhdxMaxEntries {
+		return fmt.Errorf("%w: %d metadata entries", ErrUnsupportedImage, count)
+	}
+	entries := make([]vhdxMetadataEntry, count)
+	if err := binary.Read(bytes.NewReader(table[32:]), binary.LittleEndian, entries); err != nil {
+		return err
+	}
+	items := make(map[string][]byte)
+	for _, entry := range entries {
+		id := formatGUID(entry.ItemID)
+		switch id {
+		case vhdxFileParameters, vhdxVirtualDiskSize, vhdxLogicalSectorSize:
+			item := make([]byte, entry.Length)
+			if _, err := v.file.ReadAt(item, int64(region.FileOffset)+int64(entry.Offset)); err != nil {
+				return fmt.Errorf("unable to read metadata item %s: %w", id, err)
+			}
+			items[id] = item
+		case vhdxPhysicalSectorSize, vhdxPage83Data:
+		default:
+			if entry.Flags&vhdxRequired != 0 {
+				return fmt.Errorf("%w: required metadata item %s", ErrUnsupportedImage, id)
+			}
+		}
+	}
+	fileParameters, diskSize, sectorSize := items[vhdxFileParameters], items[vhdxVirtualDiskSize], items[vhdxLogicalSectorSize]
+	if len(fileParameters) < 8 || len(diskSize) < 8 || len(sectorSize) < 4 {
+		return fmt.Errorf("%w: missing required metadata", ErrUnsupportedImage)
+	}
+	if binary.LittleEndian.Uint32(fileParameters[4:])&vhdxHasParent != 0 {
+		return fmt.Errorf("%w: differencing vhdx images", ErrUnsupportedImage)
+	}
+	blockSize := binary.LittleEndian.Uint32(fileParameters)
+	if blockSize < vhdxMinBlockSize || blockSize > vhdxMaxBlockSize || blockSize&(blockSize-1) != 0 {
+		return fmt.Errorf("%w: block size %d", ErrUnsupportedImage, blockSize)
+	}
+	logicalSectorSize := binary.LittleEndian.Uint32(sectorSize)
+	if logicalSectorSize != 512 && logicalSectorSize != 4096 {
+		return fmt.Errorf("%w: logical sector size %d", ErrUnsupportedImage, logicalSectorSize)
+	}
+	v.size = int64(binary.LittleEndian.Uint64(diskSize))
+	if v.size < 0 || v.size > 1<<62 {
+		return fmt.Errorf("%w: size %d", ErrUnsupportedImage, v.size)
+	}
+	v.blockSize = int64(blockSize)
+	v.chunkRatio = vhdxSectorBitmapSize * int64(logicalSectorSize) / v.blockSize
+	return nil
+}
+
+func (v *vhdxImage) readBAT(region vhdxTableEntry) error {
+	blocks := (v.size + v.blockSize - 1) / v.blockSize
+	entries := blocks
+	if blocks > 0 {
+		entries += (blocks - 1) / v.chunkRatio
+	}
+	if entries*8 > int64(region.Length) || entries*8 > vhdxMaxBATSize {
+		return fmt.Errorf("%w: invalid BAT size %d", ErrUnsupportedImage, region.Length)
+	}
+	v.bat = make([]uint64, entries)
+	reader := io.NewSectionReader(v.file, int64(region.FileOffset), entries*8)
+	if err := binary.Read(reader, binary.LittleEndian, v.bat); err != nil {
+		return fmt.Errorf("unable to read BAT: %w", err)
+	}
+	return nil
+}
+
+// vhdxChecksumValid checks the CRC-32C of the structure, computed with the
+// checksum field set to zero.
+func vhdxChecksumValid(buf []byte, checksum uint32) bool {
+	data := bytes.Clone(buf)
+	binary.LittleEndian.PutUint32(data[4:], 0)
+	return crc32.Checksum(data, vhdxCRCTable) == checksum
+}
+
+// formatGUID formats a GUID stored with its first three fields in little endian.
+func formatGUID(guid [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X", binary.LittleEndian.Uint32(guid[0:]),
+		binary.LittleEndian.Uint16(guid[4:]), binary.LittleEndian.Uint16(guid[6:]), guid[8:10], guid[10:])
+}
+
+func (v *vhdxImage) Size() int64 {
+	return v.size
+}
+
+func (v *vhdxImage) Format() string {
+	return FormatVHDX
+}
+
+func (v *vhdxImage) Close() error {
+	return v.file.Close()
+}
+
+// batEntry returns the BAT entry of the block, skipping the sector bitmap entries.
+func (v *vhdxImage) batEntry(blockOffset int64) uint64 {
+	index := blockOffset / v.blockSize
+	return v.bat[index+index/v.chunkRatio]
+}
+
+// ReadAt reads the virtual disk, it is safe for concurrent use.
+func (v *vhdxImage) ReadAt(p []byte, offset int64) (int, error) {
+	return readBlocks(p, offset, v.size, v.blockSize, v.readBlock)
+}
+
+func (v *vhdxImage) readBlock(buf []byte, blockOffset, inBlock int64) error {
+	entry := v.batEntry(blockOffset)
+	if entry&vhdxBATStateMask != vhdxBATFullyPresent {
+		clear(buf)
+		return nil
+	}
+	n, err := v.file.ReadAt(buf, int64(entry>>vhdxBATOffsetShift)*1024*1024+inBlock)
+	if err == io.EOF {
+		clear(buf[n:])
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read block at %d: %w", blockOffset, err)
+	}
+	return nil
+}
+
+// Allocated returns true if any block in the range is present in the image.
+func (v *vhdxImage) Allocated(offset, length int64) (bool, error) {
+	return allocatedBlocks(offset, length, v.size, v.blockSize, func(blockOffset int64) (bool, error) {
+		return v.batEntry(blockOffset)&vhdxBATStateMask == vhdxBATFullyPresent, nil
+	})
+}
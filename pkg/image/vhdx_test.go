@@ -0,0 +1,188 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const testVHDXBlockSize = vhdxMinBlockSize
+
+// testVHDX builds small dynamic VHDX images for the tests, with the metadata
+// region at 1MiB, the BAT region at 2MiB and the blocks after it.
+type testVHDX struct {
+	size   int64
+	blocks map[int64][]byte
+	zero   []int64
+	// sequence numbers of the two headers, 0 writes an invalid header
+	sequence   [2]uint64
+	logGUID    [16]byte
+	fileFlags  uint32
+	extraItems []string
+}
+
+func parseGUID(guid string) [16]byte {
+	var b [16]byte
+	var d1 uint32
+	var d2, d3 uint16
+	var d4 [8]byte
+	_, err := fmt.Sscanf(guid, "%08X-%04X-%04X-%02X%02X-%02X%02X%02X%02X%02X%02X",
+		&d1, &d2, &d3, &d4[0], &d4[1], &d4[2], &d4[3], &d4[4], &d4[5], &d4[6], &d4[7])
+	Expect(err).ToNot(HaveOccurred())
+	binary.LittleEndian.PutUint32(b[0:], d1)
+	binary.LittleEndian.PutUint16(b[4:], d2)
+	binary.LittleEndian.PutUint16(b[6:], d3)
+	copy(b[8:], d4[:])
+	return b
+}
+
+func vhdxChecksum(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[4:], crc32.Checksum(buf, vhdxCRCTable))
+}
+
+func (t *testVHDX) write(fileName string) {
+	const mb = 1024 * 1024
+	blocks := (t.size + testVHDXBlockSize - 1) / testVHDXBlockSize
+	out := make([]byte, 3*mb+blocks*testVHDXBlockSize)
+	copy(out, vhdxMagic)
+
+	for i, offset := range vhdxHeaderOffsets {
+		if t.sequence[i] == 0 {
+			continue
+		}
+		h := vhdxHeader{SequenceNumber: t.sequence[i], LogGUID: t.logGUID, Version: 1}
+		copy(h.Signature[:], vhdxHeaderSignature)
+		buf := &bytes.Buffer{}
+		Expect(binary.Write(buf, binary.LittleEndian, h)).To(Succeed())
+		header := out[offset : offset+vhdxHeaderSize]
+		copy(header, buf.Bytes())
+		vhdxChecksum(header)
+	}
+
+	regions := &bytes.Buffer{}
+	regions.WriteString(vhdxRegionSignature)
+	Expect(binary.Write(regions, binary.LittleEndian, []uint32{0, 2, 0})).To(Succeed())
+	Expect(binary.Write(regions, binary.LittleEndian, []vhdxTableEntry{
+		{GUID: parseGUID(vhdxMetadataRegion), FileOffset: mb, Length: mb, Required: 1},
+		{GUID: parseGUID(vhdxBATRegion), FileOffset: 2 * mb, Length: mb, Required: 1},
+	})).To(Succeed())
+	for _, offset := range vhdxRegionOffsets {
+		table := out[offset : offset+vhdxRegionTableSize]
+		copy(table, regions.Bytes())
+		vhdxChecksum(table)
+	}
+
+	items := map[string][]byte{
+		vhdxFileParameters:    binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, testVHDXBlockSize), t.fileFlags),
+		vhdxVirtualDiskSize:   binary.LittleEndian.AppendUint64(nil, uint64(t.size)),
+		vhdxLogicalSectorSize: binary.LittleEndian.AppendUint32(nil, 512),
+	}
+	for _, item := range t.extraItems {
+		items[item] = make([]byte, 8)
+	}
+	metadata := out[mb : 2*mb]
+	copy(metadata, vhdxMetadataSignature)
+	binary.LittleEndian.PutUint16(metadata[10:], uint16(len(items)))
+	itemOffset := uint32(64 * 1024)
+	entry := 32
+	for id, data := range items {
+		e := vhdxMetadataEntry{ItemID: parseGUID(id), Offset: itemOffset, Length: uint32(len(data)), Flags: vhdxRequired}
+		buf := &bytes.Buffer{}
+		Expect(binary.Write(buf, binary.LittleEndian, e)).To(Succeed())
+		copy(metadata[entry:], buf.Bytes())
+		copy(metadata[itemOffset:], data)
+		entry += 32
+		itemOffset += uint32(len(data))
+	}
+
+	bat := out[2*mb : 3*mb]
+	for offset, data := range t.blocks {
+		index := offset / testVHDXBlockSize
+		fileOffset := 3*mb + index*testVHDXBlockSize
+		binary.LittleEndian.PutUint64(bat[index*8:], uint64(fileOffset/mb)<<vhdxBATOffsetShift|vhdxBATFullyPresent)
+		copy(out[fileOffset:], data)
+	}
+	for _, offset := range t.zero {
+		binary.LittleEndian.PutUint64(bat[offset/testVHDXBlockSize*8:], 2)
+	}
+	Expect(os.WriteFile(fileName, out, 0644)).To(Succeed())
+}
+
+// newTestVHDX returns a 4 block image with data in block 1 and the partial last
+// block, a zero block 2, and its expected content.
+func newTestVHDX() (*testVHDX, []byte) {
+	expected := make([]byte, 3*testVHDXBlockSize+testClusterSize)
+	t := &testVHDX{
+		size: int64(len(expected)),
+		blocks: map[int64][]byte{
+			1 * testVHDXBlockSize: randomData(testVHDXBlockSize, 1),
+			3 * testVHDXBlockSize: randomData(testClusterSize, 3),
+		},
+		zero:     []int64{2 * testVHDXBlockSize},
+		sequence: [2]uint64{1, 2},
+	}
+	for offset, data := range t.blocks {
+		copy(expected[offset:], data)
+	}
+	return t, expected
+}
+
+var _ = Describe("vhdx tests", func() {
+	var (
+		tmpDir   string
+		fileName string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "image-vhdx")
+		Expect(err).ToNot(HaveOccurred())
+		fileName = filepath.Join(tmpDir, "image.vhdx")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	DescribeTable("should read the virtual disk", func(sequence [2]uint64) {
+		t, expected := newTestVHDX()
+		t.sequence = sequence
+		t.write(fileName)
+		Expect(DetectFormat(fileName)).To(Equal(FormatVHDX))
+		img, err := Open(fileName, FormatAuto)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(img.Format()).To(Equal(FormatVHDX))
+		Expect(img.Size()).To(Equal(int64(len(expected))))
+		Expect(readAll(img)).To(Equal(expected))
+		for block, allocated := range map[int64]bool{0: false, 1: true, 2: false, 3: true} {
+			ok, err := img.Allocated(block*testVHDXBlockSize, testVHDXBlockSize)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(Equal(allocated), "block %d", block)
+		}
+	},
+		Entry("with two valid headers", [2]uint64{1, 2}),
+		Entry("with only the first header valid", [2]uint64{1, 0}),
+		Entry("with only the second header valid", [2]uint64{0, 3}),
+	)
+
+	DescribeTable("should reject unsupported images", func(modify func(*testVHDX)) {
+		t, _ := newTestVHDX()
+		modify(t)
+		t.write(fileName)
+		_, err := Open(fileName, FormatVHDX)
+		Expect(errors.Is(err, ErrUnsupportedImage)).To(BeTrue(), "error %v", err)
+	},
+		Entry("log to replay", func(t *testVHDX) { t.logGUID = [16]byte{1} }),
+		Entry("differencing", func(t *testVHDX) { t.fileFlags = vhdxHasParent }),
+		Entry("unknown required metadata", func(t *testVHDX) { t.extraItems = []string{"A8D35F2D-B30B-454D-ABF7-D3D84834AB0C"} }),
+		Entry("no valid header", func(t *testVHDX) { t.sequence = [2]uint64{} }),
+	)
+})
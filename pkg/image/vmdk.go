@@ -0,0 +1,264 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	vmdkMagic           = "KDMV"
+	vmdkDescriptorMagic = "# Disk DescriptorFile"
+	vmdkSectorSize      = 512
+	vmdkMaxGrainSize    = 1 << 20
+	vmdkMaxGTEsPerGT    = 1 << 16
+
+	vmdkFlagCompressed     = uint32(1) << 16
+	vmdkCompressionDeflate = 1
+	// vmdkGDAtEnd marks a stream optimized image, the grain directory offset is in
+	// the footer
+	vmdkGDAtEnd = ^uint64(0)
+	// grain table entry of a grain that reads as zeros
+	vmdkGrainZero = 1
+)
+
+// vmdkHeader is the little endian header of a sparse extent, stream optimized
+// images repeat it in a footer before the end of stream marker.
+type vmdkHeader struct {
+	Magic              [4]byte
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+// vmdkImage reads the virtual disk of a monolithic sparse or stream optimized
+// VMDK image. Grains that are not allocated read as zeros.
+type vmdkImage struct {
+	file        *os.File
+	header      vmdkHeader
+	grainSize   int64
+	gd          []uint32
+	grainTables blockCache[[]uint32]
+	grains      blockCache[[]byte]
+}
+
+func openVMDK(fileName string) (*vmdkImage, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	v := &vmdkImage{file: f}
+	if err := v.init(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return v, nil
+}
+
+func (v *vmdkImage) init() error {
+	if err := v.readHeader(0, &v.header); err != nil {
+		return err
+	}
+	if v.header.GDOffset == vmdkGDAtEnd {
+		// The footer is followed by the end of stream marker
+		info, err := v.file.Stat()
+		if err != nil {
+			return err
+		}
+		if err := v.readHeader(info.Size()-2*vmdkSectorSize, &v.header); err != nil {
+			return fmt.Errorf("unable to read footer: %w", err)
+		}
+		if v.header.GDOffset == vmdkGDAtEnd {
+			return fmt.Errorf("%w: grain directory offset missing in footer", ErrUnsupportedImage)
+		}
+	}
+	h := &v.header
+	if h.Version < 1 || h.Version > 3 {
+		return fmt.Errorf("%w: vmdk version %d", ErrUnsupportedImage, h.Version)
+	}
+	if h.GrainSize == 0 || h.GrainSize&(h.GrainSize-1) != 0 || h.GrainSize*vmdkSectorSize > vmdkMaxGrainSize {
+		return fmt.Errorf("%w: grain size %d", ErrUnsupportedImage, h.GrainSize)
+	}
+	if h.NumGTEsPerGT == 0 || h.NumGTEsPerGT > vmdkMaxGTEsPerGT {
+		return fmt.Errorf("%w: %d grain table entries", ErrUnsupportedImage, h.NumGTEsPerGT)
+	}
+	if h.Flags&vmdkFlagCompressed != 0 && h.CompressAlgorithm != vmdkCompressionDeflate {
+		return fmt.Errorf("%w: compression algorithm %d", ErrUnsupportedImage, h.CompressAlgorithm)
+	}
+	if h.Capacity > uint64(1)<<62/vmdkSectorSize {
+		return fmt.Errorf("%w: capacity %d", ErrUnsupportedImage, h.Capacity)
+	}
+	if err := v.checkDescriptor(); err != nil {
+		return err
+	}
+	v.grainSize = int64(h.GrainSize) * vmdkSectorSize
+	gtCoverage := uint64(h.NumGTEsPerGT) * h.GrainSize
+	v.gd = make([]uint32, (h.Capacity+gtCoverage-1)/gtCoverage)
+	reader := io.NewSectionReader(v.file, int64(h.GDOffset)*vmdkSectorSize, int64(len(v.gd))*4)
+	if err := binary.Read(reader, binary.LittleEndian, v.gd); err != nil {
+		return fmt.Errorf("unable to read grain directory: %w", err)
+	}
+	return nil
+}
+
+func (v *vmdkImage) readHeader(offset int64, h *vmdkHeader) error {
+	if err := binary.Read(io.NewSectionReader(v.file, offset, vmdkSectorSize), binary.LittleEndian, h); err != nil {
+		return fmt.Errorf("%w: not a sparse vmdk image", ErrUnsupportedImage)
+	}
+	if !bytes.Equal(h.Magic[:], []byte(vmdkMagic)) {
+		return fmt.Errorf("%w: not a sparse vmdk image", ErrUnsupportedImage)
+	}
+	return nil
+}
+
+// checkDescriptor refuses images with extents in other files, and delta images
+// that need their parent.
+func (v *vmdkImage) checkDescriptor() error {
+	if v.header.DescriptorOffset == 0 {
+		return nil
+	}
+	descriptor := make([]byte, v.header.DescriptorSize*vmdkSectorSize)
+	if _, err := v.file.ReadAt(descriptor, int64(v.header.DescriptorOffset)*vmdkSectorSize); err != nil && err != io.EOF {
+		return fmt.Errorf("unable to read descriptor: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(descriptor, "\x00")))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "createType":
+			if value != "monolithicSparse" && value != "streamOptimized" {
+				return fmt.Errorf("%w: vmdk type %s", ErrUnsupportedImage, value)
+			}
+		case "parentCID":
+			if value != "ffffffff" {
+				return fmt.Errorf("%w: vmdk delta images", ErrUnsupportedImage)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (v *vmdkImage) Size() int64 {
+	return int64(v.header.Capacity) * vmdkSectorSize
+}
+
+func (v *vmdkImage) Format() string {
+	return FormatVMDK
+}
+
+func (v *vmdkImage) Close() error {
+	return v.file.Close()
+}
+
+// ReadAt reads the virtual disk, it is safe for concurrent use.
+func (v *vmdkImage) ReadAt(p []byte, offset int64) (int, error) {
+	return readBlocks(p, offset, v.Size(), v.grainSize, v.readGrain)
+}
+
+func (v *vmdkImage) readGrain(buf []byte, grainOffset, inGrain int64) error {
+	entry, err := v.grainEntry(grainOffset)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry <= vmdkGrainZero:
+		clear(buf)
+	case v.header.Flags&vmdkFlagCompressed != 0:
+		data, err := v.readCompressedGrain(int64(entry) * vmdkSectorSize)
+		if err != nil {
+			return err
+		}
+		copy(buf, data[inGrain:])
+	default:
+		n, err := v.file.ReadAt(buf, int64(entry)*vmdkSectorSize+inGrain)
+		if err == io.EOF {
+			clear(buf[n:])
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read grain at %d: %w", grainOffset, err)
+		}
+	}
+	return nil
+}
+
+// grainEntry returns the sector of the grain, 0 if it is not allocated.
+func (v *vmdkImage) grainEntry(grainOffset int64) (uint32, error) {
+	index := grainOffset / v.grainSize
+	perTable := int64(v.header.NumGTEsPerGT)
+	gtSector := v.gd[index/perTable]
+	if gtSector == 0 {
+		return 0, nil
+	}
+	table, ok := v.grainTables.get(int64(gtSector))
+	if !ok {
+		table = make([]uint32, perTable)
+		reader := io.NewSectionReader(v.file, int64(gtSector)*vmdkSectorSize, perTable*4)
+		if err := binary.Read(reader, binary.LittleEndian, table); err != nil {
+			return 0, fmt.Errorf("unable to read grain table at sector %d: %w", gtSector, err)
+		}
+		v.grainTables.put(int64(gtSector), table)
+	}
+	return table[index%perTable], nil
+}
+
+// readCompressedGrain reads and inflates a grain that starts with a marker of
+// its virtual sector and compressed size.
+func (v *vmdkImage) readCompressedGrain(offset int64) ([]byte, error) {
+	if data, ok := v.grains.get(offset); ok {
+		return data, nil
+	}
+	var marker struct {
+		LBA  uint64
+		Size uint32
+	}
+	if err := binary.Read(io.NewSectionReader(v.file, offset, 12), binary.LittleEndian, &marker); err != nil {
+		return nil, fmt.Errorf("unable to read grain marker at %d: %w", offset, err)
+	}
+	if int64(marker.Size) > 2*v.grainSize+vmdkSectorSize {
+		return nil, fmt.Errorf("invalid compressed grain size %d at %d", marker.Size, offset)
+	}
+	reader, err := zlib.NewReader(io.NewSectionReader(v.file, offset+12, int64(marker.Size)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to inflate grain at %d: %w", offset, err)
+	}
+	defer reader.Close()
+	data := make([]byte, v.grainSize)
+	// The last grain can be shorter than the grain size
+	if _, err := io.ReadFull(reader, data); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("unable to inflate grain at %d: %w", offset, err)
+	}
+	v.grains.put(offset, data)
+	return data, nil
+}
+
+// Allocated returns true if any grain in the range has data in the image.
+func (v *vmdkImage) Allocated(offset, length int64) (bool, error) {
+	return allocatedBlocks(offset, length, v.Size(), v.grainSize, func(grainOffset int64) (bool, error) {
+		entry, err := v.grainEntry(grainOffset)
+		return entry > vmdkGrainZero, err
+	})
+}
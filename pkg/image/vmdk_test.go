@@ -0,0 +1,209 @@
+package image
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// testVMDK builds small sparse VMDK images for the tests, the grains of stream
+// optimized images are compressed.
+type testVMDK struct {
+	streamOptimized   bool
+	capacity          int64
+	gtesPerGT         uint32
+	createType        string
+	parentCID         string
+	compressAlgorithm uint16
+	// virtual grain offset to data
+	grains map[int64][]byte
+	zero   []int64
+}
+
+func (t *testVMDK) write(fileName string) {
+	const grainSize = testClusterSize
+	out := &bytes.Buffer{}
+	pad := func() {
+		out.Write(make([]byte, (vmdkSectorSize-out.Len()%vmdkSectorSize)%vmdkSectorSize))
+	}
+	sector := func() uint32 {
+		return uint32(out.Len() / vmdkSectorSize)
+	}
+	// sector 0 is the header, sectors 1 and 2 the descriptor
+	out.Write(make([]byte, 3*vmdkSectorSize))
+	descriptor := "# Disk DescriptorFile\nversion=1\nCID=12345678\nparentCID=" + t.parentCID + "\ncreateType=\"" + t.createType + "\"\n"
+	copy(out.Bytes()[vmdkSectorSize:], descriptor)
+
+	entries := make(map[int64]uint32)
+	offsets := make([]int64, 0, len(t.grains))
+	for offset := range t.grains {
+		offsets = append(offsets, offset)
+	}
+	slices.Sort(offsets)
+	for _, offset := range offsets {
+		data := t.grains[offset]
+		entries[offset/grainSize] = sector()
+		if t.streamOptimized {
+			compressed := &bytes.Buffer{}
+			w := zlib.NewWriter(compressed)
+			_, err := w.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Close()).To(Succeed())
+			Expect(binary.Write(out, binary.LittleEndian, uint64(offset/vmdkSectorSize))).To(Succeed())
+			Expect(binary.Write(out, binary.LittleEndian, uint32(compressed.Len()))).To(Succeed())
+			out.Write(compressed.Bytes())
+		} else {
+			out.Write(data)
+			out.Write(make([]byte, grainSize-len(data)))
+		}
+		pad()
+	}
+	for _, offset := range t.zero {
+		entries[offset/grainSize] = vmdkGrainZero
+	}
+
+	grains := (t.capacity + grainSize - 1) / grainSize
+	gd := make([]uint32, (grains+int64(t.gtesPerGT)-1)/int64(t.gtesPerGT))
+	for i := range gd {
+		table := make([]uint32, t.gtesPerGT)
+		used := false
+		for j := range table {
+			table[j] = entries[int64(i)*int64(t.gtesPerGT)+int64(j)]
+			used = used || table[j] != 0
+		}
+		if used {
+			gd[i] = sector()
+			Expect(binary.Write(out, binary.LittleEndian, table)).To(Succeed())
+			pad()
+		}
+	}
+	gdOffset := uint64(sector())
+	Expect(binary.Write(out, binary.LittleEndian, gd)).To(Succeed())
+	pad()
+
+	h := vmdkHeader{
+		Version:           1,
+		Capacity:          uint64(t.capacity / vmdkSectorSize),
+		GrainSize:         grainSize / vmdkSectorSize,
+		DescriptorOffset:  1,
+		DescriptorSize:    2,
+		NumGTEsPerGT:      t.gtesPerGT,
+		GDOffset:          gdOffset,
+		CompressAlgorithm: t.compressAlgorithm,
+	}
+	copy(h.Magic[:], vmdkMagic)
+	if t.streamOptimized {
+		h.Version = 3
+		h.Flags = vmdkFlagCompressed
+		// The footer marker, the footer and the end of stream marker
+		out.Write(make([]byte, vmdkSectorSize))
+		footer := &bytes.Buffer{}
+		Expect(binary.Write(footer, binary.LittleEndian, h)).To(Succeed())
+		out.Write(footer.Bytes())
+		out.Write(make([]byte, vmdkSectorSize))
+		h.GDOffset = vmdkGDAtEnd
+	}
+	header := &bytes.Buffer{}
+	Expect(binary.Write(header, binary.LittleEndian, h)).To(Succeed())
+	b := out.Bytes()
+	copy(b, header.Bytes())
+	Expect(os.WriteFile(fileName, b, 0644)).To(Succeed())
+}
+
+// newTestVMDK returns a 20 grain image with data in grains 1, 5 and the partial
+// last grain, a zero grain 7, and its expected content.
+func newTestVMDK(streamOptimized bool) (*testVMDK, []byte) {
+	expected := make([]byte, 19*testClusterSize+vmdkSectorSize)
+	t := &testVMDK{
+		streamOptimized:   streamOptimized,
+		capacity:          int64(len(expected)),
+		gtesPerGT:         4,
+		createType:        "monolithicSparse",
+		parentCID:         "ffffffff",
+		compressAlgorithm: vmdkCompressionDeflate,
+		grains: map[int64][]byte{
+			1 * testClusterSize:  randomData(testClusterSize, 1),
+			5 * testClusterSize:  bytes.Repeat([]byte("grain"), testClusterSize/5+1)[:testClusterSize],
+			19 * testClusterSize: randomData(vmdkSectorSize, 19),
+		},
+		zero: []int64{7 * testClusterSize},
+	}
+	if streamOptimized {
+		t.createType = "streamOptimized"
+	}
+	for offset, data := range t.grains {
+		copy(expected[offset:], data)
+	}
+	return t, expected
+}
+
+var _ = Describe("vmdk tests", func() {
+	var (
+		tmpDir   string
+		fileName string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "image-vmdk")
+		Expect(err).ToNot(HaveOccurred())
+		fileName = filepath.Join(tmpDir, "image.vmdk")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	DescribeTable("should read the virtual disk", func(streamOptimized bool) {
+		t, expected := newTestVMDK(streamOptimized)
+		t.write(fileName)
+		Expect(DetectFormat(fileName)).To(Equal(FormatVMDK))
+		img, err := Open(fileName, FormatAuto)
+		Expect(err).ToNot(HaveOccurred())
+		defer img.Close()
+		Expect(img.Format()).To(Equal(FormatVMDK))
+		Expect(img.Size()).To(Equal(int64(len(expected))))
+		Expect(readAll(img)).To(Equal(expected))
+
+		// Unaligned read across grains
+		buf := make([]byte, testClusterSize+100)
+		_, err = img.ReadAt(buf, testClusterSize-50)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf).To(Equal(expected[testClusterSize-50 : 2*testClusterSize+50]))
+
+		for grain, allocated := range map[int64]bool{0: false, 1: true, 5: true, 7: false, 12: false, 19: true} {
+			ok, err := img.Allocated(grain*testClusterSize, testClusterSize)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(Equal(allocated), "grain %d", grain)
+		}
+	},
+		Entry("monolithic sparse", false),
+		Entry("stream optimized", true),
+	)
+
+	DescribeTable("should reject unsupported images", func(modify func(*testVMDK)) {
+		t, _ := newTestVMDK(true)
+		modify(t)
+		t.write(fileName)
+		_, err := Open(fileName, FormatVMDK)
+		Expect(errors.Is(err, ErrUnsupportedImage)).To(BeTrue(), "error %v", err)
+	},
+		Entry("delta image", func(t *testVMDK) { t.parentCID = "87654321" }),
+		Entry("flat extents", func(t *testVMDK) { t.createType = "monolithicFlat" }),
+		Entry("unknown compression", func(t *testVMDK) { t.compressAlgorithm = 2 }),
+	)
+
+	It("should detect a descriptor file and refuse to open it", func() {
+		Expect(os.WriteFile(fileName, []byte("# Disk DescriptorFile\ncreateType=\"twoGbMaxExtentSparse\"\n"), 0644)).To(Succeed())
+		Expect(DetectFormat(fileName)).To(Equal(FormatVMDK))
+		_, err := Open(fileName, FormatAuto)
+		Expect(errors.Is(err, ErrUnsupportedImage)).To(BeTrue())
+	})
+})
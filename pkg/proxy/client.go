@@ -7,17 +7,26 @@ import (
 	"time"
 
 	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/transport"
 )
 
 type ProxyClient struct {
+	listenAddress string
 	listenPort    int
 	targetPort    int
 	targetAddress string
 	log           logr.Logger
 }
 
-func NewProxyClient(listenPort, targetPort int, targetAddress string, logger logr.Logger) *ProxyClient {
+// NewProxyClient creates a proxy client, the addresses can be a host or a
+// unix:// or vsock:// address.
+func NewProxyClient(listenAddress string, listenPort, targetPort int, targetAddress string, logger logr.Logger) *ProxyClient {
+	if listenAddress == "" {
+		listenAddress = "localhost"
+	}
 	return &ProxyClient{
+		listenAddress: listenAddress,
 		listenPort:    listenPort,
 		targetPort:    targetPort,
 		targetAddress: targetAddress,
@@ -29,9 +38,17 @@ func (b *ProxyClient) ConnectToTarget(identifier string) error {
 	if len(identifier) != identifierLength {
 		return fmt.Errorf("identifier must be %d characters", identifierLength)
 	}
-	b.log.Info("Listening:", "host", "localhost", "port", b.listenPort)
-	// Create a listener on the desired port
-	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", b.listenPort))
+	listenAddress, err := transport.ParseAddress(b.listenAddress, b.listenPort)
+	if err != nil {
+		return err
+	}
+	targetAddress, err := transport.ParseAddress(b.targetAddress, b.targetPort)
+	if err != nil {
+		return err
+	}
+	b.log.Info("Listening:", "address", listenAddress.String())
+	// Create a listener on the desired address
+	listener, err := transport.Listen(listenAddress)
 	if err != nil {
 		return err
 	}
@@ -43,12 +60,12 @@ func (b *ProxyClient) ConnectToTarget(identifier string) error {
 	}
 	defer inConn.Close()
 
-	b.log.Info("Connecting to target", "address", b.targetAddress, "port", b.targetPort)
+	b.log.Info("Connecting to target", "address", targetAddress.String())
 	retry := true
 	var outConn net.Conn
 	retryCount := 0
 	for retry {
-		outConn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", b.targetAddress, b.targetPort))
+		outConn, err = transport.Dial(targetAddress)
 		retry = err != nil
 		if err != nil {
 			b.log.Error(err, "Unable to connect to target")
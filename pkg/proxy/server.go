@@ -1,185 +1,135 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
-	"os/exec"
-	"strconv"
 	"sync"
-	"time"
 
 	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/blockrsync"
+	"github.com/awels/blockrsync/pkg/transport"
 )
 
 const (
 	identifierLength = 32 // Length of the md5sum
-	blockRsyncPort   = 3222
 )
 
+// ProxyServer serves the files of the identifiers, the path of each file is
+// taken from the environment variable named after the identifier. Every
+// identifier is a module of a daemon, the server exits once all of them are
+// synced.
 type ProxyServer struct {
-	listenPort     int    // Port to listen on
-	blockrsyncPath string // Path to blockrsync binary
-	blockSize      int    // Block size to use
-	log            logr.Logger
-	identifiers    []string
-	wg             sync.WaitGroup
+	listenAddress string // Address to listen on, overrides the port
+	listenPort    int    // Port to listen on
+	log           logr.Logger
+	identifiers   []string
 }
 
-func NewProxyServer(blockrsyncPath string, blockSize, listenPort int, identifiers []string, logger logr.Logger) *ProxyServer {
+func NewProxyServer(listenAddress string, listenPort int, identifiers []string, logger logr.Logger) *ProxyServer {
 	return &ProxyServer{
-		listenPort:     listenPort,
-		blockrsyncPath: blockrsyncPath,
-		log:            logger,
-		identifiers:    identifiers,
-		blockSize:      blockSize,
+		listenAddress: listenAddress,
+		listenPort:    listenPort,
+		log:           logger,
+		identifiers:   identifiers,
 	}
 }
 
 func (b *ProxyServer) StartServer() error {
-	for _, identifier := range b.identifiers {
-		if len(identifier) != identifierLength {
-			return fmt.Errorf("identifier must be %d characters", identifierLength)
-		}
+	config, err := b.daemonConfig()
+	if err != nil {
+		return err
 	}
-	b.log.Info("Listening:", "host", "localhost", "port", b.listenPort)
-	// Create a listener on the desired port
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", b.listenPort))
+	listenAddress, err := transport.ParseAddress(b.listenAddress, b.listenPort)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	mu := &sync.Mutex{}
-	processingMap := make(map[string]int)
-
-	for i := 1; i <= len(b.identifiers); i++ {
-		b.wg.Add(1)
-		go b.processConnection(listener, processingMap, mu, i)
+	b.log.Info("Listening:", "address", listenAddress.String())
+	// Create a listener on the desired address
+	listener, err := transport.Listen(listenAddress)
+	if err != nil {
+		return err
 	}
-	b.wg.Wait()
-	return nil
+	defer listener.Close()
+	return b.serve(listener, blockrsync.NewBlockrsyncDaemon(config, 0, &blockrsync.BlockRsyncOptions{}, b.log.WithName("daemon")))
 }
 
-func (b *ProxyServer) processConnection(listener net.Listener, processing map[string]int, mu *sync.Mutex, i int) {
-	keepTrying := true
-	for keepTrying {
-		b.log.Info("Waiting for connection")
-		// Accept incoming connections
-		conn, err := listener.Accept()
-		if err != nil {
-			b.log.Error(err, "Unable to accept connection")
-		}
-		file, header, err := b.getTargetFileFromIdentifier(conn)
-		if err != nil {
-			b.log.Error(err, "Unable to get target file from identifier")
-			conn.Close()
-		}
-		mu.Lock()
-		if processing[header] > 0 {
-			// Someone else is processing same header, ignore this connection
-			b.log.Info("other thread is processing header", "thread", processing[header], "header", header)
-			mu.Unlock()
-			conn.Close()
-			continue
-		} else {
-			b.log.Info("processing header", "header", header, "thread", i)
-			processing[header] = i
-			mu.Unlock()
+// daemonConfig creates a module for every identifier, with the path of the file
+// from the environment.
+func (b *ProxyServer) daemonConfig() (*blockrsync.DaemonConfig, error) {
+	config := &blockrsync.DaemonConfig{}
+	for _, identifier := range b.identifiers {
+		if len(identifier) != identifierLength {
+			return nil, fmt.Errorf("identifier must be %d characters", identifierLength)
 		}
-
-		b.log.Info("Accepted connection, starting blockrsync server", "port", blockRsyncPort+i)
-		err = b.startsBlockrsyncServer(conn, file, blockRsyncPort+i)
+		file, err := lookupTargetFile(identifier)
 		if err != nil {
-			b.log.Error(err, "Unable to start blockrsync server")
-		} else {
-			b.wg.Done()
-			keepTrying = false
-		}
-	}
-}
-
-func (b *ProxyServer) getTargetFileFromIdentifier(conn net.Conn) (string, string, error) {
-	header := make([]byte, identifierLength)
-	n, err := io.ReadFull(conn, header)
-	if err != nil {
-		return "", "", err
-	}
-	if n != identifierLength {
-		return "", "", fmt.Errorf("expected %d bytes, got %d", identifierLength, n)
-	}
-	file := os.Getenv(string(header))
-	if file == "" {
-		file = os.Getenv((fmt.Sprintf("id-%s", header)))
-		if file == "" {
-			return "", "", fmt.Errorf("no filepath found for %s", string(header))
+			return nil, err
 		}
+		config.Modules = append(config.Modules, blockrsync.Module{Name: identifier, Path: file})
 	}
-	return file, string(header), nil
+	return config, nil
 }
 
-func (b *ProxyServer) startsBlockrsyncServer(rw io.ReadWriteCloser, file string, port int) error {
-	defer rw.Close()
-
-	b.log.Info("writing to file", "file", file)
-	go b.forkProcess(file, port)
-
-	notConnect := true
-	var blockRsyncConn net.Conn
-	var err error
-	for notConnect {
-		b.log.Info("Connecting to blockrsync server", "port", port)
-		blockRsyncConn, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
-		if err != nil {
-			b.log.Info("Waiting to connect to blockrsync server", "error", err)
-			time.Sleep(1 * time.Second)
-		} else {
-			b.log.Info("Connected to blockrsync server")
-			notConnect = false
-		}
+// serve accepts connections until every identifier has been synced. The daemon
+// rejects unknown identifiers, and identifiers that are already being synced by
+// another connection.
+func (b *ProxyServer) serve(listener net.Listener, daemon *blockrsync.BlockrsyncDaemon) error {
+	mu := &sync.Mutex{}
+	remaining := make(map[string]bool)
+	for _, identifier := range b.identifiers {
+		remaining[identifier] = true
 	}
-	go func() {
-		_, err = io.Copy(rw, blockRsyncConn)
+	for {
+		b.log.Info("Waiting for connection")
+		conn, err := listener.Accept()
 		if err != nil {
-			b.log.Error(err, "Unable to copy data from server to client")
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
 		}
-	}()
-	b.log.Info("Copying data")
-	_, err = io.Copy(blockRsyncConn, rw)
-	if err != nil {
-		b.log.Error(err, "Unable to copy data from client to server")
-		return err
+		go func() {
+			defer conn.Close()
+			identifier, err := readIdentifier(conn)
+			if err != nil {
+				b.log.Error(err, "Unable to read identifier")
+				return
+			}
+			b.log.Info("Accepted connection", "identifier", identifier)
+			if err := daemon.ServeModule(conn, identifier); err != nil {
+				b.log.Error(err, "Unable to sync", "identifier", identifier)
+				return
+			}
+			b.log.Info("Successfully completed sync", "identifier", identifier)
+			mu.Lock()
+			defer mu.Unlock()
+			delete(remaining, identifier)
+			if len(remaining) == 0 {
+				listener.Close()
+			}
+		}()
 	}
-
-	b.log.Info("Successfully completed sync proxy")
-	return nil
 }
 
-func (b *ProxyServer) forkProcess(file string, port int) {
-	arguments := []string{
-		file,
-		"--target",
-		"--port",
-		strconv.Itoa(port),
-		"--zap-log-level",
-		"3",
-		"--block-size",
-		strconv.Itoa(b.blockSize),
+func readIdentifier(conn net.Conn) (string, error) {
+	header := make([]byte, identifierLength)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
 	}
+	return string(header), nil
+}
 
-	b.log.Info("Starting blockrsync server", "arguments", arguments)
-	cmd := exec.Command(b.blockrsyncPath, arguments...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	// Start the command
-	err := cmd.Start()
-	if err != nil {
-		b.log.Error(err, "Unable to start blockrsync server")
-	}
-	// Wait for the command to finish
-	err = cmd.Wait()
-	if err != nil {
-		b.log.Error(err, "Waiting for blockrsync server to complete")
+func lookupTargetFile(identifier string) (string, error) {
+	file := os.Getenv(identifier)
+	if file == "" {
+		file = os.Getenv(fmt.Sprintf("id-%s", identifier))
+		if file == "" {
+			return "", fmt.Errorf("no filepath found for %s", identifier)
+		}
 	}
+	return file, nil
 }
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	NetworkTCP   = "tcp"
+	NetworkUnix  = "unix"
+	NetworkVsock = "vsock"
+
+	// vsockCIDAny accepts connections for any context ID
+	vsockCIDAny = ^uint32(0)
+)
+
+// Address is a listen or dial address. It is parsed from a host, host:port,
+// tcp://host:port, unix:///path/to/socket or vsock://cid:port string.
+type Address struct {
+	Network string
+	// Host is the tcp host, or the path of the unix socket
+	Host string
+	CID  uint32
+	Port int
+}
+
+// ParseAddress parses the address, defaultPort is used if the address has no port.
+func ParseAddress(address string, defaultPort int) (*Address, error) {
+	scheme, rest, found := strings.Cut(address, "://")
+	if !found {
+		scheme, rest = NetworkTCP, address
+	}
+	switch scheme {
+	case NetworkTCP:
+		host, port, err := splitHostPort(rest, defaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %w", address, err)
+		}
+		return &Address{Network: NetworkTCP, Host: host, Port: port}, nil
+	case NetworkUnix:
+		if rest == "" {
+			return nil, fmt.Errorf("invalid address %s: missing socket path", address)
+		}
+		return &Address{Network: NetworkUnix, Host: rest}, nil
+	case NetworkVsock:
+		cid, port, err := splitHostPort(rest, defaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %w", address, err)
+		}
+		a := &Address{Network: NetworkVsock, CID: vsockCIDAny, Port: port}
+		if cid != "" {
+			c, err := strconv.ParseUint(cid, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %s: invalid context ID %s", address, cid)
+			}
+			a.CID = uint32(c)
+		}
+		return a, nil
+	default:
+		return nil, fmt.Errorf("invalid address %s: unsupported scheme %s", address, scheme)
+	}
+}
+
+// splitHostPort splits host and port, a missing port is replaced with the default.
+func splitHostPort(hostPort string, defaultPort int) (string, int, error) {
+	host, portString, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		// No port, or an IPv6 address without brackets
+		return strings.Trim(hostPort, "[]"), defaultPort, nil
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %s", portString)
+	}
+	return host, port, nil
+}
+
+func (a *Address) String() string {
+	switch a.Network {
+	case NetworkUnix:
+		return NetworkUnix + "://" + a.Host
+	case NetworkVsock:
+		cid := ""
+		if a.CID != vsockCIDAny {
+			cid = strconv.FormatUint(uint64(a.CID), 10)
+		}
+		return fmt.Sprintf("%s://%s:%d", NetworkVsock, cid, a.Port)
+	default:
+		return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+	}
+}
+
+// Listen creates a listener for the address. A stale unix socket left behind by a
+// previous run is removed first, a socket another process is listening on is not.
+func Listen(a *Address) (net.Listener, error) {
+	switch a.Network {
+	case NetworkUnix:
+		if fi, err := os.Lstat(a.Host); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+			if err := removeStaleSocket(a.Host); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen(NetworkUnix, a.Host)
+	case NetworkVsock:
+		return listenVsock(a.CID, uint32(a.Port))
+	default:
+		return net.Listen(NetworkTCP, a.String())
+	}
+}
+
+// removeStaleSocket removes the unix socket if nothing is listening on it, which
+// refuses the connection.
+func removeStaleSocket(path string) error {
+	conn, err := net.Dial(NetworkUnix, path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket %s: %w", path, syscall.EADDRINUSE)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("unix socket %s: %w: %v", path, syscall.EADDRINUSE, err)
+	}
+	return os.Remove(path)
+}
+
+func Dial(a *Address) (net.Conn, error) {
+	switch a.Network {
+	case NetworkUnix:
+		return net.Dial(NetworkUnix, a.Host)
+	case NetworkVsock:
+		if a.CID == vsockCIDAny {
+			return nil, fmt.Errorf("a context ID is required to connect to %s", a)
+		}
+		return dialVsock(a.CID, uint32(a.Port))
+	default:
+		return net.Dial(NetworkTCP, a.String())
+	}
+}
@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("address tests", func() {
+	DescribeTable("should parse addresses", func(address string, expected *Address, expectedString string) {
+		a, err := ParseAddress(address, 8000)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a).To(Equal(expected))
+		Expect(a.String()).To(Equal(expectedString))
+	},
+		Entry("empty", "", &Address{Network: NetworkTCP, Port: 8000}, ":8000"),
+		Entry("host", "localhost", &Address{Network: NetworkTCP, Host: "localhost", Port: 8000}, "localhost:8000"),
+		Entry("host and port", "localhost:9000", &Address{Network: NetworkTCP, Host: "localhost", Port: 9000}, "localhost:9000"),
+		Entry("tcp scheme", "tcp://10.0.0.1:9000", &Address{Network: NetworkTCP, Host: "10.0.0.1", Port: 9000}, "10.0.0.1:9000"),
+		Entry("ipv6", "::1", &Address{Network: NetworkTCP, Host: "::1", Port: 8000}, "[::1]:8000"),
+		Entry("ipv6 with port", "[::1]:9000", &Address{Network: NetworkTCP, Host: "::1", Port: 9000}, "[::1]:9000"),
+		Entry("unix", "unix:///run/brs.sock", &Address{Network: NetworkUnix, Host: "/run/brs.sock"}, "unix:///run/brs.sock"),
+		Entry("vsock", "vsock://3:9000", &Address{Network: NetworkVsock, CID: 3, Port: 9000}, "vsock://3:9000"),
+		Entry("vsock without port", "vsock://3", &Address{Network: NetworkVsock, CID: 3, Port: 8000}, "vsock://3:8000"),
+		Entry("vsock any context", "vsock://:9000", &Address{Network: NetworkVsock, CID: vsockCIDAny, Port: 9000}, "vsock://:9000"),
+	)
+
+	DescribeTable("should reject invalid addresses", func(address string) {
+		_, err := ParseAddress(address, 8000)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("unknown scheme", "http://localhost"),
+		Entry("invalid port", "localhost:abc"),
+		Entry("port out of range", "localhost:70000"),
+		Entry("unix without path", "unix://"),
+		Entry("invalid context ID", "vsock://abc:9000"),
+	)
+
+	It("should listen and dial on a unix socket, replacing a stale socket", func() {
+		tmpDir, err := os.MkdirTemp("", "transport")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		a, err := ParseAddress("unix://"+filepath.Join(tmpDir, "brs.sock"), 0)
+		Expect(err).ToNot(HaveOccurred())
+		stale, err := Listen(a)
+		Expect(err).ToNot(HaveOccurred())
+		// Leave the socket file behind like a crashed process would
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		Expect(stale.Close()).To(Succeed())
+
+		listener, err := Listen(a)
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		expectConnection(listener, a)
+	})
+
+	It("should not replace a unix socket another process is listening on", func() {
+		tmpDir, err := os.MkdirTemp("", "transport")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		a, err := ParseAddress("unix://"+filepath.Join(tmpDir, "brs.sock"), 0)
+		Expect(err).ToNot(HaveOccurred())
+		running, err := Listen(a)
+		Expect(err).ToNot(HaveOccurred())
+		defer running.Close()
+
+		_, err = Listen(a)
+		Expect(err).To(MatchError(syscall.EADDRINUSE))
+		// The socket of the running listener is still there
+		conn, err := Dial(a)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conn.Close()).To(Succeed())
+	})
+
+	It("should listen and dial on vsock", func() {
+		// The loopback context ID only works if the vsock_loopback module is loaded
+		listener, err := Listen(&Address{Network: NetworkVsock, CID: 1})
+		if err != nil {
+			Skip("vsock is not available: " + err.Error())
+		}
+		defer listener.Close()
+		a, err := ParseAddress(listener.Addr().String(), 0)
+		Expect(err).ToNot(HaveOccurred())
+		expectConnection(listener, a)
+	})
+
+	It("should not dial vsock without a context ID", func() {
+		_, err := Dial(&Address{Network: NetworkVsock, CID: vsockCIDAny, Port: 9000})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func expectConnection(listener net.Listener, a *Address) {
+	go func() {
+		defer GinkgoRecover()
+		conn, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		_, err = io.Copy(conn, conn)
+		Expect(err).ToNot(HaveOccurred())
+	}()
+	conn, err := Dial(a)
+	Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	Expect(err).ToNot(HaveOccurred())
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(string(b)).To(Equal("hello"))
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a *vsockAddr) Network() string {
+	return NetworkVsock
+}
+
+func (a *vsockAddr) String() string {
+	return (&Address{Network: NetworkVsock, CID: a.cid, Port: int(a.port)}).String()
+}
+
+func localVsockAddr(fd int) (*vsockAddr, error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	vm, ok := sa.(*unix.SockaddrVM)
+	if !ok {
+		return nil, errors.New("not a vsock socket")
+	}
+	return &vsockAddr{cid: vm.CID, port: vm.Port}, nil
+}
+
+// vsockListener wraps a non blocking vsock socket in an os.File, so accepting
+// uses the runtime poller and unblocks when the listener is closed.
+type vsockListener struct {
+	f    *os.File
+	addr *vsockAddr
+}
+
+func listenVsock(cid, port uint32) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	addr, err := localVsockAddr(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &vsockListener{
+		f:    os.NewFile(uintptr(fd), addr.String()),
+		addr: addr,
+	}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	rc, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, closedError(err)
+	}
+	var (
+		nfd       int
+		sa        unix.Sockaddr
+		acceptErr error
+	)
+	err = rc.Read(func(fd uintptr) bool {
+		nfd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK)
+		return acceptErr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, closedError(err)
+	}
+	if acceptErr != nil {
+		return nil, os.NewSyscallError("accept4", acceptErr)
+	}
+	remote := &vsockAddr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote.cid, remote.port = vm.CID, vm.Port
+	}
+	return newVsockConn(nfd, l.addr, remote), nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.f.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// closedError translates the error of a closed file to the error of a closed
+// listener, so callers can handle all listeners the same way.
+func closedError(err error) error {
+	if errors.Is(err, os.ErrClosed) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+type vsockConn struct {
+	*os.File
+	local  *vsockAddr
+	remote *vsockAddr
+}
+
+func newVsockConn(fd int, local, remote *vsockAddr) *vsockConn {
+	return &vsockConn{
+		File:   os.NewFile(uintptr(fd), remote.String()),
+		local:  local,
+		remote: remote,
+	}
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func dialVsock(cid, port uint32) (net.Conn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	local, err := localVsockAddr(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return newVsockConn(fd, local, &vsockAddr{cid: cid, port: port}), nil
+}
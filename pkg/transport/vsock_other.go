@@ -0,0 +1,18 @@
+//go:build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+var errVsockUnsupported = errors.New("vsock is only supported on linux")
+
+func listenVsock(cid, port uint32) (net.Listener, error) {
+	return nil, errVsockUnsupported
+}
+
+func dialVsock(cid, port uint32) (net.Conn, error) {
+	return nil, errVsockUnsupported
+}